@@ -0,0 +1,110 @@
+// Draws a blurred placeholder behind each image with a data-blurhash attribute until the image has loaded.
+// The BlurHash (https://blurha.sh) is decoded onto a small canvas which is stretched over the image.
+(function () {
+    var chars = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~";
+    var size = 32;
+
+    function decode83(str) {
+        var value = 0;
+        for (var i = 0; i < str.length; i++) {
+            var digit = chars.indexOf(str[i]);
+            if (digit < 0) {
+                return NaN;
+            }
+            value = value * 83 + digit;
+        }
+        return value;
+    }
+
+    function srgbToLinear(value) {
+        var v = value / 255;
+        return v <= 0.04045 ? v / 12.92 : Math.pow((v + 0.055) / 1.055, 2.4);
+    }
+
+    function linearToSRGB(value) {
+        var v = Math.max(0, Math.min(1, value));
+        if (v <= 0.0031308) {
+            return Math.round(v * 12.92 * 255);
+        }
+        return Math.round((1.055 * Math.pow(v, 1 / 2.4) - 0.055) * 255);
+    }
+
+    function signPow(v, exp) {
+        return (v < 0 ? -1 : 1) * Math.pow(Math.abs(v), exp);
+    }
+
+    // pixels returns the RGBA pixels of a size x size picture of hash, or null if hash is not valid
+    function pixels(hash) {
+        if (hash.length < 6) {
+            return null;
+        }
+        var sizeFlag = decode83(hash[0]);
+        var numY = Math.floor(sizeFlag / 9) + 1;
+        var numX = (sizeFlag % 9) + 1;
+        if (hash.length !== 4 + 2 * numX * numY) {
+            return null;
+        }
+        var maxValue = (decode83(hash[1]) + 1) / 166;
+
+        var dc = decode83(hash.substring(2, 6));
+        var colors = [[srgbToLinear(dc >> 16), srgbToLinear((dc >> 8) & 255), srgbToLinear(dc & 255)]];
+        for (var i = 1; i < numX * numY; i++) {
+            var ac = decode83(hash.substring(4 + i * 2, 6 + i * 2));
+            colors.push([
+                signPow((Math.floor(ac / (19 * 19)) - 9) / 9, 2) * maxValue,
+                signPow((Math.floor(ac / 19) % 19 - 9) / 9, 2) * maxValue,
+                signPow((ac % 19 - 9) / 9, 2) * maxValue
+            ]);
+        }
+
+        var data = new Uint8ClampedArray(size * size * 4);
+        for (var y = 0; y < size; y++) {
+            for (var x = 0; x < size; x++) {
+                var r = 0, g = 0, b = 0;
+                for (var j = 0; j < numY; j++) {
+                    for (var k = 0; k < numX; k++) {
+                        var basis = Math.cos(Math.PI * x * k / size) * Math.cos(Math.PI * y * j / size);
+                        var color = colors[k + j * numX];
+                        r += color[0] * basis;
+                        g += color[1] * basis;
+                        b += color[2] * basis;
+                    }
+                }
+                var p = 4 * (x + y * size);
+                data[p] = linearToSRGB(r);
+                data[p + 1] = linearToSRGB(g);
+                data[p + 2] = linearToSRGB(b);
+                data[p + 3] = 255;
+            }
+        }
+        return data;
+    }
+
+    var canvas = document.createElement("canvas");
+    canvas.width = size;
+    canvas.height = size;
+    var ctx = canvas.getContext("2d");
+    if (!ctx || !window.Uint8ClampedArray) {
+        return;
+    }
+
+    var images = document.querySelectorAll("img[data-blurhash]");
+    for (var i = 0; i < images.length; i++) {
+        var img = images[i];
+        if (img.complete && img.naturalWidth) {
+            continue;
+        }
+        var data = pixels(img.getAttribute("data-blurhash"));
+        if (!data) {
+            continue;
+        }
+        var imageData = ctx.createImageData(size, size);
+        imageData.data.set(data);
+        ctx.putImageData(imageData, 0, 0);
+        img.style.backgroundImage = "url(" + canvas.toDataURL() + ")";
+        img.style.backgroundSize = "100% 100%";
+        img.addEventListener("load", function () {
+            this.style.backgroundImage = "";
+        });
+    }
+})();
@@ -0,0 +1,255 @@
+// Drag and drop reordering of images on the gallery edit page.
+// When an image is dropped the hidden order inputs are rebuilt and the order form is submitted.
+(function () {
+    var container = document.getElementById("sortableImages");
+    var form = document.getElementById("imageOrderForm");
+    var inputs = document.getElementById("imageOrderInputs");
+    if (!container || !form || !inputs) {
+        return;
+    }
+
+    var dragged = null;
+    var original = currentOrder().join("\n");
+
+    container.addEventListener("dragstart", function (e) {
+        dragged = e.target.closest(".sortable-image");
+        if (!dragged) {
+            return;
+        }
+        dragged.classList.add("dragging");
+        e.dataTransfer.effectAllowed = "move";
+        e.dataTransfer.setData("text/plain", dragged.dataset.filename);
+    });
+
+    container.addEventListener("dragover", function (e) {
+        var target = e.target.closest(".sortable-image");
+        if (!dragged || !target || target === dragged) {
+            return;
+        }
+        e.preventDefault();
+        var rect = target.getBoundingClientRect();
+        var after = (e.clientX - rect.left) > rect.width / 2;
+        container.insertBefore(dragged, after ? target.nextSibling : target);
+    });
+
+    container.addEventListener("drop", function (e) {
+        e.preventDefault();
+    });
+
+    container.addEventListener("dragend", function () {
+        if (!dragged) {
+            return;
+        }
+        dragged.classList.remove("dragging");
+        dragged = null;
+        if (currentOrder().join("\n") !== original) {
+            saveOrder();
+        }
+    });
+
+    function currentOrder() {
+        var images = container.querySelectorAll(".sortable-image");
+        var order = [];
+        for (var i = 0; i < images.length; i++) {
+            order.push(images[i].dataset.filename);
+        }
+        return order;
+    }
+
+    function saveOrder() {
+        while (inputs.firstChild) {
+            inputs.removeChild(inputs.firstChild);
+        }
+        var order = currentOrder();
+        for (var i = 0; i < order.length; i++) {
+            var input = document.createElement("input");
+            input.type = "hidden";
+            input.name = "order";
+            input.value = order[i];
+            inputs.appendChild(input);
+        }
+        form.submit();
+    }
+})();
+
+// Autocomplete for the comma separated tags field on the gallery edit page.
+// Suggestions are fetched for the tag currently being typed, and choosing one replaces it.
+(function () {
+    var input = document.getElementById("tags");
+    var list = document.getElementById("tagSuggestions");
+    if (!input || !list || !window.fetch) {
+        return;
+    }
+
+    var pending = null;
+
+    function currentTag() {
+        var parts = input.value.split(",");
+        return parts[parts.length - 1].trim();
+    }
+
+    function hide() {
+        list.style.display = "none";
+        while (list.firstChild) {
+            list.removeChild(list.firstChild);
+        }
+    }
+
+    function choose(name) {
+        var parts = input.value.split(",");
+        parts[parts.length - 1] = " " + name;
+        input.value = parts.join(",").replace(/^\s+/, "") + ", ";
+        hide();
+        input.focus();
+    }
+
+    function show(names) {
+        hide();
+        var existing = input.value.split(",").map(function (t) { return t.trim().toLowerCase(); });
+        names.forEach(function (name) {
+            if (existing.indexOf(name) !== -1) {
+                return;
+            }
+            var item = document.createElement("li");
+            var link = document.createElement("a");
+            link.href = "#";
+            link.textContent = name;
+            link.addEventListener("mousedown", function (e) {
+                e.preventDefault();
+                choose(name);
+            });
+            item.appendChild(link);
+            list.appendChild(item);
+        });
+        if (list.firstChild) {
+            list.style.display = "block";
+        }
+    }
+
+    input.addEventListener("input", function () {
+        var tag = currentTag();
+        clearTimeout(pending);
+        if (tag === "") {
+            hide();
+            return;
+        }
+        pending = setTimeout(function () {
+            var url = input.dataset.suggestUrl + "?q=" + encodeURIComponent(tag);
+            fetch(url, { credentials: "same-origin" })
+                .then(function (res) { return res.ok ? res.json() : []; })
+                .then(function (names) {
+                    if (currentTag() === tag) {
+                        show(names || []);
+                    }
+                })
+                .catch(hide);
+        }, 150);
+    });
+
+    input.addEventListener("blur", hide);
+})();
+
+// Select all toggle for the images that bulk actions apply to.
+(function () {
+    var toggle = document.getElementById("selectAllImages");
+    if (!toggle) {
+        return;
+    }
+    var boxes = document.querySelectorAll("input[name=filenames]");
+
+    toggle.addEventListener("change", function () {
+        for (var i = 0; i < boxes.length; i++) {
+            boxes[i].checked = toggle.checked;
+        }
+    });
+
+    for (var i = 0; i < boxes.length; i++) {
+        boxes[i].addEventListener("change", function () {
+            var all = true;
+            for (var j = 0; j < boxes.length; j++) {
+                all = all && boxes[j].checked;
+            }
+            toggle.checked = all;
+        });
+    }
+})();
+
+// Ask before running bulk actions that cannot be undone, such as deleting the selected images.
+// Pressing enter in a bulk field runs the action next to it rather than the first action in the form.
+(function () {
+    var fields = document.querySelectorAll("#imageBulkForm input[type=text]");
+    for (var j = 0; j < fields.length; j++) {
+        fields[j].addEventListener("keydown", function (e) {
+            var button = this.closest(".image-bulk-row").querySelector("button");
+            if (e.key === "Enter" && button) {
+                e.preventDefault();
+                button.click();
+            }
+        });
+    }
+
+    var buttons = document.querySelectorAll("#imageBulkForm [data-confirm]");
+    for (var i = 0; i < buttons.length; i++) {
+        buttons[i].addEventListener("click", function (e) {
+            if (!window.confirm(this.dataset.confirm)) {
+                e.preventDefault();
+            }
+        });
+    }
+})();
+
+// Show share links as full URLs that can be copied and sent to people, and select them when clicked.
+(function () {
+    var inputs = document.querySelectorAll(".share-url");
+    for (var i = 0; i < inputs.length; i++) {
+        inputs[i].value = window.location.origin + inputs[i].value;
+        inputs[i].addEventListener("click", function () {
+            this.select();
+        });
+    }
+})();
+
+// Show the progress of imports that are still running, and reload the page once they finish
+// so the imported images appear.
+(function () {
+    var imports = document.querySelectorAll("[data-progress-url]");
+    if (!imports.length || !window.fetch) {
+        return;
+    }
+
+    var running = imports.length;
+    for (var i = 0; i < imports.length; i++) {
+        poll(imports[i]);
+    }
+
+    function poll(el) {
+        fetch(el.dataset.progressUrl, {credentials: "same-origin"})
+            .then(function (res) {
+                return res.json();
+            })
+            .then(function (progress) {
+                var bar = el.querySelector(".progress-bar");
+                if (bar) {
+                    bar.style.width = progress.percent + "%";
+                    bar.setAttribute("aria-valuenow", progress.percent);
+                }
+                el.querySelector(".import-status").textContent =
+                    progress.processed + " of " + progress.total + " files processed";
+                if (progress.finished) {
+                    running--;
+                    if (running === 0) {
+                        window.location.reload();
+                    }
+                    return;
+                }
+                setTimeout(function () {
+                    poll(el);
+                }, 1000);
+            })
+            .catch(function () {
+                setTimeout(function () {
+                    poll(el);
+                }, 5000);
+            });
+    }
+})();
@@ -0,0 +1,73 @@
+// Choosing favourites on galleries open for proofing without reloading the page.
+// The favourite forms still work without this script, they just reload the page.
+(function () {
+    var forms = document.querySelectorAll(".favourite-form");
+    if (!forms.length || !window.fetch || !window.URLSearchParams) {
+        return;
+    }
+    var error = document.getElementById("proofingError");
+
+    for (var i = 0; i < forms.length; i++) {
+        forms[i].addEventListener("submit", toggle);
+    }
+
+    function toggle(e) {
+        e.preventDefault();
+        var form = e.currentTarget;
+        var button = form.querySelector("button");
+        button.disabled = true;
+        fetch(form.action, {
+            method: "POST",
+            credentials: "same-origin",
+            headers: {
+                "Accept": "application/json",
+                "Content-Type": "application/x-www-form-urlencoded"
+            },
+            body: new URLSearchParams(new FormData(form)).toString()
+        }).then(function (res) {
+            return res.json();
+        }).then(function (result) {
+            button.disabled = false;
+            showError(result.error);
+            if (!result.error) {
+                update(result);
+            }
+        }).catch(function () {
+            // Fall back to submitting the form normally
+            form.removeEventListener("submit", toggle);
+            form.submit();
+        });
+    }
+
+    // update marks every favourite button for the image, and every count, with the selection's new state
+    function update(result) {
+        for (var i = 0; i < forms.length; i++) {
+            var form = forms[i];
+            if (form.elements.image_id.value !== String(result.image_id)) {
+                continue;
+            }
+            var button = form.querySelector("button");
+            form.elements.favourite.value = result.favourite ? "false" : "true";
+            button.classList.toggle("chosen", result.favourite);
+            button.classList.toggle("btn-danger", result.favourite);
+            button.classList.toggle("btn-default", !result.favourite);
+            button.setAttribute("aria-pressed", result.favourite ? "true" : "false");
+            button.querySelector(".favourite-label").textContent = result.favourite ? "Chosen" : "Choose";
+        }
+        var counts = document.querySelectorAll("[data-proofing-count]");
+        for (var j = 0; j < counts.length; j++) {
+            counts[j].textContent = result.count;
+        }
+    }
+
+    function showError(message) {
+        if (!error) {
+            if (message) {
+                window.alert(message);
+            }
+            return;
+        }
+        error.textContent = message || "";
+        error.classList.toggle("hidden", !message);
+    }
+})();
@@ -0,0 +1,155 @@
+// A small tus 1.0 client for uploading large images to a gallery in chunks.
+// Each file's upload URL is remembered in localStorage so choosing the same file again after an
+// interruption, even after reloading the page, resumes it from the last chunk the server received.
+(function () {
+    var container = document.getElementById("resumableUpload");
+    var input = document.getElementById("resumableFiles");
+    var list = document.getElementById("resumableProgress");
+    if (!container || !input || !list || !window.fetch) {
+        return;
+    }
+
+    var endpoint = container.dataset.endpoint;
+    var csrfToken = container.querySelector("input[name='gorilla.csrf.Token']").value;
+    var chunkSize = 5 * 1024 * 1024;
+    var retryDelays = [1000, 3000, 5000, 10000, 20000];
+
+    input.addEventListener("change", function () {
+        var files = Array.prototype.slice.call(input.files);
+        input.value = "";
+        var uploads = files.map(function (file) {
+            return upload(file, progressItem(file));
+        });
+        Promise.all(uploads).then(function (results) {
+            if (results.some(Boolean)) {
+                window.location.reload();
+            }
+        });
+    });
+
+    // upload sends file in chunks and resolves to true if it finished
+    function upload(file, item) {
+        var key = "tus:" + endpoint + ":" + file.name + ":" + file.size + ":" + file.lastModified;
+        var attempt = 0;
+
+        function start() {
+            var url = localStorage.getItem(key);
+            var ready = url ? resume(url) : create();
+            return ready.then(function (state) {
+                return send(state.url, state.offset);
+            });
+        }
+
+        function create() {
+            return request("POST", endpoint, {
+                "Upload-Length": String(file.size),
+                "Upload-Metadata": "filename " + btoa(unescape(encodeURIComponent(file.name)))
+            }).then(function (res) {
+                if (res.status !== 201) {
+                    return failed(res);
+                }
+                var url = res.headers.get("Location");
+                localStorage.setItem(key, url);
+                return {url: url, offset: 0};
+            });
+        }
+
+        function resume(url) {
+            return request("HEAD", url, {}).then(function (res) {
+                if (res.status !== 200) {
+                    // The upload expired or finished, so start again
+                    localStorage.removeItem(key);
+                    return create();
+                }
+                return {url: url, offset: parseInt(res.headers.get("Upload-Offset"), 10)};
+            });
+        }
+
+        function send(url, offset) {
+            item.update(offset / file.size);
+            if (offset >= file.size) {
+                localStorage.removeItem(key);
+                item.done();
+                return true;
+            }
+            var headers = {
+                "Upload-Offset": String(offset),
+                "Content-Type": "application/offset+octet-stream"
+            };
+            return request("PATCH", url, headers, file.slice(offset, offset + chunkSize)).then(function (res) {
+                if (res.status !== 204) {
+                    return failed(res);
+                }
+                attempt = 0;
+                return send(url, parseInt(res.headers.get("Upload-Offset"), 10));
+            });
+        }
+
+        function run() {
+            return start().catch(function (err) {
+                if (err.permanent || attempt >= retryDelays.length) {
+                    item.error(err.message);
+                    return false;
+                }
+                item.retrying();
+                return new Promise(function (resolve) {
+                    setTimeout(resolve, retryDelays[attempt++]);
+                }).then(run);
+            });
+        }
+
+        return run();
+    }
+
+    // failed rejects with the server's message. Client errors will not succeed if retried.
+    function failed(res) {
+        return res.text().then(function (text) {
+            var err = new Error(text || res.statusText);
+            err.permanent = res.status >= 400 && res.status < 500 && res.status !== 409 && res.status !== 404;
+            throw err;
+        });
+    }
+
+    function request(method, url, headers, body) {
+        headers["Tus-Resumable"] = "1.0.0";
+        headers["X-CSRF-Token"] = csrfToken;
+        return fetch(url, {method: method, headers: headers, body: body, credentials: "same-origin"});
+    }
+
+    function progressItem(file) {
+        var li = document.createElement("li");
+        var label = document.createElement("span");
+        label.textContent = file.name;
+        var status = document.createElement("span");
+        status.className = "resumable-status";
+        var progress = document.createElement("div");
+        progress.className = "progress";
+        var bar = document.createElement("div");
+        bar.className = "progress-bar";
+        bar.style.width = "0%";
+        progress.appendChild(bar);
+        li.appendChild(label);
+        li.appendChild(status);
+        li.appendChild(progress);
+        list.appendChild(li);
+
+        return {
+            update: function (fraction) {
+                var percent = Math.floor(fraction * 100);
+                bar.style.width = percent + "%";
+                status.textContent = " " + percent + "%";
+            },
+            retrying: function () {
+                status.textContent = " connection lost, retrying...";
+            },
+            done: function () {
+                bar.className = "progress-bar progress-bar-success";
+                status.textContent = " done";
+            },
+            error: function (message) {
+                bar.className = "progress-bar progress-bar-danger";
+                status.textContent = " " + message;
+            }
+        };
+    }
+})();
@@ -0,0 +1,201 @@
+// Image viewer navigation. The arrow keys and swipes move to the previous and next images, and Escape returns
+// to the gallery. The slideshow shows the gallery's images fullscreen, moving on every few seconds, and keeps
+// the address bar on the permalink of the image being shown.
+(function () {
+    var viewer = document.getElementById("viewer");
+    if (!viewer) {
+        return;
+    }
+    var galleryURL = viewer.dataset.galleryUrl;
+    var slideshowInterval = 5000;
+    var swipeDistance = 50;
+    var slideshow = null;
+
+    function follow(id) {
+        var link = document.getElementById(id);
+        if (link) {
+            window.location.href = link.href;
+        }
+    }
+
+    // onSwipe calls left or right when el is swiped horizontally
+    function onSwipe(el, left, right) {
+        var startX = null;
+        var startY = null;
+        el.addEventListener("touchstart", function (e) {
+            startX = e.changedTouches[0].clientX;
+            startY = e.changedTouches[0].clientY;
+        }, {passive: true});
+        el.addEventListener("touchend", function (e) {
+            if (startX === null) {
+                return;
+            }
+            var dx = e.changedTouches[0].clientX - startX;
+            var dy = e.changedTouches[0].clientY - startY;
+            startX = null;
+            if (Math.abs(dx) < swipeDistance || Math.abs(dx) < Math.abs(dy)) {
+                return;
+            }
+            if (dx < 0) {
+                left();
+            } else {
+                right();
+            }
+        });
+    }
+
+    document.addEventListener("keydown", function (e) {
+        if (e.altKey || e.ctrlKey || e.metaKey || e.target.closest("input, textarea, select")) {
+            return;
+        }
+        if (slideshow) {
+            slideshow.key(e);
+            return;
+        }
+        switch (e.key) {
+        case "ArrowLeft":
+            follow("viewerPrev");
+            break;
+        case "ArrowRight":
+            follow("viewerNext");
+            break;
+        case "Escape":
+            window.location.href = galleryURL;
+            break;
+        }
+    });
+    onSwipe(viewer, function () { follow("viewerNext"); }, function () { follow("viewerPrev"); });
+
+    var button = document.getElementById("slideshowButton");
+    if (!button || !window.fetch || !window.history.replaceState) {
+        return;
+    }
+    button.classList.remove("hidden");
+    button.addEventListener("click", function () {
+        button.disabled = true;
+        fetch(galleryURL, {headers: {Accept: "application/json"}, credentials: "same-origin"})
+            .then(function (res) {
+                if (!res.ok) {
+                    throw new Error(res.statusText);
+                }
+                return res.json();
+            })
+            .then(function (gallery) {
+                if (gallery.images.length) {
+                    slideshow = startSlideshow(gallery.images, parseInt(viewer.dataset.index, 10) - 1);
+                }
+            })
+            .catch(function () {})
+            .then(function () {
+                button.disabled = false;
+            });
+    });
+
+    function startSlideshow(images, index) {
+        var start = window.location.href;
+        var el = document.createElement("div");
+        el.className = "slideshow";
+        el.innerHTML =
+            '<img class="slideshow-image" alt="">' +
+            '<p class="slideshow-caption"></p>' +
+            '<div class="slideshow-controls">' +
+            '<button type="button" class="btn btn-default" data-action="prev" title="Previous (←)">&lsaquo;</button> ' +
+            '<button type="button" class="btn btn-default" data-action="play" title="Play or pause (space)"></button> ' +
+            '<button type="button" class="btn btn-default" data-action="next" title="Next (→)">&rsaquo;</button> ' +
+            '<button type="button" class="btn btn-default" data-action="close" title="Close (Esc)">&times;</button>' +
+            '</div>';
+        document.body.appendChild(el);
+        var img = el.querySelector(".slideshow-image");
+        var caption = el.querySelector(".slideshow-caption");
+        var play = el.querySelector('[data-action="play"]');
+        var timer = null;
+        var preload = new Image();
+
+        function show(i) {
+            index = (i + images.length) % images.length;
+            var image = images[index];
+            img.src = image.large_url;
+            img.alt = image.alt;
+            img.style.backgroundColor = image.dominant_color || "";
+            caption.textContent = image.caption || "";
+            preload.src = images[(index + 1) % images.length].large_url;
+            window.history.replaceState(null, "", image.view_url);
+        }
+
+        function setPlaying(playing) {
+            clearInterval(timer);
+            timer = playing ? setInterval(function () { show(index + 1); }, slideshowInterval) : null;
+            play.innerHTML = playing ? "&#10074;&#10074;" : "&#9654;";
+        }
+
+        // move shows image i, waiting a full interval before moving on again if the slideshow is playing
+        function move(i) {
+            show(i);
+            if (timer) {
+                setPlaying(true);
+            }
+        }
+
+        function close() {
+            setPlaying(false);
+            document.removeEventListener("fullscreenchange", onFullscreenChange);
+            if (document.fullscreenElement) {
+                document.exitFullscreen();
+            }
+            el.parentNode.removeChild(el);
+            slideshow = null;
+            // Load the page of the image the slideshow stopped on so its details are shown
+            if (window.location.href !== start) {
+                window.location.reload();
+            }
+        }
+
+        function onFullscreenChange() {
+            if (!document.fullscreenElement) {
+                close();
+            }
+        }
+
+        el.addEventListener("click", function (e) {
+            var action = e.target.dataset.action;
+            if (action === "prev") {
+                move(index - 1);
+            } else if (action === "next") {
+                move(index + 1);
+            } else if (action === "play") {
+                setPlaying(!timer);
+            } else if (action === "close") {
+                close();
+            }
+        });
+        onSwipe(el, function () { move(index + 1); }, function () { move(index - 1); });
+
+        if (el.requestFullscreen) {
+            el.requestFullscreen().then(function () {
+                document.addEventListener("fullscreenchange", onFullscreenChange);
+            }).catch(function () {});
+        }
+        show(index);
+        setPlaying(true);
+
+        return {
+            key: function (e) {
+                switch (e.key) {
+                case "ArrowLeft":
+                    move(index - 1);
+                    break;
+                case "ArrowRight":
+                    move(index + 1);
+                    break;
+                case " ":
+                    e.preventDefault();
+                    setPlaying(!timer);
+                    break;
+                case "Escape":
+                    close();
+                    break;
+                }
+            }
+        };
+    }
+})();
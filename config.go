@@ -5,6 +5,11 @@ import (
 	"log"
 	"os"
 	"strconv"
+	"strings"
+	"time"
+
+	"github.com/curtisvermeeren/web-development-with-go/models"
+	"github.com/curtisvermeeren/web-development-with-go/rand"
 )
 
 type PostgresConfig struct {
@@ -36,29 +41,76 @@ func DefaultPostgresConfig() PostgresConfig {
 	}
 }
 
+// minImageURLKeyLen is the fewest bytes an image URL signing key can have in production
+const minImageURLKeyLen = 32
+
 type Config struct {
-	Port     int
-	Env      string
-	Pepper   string
-	HMACKey  string
-	Database PostgresConfig
+	Port               int
+	Env                string
+	Pepper             string
+	HMACKey            string
+	ImageURLKey        string
+	ImageURLTTLMinutes int
+	TrashRetentionDays int
+	JobWorkers         int
+	StorageQuotaMB     int
+	ImageQuota         int
+	VariantCacheMB     int
+	AdminEmails        []string
+	Database           PostgresConfig
 }
 
 func (c Config) IsProd() bool {
 	return c.Env == "prod"
 }
 
+// Quota is how much each user can store. A limit of 0 means there is no limit.
+func (c Config) Quota() models.Quota {
+	return models.Quota{
+		MaxBytes:  int64(c.StorageQuotaMB) << 20,
+		MaxImages: c.ImageQuota,
+	}
+}
+
+// ImageURLTTL is how long signed image URLs last at least
+func (c Config) ImageURLTTL() time.Duration {
+	return time.Duration(c.ImageURLTTLMinutes) * time.Minute
+}
+
+// VariantCacheSize is how many bytes of resized images are kept on disk
+func (c Config) VariantCacheSize() int64 {
+	return int64(c.VariantCacheMB) << 20
+}
+
+// TrashRetention is how long deleted galleries are kept before they are purged
+func (c Config) TrashRetention() time.Duration {
+	return time.Duration(c.TrashRetentionDays) * 24 * time.Hour
+}
+
 func DefaultConfig() Config {
 	return Config{
-		Port:     8080,
-		Env:      "dev",
-		Pepper:   "secret-random-string",
-		HMACKey:  "secret-hmac-key",
-		Database: DefaultPostgresConfig(),
+		Port:               8080,
+		Env:                "dev",
+		Pepper:             "secret-random-string",
+		HMACKey:            "secret-hmac-key",
+		ImageURLKey:        "secret-image-url-key",
+		ImageURLTTLMinutes: 60,
+		TrashRetentionDays: 30,
+		JobWorkers:         4,
+		StorageQuotaMB:     1024,
+		ImageQuota:         10000,
+		VariantCacheMB:     512,
+		Database:           DefaultPostgresConfig(),
 	}
 }
 
 func LoadConfig() Config {
+	// Environment the application runs in, dev unless set to prod
+	env := DefaultConfig().Env
+	if e := os.Getenv("ENV"); e != "" {
+		env = e
+	}
+
 	// Database setup
 	host := os.Getenv("POSTGRES_HOST")
 	port, err := strconv.Atoi(os.Getenv("POSTGRES_PORT"))
@@ -80,16 +132,115 @@ func LoadConfig() Config {
 	// Get the hmacSecretKey from env
 	hmacSecretKey := os.Getenv("SECRETHMACKEY")
 
+	// Key for signing image URLs, kept separate from the HMAC key so it can be shared with a CDN
+	imageURLKey, err := loadImageURLKey(env)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Number of minutes signed image URLs last for at least
+	imageURLTTLMinutes := DefaultConfig().ImageURLTTLMinutes
+	if minutes := os.Getenv("IMAGEURLTTLMINUTES"); minutes != "" {
+		imageURLTTLMinutes, err = strconv.Atoi(minutes)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	// Password pepper for the application
 	userPasswordPepper := os.Getenv("PASSWORDPEPPER")
 
+	// Number of days deleted galleries stay in the trash before being purged
+	trashRetentionDays := DefaultConfig().TrashRetentionDays
+	if days := os.Getenv("TRASHRETENTIONDAYS"); days != "" {
+		trashRetentionDays, err = strconv.Atoi(days)
+		if err != nil {
+			log.Fatal(err)
+		}
+		// With no days in the trash every deleted gallery would be purged as soon as the purge job runs
+		if trashRetentionDays < 1 {
+			log.Fatal("TRASHRETENTIONDAYS must be at least 1")
+		}
+	}
+
+	// Number of background jobs run at once
+	jobWorkers := DefaultConfig().JobWorkers
+	if workers := os.Getenv("JOBWORKERS"); workers != "" {
+		jobWorkers, err = strconv.Atoi(workers)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if jobWorkers < 1 {
+			log.Fatal("JOBWORKERS must be at least 1")
+		}
+	}
+
+	// Storage and number of images each user can have, where 0 is unlimited
+	storageQuotaMB := DefaultConfig().StorageQuotaMB
+	if mb := os.Getenv("STORAGEQUOTAMB"); mb != "" {
+		storageQuotaMB, err = strconv.Atoi(mb)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	imageQuota := DefaultConfig().ImageQuota
+	if images := os.Getenv("IMAGEQUOTA"); images != "" {
+		imageQuota, err = strconv.Atoi(images)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Megabytes of resized images kept on disk, where 0 is unlimited
+	variantCacheMB := DefaultConfig().VariantCacheMB
+	if mb := os.Getenv("VARIANTCACHEMB"); mb != "" {
+		variantCacheMB, err = strconv.Atoi(mb)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Comma separated emails of the users who can use the admin pages
+	var adminEmails []string
+	for _, email := range strings.Split(os.Getenv("ADMINEMAILS"), ",") {
+		if email = strings.TrimSpace(email); email != "" {
+			adminEmails = append(adminEmails, email)
+		}
+	}
+
 	config := Config{
-		Port:     8080,
-		Env:      "dev",
-		Pepper:   userPasswordPepper,
-		HMACKey:  hmacSecretKey,
-		Database: dbConfig,
+		Port:               8080,
+		Env:                env,
+		Pepper:             userPasswordPepper,
+		HMACKey:            hmacSecretKey,
+		ImageURLKey:        imageURLKey,
+		ImageURLTTLMinutes: imageURLTTLMinutes,
+		TrashRetentionDays: trashRetentionDays,
+		JobWorkers:         jobWorkers,
+		StorageQuotaMB:     storageQuotaMB,
+		ImageQuota:         imageQuota,
+		VariantCacheMB:     variantCacheMB,
+		AdminEmails:        adminEmails,
+		Database:           dbConfig,
 	}
 
 	return config
 }
+
+// loadImageURLKey reads IMAGEURLKEY. Anyone who knows the key can sign URLs to private images,
+// so production refuses to start without a long enough key, and development makes up a random
+// one that lasts until the server restarts.
+func loadImageURLKey(env string) (string, error) {
+	key := os.Getenv("IMAGEURLKEY")
+	if env == "prod" {
+		if len(key) < minImageURLKeyLen {
+			return "", fmt.Errorf("IMAGEURLKEY must be at least %d bytes long in prod", minImageURLKeyLen)
+		}
+		return key, nil
+	}
+	if key == "" {
+		log.Println("IMAGEURLKEY is not set, signing image URLs with a random key")
+		return rand.String(minImageURLKeyLen)
+	}
+	return key, nil
+}
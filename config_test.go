@@ -0,0 +1,51 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLoadImageURLKey(t *testing.T) {
+	strong := strings.Repeat("k", minImageURLKeyLen)
+	tests := []struct {
+		env     string
+		key     string
+		wantErr bool
+		want    string
+	}{
+		{"prod", "", true, ""},
+		{"prod", "short", true, ""},
+		{"prod", strong[1:], true, ""},
+		{"prod", strong, false, strong},
+		{"dev", "short", false, "short"},
+	}
+	for _, tt := range tests {
+		t.Setenv("IMAGEURLKEY", tt.key)
+		got, err := loadImageURLKey(tt.env)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("loadImageURLKey(%q) with key %q: err = %v, want error %v", tt.env, tt.key, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("loadImageURLKey(%q) with key %q = %q, want %q", tt.env, tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestLoadImageURLKeyGeneratesDevKey(t *testing.T) {
+	t.Setenv("IMAGEURLKEY", "")
+	a, err := loadImageURLKey("dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := loadImageURLKey("dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(a) < minImageURLKeyLen {
+		t.Errorf("generated key %q is shorter than %d bytes", a, minImageURLKeyLen)
+	}
+	if a == b {
+		t.Errorf("generated the same key %q twice", a)
+	}
+}
@@ -0,0 +1,299 @@
+package controllers
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/curtisvermeeren/web-development-with-go/context"
+	"github.com/curtisvermeeren/web-development-with-go/models"
+	"github.com/curtisvermeeren/web-development-with-go/views"
+	"github.com/gorilla/mux"
+)
+
+const (
+	IndexAlbums = "index_albums"
+	ShowAlbum   = "show_album"
+	EditAlbum   = "edit_album"
+)
+
+type Albums struct {
+	IndexView *views.View
+	ShowView  *views.View
+	EditView  *views.View
+	as        models.AlbumService
+	gs        models.GalleryService
+	is        models.ImageService
+	r         *mux.Router
+}
+
+// AlbumForm represents the input fields used to create and edit an album
+type AlbumForm struct {
+	Title      string `schema:"title"`
+	ParentID   uint   `schema:"parent_id"`
+	Visibility string `schema:"visibility"`
+}
+
+// AlbumIndexData is passed to the albums index view
+type AlbumIndexData struct {
+	Albums []models.AlbumNode
+}
+
+// AlbumData is passed to the album show and edit views
+type AlbumData struct {
+	Album       *models.Album
+	Breadcrumbs []models.Album
+	Children    []models.Album
+	Galleries   []models.Gallery
+	// Parents are the albums this album can be moved into
+	Parents []models.AlbumNode
+	IsOwner bool
+}
+
+// NewAlbums creates and returns an Albums controller
+func NewAlbums(as models.AlbumService, gs models.GalleryService, is models.ImageService, r *mux.Router) *Albums {
+	return &Albums{
+		IndexView: views.NewView("bootstrap", "albums/index"),
+		ShowView:  views.NewView("bootstrap", "albums/show"),
+		EditView:  views.NewView("bootstrap", "albums/edit"),
+		as:        as,
+		gs:        gs,
+		is:        is,
+		r:         r,
+	}
+}
+
+// Index lists the current user's albums as a tree
+// GET /albums
+func (a *Albums) Index(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	tree, err := a.as.Tree(user.ID)
+	if err != nil {
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	var vd views.Data
+	vd.Yield = AlbumIndexData{Albums: tree}
+	a.IndexView.Render(w, r, vd)
+}
+
+// Create adds a new album
+// POST /albums
+func (a *Albums) Create(w http.ResponseWriter, r *http.Request) {
+	var form AlbumForm
+	if err := parseForm(r, &form); err != nil {
+		a.redirect(w, r, IndexAlbums, nil, views.ErrorAlert(err))
+		return
+	}
+
+	user := context.User(r.Context())
+	album := models.Album{
+		UserID:     user.ID,
+		ParentID:   form.ParentID,
+		Title:      form.Title,
+		Visibility: models.Visibility(form.Visibility),
+	}
+	if err := a.as.Create(&album); err != nil {
+		a.redirect(w, r, IndexAlbums, nil, views.ErrorAlert(err))
+		return
+	}
+	a.redirect(w, r, ShowAlbum, &album, views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "Album created successfully",
+	})
+}
+
+// Show lists the albums and galleries inside an album.
+// Visitors other than the owner only see what is public.
+// GET /albums/:id
+func (a *Albums) Show(w http.ResponseWriter, r *http.Request) {
+	album, err := a.albumByID(w, r)
+	if err != nil {
+		return
+	}
+	user := context.User(r.Context())
+	if !album.VisibleTo(user) {
+		http.Error(w, "Album not found", http.StatusNotFound)
+		return
+	}
+	isOwner := user != nil && user.ID == album.UserID
+
+	data, err := a.albumData(album, isOwner)
+	if err != nil {
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+
+	children, err := a.as.ByParentID(album.UserID, album.ID)
+	if err != nil {
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	for _, child := range children {
+		if isOwner || child.IsPublic() {
+			data.Children = append(data.Children, child)
+		}
+	}
+
+	galleries, _, err := a.gs.Find(models.GalleryQuery{
+		UserID:     album.UserID,
+		AlbumID:    album.ID,
+		PublicOnly: !isOwner,
+		Sort:       models.SortTitle,
+		Pagination: models.Pagination{
+			Limit: models.MaxPageLimit,
+		},
+	})
+	if err != nil {
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	if err := loadImages(a.is, galleries); err != nil {
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	data.Galleries = galleries
+
+	var vd views.Data
+	vd.Yield = data
+	a.ShowView.Render(w, r, vd)
+}
+
+// Edit shows the form to rename, move or change the visibility of an album
+// GET /albums/:id/edit
+func (a *Albums) Edit(w http.ResponseWriter, r *http.Request) {
+	album, err := a.ownedAlbum(w, r)
+	if err != nil {
+		return
+	}
+	data, err := a.albumData(album, true)
+	if err != nil {
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	var vd views.Data
+	vd.Yield = data
+	a.EditView.Render(w, r, vd)
+}
+
+// Update saves changes to an album
+// POST /albums/:id/update
+func (a *Albums) Update(w http.ResponseWriter, r *http.Request) {
+	album, err := a.ownedAlbum(w, r)
+	if err != nil {
+		return
+	}
+
+	var form AlbumForm
+	if err := parseForm(r, &form); err != nil {
+		a.redirect(w, r, EditAlbum, album, views.ErrorAlert(err))
+		return
+	}
+	album.Title = form.Title
+	album.ParentID = form.ParentID
+	album.Visibility = models.Visibility(form.Visibility)
+	if err := a.as.Update(album); err != nil {
+		a.redirect(w, r, EditAlbum, album, views.ErrorAlert(err))
+		return
+	}
+	a.redirect(w, r, EditAlbum, album, views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "Album updated successfully",
+	})
+}
+
+// Delete removes an album. Its albums and galleries move up to its parent.
+// POST /albums/:id/delete
+func (a *Albums) Delete(w http.ResponseWriter, r *http.Request) {
+	album, err := a.ownedAlbum(w, r)
+	if err != nil {
+		return
+	}
+	if err := a.as.Delete(album.ID); err != nil {
+		a.redirect(w, r, EditAlbum, album, views.ErrorAlert(err))
+		return
+	}
+	a.redirect(w, r, IndexAlbums, nil, views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "Album deleted. Its contents were moved up a level.",
+	})
+}
+
+// albumData loads the breadcrumbs of album, and for its owner the albums it can be moved into
+func (a *Albums) albumData(album *models.Album, isOwner bool) (AlbumData, error) {
+	data := AlbumData{
+		Album:   album,
+		IsOwner: isOwner,
+	}
+	crumbs, err := a.as.Breadcrumbs(album.ParentID)
+	if err != nil {
+		return data, err
+	}
+	data.Breadcrumbs = crumbs
+	if !isOwner {
+		return data, nil
+	}
+
+	tree, err := a.as.Tree(album.UserID)
+	if err != nil {
+		return data, err
+	}
+	// Leave out the album itself and everything below it, which directly follow it in the tree
+	for i := 0; i < len(tree); i++ {
+		if tree[i].ID != album.ID {
+			data.Parents = append(data.Parents, tree[i])
+			continue
+		}
+		depth := tree[i].Depth
+		for i+1 < len(tree) && tree[i+1].Depth > depth {
+			i++
+		}
+	}
+	return data, nil
+}
+
+// redirect sends the user to the named route with an alert, using the album's ID when the route needs one
+func (a *Albums) redirect(w http.ResponseWriter, r *http.Request, route string, album *models.Album, alert views.Alert) {
+	var pairs []string
+	if album != nil {
+		pairs = []string{"id", strconv.Itoa(int(album.ID))}
+	}
+	url, err := a.r.Get(route).URL(pairs...)
+	if err != nil {
+		http.Redirect(w, r, "/albums", http.StatusFound)
+		return
+	}
+	views.RedirectAlert(w, r, url.Path, http.StatusFound, alert)
+}
+
+// ownedAlbum returns the album from the URL if it belongs to the current user
+func (a *Albums) ownedAlbum(w http.ResponseWriter, r *http.Request) (*models.Album, error) {
+	album, err := a.albumByID(w, r)
+	if err != nil {
+		return nil, err
+	}
+	user := context.User(r.Context())
+	if album.UserID != user.ID {
+		http.Error(w, "You do not have permission to edit this album", http.StatusForbidden)
+		return nil, models.ErrAlbumNotFound
+	}
+	return album, nil
+}
+
+func (a *Albums) albumByID(w http.ResponseWriter, r *http.Request) (*models.Album, error) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid album ID", http.StatusNotFound)
+		return nil, err
+	}
+	album, err := a.as.ByID(uint(id))
+	if err != nil {
+		switch err {
+		case models.ErrNotFound:
+			http.Error(w, "Album not found", http.StatusNotFound)
+		default:
+			http.Error(w, "Whoops! Something went wrong", http.StatusInternalServerError)
+		}
+		return nil, err
+	}
+	return album, nil
+}
@@ -0,0 +1,291 @@
+package controllers
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/curtisvermeeren/web-development-with-go/context"
+	"github.com/curtisvermeeren/web-development-with-go/models"
+	"github.com/curtisvermeeren/web-development-with-go/views"
+	"github.com/gorilla/mux"
+)
+
+// inboxSize is how many of the most recent comments are listed in a user's inbox
+const inboxSize = 100
+
+// CommentsData is passed to the comments partial shown on gallery and image viewer pages
+type CommentsData struct {
+	// Comments are in thread order, with hidden comments only included for the gallery's owner
+	Comments []models.Comment
+	// ImageID is the image the comments are about, or 0 for the gallery itself
+	ImageID uint
+	// Action is where new comments are posted, keeping the share link the gallery is being viewed through
+	Action string
+	// GalleryID is the gallery the comments are on, used for the owner's moderation forms
+	GalleryID uint
+	// OwnerID is the user who owns the gallery, whose comments are marked as theirs
+	OwnerID uint
+	IsOwner bool
+	Locked  bool
+	// CanComment is set when the viewer may leave comments: signed in users, and guests viewing through a share link
+	CanComment bool
+	// Guest is set when the viewer has to give their name to comment
+	Guest bool
+}
+
+// CanPost reports whether the viewer may leave a comment now. The gallery's owner can still comment while comments are locked.
+func (d *CommentsData) CanPost() bool {
+	return d.CanComment && (!d.Locked || d.IsOwner)
+}
+
+// CommentFormData is passed to the form for a new comment, or a reply to ParentID
+type CommentFormData struct {
+	*CommentsData
+	ParentID uint
+}
+
+// Form is the data for the form that replies to the comment with parentID, or starts a thread if it is 0
+func (d *CommentsData) Form(parentID uint) CommentFormData {
+	return CommentFormData{CommentsData: d, ParentID: parentID}
+}
+
+// CommentForm is a new comment, or a reply to ParentID. Website is hidden from people, so only spam bots fill it in.
+type CommentForm struct {
+	Body     string `schema:"body"`
+	Name     string `schema:"name"`
+	ParentID uint   `schema:"parent_id"`
+	ImageID  uint   `schema:"image_id"`
+	Website  string `schema:"website"`
+}
+
+// comments gathers the comments on the gallery, or on image if it is not nil, for the comments partial
+func (g *Galleries) comments(r *http.Request, data GalleryShowData, image *models.Image) *CommentsData {
+	user := context.User(r.Context())
+	cd := CommentsData{
+		Action:    data.withShare(fmt.Sprintf("/galleries/%s/comments", data.PublicID)),
+		GalleryID: data.ID,
+		OwnerID:   data.UserID,
+		IsOwner:   user != nil && user.ID == data.UserID,
+		Locked:    data.CommentsLocked,
+	}
+	var comments []models.Comment
+	var err error
+	if image != nil {
+		cd.ImageID = image.ID
+		comments, err = g.cs.ByImageID(image.ID)
+	} else {
+		comments, err = g.cs.ByGalleryID(data.ID)
+	}
+	if err != nil {
+		log.Println(err)
+	}
+	cd.Comments = models.Thread(comments, cd.IsOwner)
+	if user != nil {
+		cd.CanComment = true
+	} else if g.shareLink(r, data.Gallery) != nil {
+		cd.CanComment = true
+		cd.Guest = true
+	}
+	return &cd
+}
+
+// CommentCreate leaves a comment on a gallery or one of its images. Signed in users comment under their own
+// name and guests viewing through a share link give one.
+// POST /galleries/:publicID/comments
+func (g *Galleries) CommentCreate(w http.ResponseWriter, r *http.Request) {
+	data, ok := g.showData(w, r)
+	if !ok {
+		return
+	}
+	var form CommentForm
+	if err := parseForm(r, &form); err != nil {
+		views.RedirectAlert(w, r, data.GalleryURL(), http.StatusFound, views.ErrorAlert(err))
+		return
+	}
+	back, ok := commentPage(data, form.ImageID)
+	if !ok {
+		http.Error(w, "Image not found", http.StatusNotFound)
+		return
+	}
+	// Spam bots are sent back as if their comment had been saved
+	if form.Website != "" {
+		http.Redirect(w, r, back, http.StatusFound)
+		return
+	}
+
+	comment := models.Comment{
+		GalleryID: data.ID,
+		ImageID:   form.ImageID,
+		ParentID:  form.ParentID,
+		OwnerID:   data.UserID,
+		Body:      form.Body,
+	}
+	user := context.User(r.Context())
+	if user != nil {
+		comment.UserID = user.ID
+		comment.Name = user.Name
+		comment.AuthorKey = models.UserAuthorKey(user.ID)
+	} else if link := g.shareLink(r, data.Gallery); link != nil {
+		comment.Name = form.Name
+		comment.AuthorKey = models.GuestAuthorKey(link.ID, clientAddress(r))
+	} else {
+		http.Error(w, "You do not have permission to comment on this gallery", http.StatusForbidden)
+		return
+	}
+	if data.CommentsLocked && comment.UserID != data.UserID {
+		views.RedirectAlert(w, r, back, http.StatusFound, views.Alert{
+			Level:   views.AlertLvlWarning,
+			Message: "Comments on this gallery are closed.",
+		})
+		return
+	}
+	if err := g.cs.Create(&comment); err != nil {
+		views.RedirectAlert(w, r, back, http.StatusFound, views.ErrorAlert(err))
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("%s#comment-%v", back, comment.ID), http.StatusFound)
+}
+
+// CommentHide hides a comment, and the replies to it, from everyone but the gallery's owner, or shows it again
+// POST /galleries/:id/comments/:commentID/hide
+func (g *Galleries) CommentHide(w http.ResponseWriter, r *http.Request) {
+	data, comment, ok := g.moderatedComment(w, r)
+	if !ok {
+		return
+	}
+	back, _ := commentPage(data, comment.ImageID)
+	if err := g.cs.SetHidden(comment.ID, !comment.Hidden); err != nil {
+		views.RedirectAlert(w, r, back, http.StatusFound, views.ErrorAlert(err))
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("%s#comment-%v", back, comment.ID), http.StatusFound)
+}
+
+// CommentDelete removes a comment along with every reply to it
+// POST /galleries/:id/comments/:commentID/delete
+func (g *Galleries) CommentDelete(w http.ResponseWriter, r *http.Request) {
+	data, comment, ok := g.moderatedComment(w, r)
+	if !ok {
+		return
+	}
+	back, _ := commentPage(data, comment.ImageID)
+	if err := g.cs.Delete(comment.ID); err != nil {
+		views.RedirectAlert(w, r, back, http.StatusFound, views.ErrorAlert(err))
+		return
+	}
+	views.RedirectAlert(w, r, back, http.StatusFound, views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "Comment deleted",
+	})
+}
+
+// CommentLock stops new comments being left on the gallery and its images, or allows them again.
+// The gallery's owner can still comment while comments are locked.
+// POST /galleries/:id/comments/lock
+func (g *Galleries) CommentLock(w http.ResponseWriter, r *http.Request) {
+	data, ok := g.showData(w, r)
+	if !ok {
+		return
+	}
+	user := context.User(r.Context())
+	if data.UserID != user.ID {
+		http.Error(w, "You do not have permission to moderate this gallery", http.StatusForbidden)
+		return
+	}
+	var form CommentForm
+	if err := parseForm(r, &form); err != nil {
+		views.RedirectAlert(w, r, data.GalleryURL(), http.StatusFound, views.ErrorAlert(err))
+		return
+	}
+	back, ok := commentPage(data, form.ImageID)
+	if !ok {
+		back = data.GalleryURL()
+	}
+	data.CommentsLocked = !data.CommentsLocked
+	if err := g.gs.Update(data.Gallery); err != nil {
+		views.RedirectAlert(w, r, back, http.StatusFound, views.ErrorAlert(err))
+		return
+	}
+	http.Redirect(w, r, back+"#comments", http.StatusFound)
+}
+
+// Inbox lists the most recent comments on the user's galleries. Opening it marks them all as seen.
+// GET /comments
+func (g *Galleries) Inbox(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	var vd views.Data
+	notices, err := g.cs.ByOwnerID(user.ID, inboxSize)
+	if err != nil {
+		vd.SetAlert(err)
+		g.InboxView.Render(w, r, vd)
+		return
+	}
+	// Only the comments listed here have been seen. Older ones beyond the list stay counted in the navbar.
+	var unseen []uint
+	for _, notice := range notices {
+		if !notice.Seen {
+			unseen = append(unseen, notice.ID)
+		}
+	}
+	if err := g.cs.MarkSeen(user.ID, unseen); err != nil {
+		log.Println(err)
+	} else {
+		user.UnseenComments -= len(unseen)
+		if user.UnseenComments < 0 {
+			user.UnseenComments = 0
+		}
+	}
+	vd.Yield = notices
+	g.InboxView.Render(w, r, vd)
+}
+
+// moderatedComment returns the comment being moderated if the user owns the gallery it was left on.
+// Otherwise an error is written and ok is false.
+func (g *Galleries) moderatedComment(w http.ResponseWriter, r *http.Request) (GalleryShowData, *models.Comment, bool) {
+	data, ok := g.showData(w, r)
+	if !ok {
+		return data, nil, false
+	}
+	user := context.User(r.Context())
+	if data.UserID != user.ID {
+		http.Error(w, "You do not have permission to moderate this gallery", http.StatusForbidden)
+		return data, nil, false
+	}
+	id, err := strconv.Atoi(mux.Vars(r)["commentID"])
+	if err != nil {
+		http.Error(w, "Comment not found", http.StatusNotFound)
+		return data, nil, false
+	}
+	comment, err := g.cs.ByID(uint(id))
+	if err != nil || comment.GalleryID != data.ID {
+		http.Error(w, "Comment not found", http.StatusNotFound)
+		return data, nil, false
+	}
+	return data, comment, true
+}
+
+// commentPage is the page comments on the image with imageID are shown on, or the gallery's page
+// when imageID is 0. ok is false if the image is not in the gallery.
+func commentPage(data GalleryShowData, imageID uint) (page string, ok bool) {
+	if imageID == 0 {
+		return data.GalleryURL(), true
+	}
+	for _, image := range data.Images {
+		if image.ID == imageID {
+			return data.ViewURL(image), true
+		}
+	}
+	return data.GalleryURL(), false
+}
+
+// clientAddress is the IP address the request came from
+func clientAddress(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
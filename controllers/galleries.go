@@ -1,9 +1,15 @@
 package controllers
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
+	"log"
 	"net/http"
+	"net/url"
+	"sort"
 	"strconv"
+	"strings"
 
 	"github.com/curtisvermeeren/web-development-with-go/context"
 	"github.com/curtisvermeeren/web-development-with-go/models"
@@ -12,32 +18,157 @@ import (
 )
 
 const (
-	ShowGallery    = "show_gallery"
-	IndexGalleries = "index_galleries"
-	EditGallery    = "edit_gallery"
+	ShowGallery      = "show_gallery"
+	ShowGalleryImage = "show_gallery_image"
+	IndexGalleries   = "index_galleries"
+	EditGallery      = "edit_gallery"
 
 	maxMultipartMem = 1 << 20 // 1 megabyte
+	recentImports   = 3
+	// maxImportSize is the largest ZIP archive that can be imported, along with the rest of its form
+	maxImportSize = 2 << 30 // 2 gigabytes
 )
 
 type Galleries struct {
-	New       *views.View
-	ShowView  *views.View
-	EditView  *views.View
-	IndexView *views.View
-	gs        models.GalleryService
-	is        models.ImageService
-	r         *mux.Router
+	New         *views.View
+	ShowView    *views.View
+	EditView    *views.View
+	IndexView   *views.View
+	SimilarView *views.View
+	ViewerView  *views.View
+	InboxView   *views.View
+	ProofView   *views.View
+	gs          models.GalleryService
+	is          models.ImageService
+	ts          models.TagService
+	as          models.AlbumService
+	ar          models.ArchiveService
+	sl          models.ShareLinkService
+	ims         models.ImportService
+	usage       models.UsageService
+	signer      *models.ImageSigner
+	vs          models.VariantService
+	wm          models.WatermarkService
+	cs          models.CommentService
+	ss          models.SelectionService
+	r           *mux.Router
 }
 
-func NewGalleries(gs models.GalleryService, is models.ImageService, r *mux.Router) *Galleries {
+// GalleryEditData is passed to the gallery edit view.
+// It embeds the gallery so the view can use the gallery's fields directly.
+type GalleryEditData struct {
+	*models.Gallery
+	// Albums are the albums the gallery can be moved into
+	Albums []models.AlbumNode
+	// Destinations are the user's other galleries that images can be moved or copied to
+	Destinations []models.Gallery
+	// Results are the outcomes of the bulk action that was just applied, keyed by filename
+	Results map[string]*ImageBulkResult
+	// ShareLinks give people without an account access to the gallery
+	ShareLinks []models.ShareLink
+	// Imports are the most recent ZIP imports into the gallery
+	Imports []models.Import
+	// Watermark is drawn on the gallery's images shown to other people, or is nil if there is none
+	Watermark *models.Watermark
+	// WatermarkPositions are the positions the watermark can be drawn at
+	WatermarkPositions []models.WatermarkPosition
+}
+
+// GalleryShowData is passed to the gallery show view
+type GalleryShowData struct {
+	*models.Gallery
+	// DownloadURL downloads every image in the gallery, or is empty if the viewer may not download them
+	DownloadURL string
+	signer      *models.ImageSigner
+	// watermarked is set when the viewer sees the gallery's images with a watermark and may not see the originals
+	watermarked bool
+	// share is the token of the share link the gallery is being viewed through, if any
+	share string
+	// Comments are the comments on the gallery itself, or on the image being viewed
+	Comments *CommentsData
+	// Selection is the viewer's selection of favourites, or nil if the gallery is not open for proofing
+	Selection *SelectionData
+}
+
+// GalleryURL is the URL of the gallery's page, keeping the share link it is being viewed through
+func (d GalleryShowData) GalleryURL() string {
+	return d.withShare(d.Path())
+}
+
+// ViewURL is the permalink of image's page in the viewer, keeping the share link the gallery is being viewed through
+func (d GalleryShowData) ViewURL(image models.Image) string {
+	return d.withShare(d.ImagePath(image.Filename))
+}
+
+// withShare adds the share token to path
+func (d GalleryShowData) withShare(path string) string {
+	if d.share == "" {
+		return path
+	}
+	return path + "?" + url.Values{"share": {d.share}}.Encode()
+}
+
+// ImageURL is the URL of image. Images in galleries that are not public get signed URLs,
+// so they load for people viewing through a share link and can be served from a CDN.
+// Viewers who see a watermark get a large variant with the watermark instead of the original.
+func (d GalleryShowData) ImageURL(image models.Image) string {
+	if d.watermarked {
+		large := models.VariantPresets["large"]
+		if d.IsPublic() || d.signer == nil {
+			return image.VariantPath(large)
+		}
+		return image.SignedVariantPath(d.signer, large)
+	}
+	if d.IsPublic() || d.signer == nil {
+		return image.Path()
+	}
+	return image.SignedPath(d.signer)
+}
+
+// ThumbURL is the URL of a thumbnail of image, signed like ImageURL
+func (d GalleryShowData) ThumbURL(image models.Image) string {
+	if d.IsPublic() || d.signer == nil {
+		return image.ThumbPath()
+	}
+	return image.SignedVariantPath(d.signer, models.VariantPresets["thumb"])
+}
+
+// LargeURL is the URL of a large variant of image for showing in the viewer, signed like ImageURL
+func (d GalleryShowData) LargeURL(image models.Image) string {
+	large := models.VariantPresets["large"]
+	if d.IsPublic() || d.signer == nil {
+		return image.VariantPath(large)
+	}
+	return image.SignedVariantPath(d.signer, large)
+}
+
+func NewGalleries(gs models.GalleryService, is models.ImageService, ts models.TagService, as models.AlbumService,
+	ar models.ArchiveService, sl models.ShareLinkService, ims models.ImportService, usage models.UsageService,
+	signer *models.ImageSigner, vs models.VariantService, wm models.WatermarkService, cs models.CommentService,
+	ss models.SelectionService, r *mux.Router) *Galleries {
 	return &Galleries{
-		New:       views.NewView("bootstrap", "galleries/new"),
-		ShowView:  views.NewView("bootstrap", "galleries/show"),
-		EditView:  views.NewView("bootstrap", "galleries/edit"),
-		IndexView: views.NewView("bootstrap", "galleries/index"),
-		gs:        gs,
-		is:        is,
-		r:         r,
+		New:         views.NewView("bootstrap", "galleries/new"),
+		ShowView:    views.NewView("bootstrap", "galleries/show", "galleries/comments", "galleries/proofing"),
+		EditView:    views.NewView("bootstrap", "galleries/edit"),
+		IndexView:   views.NewView("bootstrap", "galleries/index"),
+		SimilarView: views.NewView("bootstrap", "galleries/similar"),
+		ViewerView:  views.NewView("bootstrap", "galleries/image", "galleries/comments", "galleries/proofing"),
+		InboxView:   views.NewView("bootstrap", "comments/index"),
+		ProofView:   views.NewView("bootstrap", "galleries/proofing_summary"),
+		gs:          gs,
+		is:          is,
+		ts:          ts,
+		as:          as,
+		ar:          ar,
+		sl:          sl,
+		ims:         ims,
+		usage:       usage,
+		signer:      signer,
+		vs:          vs,
+		wm:          wm,
+		cs:          cs,
+		ss:          ss,
+		r:           r,
 	}
 
 }
@@ -54,14 +185,26 @@ func (g *Galleries) Create(w http.ResponseWriter, r *http.Request) {
 
 	user := context.User(r.Context())
 	gallery := models.Gallery{
-		Title:  form.Title,
-		UserID: user.ID,
+		Title:       form.Title,
+		Description: form.Description,
+		Visibility:  models.Visibility(form.Visibility),
+		UserID:      user.ID,
 	}
 	if err := g.gs.Create(&gallery); err != nil {
 		vd.SetAlert(err)
 		g.New.Render(w, r, vd)
 		return
 	}
+	// The gallery already exists at this point, so tag errors are shown on its edit page
+	if err := g.ts.SetGalleryTags(gallery.ID, models.ParseTags(form.Tags)); err != nil {
+		url, err := g.r.Get(EditGallery).URL("id", strconv.Itoa(int(gallery.ID)))
+		if err != nil {
+			http.Redirect(w, r, "/galleries", http.StatusFound)
+			return
+		}
+		views.RedirectAlert(w, r, url.Path, http.StatusFound, views.ErrorAlert(err))
+		return
+	}
 
 	url, err := g.r.Get(IndexGalleries).URL("id", strconv.Itoa(int(gallery.ID)))
 	if err != nil {
@@ -71,20 +214,239 @@ func (g *Galleries) Create(w http.ResponseWriter, r *http.Request) {
 }
 
 type GalleryForm struct {
-	Title string `schema:"title"`
+	Title       string `schema:"title"`
+	Slug        string `schema:"slug"`
+	Description string `schema:"description"`
+	Visibility  string `schema:"visibility"`
+	Tags        string `schema:"tags"`
+	AlbumID     uint   `schema:"album_id"`
+}
+
+// ImageForm represents the caption and alt text fields for a single image
+type ImageForm struct {
+	Caption string `schema:"caption"`
+	AltText string `schema:"alt_text"`
+}
+
+// ImageOrderForm lists the filenames of a gallery's images in their new order
+type ImageOrderForm struct {
+	Order []string `schema:"order"`
 }
 
-// GET /galleries/id
+// ImageBulkForm applies Action to the selected images of a gallery.
+// Caption, Tags and GalleryID are only used by the actions that need them.
+type ImageBulkForm struct {
+	Filenames []string `schema:"filenames"`
+	Action    string   `schema:"action"`
+	Caption   string   `schema:"caption"`
+	Tags      string   `schema:"tags"`
+	GalleryID uint     `schema:"gallery_id"`
+}
+
+// ImageBulkResult is the outcome of a bulk action for one image as reported to JSON clients
+type ImageBulkResult struct {
+	Filename string `json:"filename"`
+	OK       bool   `json:"ok"`
+	Error    string `json:"error,omitempty"`
+}
+
+// GET /galleries/:publicID-:slug
 func (g *Galleries) Show(w http.ResponseWriter, r *http.Request) {
-	gallery, err := g.galleryById(w, r)
-	if err != nil {
+	data, ok := g.showData(w, r)
+	if !ok {
+		return
+	}
+	// Links without the slug, or with one the gallery no longer has, are sent to its current address.
+	// This happens after checking the viewer may see the gallery so the slug never gives away a private title.
+	if mux.Vars(r)["slug"] != data.Slug {
+		u := *r.URL
+		u.Path = data.Path()
+		http.Redirect(w, r, u.String(), http.StatusMovedPermanently)
 		return
 	}
+	if wantsJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(data.JSON())
+		return
+	}
+	data.Comments = g.comments(r, data, nil)
+	data.Selection = g.selectionData(r, data)
 	var vd views.Data
-	vd.Yield = gallery
+	vd.Yield = data
 	g.ShowView.Render(w, r, vd)
 }
 
+// ShowByID permanently redirects links made before galleries had public IDs, such as /galleries/3-trip,
+// to the gallery's current address. Only people who can view the gallery are redirected,
+// so the sequential IDs cannot be used to find private galleries or their titles.
+// GET /galleries/:id-:slug
+func (g *Galleries) ShowByID(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Gallery not found", http.StatusNotFound)
+		return
+	}
+	gallery, err := g.gs.ByID(uint(id))
+	if err != nil {
+		switch err {
+		case models.ErrNotFound:
+			http.Error(w, "Gallery not found", http.StatusNotFound)
+		default:
+			http.Error(w, "Whoops! Something went wrong", http.StatusInternalServerError)
+		}
+		return
+	}
+	if canView, _ := g.access(r, gallery); !canView {
+		http.Error(w, "Gallery not found", http.StatusNotFound)
+		return
+	}
+	u := *r.URL
+	u.Path = gallery.Path()
+	http.Redirect(w, r, u.String(), http.StatusMovedPermanently)
+}
+
+// showData loads the gallery being requested and works out how the viewer may see its images.
+// If the gallery cannot be viewed an error is written and ok is false.
+func (g *Galleries) showData(w http.ResponseWriter, r *http.Request) (data GalleryShowData, ok bool) {
+	gallery, err := g.galleryById(w, r)
+	if err != nil {
+		return data, false
+	}
+	canView, canDownload := g.access(r, gallery)
+	if !canView {
+		http.Error(w, "Gallery not found", http.StatusNotFound)
+		return data, false
+	}
+	wm, err := g.watermark(gallery)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Whoops! Something went wrong", http.StatusInternalServerError)
+		return data, false
+	}
+	data = GalleryShowData{
+		Gallery: gallery,
+		signer:  g.signer,
+		// The owner can always download the originals, so never sees the watermark
+		watermarked: wm != nil && !canDownload,
+		share:       r.URL.Query().Get("share"),
+	}
+	if canDownload && len(gallery.Images) > 0 {
+		data.DownloadURL = data.withShare(fmt.Sprintf("/galleries/%s/download", gallery.PublicID))
+	}
+	return data, true
+}
+
+// GalleryJSON is a gallery as returned to JSON clients
+type GalleryJSON struct {
+	ID          string      `json:"id"`
+	Title       string      `json:"title"`
+	Description string      `json:"description,omitempty"`
+	DownloadURL string      `json:"download_url,omitempty"`
+	Images      []ImageJSON `json:"images"`
+}
+
+// ImageJSON is an image as returned to JSON clients, with its size and placeholders
+// so clients can lay out the page before the image loads
+type ImageJSON struct {
+	Filename      string `json:"filename"`
+	URL           string `json:"url"`
+	ThumbURL      string `json:"thumb_url"`
+	LargeURL      string `json:"large_url"`
+	ViewURL       string `json:"view_url"`
+	Caption       string `json:"caption,omitempty"`
+	Alt           string `json:"alt"`
+	Width         int    `json:"width,omitempty"`
+	Height        int    `json:"height,omitempty"`
+	BlurHash      string `json:"blurhash,omitempty"`
+	DominantColor string `json:"dominant_color,omitempty"`
+}
+
+// JSON is the gallery and its images as returned to JSON clients, with the same URLs as the page
+func (d GalleryShowData) JSON() GalleryJSON {
+	out := GalleryJSON{
+		ID:          d.PublicID,
+		Title:       d.Title,
+		Description: d.Description,
+		DownloadURL: d.DownloadURL,
+		Images:      make([]ImageJSON, len(d.Images)),
+	}
+	for i, image := range d.Images {
+		out.Images[i] = ImageJSON{
+			Filename:      image.Filename,
+			URL:           d.ImageURL(image),
+			ThumbURL:      d.ThumbURL(image),
+			LargeURL:      d.LargeURL(image),
+			ViewURL:       d.ViewURL(image),
+			Caption:       image.Caption,
+			Alt:           image.Alt(),
+			Width:         image.Width,
+			Height:        image.Height,
+			BlurHash:      image.BlurHash,
+			DominantColor: image.DominantColor,
+		}
+	}
+	return out
+}
+
+// Download sends a ZIP archive of every image in the gallery along with a manifest of their captions.
+// The first download of an archive is streamed while a copy is cached on disk. Later downloads, and
+// requests to resume an interrupted download with a Range header, are served from the cached copy.
+// GET /galleries/:publicID/download
+func (g *Galleries) Download(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryById(w, r)
+	if err != nil {
+		return
+	}
+	canView, canDownload := g.access(r, gallery)
+	if !canView {
+		http.Error(w, "Gallery not found", http.StatusNotFound)
+		return
+	}
+	if !canDownload {
+		http.Error(w, "You do not have permission to download this gallery", http.StatusForbidden)
+		return
+	}
+
+	etag, err := g.ar.ETag(gallery)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Whoops! Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	name := gallery.Title + ".zip"
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", contentDisposition(name))
+	w.Header().Set("ETag", `"`+etag+`"`)
+	w.Header().Set("Cache-Control", "private, no-cache")
+
+	archive, err := g.ar.Open(gallery.ID, etag)
+	if err == models.ErrNotFound && r.Header.Get("Range") == "" {
+		// Stream the archive rather than making the client wait for it to be built.
+		// Its length is unknown, but the cached copy will support resuming.
+		w.Header().Set("Accept-Ranges", "bytes")
+		if err := g.ar.Stream(w, gallery, etag); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+	if err == models.ErrNotFound {
+		archive, err = g.ar.Build(gallery, etag)
+	}
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Whoops! Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	defer archive.Close()
+	info, err := archive.Stat()
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Whoops! Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	http.ServeContent(w, r, name, info.ModTime(), archive)
+}
+
 // GET /galleries/:id/edit
 func (g *Galleries) Edit(w http.ResponseWriter, r *http.Request) {
 	gallery, err := g.galleryById(w, r)
@@ -100,7 +462,7 @@ func (g *Galleries) Edit(w http.ResponseWriter, r *http.Request) {
 
 	var vd views.Data
 	vd.Yield = gallery
-	g.EditView.Render(w, r, vd)
+	g.renderEdit(w, r, vd)
 }
 
 // POST /galleries/:id/update
@@ -120,12 +482,21 @@ func (g *Galleries) Update(w http.ResponseWriter, r *http.Request) {
 	var form GalleryForm
 	if err := parseForm(r, &form); err != nil {
 		vd.SetAlert(err)
-		g.EditView.Render(w, r, vd)
+		g.renderEdit(w, r, vd)
 		return
 	}
 
 	gallery.Title = form.Title
+	gallery.Slug = form.Slug
+	gallery.Description = form.Description
+	gallery.Visibility = models.Visibility(form.Visibility)
+	gallery.AlbumID = form.AlbumID
 	err = g.gs.Update(gallery)
+	if err == nil {
+		err = g.ts.SetGalleryTags(gallery.ID, models.ParseTags(form.Tags))
+		gallery.Tags, _ = g.ts.ByGalleryID(gallery.ID)
+		gallery.Breadcrumbs, _ = g.as.Breadcrumbs(gallery.AlbumID)
+	}
 	if err != nil {
 		vd.SetAlert(err)
 	} else {
@@ -135,7 +506,7 @@ func (g *Galleries) Update(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	g.EditView.Render(w, r, vd)
+	g.renderEdit(w, r, vd)
 }
 
 // POST /galleries/:id/delete
@@ -156,7 +527,7 @@ func (g *Galleries) Delete(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		vd.SetAlert(err)
 		vd.Yield = gallery
-		g.EditView.Render(w, r, vd)
+		g.renderEdit(w, r, vd)
 		return
 	}
 
@@ -165,19 +536,121 @@ func (g *Galleries) Delete(w http.ResponseWriter, r *http.Request) {
 		http.Redirect(w, r, "/", http.StatusFound)
 		return
 	}
-	http.Redirect(w, r, url.Path, http.StatusFound)
+	views.RedirectAlert(w, r, url.Path, http.StatusFound, views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "Gallery moved to the trash",
+	})
+}
+
+// GalleryIndexForm represents the sorting, filtering and paging parameters of the galleries index
+type GalleryIndexForm struct {
+	Query  string `schema:"q"`
+	Tag    string `schema:"tag"`
+	Sort   string `schema:"sort"`
+	Cursor string `schema:"cursor"`
+	Offset int    `schema:"offset"`
+	Limit  int    `schema:"limit"`
+}
+
+// GalleryIndexData is passed to the galleries index view
+type GalleryIndexData struct {
+	Galleries []models.Gallery
+	Query     string
+	Tag       string
+	TagCloud  []models.TagCount
+	Sort      string
+	Sorts     []GallerySortOption
+	NextURL   string
+	PrevURL   string
+	// Usage is how much of their quota the user has used
+	Usage *models.Usage
+}
+
+// GallerySortOption is an entry in the sort menu of the galleries index
+type GallerySortOption struct {
+	Value string
+	Label string
+	sort  models.GallerySort
+	desc  bool
+}
+
+// gallerySorts lists the orderings offered on the galleries index, the first being the default
+var gallerySorts = []GallerySortOption{
+	{Value: "newest", Label: "Newest", sort: models.SortCreated, desc: true},
+	{Value: "oldest", Label: "Oldest", sort: models.SortCreated},
+	{Value: "updated", Label: "Recently updated", sort: models.SortUpdated, desc: true},
+	{Value: "title", Label: "Title A-Z", sort: models.SortTitle},
+	{Value: "title_desc", Label: "Title Z-A", sort: models.SortTitle, desc: true},
 }
 
 // GET /galleries
 func (g *Galleries) Index(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	var form GalleryIndexForm
+	if err := parseURLParams(r, &form); err != nil {
+		vd.SetAlert(err)
+	}
+
+	sort := gallerySorts[0]
+	for _, option := range gallerySorts {
+		if option.Value == form.Sort {
+			sort = option
+		}
+	}
+
 	user := context.User(r.Context())
-	galleries, err := g.gs.ByUserID(user.ID)
+	galleries, page, err := g.gs.Find(models.GalleryQuery{
+		UserID: user.ID,
+		Title:  form.Query,
+		Tag:    form.Tag,
+		Sort:   sort.sort,
+		Desc:   sort.desc,
+		Pagination: models.Pagination{
+			Limit:  form.Limit,
+			Cursor: form.Cursor,
+			Offset: form.Offset,
+		},
+	})
+	if err == models.ErrCursorInvalid {
+		http.Redirect(w, r, r.URL.Path, http.StatusFound)
+		return
+	}
 	if err != nil {
 		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
 		return
 	}
-	var vd views.Data
-	vd.Yield = galleries
+	if err := loadImages(g.is, galleries); err != nil {
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+
+	cloud, err := g.ts.CloudByUserID(user.ID, false)
+	if err != nil {
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	usage, err := g.usage.ByUserID(user.ID)
+	if err != nil {
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+
+	data := GalleryIndexData{
+		Galleries: galleries,
+		Query:     form.Query,
+		Tag:       models.NormalizeTag(form.Tag),
+		TagCloud:  cloud,
+		Sort:      sort.Value,
+		Sorts:     gallerySorts,
+		Usage:     usage,
+	}
+	if page.HasNext() {
+		data.NextURL = pageURL(r, page.Next)
+	}
+	if page.HasPrev() {
+		data.PrevURL = pageURL(r, page.Prev)
+	}
+	vd.Yield = data
 	g.IndexView.Render(w, r, vd)
 }
 
@@ -199,34 +672,125 @@ func (g *Galleries) ImageUpload(w http.ResponseWriter, r *http.Request) {
 	err = r.ParseMultipartForm(maxMultipartMem)
 	if err != nil {
 		vd.SetAlert(err)
-		g.EditView.Render(w, r, vd)
+		g.renderEdit(w, r, vd)
 		return
 	}
 
+	skipDuplicates := r.FormValue("skip_duplicates") == "true"
+	var duplicates []string
 	files := r.MultipartForm.File["images"]
+
+	// Refuse uploads that clearly will not fit before storing any of them.
+	// Each image is still checked as it is stored in case other uploads use up the space first.
+	var size int64
+	var count int
+	for _, f := range files {
+		if models.IsImageFilename(f.Filename) {
+			size += f.Size
+			count++
+		}
+	}
+	if err := g.usage.Check(user.ID, size, count); err != nil {
+		vd.SetAlert(err)
+		g.renderEdit(w, r, vd)
+		return
+	}
 	for _, f := range files {
+		// Uploading a folder can include files that are not images, such as .DS_Store
+		if !models.IsImageFilename(f.Filename) {
+			continue
+		}
 		file, err := f.Open()
 		if err != nil {
 			vd.SetAlert(err)
-			g.EditView.Render(w, r, vd)
+			g.renderEdit(w, r, vd)
 			return
 		}
 		defer file.Close()
 
+		duplicate, err := g.is.FindDuplicate(gallery.ID, file)
+		if err != nil {
+			vd.SetAlert(err)
+			g.renderEdit(w, r, vd)
+			return
+		}
+		if duplicate != nil {
+			duplicates = append(duplicates, f.Filename)
+			if skipDuplicates {
+				continue
+			}
+		}
+
 		err = g.is.Create(gallery.ID, file, f.Filename)
 		if err != nil {
 			vd.SetAlert(err)
-			g.EditView.Render(w, r, vd)
+			g.renderEdit(w, r, vd)
 			return
 		}
 	}
 
+	if len(duplicates) == 0 {
+		g.redirectToEdit(w, r, gallery)
+		return
+	}
+	msg := "These images were already in the gallery and were uploaded again: "
+	if skipDuplicates {
+		msg = "These images were already in the gallery and were skipped: "
+	}
 	url, err := g.r.Get(EditGallery).URL("id", fmt.Sprintf("%v", gallery.ID))
 	if err != nil {
 		http.Redirect(w, r, "/galleries", http.StatusFound)
 		return
 	}
-	http.Redirect(w, r, url.Path, http.StatusFound)
+	views.RedirectAlert(w, r, url.Path, http.StatusFound, views.Alert{
+		Level:   views.AlertLvlWarning,
+		Message: msg + strings.Join(duplicates, ", "),
+	})
+}
+
+// SimilarData is passed to the similar photos view
+type SimilarData struct {
+	Groups []models.SimilarGroup
+	// Distance is how many bits the perceptual hashes of similar photos may differ by
+	Distance    int
+	MaxDistance int
+	// Galleries maps gallery IDs to the user's galleries so each photo can link to where it is
+	Galleries map[uint]*models.Gallery
+}
+
+// Similar shows groups of photos across the current user's galleries that look alike,
+// such as the same shot uploaded twice or edited copies of a photo.
+// GET /galleries/similar?distance=10
+func (g *Galleries) Similar(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	data := SimilarData{
+		Distance:    models.DefaultSimilarDistance,
+		MaxDistance: models.MaxSimilarDistance,
+	}
+	if d, err := strconv.Atoi(r.URL.Query().Get("distance")); err == nil && d >= 0 && d <= models.MaxSimilarDistance {
+		data.Distance = d
+	}
+
+	var vd views.Data
+	groups, err := g.is.Similar(user.ID, data.Distance)
+	if err != nil {
+		vd.SetAlert(err)
+		g.SimilarView.Render(w, r, vd)
+		return
+	}
+	galleries, err := g.gs.ByUserID(user.ID)
+	if err != nil {
+		vd.SetAlert(err)
+		g.SimilarView.Render(w, r, vd)
+		return
+	}
+	data.Groups = groups
+	data.Galleries = make(map[uint]*models.Gallery, len(galleries))
+	for i := range galleries {
+		data.Galleries[galleries[i].ID] = &galleries[i]
+	}
+	vd.Yield = data
+	g.SimilarView.Render(w, r, vd)
 }
 
 // POST /galleries/:id/images/:filename/delete
@@ -252,40 +816,708 @@ func (g *Galleries) ImageDelete(w http.ResponseWriter, r *http.Request) {
 		var vd views.Data
 		vd.Yield = gallery
 		vd.SetAlert(err)
-		g.EditView.Render(w, r, vd)
+		g.renderEdit(w, r, vd)
 		return
 	}
 
-	url, err := g.r.Get(EditGallery).URL("id", fmt.Sprintf("%v", gallery.ID))
+	g.redirectToEdit(w, r, gallery)
+}
+
+// POST /galleries/:id/images/:filename/update
+func (g *Galleries) ImageUpdate(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryById(w, r)
 	if err != nil {
-		http.Redirect(w, r, "/galleries", http.StatusFound)
+		return
+	}
+	user := context.User(r.Context())
+	if gallery.UserID != user.ID {
+		http.Error(w, "You do not have permission to edit this gallery or image", http.StatusForbidden)
 		return
 	}
 
-	http.Redirect(w, r, url.Path, http.StatusFound)
+	var vd views.Data
+	vd.Yield = gallery
+	var form ImageForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		g.renderEdit(w, r, vd)
+		return
+	}
+
+	image, err := g.is.ByFilename(gallery.ID, mux.Vars(r)["filename"])
+	if err != nil {
+		vd.SetAlert(err)
+		g.renderEdit(w, r, vd)
+		return
+	}
+	image.Caption = form.Caption
+	image.AltText = form.AltText
+	if err := g.is.Update(image); err != nil {
+		vd.SetAlert(err)
+		g.renderEdit(w, r, vd)
+		return
+	}
+
+	g.redirectToEdit(w, r, gallery)
 }
 
-func (g *Galleries) galleryById(w http.ResponseWriter, r *http.Request) (*models.Gallery, error) {
-	vars := mux.Vars(r)
-	idString := vars["id"]
-	id, err := strconv.Atoi(idString)
+// POST /galleries/:id/images/:filename/cover
+func (g *Galleries) ImageCover(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryById(w, r)
 	if err != nil {
-		http.Error(w, "Invalid gallery ID", http.StatusNotFound)
-		return nil, err
+		return
 	}
-	gallery, err := g.gs.ByID(uint(id))
+	user := context.User(r.Context())
+	if gallery.UserID != user.ID {
+		http.Error(w, "You do not have permission to edit this gallery or image", http.StatusForbidden)
+		return
+	}
+
+	err = g.is.SetCover(gallery.ID, mux.Vars(r)["filename"])
 	if err != nil {
-		switch err {
-		case models.ErrNotFound:
-			http.Error(w, "Gallery not found", http.StatusNotFound)
-		default:
-			http.Error(w, "Whoops! Something went wrong", http.StatusInternalServerError)
-		}
-		return nil, err
+		var vd views.Data
+		vd.Yield = gallery
+		vd.SetAlert(err)
+		g.renderEdit(w, r, vd)
+		return
+	}
+
+	g.redirectToEdit(w, r, gallery)
+}
+
+// POST /galleries/:id/images/order
+func (g *Galleries) ImageOrder(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryById(w, r)
+	if err != nil {
+		return
+	}
+	user := context.User(r.Context())
+	if gallery.UserID != user.ID {
+		http.Error(w, "You do not have permission to edit this gallery", http.StatusForbidden)
+		return
+	}
+
+	var vd views.Data
+	vd.Yield = gallery
+	var form ImageOrderForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		g.renderEdit(w, r, vd)
+		return
+	}
+	if err := g.is.Reorder(gallery.ID, form.Order); err != nil {
+		vd.SetAlert(err)
+		g.renderEdit(w, r, vd)
+		return
 	}
 
-	images, _ := g.is.ByGalleryID(gallery.ID)
-	gallery.Images = images
+	g.redirectToEdit(w, r, gallery)
+}
+
+// ImageBulk deletes, captions, tags, moves, copies or downloads the selected images of a gallery in one request.
+// Every action except download reports the outcome for each image, as JSON if the client asks for it
+// and otherwise on the edit page.
+// POST /galleries/:id/images/bulk
+func (g *Galleries) ImageBulk(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryById(w, r)
+	if err != nil {
+		return
+	}
+	user := context.User(r.Context())
+	if gallery.UserID != user.ID {
+		http.Error(w, "You do not have permission to edit this gallery", http.StatusForbidden)
+		return
+	}
+
+	var form ImageBulkForm
+	if err := parseForm(r, &form); err != nil {
+		g.bulkError(w, r, gallery, err)
+		return
+	}
+	if len(form.Filenames) == 0 {
+		g.bulkError(w, r, gallery, models.ErrNoImagesSelected)
+		return
+	}
+
+	var results models.ImageResults
+	switch form.Action {
+	case "delete":
+		results = g.is.DeleteMany(gallery.ID, form.Filenames)
+	case "caption":
+		results = g.is.UpdateMany(gallery.ID, form.Filenames, func(image *models.Image) {
+			image.Caption = form.Caption
+		})
+	case "tag":
+		results = g.tagImages(gallery.ID, form.Filenames, models.ParseTags(form.Tags))
+	case "move", "copy":
+		dst, err := g.gs.ByID(form.GalleryID)
+		if err != nil || dst.UserID != user.ID {
+			g.bulkError(w, r, gallery, models.ErrDestinationInvalid)
+			return
+		}
+		transfer := g.is.Copy
+		if form.Action == "move" {
+			transfer = g.is.Move
+		}
+		_, err = transfer(gallery.ID, form.Filenames, dst.ID)
+		// Moves and copies are all or nothing, so every image shares the outcome
+		results = make(models.ImageResults, len(form.Filenames))
+		for i, filename := range form.Filenames {
+			results[i] = models.ImageResult{Filename: filename, Err: err}
+		}
+	case "download":
+		g.downloadImages(w, r, gallery, form.Filenames)
+		return
+	default:
+		g.bulkError(w, r, gallery, models.ErrBulkActionInvalid)
+		return
+	}
+
+	out := make([]ImageBulkResult, len(results))
+	for i, result := range results {
+		out[i] = ImageBulkResult{Filename: result.Filename, OK: result.Err == nil}
+		if result.Err != nil {
+			out[i].Error = views.ErrorAlert(result.Err).Message
+		}
+	}
+	if wantsJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"results": out})
+		return
+	}
+
+	// Reload the images so the page reflects what changed
+	gallery.Images, err = g.imagesWithTags(gallery.ID)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Whoops! Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	data := g.editData(gallery)
+	data.Results = make(map[string]*ImageBulkResult, len(out))
+	for i := range out {
+		data.Results[out[i].Filename] = &out[i]
+	}
+	var vd views.Data
+	vd.Yield = data
+	verb := bulkActionVerbs[form.Action]
+	if failed := results.Failed(); failed > 0 {
+		vd.AlertError(fmt.Sprintf("%d of %d images could not be %s. The problems are shown below each image.", failed, len(results), verb))
+	} else {
+		vd.Alert = &views.Alert{
+			Level:   views.AlertLvlSuccess,
+			Message: fmt.Sprintf("%d %s %s", len(results), pluralImages(len(results)), verb),
+		}
+	}
+	g.EditView.Render(w, r, vd)
+}
+
+// bulkActionVerbs describe what each bulk action did to the images, for the message shown afterwards
+var bulkActionVerbs = map[string]string{
+	"delete":  "deleted",
+	"caption": "captioned",
+	"tag":     "tagged",
+	"move":    "moved",
+	"copy":    "copied",
+}
+
+// pluralImages is "image" or "images" to follow the number n
+func pluralImages(n int) string {
+	if n == 1 {
+		return "image"
+	}
+	return "images"
+}
+
+// tagImages adds names to the tags of each of a gallery's images with filenames
+func (g *Galleries) tagImages(galleryID uint, filenames []string, names []string) models.ImageResults {
+	results := make(models.ImageResults, len(filenames))
+	for i, filename := range filenames {
+		results[i].Filename = filename
+		image, err := g.is.ByFilename(galleryID, filename)
+		if err != nil {
+			results[i].Err = err
+			continue
+		}
+		results[i].Err = g.ts.AddImageTags(image.ID, names)
+	}
+	return results
+}
+
+// downloadImages streams a ZIP archive of a gallery's images with filenames
+func (g *Galleries) downloadImages(w http.ResponseWriter, r *http.Request, gallery *models.Gallery, filenames []string) {
+	selected := make(map[string]bool, len(filenames))
+	for _, filename := range filenames {
+		selected[filename] = true
+	}
+	var images []models.Image
+	for _, image := range gallery.Images {
+		if selected[image.Filename] {
+			images = append(images, image)
+		}
+	}
+	if len(images) == 0 {
+		g.bulkError(w, r, gallery, models.ErrNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", contentDisposition(gallery.Title+".zip"))
+	if err := g.ar.Write(w, gallery, images); err != nil {
+		// The response has already started so the error can only be logged
+		log.Println(err)
+	}
+}
+
+// imagesWithTags returns the images of a gallery with their tags loaded
+func (g *Galleries) imagesWithTags(galleryID uint) ([]models.Image, error) {
+	images, err := g.is.ByGalleryID(galleryID)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]uint, len(images))
+	for i, image := range images {
+		ids[i] = image.ID
+	}
+	tags, err := g.ts.ByImageIDs(ids)
+	if err != nil {
+		return nil, err
+	}
+	for i := range images {
+		images[i].Tags = tags[images[i].ID]
+	}
+	return images, nil
+}
+
+// loadImages fills in the images of galleries with one query, for listings that show their covers and counts
+func loadImages(is models.ImageService, galleries []models.Gallery) error {
+	ids := make([]uint, len(galleries))
+	for i := range galleries {
+		ids[i] = galleries[i].ID
+	}
+	images, err := is.ByGalleryIDs(ids)
+	if err != nil {
+		return err
+	}
+	for i := range galleries {
+		galleries[i].Images = images[galleries[i].ID]
+	}
+	return nil
+}
+
+// bulkError reports an error that stopped a bulk action before any image was changed
+func (g *Galleries) bulkError(w http.ResponseWriter, r *http.Request, gallery *models.Gallery, err error) {
+	if wantsJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": views.ErrorAlert(err).Message})
+		return
+	}
+	var vd views.Data
+	vd.Yield = gallery
+	vd.SetAlert(err)
+	g.renderEdit(w, r, vd)
+}
+
+// ImportCreate starts importing an uploaded ZIP archive of images into the gallery.
+// The upload is written to disk as it is received rather than held in memory.
+// POST /galleries/:id/imports
+func (g *Galleries) ImportCreate(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryById(w, r)
+	if err != nil {
+		return
+	}
+	user := context.User(r.Context())
+	if gallery.UserID != user.ID {
+		http.Error(w, "Gallery not found", http.StatusNotFound)
+		return
+	}
+
+	var vd views.Data
+	vd.Yield = gallery
+	if r.ContentLength > maxImportSize {
+		vd.AlertError("ZIP archives can be at most 2 GB. Split the images into smaller archives and import each of them.")
+		g.renderEdit(w, r, vd)
+		return
+	}
+	// Requests that do not say how long they are stop being read at the limit, before they fill the disk
+	r.Body = http.MaxBytesReader(w, r.Body, maxImportSize)
+	if err := r.ParseMultipartForm(maxMultipartMem); err != nil {
+		vd.SetAlert(err)
+		g.renderEdit(w, r, vd)
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+	file, header, err := r.FormFile("archive")
+	if err != nil {
+		vd.AlertError("Please choose a ZIP archive to import")
+		g.renderEdit(w, r, vd)
+		return
+	}
+	defer file.Close()
+	// The archive is kept until the import finishes, and its images take up at least as much space once imported
+	if err := g.usage.Check(user.ID, header.Size, 0); err != nil {
+		vd.SetAlert(err)
+		g.renderEdit(w, r, vd)
+		return
+	}
+	if _, err := g.ims.Create(gallery.ID, user.ID, file); err != nil {
+		vd.SetAlert(err)
+		g.renderEdit(w, r, vd)
+		return
+	}
+
+	url, err := g.r.Get(EditGallery).URL("id", fmt.Sprintf("%v", gallery.ID))
+	if err != nil {
+		http.Redirect(w, r, "/galleries", http.StatusFound)
+		return
+	}
+	views.RedirectAlert(w, r, url.Path, http.StatusFound, views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "Import started. Images will appear in the gallery as they are imported.",
+	})
+}
+
+// ImportProgress is the progress of an import as reported to the edit page while it runs
+type ImportProgress struct {
+	Status    models.ImportStatus `json:"status"`
+	Total     int                 `json:"total"`
+	Processed int                 `json:"processed"`
+	Imported  int                 `json:"imported"`
+	Skipped   int                 `json:"skipped"`
+	Percent   int                 `json:"percent"`
+	Finished  bool                `json:"finished"`
+}
+
+// ImportShow reports the progress of an import as JSON
+// GET /galleries/:id/imports/:importID
+func (g *Galleries) ImportShow(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryById(w, r)
+	if err != nil {
+		return
+	}
+	user := context.User(r.Context())
+	if gallery.UserID != user.ID {
+		http.Error(w, "Gallery not found", http.StatusNotFound)
+		return
+	}
+	importID, err := strconv.Atoi(mux.Vars(r)["importID"])
+	if err != nil {
+		http.Error(w, "Import not found", http.StatusNotFound)
+		return
+	}
+	imp, err := g.ims.ByID(uint(importID))
+	if err != nil || imp.GalleryID != gallery.ID {
+		http.Error(w, "Import not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ImportProgress{
+		Status:    imp.Status,
+		Total:     imp.Total,
+		Processed: imp.Processed,
+		Imported:  imp.Imported,
+		Skipped:   imp.Skipped,
+		Percent:   imp.Percent(),
+		Finished:  imp.Finished(),
+	})
+}
+
+// ShareForm creates a share link
+type ShareForm struct {
+	AllowDownload bool `schema:"allow_download"`
+}
+
+// POST /galleries/:id/shares
+func (g *Galleries) ShareCreate(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryById(w, r)
+	if err != nil {
+		return
+	}
+	user := context.User(r.Context())
+	if gallery.UserID != user.ID {
+		http.Error(w, "You do not have permission to share this gallery", http.StatusForbidden)
+		return
+	}
+
+	var vd views.Data
+	vd.Yield = gallery
+	var form ShareForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		g.renderEdit(w, r, vd)
+		return
+	}
+	link := models.ShareLink{
+		GalleryID:     gallery.ID,
+		AllowDownload: form.AllowDownload,
+	}
+	if err := g.sl.Create(&link); err != nil {
+		vd.SetAlert(err)
+		g.renderEdit(w, r, vd)
+		return
+	}
+	g.redirectToEdit(w, r, gallery)
+}
+
+// POST /galleries/:id/shares/:shareID/delete
+func (g *Galleries) ShareDelete(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryById(w, r)
+	if err != nil {
+		return
+	}
+	user := context.User(r.Context())
+	if gallery.UserID != user.ID {
+		http.Error(w, "You do not have permission to share this gallery", http.StatusForbidden)
+		return
+	}
+
+	shareID, err := strconv.Atoi(mux.Vars(r)["shareID"])
+	if err != nil {
+		http.Error(w, "Invalid share link ID", http.StatusNotFound)
+		return
+	}
+	if err := g.sl.Delete(gallery.ID, uint(shareID)); err != nil {
+		var vd views.Data
+		vd.Yield = gallery
+		vd.SetAlert(err)
+		g.renderEdit(w, r, vd)
+		return
+	}
+	g.redirectToEdit(w, r, gallery)
+}
+
+// WatermarkForm sets up a gallery's watermark. The PNG image of an image watermark is uploaded as the image file.
+type WatermarkForm struct {
+	Kind     string `schema:"kind"`
+	Text     string `schema:"text"`
+	Position string `schema:"position"`
+	Opacity  int    `schema:"opacity"`
+	Scale    int    `schema:"scale"`
+}
+
+// WatermarkUpdate sets up the watermark drawn on the gallery's images shown to other people
+// POST /galleries/:id/watermark
+func (g *Galleries) WatermarkUpdate(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryById(w, r)
+	if err != nil {
+		return
+	}
+	user := context.User(r.Context())
+	if gallery.UserID != user.ID {
+		http.Error(w, "You do not have permission to edit this gallery", http.StatusForbidden)
+		return
+	}
+
+	var vd views.Data
+	vd.Yield = gallery
+	if err := r.ParseMultipartForm(maxMultipartMem); err != nil {
+		vd.SetAlert(err)
+		g.renderEdit(w, r, vd)
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+	var form WatermarkForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		g.renderEdit(w, r, vd)
+		return
+	}
+	wm := models.Watermark{
+		GalleryID: gallery.ID,
+		Kind:      models.WatermarkKind(form.Kind),
+		Text:      form.Text,
+		Position:  models.WatermarkPosition(form.Position),
+		Opacity:   form.Opacity,
+		Scale:     form.Scale,
+	}
+	// The image only needs to be uploaded again to replace it
+	var image io.Reader
+	if file, _, err := r.FormFile("image"); err == nil {
+		defer file.Close()
+		image = file
+	}
+	if err := g.wm.Save(&wm, image); err != nil {
+		vd.SetAlert(err)
+		g.renderEdit(w, r, vd)
+		return
+	}
+	g.redirectToEdit(w, r, gallery)
+}
+
+// WatermarkDelete removes the gallery's watermark
+// POST /galleries/:id/watermark/delete
+func (g *Galleries) WatermarkDelete(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryById(w, r)
+	if err != nil {
+		return
+	}
+	user := context.User(r.Context())
+	if gallery.UserID != user.ID {
+		http.Error(w, "You do not have permission to edit this gallery", http.StatusForbidden)
+		return
+	}
+	if err := g.wm.Delete(gallery.ID); err != nil {
+		var vd views.Data
+		vd.Yield = gallery
+		vd.SetAlert(err)
+		g.renderEdit(w, r, vd)
+		return
+	}
+	g.redirectToEdit(w, r, gallery)
+}
+
+// access reports whether the current user, or someone holding a share link from the request's share parameter,
+// can view gallery and download its images. Public galleries can be viewed by anyone, and downloaded by anyone
+// unless they have a watermark.
+func (g *Galleries) access(r *http.Request, gallery *models.Gallery) (canView, canDownload bool) {
+	user := context.User(r.Context())
+	if user != nil && user.ID == gallery.UserID {
+		return true, true
+	}
+	if gallery.IsPublic() {
+		// Watermarked originals are only downloadable by the owner and through share links that allow it
+		wm, err := g.watermark(gallery)
+		if err != nil {
+			log.Println(err)
+		}
+		return true, err == nil && wm == nil
+	}
+	if link := g.shareLink(r, gallery); link != nil {
+		return true, link.AllowDownload
+	}
+	return false, false
+}
+
+// shareLink returns the share link the gallery is being viewed through, or nil if there is none
+func (g *Galleries) shareLink(r *http.Request, gallery *models.Gallery) *models.ShareLink {
+	token := r.URL.Query().Get("share")
+	if token == "" {
+		return nil
+	}
+	link, err := g.sl.ByToken(gallery.ID, token)
+	if err != nil {
+		return nil
+	}
+	return link
+}
+
+// watermark returns the gallery's watermark, or nil if it does not have one
+func (g *Galleries) watermark(gallery *models.Gallery) (*models.Watermark, error) {
+	wm, err := g.wm.ByGalleryID(gallery.ID)
+	if err == models.ErrNotFound {
+		return nil, nil
+	}
+	return wm, err
+}
+
+// renderEdit renders the edit view for the gallery in vd.Yield along with the albums it can be moved into
+func (g *Galleries) renderEdit(w http.ResponseWriter, r *http.Request, vd views.Data) {
+	if gallery, ok := vd.Yield.(*models.Gallery); ok {
+		vd.Yield = g.editData(gallery)
+	}
+	g.EditView.Render(w, r, vd)
+}
+
+// editData gathers what the edit view needs besides the gallery itself
+func (g *Galleries) editData(gallery *models.Gallery) GalleryEditData {
+	albums, err := g.as.Tree(gallery.UserID)
+	if err != nil {
+		log.Println(err)
+	}
+	destinations, err := g.destinations(gallery)
+	if err != nil {
+		log.Println(err)
+	}
+	links, err := g.sl.ByGalleryID(gallery.ID)
+	if err != nil {
+		log.Println(err)
+	}
+	imports, err := g.ims.ByGalleryID(gallery.ID, recentImports)
+	if err != nil {
+		log.Println(err)
+	}
+	wm, err := g.watermark(gallery)
+	if err != nil {
+		log.Println(err)
+	}
+	return GalleryEditData{
+		Gallery:            gallery,
+		Albums:             albums,
+		Destinations:       destinations,
+		ShareLinks:         links,
+		Imports:            imports,
+		Watermark:          wm,
+		WatermarkPositions: models.WatermarkPositions,
+	}
+}
+
+// destinations returns the galleries of the owner of gallery, other than gallery itself, sorted by title
+func (g *Galleries) destinations(gallery *models.Gallery) ([]models.Gallery, error) {
+	galleries, err := g.gs.ByUserID(gallery.UserID)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(galleries, func(i, j int) bool {
+		return strings.ToLower(galleries[i].Title) < strings.ToLower(galleries[j].Title)
+	})
+	ret := make([]models.Gallery, 0, len(galleries))
+	for _, other := range galleries {
+		if other.ID != gallery.ID {
+			ret = append(ret, other)
+		}
+	}
+	return ret, nil
+}
+
+// redirectToEdit sends the user to the edit page of gallery
+func (g *Galleries) redirectToEdit(w http.ResponseWriter, r *http.Request, gallery *models.Gallery) {
+	url, err := g.r.Get(EditGallery).URL("id", fmt.Sprintf("%v", gallery.ID))
+	if err != nil {
+		http.Redirect(w, r, "/galleries", http.StatusFound)
+		return
+	}
+	http.Redirect(w, r, url.Path, http.StatusFound)
+}
+
+// galleryById loads the gallery from the URL along with its images, tags and breadcrumbs.
+// Public pages find it by its public ID and the owner's pages by its ID.
+func (g *Galleries) galleryById(w http.ResponseWriter, r *http.Request) (*models.Gallery, error) {
+	vars := mux.Vars(r)
+	var gallery *models.Gallery
+	var err error
+	if publicID, ok := vars["publicID"]; ok {
+		gallery, err = g.gs.ByPublicID(publicID)
+	} else {
+		var id int
+		id, err = strconv.Atoi(vars["id"])
+		if err != nil {
+			http.Error(w, "Invalid gallery ID", http.StatusNotFound)
+			return nil, err
+		}
+		gallery, err = g.gs.ByID(uint(id))
+	}
+	if err != nil {
+		switch err {
+		case models.ErrNotFound:
+			http.Error(w, "Gallery not found", http.StatusNotFound)
+		default:
+			http.Error(w, "Whoops! Something went wrong", http.StatusInternalServerError)
+		}
+		return nil, err
+	}
+
+	gallery.Images, err = g.imagesWithTags(gallery.ID)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Whoops! Something went wrong", http.StatusInternalServerError)
+		return nil, err
+	}
+	tags, _ := g.ts.ByGalleryID(gallery.ID)
+	gallery.Tags = tags
+	crumbs, _ := g.as.Breadcrumbs(gallery.AlbumID)
+	gallery.Breadcrumbs = crumbs
 
 	return gallery, nil
 }
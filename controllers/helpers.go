@@ -1,8 +1,10 @@
 package controllers
 
 import (
+	"mime"
 	"net/http"
 	"net/url"
+	"strings"
 
 	"github.com/gorilla/schema"
 )
@@ -29,3 +31,26 @@ func parseURLParams(r *http.Request, dst interface{}) error {
 	}
 	return parseValues(r.Form, dst)
 }
+
+// pageURL returns the current request URL with its cursor set to cursor, keeping all other query parameters.
+// Any offset is dropped because the cursor already marks the position in the listing.
+func pageURL(r *http.Request, cursor string) string {
+	query := r.URL.Query()
+	query.Del("offset")
+	query.Set("cursor", cursor)
+	u := url.URL{
+		Path:     r.URL.Path,
+		RawQuery: query.Encode(),
+	}
+	return u.String()
+}
+
+// wantsJSON reports whether the client asked for a JSON response rather than a page
+func wantsJSON(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+// contentDisposition returns a Content-Disposition header value that downloads a file named filename
+func contentDisposition(filename string) string {
+	return mime.FormatMediaType("attachment", map[string]string{"filename": filename})
+}
@@ -0,0 +1,226 @@
+package controllers
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/curtisvermeeren/web-development-with-go/context"
+	"github.com/curtisvermeeren/web-development-with-go/models"
+	"github.com/curtisvermeeren/web-development-with-go/views"
+	"github.com/gorilla/mux"
+)
+
+// imageMaxAge is how long browsers may keep an image requested by its versioned URL, which changes whenever the file does
+const imageMaxAge = 365 * 24 * time.Hour
+
+/*
+ImageShow serves an image file to anyone who can view its gallery, or who has a signed URL for it that has
+not expired. Everyone else gets a 404 so private galleries are not revealed. When a gallery has a watermark,
+its original images are only served to people who may download them, and everyone else sees the
+watermarked variants served by VariantShow.
+
+Responses carry a strong ETag, the image's SHA-256 hash, and Last-Modified so browsers can revalidate
+with conditional requests, and Range requests are supported. An image requested by its versioned URL,
+as given by Image.Path, may be cached for a year without revalidating. Images are cached privately so a shared
+cache never keeps an image after its gallery is made private, except through signed URLs, which may be cached
+by anyone until they expire.
+
+GET /images/galleries/:id/:filename
+*/
+func (g *Galleries) ImageShow(w http.ResponseWriter, r *http.Request) {
+	req := g.viewableImage(w, r, "")
+	if req == nil {
+		return
+	}
+	if !req.signed && !req.canDownload {
+		wm, err := g.watermark(req.gallery)
+		if err != nil {
+			log.Println(err)
+			http.Error(w, "Whoops! Something went wrong", http.StatusInternalServerError)
+			return
+		}
+		if wm != nil {
+			http.NotFound(w, r)
+			return
+		}
+	}
+	image := req.image
+	f, err := os.Open(image.RelativePath())
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		http.NotFound(w, r)
+		return
+	}
+
+	if image.SHA256 != "" {
+		w.Header().Set("ETag", fmt.Sprintf("%q", image.SHA256))
+	}
+	setImageCaching(w, r, image, req.signed)
+	http.ServeContent(w, r, image.Filename, info.ModTime(), f)
+}
+
+/*
+VariantShow serves an image resized, cropped or converted as asked for by its query parameters, making the
+variant the first time it is asked for. Anyone who can view the image may ask for one of the presets, while
+any other size or format needs a signed URL. Variants are cached like the images they are made from.
+The gallery's watermark, if it has one, is drawn on variants for everyone but the gallery's owner.
+
+GET /img/:id/:filename
+*/
+func (g *Galleries) VariantShow(w http.ResponseWriter, r *http.Request) {
+	v, err := models.ParseVariant(r.URL.Query())
+	if err != nil {
+		http.Error(w, views.ErrorAlert(err).Message, http.StatusBadRequest)
+		return
+	}
+	req := g.viewableImage(w, r, v.String())
+	if req == nil {
+		return
+	}
+	if v.Preset == "" && !req.signed {
+		http.Error(w, "Only preset image sizes can be used without a signed link", http.StatusForbidden)
+		return
+	}
+	wm, err := g.watermark(req.gallery)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Whoops! Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	// The same signed URL is given to the owner and everyone else, so the owner's copy without a
+	// watermark must not be kept by a shared cache
+	shared := req.signed
+	if req.owner {
+		shared = shared && wm == nil
+		wm = nil
+	}
+
+	image := req.image
+	f, err := g.vs.Open(image, v, wm)
+	if os.IsNotExist(err) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Whoops! Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	// The cached file is named by a hash of the image's content and the variant, so it makes a strong ETag.
+	// Its modification time records when it was last used rather than changed, so no Last-Modified is sent.
+	name := filepath.Base(f.Name())
+	w.Header().Set("ETag", fmt.Sprintf("%q", strings.TrimSuffix(name, filepath.Ext(name))))
+	w.Header().Set("Content-Type", g.vs.ContentType(image, v))
+	setImageCaching(w, r, image, shared)
+	http.ServeContent(w, r, name, time.Time{}, f)
+}
+
+// imageRequest is the image an image URL is for and how the viewer may see it
+type imageRequest struct {
+	gallery *models.Gallery
+	image   *models.Image
+	// signed is set when the URL has a valid signature
+	signed bool
+	// owner is set when the viewer owns the gallery
+	owner bool
+	// canDownload is set when the viewer may download the gallery's original images
+	canDownload bool
+}
+
+// viewableImage looks up the image an image URL is for, checking it can be viewed by the user or with a
+// signature for variant. Otherwise it writes an error response and returns nil.
+func (g *Galleries) viewableImage(w http.ResponseWriter, r *http.Request, variant string) *imageRequest {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.NotFound(w, r)
+		return nil
+	}
+	// Hidden files, such as uploads still being written, are never served
+	filename := vars["filename"]
+	if !models.IsImageFilename(filename) {
+		http.NotFound(w, r)
+		return nil
+	}
+	gallery, err := g.gs.ByID(uint(id))
+	switch err {
+	case nil:
+	case models.ErrNotFound:
+		http.NotFound(w, r)
+		return nil
+	default:
+		log.Println(err)
+		http.Error(w, "Whoops! Something went wrong", http.StatusInternalServerError)
+		return nil
+	}
+	// A signed URL grants access on its own, so it works without a session until it expires
+	var signErr error
+	signed := false
+	if r.URL.Query().Get("sig") != "" {
+		signErr = g.signer.Verify(r.URL.Path, variant, r.URL.Query(), time.Now())
+		signed = signErr == nil
+	}
+	canView, canDownload := g.access(r, gallery)
+	if !canView && !signed {
+		if signErr == models.ErrSignatureExpired {
+			http.Error(w, "This image link has expired. Reload the page to get a new one.", http.StatusForbidden)
+			return nil
+		}
+		http.NotFound(w, r)
+		return nil
+	}
+
+	image, err := g.is.ByFilename(gallery.ID, filename)
+	switch err {
+	case nil:
+	case models.ErrNotFound:
+		// Files stored before images had records are still served, without an ETag until they are hashed
+		image = &models.Image{GalleryID: gallery.ID, Filename: filename}
+	default:
+		log.Println(err)
+		http.Error(w, "Whoops! Something went wrong", http.StatusInternalServerError)
+		return nil
+	}
+	user := context.User(r.Context())
+	return &imageRequest{
+		gallery:     gallery,
+		image:       image,
+		signed:      signed,
+		owner:       user != nil && user.ID == gallery.UserID,
+		canDownload: canDownload,
+	}
+}
+
+// setImageCaching sets how long an image, or a variant of it, may be cached for.
+// Shared responses are for signed URLs and may be kept by shared caches until the URL expires.
+func setImageCaching(w http.ResponseWriter, r *http.Request, image *models.Image, shared bool) {
+	versioned := r.URL.Query().Get("v") != "" && r.URL.Query().Get("v") == image.Version()
+	switch {
+	case shared:
+		// The URL is the credential, so shared caches such as a CDN may keep the image until the URL expires
+		expires, _ := strconv.ParseInt(r.URL.Query().Get("expires"), 10, 64)
+		maxAge := time.Until(time.Unix(expires, 0))
+		if !versioned {
+			maxAge = 0
+		}
+		w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(maxAge.Seconds())))
+	case versioned:
+		w.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d, immutable", int(imageMaxAge.Seconds())))
+	default:
+		w.Header().Set("Cache-Control", "private, no-cache")
+	}
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+}
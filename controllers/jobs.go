@@ -0,0 +1,151 @@
+package controllers
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/curtisvermeeren/web-development-with-go/jobs"
+	"github.com/curtisvermeeren/web-development-with-go/views"
+	"github.com/gorilla/mux"
+)
+
+const (
+	IndexJobs = "index_jobs"
+
+	// jobsPerPage is how many jobs the admin page lists at a time
+	jobsPerPage = 50
+)
+
+// Jobs lets admins inspect the background job queue and retry failed jobs
+type Jobs struct {
+	IndexView *views.View
+	ShowView  *views.View
+	q         *jobs.Queue
+	r         *mux.Router
+}
+
+// JobsData is passed to the jobs index view
+type JobsData struct {
+	Jobs     []jobs.Job
+	Status   jobs.Status
+	Statuses []jobs.Status
+	Counts   map[jobs.Status]int
+	PrevPage int
+	NextPage int
+}
+
+// NewJobs creates and returns a Jobs controller
+func NewJobs(q *jobs.Queue, r *mux.Router) *Jobs {
+	return &Jobs{
+		IndexView: views.NewView("bootstrap", "jobs/index", "jobs/partials"),
+		ShowView:  views.NewView("bootstrap", "jobs/show", "jobs/partials"),
+		q:         q,
+		r:         r,
+	}
+}
+
+// Index lists jobs, optionally only those with the status given by the status query parameter
+// GET /admin/jobs
+func (j *Jobs) Index(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	status := jobs.Status(r.URL.Query().Get("status"))
+	if !validStatus(status) {
+		status = ""
+	}
+	page, err := strconv.Atoi(r.URL.Query().Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+
+	data := JobsData{
+		Status:   status,
+		Statuses: jobs.Statuses,
+		PrevPage: page - 1,
+	}
+	data.Counts, err = j.q.Counts()
+	if err != nil {
+		log.Println(err)
+		vd.SetAlert(err)
+		j.IndexView.Render(w, r, vd)
+		return
+	}
+	// Fetch one extra job to tell whether there is another page
+	data.Jobs, err = j.q.List(status, jobsPerPage+1, (page-1)*jobsPerPage)
+	if err != nil {
+		log.Println(err)
+		vd.SetAlert(err)
+		j.IndexView.Render(w, r, vd)
+		return
+	}
+	if len(data.Jobs) > jobsPerPage {
+		data.Jobs = data.Jobs[:jobsPerPage]
+		data.NextPage = page + 1
+	}
+	vd.Yield = data
+	j.IndexView.Render(w, r, vd)
+}
+
+// Show displays a job with its payload and last error
+// GET /admin/jobs/:id
+func (j *Jobs) Show(w http.ResponseWriter, r *http.Request) {
+	job, err := j.jobByID(w, r)
+	if err != nil {
+		return
+	}
+	var vd views.Data
+	vd.Yield = job
+	j.ShowView.Render(w, r, vd)
+}
+
+// Retry queues a dead or failing job to run again straight away
+// POST /admin/jobs/:id/retry
+func (j *Jobs) Retry(w http.ResponseWriter, r *http.Request) {
+	job, err := j.jobByID(w, r)
+	if err != nil {
+		return
+	}
+	alert := views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "Job queued to run again",
+	}
+	if !job.CanRetry() {
+		alert = views.Alert{
+			Level:   views.AlertLvlWarning,
+			Message: "Only dead jobs and failed jobs waiting for another attempt can be retried",
+		}
+	} else if err := j.q.Retry(job.ID); err != nil {
+		log.Println(err)
+		alert = views.ErrorAlert(err)
+	}
+
+	url, err := j.r.Get(IndexJobs).URL()
+	if err != nil {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	views.RedirectAlert(w, r, url.Path, http.StatusFound, alert)
+}
+
+func (j *Jobs) jobByID(w http.ResponseWriter, r *http.Request) (*jobs.Job, error) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid job ID", http.StatusNotFound)
+		return nil, err
+	}
+	job, err := j.q.ByID(uint(id))
+	if err != nil {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return nil, err
+	}
+	return job, nil
+}
+
+func validStatus(status jobs.Status) bool {
+	for _, s := range jobs.Statuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,259 @@
+package controllers
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/curtisvermeeren/web-development-with-go/context"
+	"github.com/curtisvermeeren/web-development-with-go/models"
+	"github.com/curtisvermeeren/web-development-with-go/views"
+	"github.com/gorilla/mux"
+)
+
+type Profiles struct {
+	ShowView *views.View
+	EditView *views.View
+	us       models.UserService
+	gs       models.GalleryService
+	is       models.ImageService
+}
+
+// ProfileData is passed to the public profile view
+type ProfileData struct {
+	Profile   *models.User
+	Galleries []models.Gallery
+	// IsOwner is set when the user is looking at their own profile, which they can see even when it is not public
+	IsOwner bool
+	NextURL string
+	PrevURL string
+}
+
+// ProfileEditData is passed to the profile settings view
+type ProfileEditData struct {
+	*models.User
+	// Galleries are all of the user's galleries, sorted by title, to choose which appear on the profile
+	Galleries []models.Gallery
+	Sorts     []models.GallerySort
+}
+
+// ProfileForm holds the profile settings. Shown are the IDs of the galleries to list on the profile.
+type ProfileForm struct {
+	Username string `schema:"username"`
+	Bio      string `schema:"bio"`
+	Website  string `schema:"website"`
+	Public   bool   `schema:"profile_public"`
+	Sort     string `schema:"profile_sort"`
+	Shown    []uint `schema:"shown"`
+}
+
+// ProfilePageForm holds the cursor of the page of galleries shown on a profile
+type ProfilePageForm struct {
+	Cursor string `schema:"cursor"`
+}
+
+// NewProfiles creates and returns a Profiles object
+func NewProfiles(us models.UserService, gs models.GalleryService, is models.ImageService) *Profiles {
+	return &Profiles{
+		ShowView: views.NewView("bootstrap", "users/profile"),
+		EditView: views.NewView("bootstrap", "users/profile_edit"),
+		us:       us,
+		gs:       gs,
+		is:       is,
+	}
+}
+
+// Show is a user's public profile with their bio, avatar and the public galleries they chose to list
+// GET /u/:username
+func (p *Profiles) Show(w http.ResponseWriter, r *http.Request) {
+	profile, err := p.us.ByUsername(mux.Vars(r)["username"])
+	if err == models.ErrNotFound {
+		http.Error(w, "Profile not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	user := context.User(r.Context())
+	isOwner := user != nil && user.ID == profile.ID
+	if !profile.ProfilePublic && !isOwner {
+		http.Error(w, "Profile not found", http.StatusNotFound)
+		return
+	}
+
+	var vd views.Data
+	var form ProfilePageForm
+	if err := parseURLParams(r, &form); err != nil {
+		vd.SetAlert(err)
+	}
+	galleries, page, err := p.gs.Find(models.GalleryQuery{
+		UserID:      profile.ID,
+		PublicOnly:  true,
+		ProfileOnly: true,
+		Sort:        profile.ProfileSort,
+		Desc:        profile.ProfileSort != models.SortTitle,
+		Pagination: models.Pagination{
+			Cursor: form.Cursor,
+		},
+	})
+	if err == models.ErrCursorInvalid {
+		http.Redirect(w, r, r.URL.Path, http.StatusFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	if err := loadImages(p.is, galleries); err != nil {
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+
+	data := ProfileData{
+		Profile:   profile,
+		Galleries: galleries,
+		IsOwner:   isOwner,
+	}
+	if page.HasNext() {
+		data.NextURL = pageURL(r, page.Next)
+	}
+	if page.HasPrev() {
+		data.PrevURL = pageURL(r, page.Prev)
+	}
+	vd.Yield = data
+	p.ShowView.Render(w, r, vd)
+}
+
+// Edit shows the user's profile settings
+// GET /profile
+func (p *Profiles) Edit(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	var vd views.Data
+	vd.Yield = p.editData(user)
+	p.EditView.Render(w, r, vd)
+}
+
+// Update saves the user's profile settings and which of their galleries are listed on their profile
+// POST /profile
+func (p *Profiles) Update(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	var vd views.Data
+	var form ProfileForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		vd.Yield = p.editData(user)
+		p.EditView.Render(w, r, vd)
+		return
+	}
+
+	user.Username = form.Username
+	user.Bio = form.Bio
+	user.Website = form.Website
+	user.ProfilePublic = form.Public
+	user.ProfileSort = models.GallerySort(form.Sort)
+	err := p.us.Update(user)
+	if err == nil {
+		err = p.gs.SetProfileGalleries(user.ID, form.Shown)
+	}
+	if err != nil {
+		vd.SetAlert(err)
+		vd.Yield = p.editData(user)
+		p.EditView.Render(w, r, vd)
+		return
+	}
+	views.RedirectAlert(w, r, "/profile", http.StatusFound, views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "Profile updated successfully",
+	})
+}
+
+// Avatar serves a user's avatar to anyone who can see their profile.
+// Only the avatar the user has now is served, so replaced avatars and the directory are never shown.
+// GET /avatars/:id/:filename
+func (p *Profiles) Avatar(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	profile, err := p.us.ByID(uint(id))
+	if err != nil || profile.Avatar == "" || profile.Avatar != vars["filename"] {
+		http.NotFound(w, r)
+		return
+	}
+	user := context.User(r.Context())
+	if !profile.ProfilePublic && (user == nil || user.ID != profile.ID) {
+		http.NotFound(w, r)
+		return
+	}
+	f, err := os.Open(profile.AvatarPath())
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		http.NotFound(w, r)
+		return
+	}
+	// Every upload gets a new filename, but the profile can stop being public at any time
+	w.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", int(imageMaxAge.Seconds())))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	http.ServeContent(w, r, profile.Avatar, info.ModTime(), f)
+}
+
+// AvatarUpdate replaces the user's avatar with an uploaded image
+// POST /profile/avatar
+func (p *Profiles) AvatarUpdate(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	if err := r.ParseMultipartForm(maxMultipartMem); err != nil {
+		views.RedirectAlert(w, r, "/profile", http.StatusFound, views.ErrorAlert(err))
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+	file, _, err := r.FormFile("avatar")
+	if err != nil {
+		views.RedirectAlert(w, r, "/profile", http.StatusFound, views.ErrorAlert(models.ErrAvatarInvalid))
+		return
+	}
+	defer file.Close()
+	if err := p.us.SetAvatar(user, file); err != nil {
+		views.RedirectAlert(w, r, "/profile", http.StatusFound, views.ErrorAlert(err))
+		return
+	}
+	http.Redirect(w, r, "/profile", http.StatusFound)
+}
+
+// AvatarDelete removes the user's avatar
+// POST /profile/avatar/delete
+func (p *Profiles) AvatarDelete(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	if err := p.us.RemoveAvatar(user); err != nil {
+		views.RedirectAlert(w, r, "/profile", http.StatusFound, views.ErrorAlert(err))
+		return
+	}
+	http.Redirect(w, r, "/profile", http.StatusFound)
+}
+
+// editData gathers the user's galleries for the profile settings view
+func (p *Profiles) editData(user *models.User) ProfileEditData {
+	galleries, err := p.gs.ByUserID(user.ID)
+	if err != nil {
+		log.Println(err)
+	}
+	sort.Slice(galleries, func(i, j int) bool {
+		return strings.ToLower(galleries[i].Title) < strings.ToLower(galleries[j].Title)
+	})
+	return ProfileEditData{
+		User:      user,
+		Galleries: galleries,
+		Sorts:     models.ProfileSorts,
+	}
+}
@@ -0,0 +1,478 @@
+package controllers
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/curtisvermeeren/web-development-with-go/context"
+	"github.com/curtisvermeeren/web-development-with-go/models"
+	"github.com/curtisvermeeren/web-development-with-go/rand"
+	"github.com/curtisvermeeren/web-development-with-go/views"
+	"github.com/gorilla/mux"
+)
+
+const (
+	// proofingCookie holds the random token that identifies a guest's selections
+	proofingCookie = "proofing_token"
+	// proofingCookieAge is how long a guest's browser remembers their selections
+	proofingCookieAge = 365 * 24 * time.Hour
+)
+
+// SelectionData is passed to the proofing panel and favourite buttons on gallery and image viewer pages
+type SelectionData struct {
+	// Selection is the viewer's selection, which has no ID until they choose their first image
+	*models.Selection
+	// Action is where favourites are chosen, keeping the share link the gallery is being viewed through
+	Action string
+	// SubmitAction is where the selection is submitted
+	SubmitAction string
+	// Limit is how many images the selection can hold, or 0 for no limit
+	Limit   int
+	IsOwner bool
+	// Received is how many selections have been submitted, shown to the gallery's owner
+	Received int
+	// Guest is set when the viewer has to give their name to submit their selection
+	Guest bool
+}
+
+// Full reports whether the selection holds as many images as it can
+func (d *SelectionData) Full() bool {
+	return d.Limit > 0 && d.Count() >= d.Limit
+}
+
+// Button is the data for the button that chooses the image with imageID, or takes it out of the selection.
+// View is set for the button in the image viewer, which is returned to after choosing.
+func (d *SelectionData) Button(imageID uint, view bool) FavouriteButtonData {
+	return FavouriteButtonData{SelectionData: d, ImageID: imageID, View: view}
+}
+
+// FavouriteButtonData is passed to the favourite button of an image
+type FavouriteButtonData struct {
+	*SelectionData
+	ImageID uint
+	View    bool
+}
+
+// Chosen reports whether the image is in the selection
+func (d FavouriteButtonData) Chosen() bool {
+	return d.Has(d.ImageID)
+}
+
+// FavouriteForm adds an image to a selection, or takes it out when Favourite is false.
+// View is set when the form was sent from the image viewer.
+type FavouriteForm struct {
+	ImageID   uint `schema:"image_id"`
+	Favourite bool `schema:"favourite"`
+	View      bool `schema:"view"`
+}
+
+// FavouriteJSON is the state of a selection after choosing an image, returned to JSON clients
+type FavouriteJSON struct {
+	ImageID   uint   `json:"image_id"`
+	Favourite bool   `json:"favourite"`
+	Count     int    `json:"count"`
+	Limit     int    `json:"limit,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// SelectionForm submits a selection
+type SelectionForm struct {
+	Name string `schema:"name"`
+	Note string `schema:"note"`
+}
+
+// ProofingForm opens or closes a gallery for proofing
+type ProofingForm struct {
+	Proofing bool `schema:"proofing"`
+	Limit    int  `schema:"proofing_limit"`
+}
+
+// ProofingData is passed to the proofing summary shown to a gallery's owner
+type ProofingData struct {
+	GalleryShowData
+	Selections []SelectionSummary
+	// Tally is every image chosen in a submitted selection, most often chosen first
+	Tally []ImageTally
+}
+
+// SelectionSummary is a selection along with the images chosen in it
+type SelectionSummary struct {
+	models.Selection
+	Images []models.Image
+}
+
+// ImageTally is an image along with the names of everyone who chose it
+type ImageTally struct {
+	Image models.Image
+	Names []string
+}
+
+// selectionData gathers the viewer's selection for the proofing panel, or returns nil if the gallery is not open for proofing
+func (g *Galleries) selectionData(r *http.Request, data GalleryShowData) *SelectionData {
+	if !data.Proofing {
+		return nil
+	}
+	user := context.User(r.Context())
+	sd := SelectionData{
+		Action:       data.withShare(fmt.Sprintf("/galleries/%s/proofing/favourites", data.PublicID)),
+		SubmitAction: data.withShare(fmt.Sprintf("/galleries/%s/proofing/submit", data.PublicID)),
+		Limit:        data.ProofingLimit,
+		IsOwner:      user != nil && user.ID == data.UserID,
+		Guest:        user == nil,
+	}
+	if sd.IsOwner {
+		sd.Selection = &models.Selection{GalleryID: data.ID}
+		selections, err := g.ss.ByGalleryID(data.ID)
+		if err != nil {
+			log.Println(err)
+		}
+		for _, s := range selections {
+			if s.Submitted() {
+				sd.Received++
+			}
+		}
+		return &sd
+	}
+	selection, err := g.selection(nil, r, data.Gallery)
+	if err != nil {
+		log.Println(err)
+		selection = &models.Selection{}
+	}
+	sd.Selection = selection
+	return &sd
+}
+
+// selection returns the viewer's selection from gallery. When w is nil a selection that has not been started
+// is returned without an ID. Otherwise it is created, and guests are given a cookie to identify them by.
+func (g *Galleries) selection(w http.ResponseWriter, r *http.Request, gallery *models.Gallery) (*models.Selection, error) {
+	selection := models.Selection{GalleryID: gallery.ID}
+	if user := context.User(r.Context()); user != nil {
+		selection.AuthorKey = models.UserAuthorKey(user.ID)
+		selection.UserID = user.ID
+		selection.Name = user.Name
+	} else if cookie, err := r.Cookie(proofingCookie); err == nil && cookie.Value != "" {
+		selection.AuthorKey = models.GuestSelectionKey(cookie.Value)
+		selection.ThrottleKey = models.GuestAddressKey(clientAddress(r))
+	} else if w != nil {
+		token, err := rand.RememberToken()
+		if err != nil {
+			return nil, err
+		}
+		http.SetCookie(w, &http.Cookie{
+			Name:     proofingCookie,
+			Value:    token,
+			Path:     "/",
+			Expires:  time.Now().Add(proofingCookieAge),
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		})
+		selection.AuthorKey = models.GuestSelectionKey(token)
+		selection.ThrottleKey = models.GuestAddressKey(clientAddress(r))
+	} else {
+		return &selection, nil
+	}
+
+	existing, err := g.ss.ByAuthor(gallery.ID, selection.AuthorKey)
+	if err == nil {
+		return existing, nil
+	}
+	if err != models.ErrSelectionNotFound {
+		return nil, err
+	}
+	if w == nil {
+		return &selection, nil
+	}
+	if err := g.ss.Create(&selection); err != nil {
+		return nil, err
+	}
+	return &selection, nil
+}
+
+// Favourite adds an image to the viewer's selection, or takes it out
+// POST /galleries/:publicID/proofing/favourites
+func (g *Galleries) Favourite(w http.ResponseWriter, r *http.Request) {
+	data, ok := g.showData(w, r)
+	if !ok {
+		return
+	}
+	var form FavouriteForm
+	if err := parseForm(r, &form); err != nil {
+		views.RedirectAlert(w, r, data.GalleryURL(), http.StatusFound, views.ErrorAlert(err))
+		return
+	}
+	var image *models.Image
+	for i := range data.Images {
+		if data.Images[i].ID == form.ImageID {
+			image = &data.Images[i]
+			break
+		}
+	}
+	if image == nil {
+		http.Error(w, "Image not found", http.StatusNotFound)
+		return
+	}
+	back := fmt.Sprintf("%s#image-%v", data.GalleryURL(), image.ID)
+	if form.View {
+		back = data.ViewURL(*image)
+	}
+
+	var selection *models.Selection
+	var err error = models.ErrProofingClosed
+	if data.Proofing {
+		selection, err = g.selection(w, r, data.Gallery)
+		if err == nil {
+			err = g.ss.Favourite(selection, image.ID, form.Favourite, data.ProofingLimit)
+		}
+	}
+	if wantsJSON(r) {
+		out := FavouriteJSON{ImageID: image.ID, Limit: data.ProofingLimit}
+		if selection != nil {
+			out.Favourite = selection.Has(image.ID)
+			out.Count = selection.Count()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err != nil {
+			out.Error = views.ErrorAlert(err).Message
+			w.WriteHeader(http.StatusBadRequest)
+		}
+		json.NewEncoder(w).Encode(out)
+		return
+	}
+	if err != nil {
+		views.RedirectAlert(w, r, back, http.StatusFound, views.ErrorAlert(err))
+		return
+	}
+	http.Redirect(w, r, back, http.StatusFound)
+}
+
+// SelectionSubmit sends the viewer's selection to the gallery's owner
+// POST /galleries/:publicID/proofing/submit
+func (g *Galleries) SelectionSubmit(w http.ResponseWriter, r *http.Request) {
+	data, ok := g.showData(w, r)
+	if !ok {
+		return
+	}
+	back := data.GalleryURL() + "#proofing"
+	if !data.Proofing {
+		views.RedirectAlert(w, r, back, http.StatusFound, views.ErrorAlert(models.ErrProofingClosed))
+		return
+	}
+	var form SelectionForm
+	if err := parseForm(r, &form); err != nil {
+		views.RedirectAlert(w, r, back, http.StatusFound, views.ErrorAlert(err))
+		return
+	}
+	selection, err := g.selection(nil, r, data.Gallery)
+	if err == nil && selection.ID == 0 {
+		err = models.ErrSelectionEmpty
+	}
+	if err != nil {
+		views.RedirectAlert(w, r, back, http.StatusFound, views.ErrorAlert(err))
+		return
+	}
+	// Signed in users are known by their own name unless they give another
+	if form.Name != "" || selection.UserID == 0 {
+		selection.Name = form.Name
+	}
+	selection.Note = form.Note
+	if err := g.ss.Submit(selection, data.ProofingLimit); err != nil {
+		views.RedirectAlert(w, r, back, http.StatusFound, views.ErrorAlert(err))
+		return
+	}
+	views.RedirectAlert(w, r, back, http.StatusFound, views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: fmt.Sprintf("Thank you! Your selection of %d photos has been sent.", selection.Count()),
+	})
+}
+
+// ProofingUpdate opens or closes the gallery for proofing and sets how many images each selection can hold
+// POST /galleries/:id/proofing
+func (g *Galleries) ProofingUpdate(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryById(w, r)
+	if err != nil {
+		return
+	}
+	user := context.User(r.Context())
+	if gallery.UserID != user.ID {
+		http.Error(w, "You do not have permission to edit this gallery", http.StatusForbidden)
+		return
+	}
+
+	var vd views.Data
+	vd.Yield = gallery
+	var form ProofingForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		g.renderEdit(w, r, vd)
+		return
+	}
+	gallery.Proofing = form.Proofing
+	gallery.ProofingLimit = form.Limit
+	if err := g.gs.Update(gallery); err != nil {
+		vd.SetAlert(err)
+		g.renderEdit(w, r, vd)
+		return
+	}
+	g.redirectToEdit(w, r, gallery)
+}
+
+// ProofingShow summarises the selections made from the gallery for its owner
+// GET /galleries/:id/proofing
+func (g *Galleries) ProofingShow(w http.ResponseWriter, r *http.Request) {
+	data, selections, ok := g.proofingSelections(w, r)
+	if !ok {
+		return
+	}
+	images := make(map[uint]models.Image, len(data.Images))
+	for _, image := range data.Images {
+		images[image.ID] = image
+	}
+
+	pd := ProofingData{GalleryShowData: data}
+	tally := make(map[uint]*ImageTally)
+	for _, s := range selections {
+		summary := SelectionSummary{Selection: s}
+		for _, id := range s.ImageIDs {
+			image, ok := images[id]
+			if !ok {
+				continue
+			}
+			summary.Images = append(summary.Images, image)
+			if !s.Submitted() {
+				continue
+			}
+			if tally[id] == nil {
+				tally[id] = &ImageTally{Image: image}
+			}
+			tally[id].Names = append(tally[id].Names, s.Name)
+		}
+		pd.Selections = append(pd.Selections, summary)
+	}
+	for _, t := range tally {
+		pd.Tally = append(pd.Tally, *t)
+	}
+	// Most chosen first, then in gallery order
+	sort.Slice(pd.Tally, func(i, j int) bool {
+		a, b := pd.Tally[i], pd.Tally[j]
+		if len(a.Names) != len(b.Names) {
+			return len(a.Names) > len(b.Names)
+		}
+		return a.Image.Position < b.Image.Position
+	})
+
+	var vd views.Data
+	vd.Yield = pd
+	g.ProofView.Render(w, r, vd)
+}
+
+// ProofingExport sends the filenames chosen in every submitted selection as a CSV file,
+// or just those chosen in one selection given by the selection parameter
+// GET /galleries/:id/proofing/export
+func (g *Galleries) ProofingExport(w http.ResponseWriter, r *http.Request) {
+	data, selections, ok := g.proofingSelections(w, r)
+	if !ok {
+		return
+	}
+	var only uint
+	if s := r.URL.Query().Get("selection"); s != "" {
+		id, err := strconv.Atoi(s)
+		if err != nil {
+			http.Error(w, "Selection not found", http.StatusNotFound)
+			return
+		}
+		only = uint(id)
+	}
+	filenames := make(map[uint]string, len(data.Images))
+	for _, image := range data.Images {
+		filenames[image.ID] = image.Filename
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", contentDisposition(data.Title+" selections.csv"))
+	out := csv.NewWriter(w)
+	out.Write([]string{"name", "submitted_at", "filename", "note"})
+	for _, s := range selections {
+		if only != 0 && s.ID != only {
+			continue
+		}
+		if only == 0 && !s.Submitted() {
+			continue
+		}
+		submitted := ""
+		if s.Submitted() {
+			submitted = s.SubmittedAt.Format(time.RFC3339)
+		}
+		for _, id := range s.ImageIDs {
+			if filename, ok := filenames[id]; ok {
+				out.Write([]string{csvCell(s.Name), submitted, csvCell(filename), csvCell(s.Note)})
+			}
+		}
+	}
+	out.Flush()
+	if err := out.Error(); err != nil {
+		log.Println(err)
+	}
+}
+
+// csvCell stops spreadsheets treating text from viewers as a formula by prefixing it with
+// an apostrophe when it starts with a character that would begin one
+func csvCell(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
+
+// SelectionReopen lets a submitted selection be changed and submitted again
+// POST /galleries/:id/proofing/:selectionID/reopen
+func (g *Galleries) SelectionReopen(w http.ResponseWriter, r *http.Request) {
+	data, selections, ok := g.proofingSelections(w, r)
+	if !ok {
+		return
+	}
+	back := fmt.Sprintf("/galleries/%v/proofing", data.ID)
+	id, _ := strconv.Atoi(mux.Vars(r)["selectionID"])
+	for i := range selections {
+		if selections[i].ID != uint(id) {
+			continue
+		}
+		if err := g.ss.Reopen(&selections[i]); err != nil {
+			views.RedirectAlert(w, r, back, http.StatusFound, views.ErrorAlert(err))
+			return
+		}
+		views.RedirectAlert(w, r, back, http.StatusFound, views.Alert{
+			Level:   views.AlertLvlSuccess,
+			Message: fmt.Sprintf("%s can change their selection again", selections[i].Name),
+		})
+		return
+	}
+	http.Error(w, "Selection not found", http.StatusNotFound)
+}
+
+// proofingSelections returns the gallery and the selections made from it if the user owns it.
+// Otherwise an error is written and ok is false.
+func (g *Galleries) proofingSelections(w http.ResponseWriter, r *http.Request) (GalleryShowData, []models.Selection, bool) {
+	data, ok := g.showData(w, r)
+	if !ok {
+		return data, nil, false
+	}
+	user := context.User(r.Context())
+	if data.UserID != user.ID {
+		http.Error(w, "You do not have permission to view this gallery's selections", http.StatusForbidden)
+		return data, nil, false
+	}
+	selections, err := g.ss.ByGalleryID(data.ID)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Whoops! Something went wrong", http.StatusInternalServerError)
+		return data, nil, false
+	}
+	return data, selections, true
+}
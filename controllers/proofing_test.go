@@ -0,0 +1,26 @@
+package controllers
+
+import "testing"
+
+func TestCSVCell(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"", ""},
+		{"Ann", "Ann"},
+		{"IMG_0001.jpg", "IMG_0001.jpg"},
+		{`=HYPERLINK("http://example.com","x")`, `'=HYPERLINK("http://example.com","x")`},
+		{"+1", "'+1"},
+		{"-1+2", "'-1+2"},
+		{"@SUM(A1)", "'@SUM(A1)"},
+		{"\tx", "'\tx"},
+		{"\rx", "'\rx"},
+		{"a=b", "a=b"},
+	}
+	for _, tt := range tests {
+		if got := csvCell(tt.in); got != tt.want {
+			t.Errorf("csvCell(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
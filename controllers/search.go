@@ -0,0 +1,96 @@
+package controllers
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/curtisvermeeren/web-development-with-go/context"
+	"github.com/curtisvermeeren/web-development-with-go/models"
+	"github.com/curtisvermeeren/web-development-with-go/views"
+)
+
+const searchPageSize = 20
+
+type Search struct {
+	ResultsView *views.View
+	ss          models.SearchService
+}
+
+// SearchForm represents the query parameters of the search page
+type SearchForm struct {
+	Query  string `schema:"q"`
+	Offset int    `schema:"offset"`
+}
+
+// SearchData is passed to the search results view
+type SearchData struct {
+	Query   string
+	Results []models.SearchResult
+	NextURL string
+	PrevURL string
+}
+
+// NewSearch creates and returns a Search controller
+func NewSearch(ss models.SearchService) *Search {
+	return &Search{
+		ResultsView: views.NewView("bootstrap", "search/results"),
+		ss:          ss,
+	}
+}
+
+// Results lists the galleries the current visitor can see that match the query
+// GET /search
+func (s *Search) Results(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	var form SearchForm
+	if err := parseURLParams(r, &form); err != nil {
+		vd.SetAlert(err)
+		s.ResultsView.Render(w, r, vd)
+		return
+	}
+
+	query := models.SearchQuery{
+		Text:   form.Query,
+		Limit:  searchPageSize,
+		Offset: form.Offset,
+	}
+	if user := context.User(r.Context()); user != nil {
+		query.ViewerID = user.ID
+	}
+
+	data := SearchData{Query: form.Query}
+	vd.Yield = &data
+	results, more, err := s.ss.Search(query)
+	if err != nil {
+		vd.SetAlert(err)
+		s.ResultsView.Render(w, r, vd)
+		return
+	}
+	data.Results = results
+	if more {
+		data.NextURL = searchURL(form.Query, form.Offset+searchPageSize)
+	}
+	if form.Offset > 0 {
+		prev := form.Offset - searchPageSize
+		if prev < 0 {
+			prev = 0
+		}
+		data.PrevURL = searchURL(form.Query, prev)
+	}
+	s.ResultsView.Render(w, r, vd)
+}
+
+// searchURL builds the URL of a page of search results
+func searchURL(query string, offset int) string {
+	values := url.Values{}
+	values.Set("q", query)
+	if offset > 0 {
+		values.Set("offset", strconv.Itoa(offset))
+	}
+	u := url.URL{
+		Path:     "/search",
+		RawQuery: values.Encode(),
+	}
+	return u.String()
+}
@@ -0,0 +1,120 @@
+package controllers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/curtisvermeeren/web-development-with-go/context"
+	"github.com/curtisvermeeren/web-development-with-go/models"
+	"github.com/curtisvermeeren/web-development-with-go/views"
+	"github.com/gorilla/mux"
+)
+
+const maxTagSuggestions = 10
+
+type Tags struct {
+	ShowView *views.View
+	gs       models.GalleryService
+	is       models.ImageService
+	ts       models.TagService
+}
+
+// TagData is passed to the tag view
+type TagData struct {
+	Tag       string
+	Galleries []models.Gallery
+	NextURL   string
+	PrevURL   string
+}
+
+// TagPageForm represents the paging parameters of the tag view
+type TagPageForm struct {
+	Cursor string `schema:"cursor"`
+}
+
+// TagSuggestForm represents the query parameters of a tag autocomplete request
+type TagSuggestForm struct {
+	Query string `schema:"q"`
+}
+
+// NewTags creates and returns a Tags controller
+func NewTags(gs models.GalleryService, is models.ImageService, ts models.TagService) *Tags {
+	return &Tags{
+		ShowView: views.NewView("bootstrap", "tags/show"),
+		gs:       gs,
+		is:       is,
+		ts:       ts,
+	}
+}
+
+// Show lists the public galleries with a tag, newest first
+// GET /tags/:tag
+func (t *Tags) Show(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	var form TagPageForm
+	if err := parseURLParams(r, &form); err != nil {
+		vd.SetAlert(err)
+	}
+
+	tag := models.NormalizeTag(mux.Vars(r)["tag"])
+	galleries, page, err := t.gs.Find(models.GalleryQuery{
+		Tag:        tag,
+		PublicOnly: true,
+		Sort:       models.SortCreated,
+		Desc:       true,
+		Pagination: models.Pagination{
+			Cursor: form.Cursor,
+		},
+	})
+	if err == models.ErrCursorInvalid {
+		http.Redirect(w, r, r.URL.Path, http.StatusFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	if err := loadImages(t.is, galleries); err != nil {
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+
+	data := TagData{
+		Tag:       tag,
+		Galleries: galleries,
+	}
+	if page.HasNext() {
+		data.NextURL = pageURL(r, page.Next)
+	}
+	if page.HasPrev() {
+		data.PrevURL = pageURL(r, page.Prev)
+	}
+	vd.Yield = data
+	t.ShowView.Render(w, r, vd)
+}
+
+// Suggest returns tag names starting with the query as JSON for autocompletion
+// GET /galleries/tags?q=
+func (t *Tags) Suggest(w http.ResponseWriter, r *http.Request) {
+	var form TagSuggestForm
+	if err := parseURLParams(r, &form); err != nil {
+		http.Error(w, "Invalid query", http.StatusBadRequest)
+		return
+	}
+
+	user := context.User(r.Context())
+	tags, err := t.ts.Suggest(user.ID, form.Query, maxTagSuggestions)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+
+	names := make([]string, len(tags))
+	for i, tag := range tags {
+		names[i] = tag.Name
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(names)
+}
@@ -0,0 +1,128 @@
+package controllers
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/curtisvermeeren/web-development-with-go/context"
+	"github.com/curtisvermeeren/web-development-with-go/models"
+	"github.com/curtisvermeeren/web-development-with-go/views"
+	"github.com/gorilla/mux"
+)
+
+const (
+	IndexTrash = "index_trash"
+)
+
+type Trash struct {
+	IndexView *views.View
+	ts        models.TrashService
+	r         *mux.Router
+}
+
+// TrashData is passed to the trash index view
+type TrashData struct {
+	Galleries     []models.Gallery
+	RetentionDays int
+}
+
+// NewTrash creates and returns a Trash controller
+func NewTrash(ts models.TrashService, r *mux.Router) *Trash {
+	return &Trash{
+		IndexView: views.NewView("bootstrap", "galleries/trash"),
+		ts:        ts,
+		r:         r,
+	}
+}
+
+// Index lists the galleries in the current user's trash
+// GET /trash
+func (t *Trash) Index(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	galleries, err := t.ts.ByUserID(user.ID)
+	if err != nil {
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	var vd views.Data
+	vd.Yield = TrashData{
+		Galleries:     galleries,
+		RetentionDays: int(t.ts.Retention().Hours() / 24),
+	}
+	t.IndexView.Render(w, r, vd)
+}
+
+// Restore moves a gallery out of the trash
+// POST /trash/:id/restore
+func (t *Trash) Restore(w http.ResponseWriter, r *http.Request) {
+	id, err := t.galleryID(w, r)
+	if err != nil {
+		return
+	}
+	user := context.User(r.Context())
+	if err := t.ts.Restore(user.ID, id); err != nil {
+		t.redirect(w, r, views.ErrorAlert(err))
+		return
+	}
+
+	url, err := t.r.Get(EditGallery).URL("id", strconv.Itoa(int(id)))
+	if err != nil {
+		http.Redirect(w, r, "/galleries", http.StatusFound)
+		return
+	}
+	views.RedirectAlert(w, r, url.Path, http.StatusFound, views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "Gallery restored successfully",
+	})
+}
+
+// Purge permanently deletes a single gallery in the trash
+// POST /trash/:id/purge
+func (t *Trash) Purge(w http.ResponseWriter, r *http.Request) {
+	id, err := t.galleryID(w, r)
+	if err != nil {
+		return
+	}
+	user := context.User(r.Context())
+	if err := t.ts.Purge(user.ID, id); err != nil {
+		t.redirect(w, r, views.ErrorAlert(err))
+		return
+	}
+	t.redirect(w, r, views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "Gallery permanently deleted",
+	})
+}
+
+// Empty permanently deletes every gallery in the current user's trash
+// POST /trash/empty
+func (t *Trash) Empty(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	if err := t.ts.Empty(user.ID); err != nil {
+		t.redirect(w, r, views.ErrorAlert(err))
+		return
+	}
+	t.redirect(w, r, views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "Trash emptied",
+	})
+}
+
+// redirect sends the user back to the trash index with an alert
+func (t *Trash) redirect(w http.ResponseWriter, r *http.Request, alert views.Alert) {
+	url, err := t.r.Get(IndexTrash).URL()
+	if err != nil {
+		http.Redirect(w, r, "/galleries", http.StatusFound)
+		return
+	}
+	views.RedirectAlert(w, r, url.Path, http.StatusFound, alert)
+}
+
+func (t *Trash) galleryID(w http.ResponseWriter, r *http.Request) (uint, error) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid gallery ID", http.StatusNotFound)
+		return 0, err
+	}
+	return uint(id), nil
+}
@@ -0,0 +1,244 @@
+package controllers
+
+import (
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/curtisvermeeren/web-development-with-go/context"
+	"github.com/curtisvermeeren/web-development-with-go/models"
+	"github.com/curtisvermeeren/web-development-with-go/views"
+	"github.com/gorilla/mux"
+)
+
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,termination,expiration"
+)
+
+/*
+Uploads is a tus 1.0 server (https://tus.io/protocols/resumable-upload) for adding images to a gallery.
+It supports the creation, termination and expiration extensions. Each gallery has its own upload endpoint
+at /galleries/:id/uploads, and finished uploads are added to the gallery.
+*/
+type Uploads struct {
+	gs models.GalleryService
+	us models.UploadService
+}
+
+func NewUploads(gs models.GalleryService, us models.UploadService) *Uploads {
+	return &Uploads{
+		gs: gs,
+		us: us,
+	}
+}
+
+// Options describes the tus features this server supports
+// OPTIONS /galleries/:id/uploads
+func (u *Uploads) Options(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", tusExtensions)
+	w.Header().Set("Tus-Max-Size", strconv.Itoa(models.MaxUploadSize))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Create starts an upload. The file's length is given by the Upload-Length header and its name by
+// the filename key of the Upload-Metadata header.
+// POST /galleries/:id/uploads
+func (u *Uploads) Create(w http.ResponseWriter, r *http.Request) {
+	gallery, ok := u.gallery(w, r)
+	if !ok {
+		return
+	}
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 1 {
+		tusError(w, "Upload-Length must be a number of bytes greater than 0", http.StatusBadRequest)
+		return
+	}
+	if length > models.MaxUploadSize {
+		tusError(w, "Upload is too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	upload := models.Upload{
+		GalleryID: gallery.ID,
+		UserID:    gallery.UserID,
+		Filename:  tusMetadata(r.Header.Get("Upload-Metadata"))["filename"],
+		Length:    length,
+	}
+	if err := u.us.Create(&upload); err != nil {
+		switch err {
+		case models.ErrFilenameInvalid:
+			tusError(w, "Only jpg, jpeg and png images can be uploaded", http.StatusBadRequest)
+		case models.ErrUploadEmpty:
+			tusError(w, "Upload-Length must be a number of bytes greater than 0", http.StatusBadRequest)
+		case models.ErrUploadTooLarge:
+			tusError(w, "Upload is too large", http.StatusRequestEntityTooLarge)
+		case models.ErrStorageQuota, models.ErrImageQuota:
+			tusError(w, views.ErrorAlert(err).Message, http.StatusRequestEntityTooLarge)
+		default:
+			log.Println(err)
+			tusError(w, "Whoops! Something went wrong", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Location", fmt.Sprintf("/galleries/%v/uploads/%s", gallery.ID, upload.ID))
+	w.Header().Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.WriteHeader(http.StatusCreated)
+}
+
+// Head reports how much of an upload has been received so a client can resume it
+// HEAD /galleries/:id/uploads/:uploadID
+func (u *Uploads) Head(w http.ResponseWriter, r *http.Request) {
+	upload, ok := u.upload(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	w.Header().Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.WriteHeader(http.StatusOK)
+}
+
+// Patch appends a chunk to an upload. The chunk must start at the offset given by the Upload-Offset header.
+// PATCH /galleries/:id/uploads/:uploadID
+func (u *Uploads) Patch(w http.ResponseWriter, r *http.Request) {
+	upload, ok := u.upload(w, r)
+	if !ok {
+		return
+	}
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		tusError(w, "Content-Type must be application/offset+octet-stream", http.StatusUnsupportedMediaType)
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		tusError(w, "Upload-Offset must be a number of bytes", http.StatusBadRequest)
+		return
+	}
+	if r.ContentLength > 0 && offset+r.ContentLength > upload.Length {
+		tusError(w, "Chunk goes past the end of the upload", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	err = u.us.Append(upload, offset, r.Body)
+	switch err {
+	case nil:
+	case models.ErrUploadOffset:
+		tusError(w, "Upload-Offset does not match the upload", http.StatusConflict)
+		return
+	case models.ErrNotFound:
+		tusError(w, "Upload not found", http.StatusNotFound)
+		return
+	case models.ErrUploadNotImage:
+		// finish has already removed the upload
+		tusError(w, "Only JPEG and PNG images can be uploaded", http.StatusUnsupportedMediaType)
+		return
+	case models.ErrStorageQuota, models.ErrImageQuota:
+		// The whole file arrived but there was no longer room for it, so there is nothing to resume
+		u.us.Delete(upload)
+		tusError(w, views.ErrorAlert(err).Message, http.StatusRequestEntityTooLarge)
+		return
+	default:
+		log.Println(err)
+		tusError(w, "Whoops! Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	if !upload.Complete() {
+		w.Header().Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	}
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Delete cancels an upload
+// DELETE /galleries/:id/uploads/:uploadID
+func (u *Uploads) Delete(w http.ResponseWriter, r *http.Request) {
+	upload, ok := u.upload(w, r)
+	if !ok {
+		return
+	}
+	if err := u.us.Delete(upload); err != nil {
+		log.Println(err)
+		tusError(w, "Whoops! Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// gallery returns the gallery being uploaded to if the current user owns it and the client speaks tus 1.0.0.
+// Otherwise it writes an error and returns false.
+func (u *Uploads) gallery(w http.ResponseWriter, r *http.Request) (*models.Gallery, bool) {
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		tusError(w, "Unsupported tus version", http.StatusPreconditionFailed)
+		return nil, false
+	}
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		tusError(w, "Gallery not found", http.StatusNotFound)
+		return nil, false
+	}
+	gallery, err := u.gs.ByID(uint(id))
+	user := context.User(r.Context())
+	if err != nil || gallery.UserID != user.ID {
+		tusError(w, "Gallery not found", http.StatusNotFound)
+		return nil, false
+	}
+	return gallery, true
+}
+
+// upload returns the upload in the request's URL if it belongs to the gallery in the URL.
+// Otherwise it writes an error and returns false.
+func (u *Uploads) upload(w http.ResponseWriter, r *http.Request) (*models.Upload, bool) {
+	gallery, ok := u.gallery(w, r)
+	if !ok {
+		return nil, false
+	}
+	upload, err := u.us.ByID(mux.Vars(r)["uploadID"])
+	if err != nil || upload.GalleryID != gallery.ID {
+		// Expired uploads are gone as far as the client is concerned
+		tusError(w, "Upload not found", http.StatusNotFound)
+		return nil, false
+	}
+	return upload, true
+}
+
+// tusError writes a plain text error that tus clients can show
+func tusError(w http.ResponseWriter, msg string, code int) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Cache-Control", "no-store")
+	http.Error(w, msg, code)
+}
+
+// tusMetadata parses an Upload-Metadata header, a comma separated list of keys and base64 encoded values
+func tusMetadata(header string) map[string]string {
+	metadata := make(map[string]string)
+	for _, pair := range strings.Split(header, ",") {
+		fields := strings.Fields(pair)
+		if len(fields) == 0 {
+			continue
+		}
+		var value []byte
+		if len(fields) > 1 {
+			decoded, err := base64.StdEncoding.DecodeString(fields[1])
+			if err != nil {
+				continue
+			}
+			value = decoded
+		}
+		metadata[fields[0]] = string(value)
+	}
+	return metadata
+}
@@ -0,0 +1,84 @@
+package controllers
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/curtisvermeeren/web-development-with-go/context"
+	"github.com/curtisvermeeren/web-development-with-go/models"
+	"github.com/curtisvermeeren/web-development-with-go/views"
+	"github.com/gorilla/mux"
+)
+
+// GalleryImageData is passed to the image viewer
+type GalleryImageData struct {
+	GalleryShowData
+	Image *models.Image
+	// Index is the position of the image in the gallery, counting from 1
+	Index int
+	// Prev and Next are the images either side of Image, or nil at either end of the gallery
+	Prev *models.Image
+	Next *models.Image
+	// EXIF summarises the camera settings recorded in the image, or is nil if there are none
+	EXIF *models.EXIF
+	// ShareLinks are the gallery's share links, which are only shown to its owner
+	ShareLinks []models.ShareLink
+}
+
+// ShareURL is the permalink of the image through link
+func (d GalleryImageData) ShareURL(link models.ShareLink) string {
+	d.share = link.Token
+	return d.ViewURL(*d.Image)
+}
+
+// Viewer shows a single image of a gallery with links to the images either side of it.
+// Its URL is a permalink to the image that keeps working through the share link it was opened with.
+// GET /galleries/:publicID/images/:filename
+func (g *Galleries) Viewer(w http.ResponseWriter, r *http.Request) {
+	gallery, ok := g.showData(w, r)
+	if !ok {
+		return
+	}
+	filename := mux.Vars(r)["filename"]
+	index := -1
+	for i := range gallery.Images {
+		if gallery.Images[i].Filename == filename {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		http.Error(w, "Image not found", http.StatusNotFound)
+		return
+	}
+
+	data := GalleryImageData{
+		GalleryShowData: gallery,
+		Image:           &gallery.Images[index],
+		Index:           index + 1,
+	}
+	if index > 0 {
+		data.Prev = &gallery.Images[index-1]
+	}
+	if index < len(gallery.Images)-1 {
+		data.Next = &gallery.Images[index+1]
+	}
+	exif, err := g.is.EXIF(data.Image)
+	if err != nil {
+		log.Println(err)
+	}
+	data.EXIF = exif
+	data.Comments = g.comments(r, gallery, data.Image)
+	data.Selection = g.selectionData(r, gallery)
+	if user := context.User(r.Context()); user != nil && user.ID == gallery.UserID {
+		links, err := g.sl.ByGalleryID(gallery.ID)
+		if err != nil {
+			log.Println(err)
+		}
+		data.ShareLinks = links
+	}
+
+	var vd views.Data
+	vd.Yield = data
+	g.ViewerView.Render(w, r, vd)
+}
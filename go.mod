@@ -6,14 +6,21 @@ require github.com/gorilla/mux v1.8.0
 
 require github.com/gorilla/schema v1.2.0
 
-require github.com/lib/pq v1.10.6
+require (
+	github.com/chai2010/webp v1.1.1
+	github.com/gorilla/csrf v1.7.1
+	github.com/jinzhu/gorm v1.9.16
+	github.com/lib/pq v1.10.6
+	github.com/yuin/goldmark v1.4.15
+	golang.org/x/crypto v0.0.0-20220722155217-630584e8d5aa
+	golang.org/x/image v0.5.0
+	golang.org/x/sync v0.1.0
+)
 
 require (
-	github.com/gorilla/csrf v1.7.1 // indirect
 	github.com/gorilla/securecookie v1.1.1 // indirect
-	github.com/jinzhu/gorm v1.9.16 // indirect
 	github.com/jinzhu/inflection v1.0.0 // indirect
 	github.com/pkg/errors v0.9.1 // indirect
-	golang.org/x/crypto v0.0.0-20220722155217-630584e8d5aa // indirect
+	golang.org/x/text v0.7.0 // indirect
 	gopkg.in/mailgun/mailgun-go.v1 v1.1.1 // indirect
 )
@@ -4,26 +4,30 @@ import (
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/base64"
-	"hash"
 )
 
-// HMAC is a wrapper around crypto/hmac
+// HMAC is a wrapper around crypto/hmac.
+// A new hash is created for each input so an HMAC can be shared by concurrent requests.
 type HMAC struct {
-	hmac hash.Hash
+	key []byte
 }
 
 // NewHMAC creates and returns a new HMAC object
 func NewHMAC(key string) HMAC {
-	h := hmac.New(sha256.New, []byte(key))
 	return HMAC{
-		hmac: h,
+		key: []byte(key),
 	}
 }
 
 // Hash will hash the provided input string using HMAC with the secret key provided when the HMAC object was created
 func (h HMAC) Hash(input string) string {
-	h.hmac.Reset()
-	h.hmac.Write([]byte(input))
-	b := h.hmac.Sum(nil)
+	mac := hmac.New(sha256.New, h.key)
+	mac.Write([]byte(input))
+	b := mac.Sum(nil)
 	return base64.URLEncoding.EncodeToString(b)
 }
+
+// Equal reports whether hash is the hash of input, in constant time so it does not leak how much of hash was right
+func (h HMAC) Equal(input, hash string) bool {
+	return hmac.Equal([]byte(h.Hash(input)), []byte(hash))
+}
@@ -0,0 +1,98 @@
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+)
+
+// Status is where a job is in its lifecycle
+type Status string
+
+const (
+	// Queued jobs are waiting for RunAt, including failed jobs waiting to be retried
+	Queued Status = "queued"
+	// Running jobs have been claimed by a worker
+	Running Status = "running"
+	// Done jobs finished successfully
+	Done Status = "done"
+	// Dead jobs failed on every attempt and will not run again unless they are retried by hand
+	Dead Status = "dead"
+)
+
+// Statuses lists every status in the order they are shown
+var Statuses = []Status{Queued, Running, Done, Dead}
+
+/*
+Job is a unit of work stored in the jobs table and run by a Queue's workers.
+
+Payload holds the job's arguments as JSON and is decoded by its handler with Decode.
+A job that fails is retried with an increasing delay until it has been attempted MaxAttempts times,
+after which it is dead. Recurring jobs have RepeatEvery set and are queued again that long after they
+finish, whether or not they succeeded.
+*/
+type Job struct {
+	ID          uint      `gorm:"primary_key"`
+	Type        string    `gorm:"not null;index"`
+	Payload     string    `gorm:"type:text;not null;default:'{}'"`
+	Status      Status    `gorm:"not null;default:'queued';index:idx_jobs_status_run_at"`
+	Attempts    int       `gorm:"not null;default:0"`
+	MaxAttempts int       `gorm:"not null;default:5"`
+	RunAt       time.Time `gorm:"not null;index:idx_jobs_status_run_at"`
+	// RepeatEvery is how often a recurring job runs, or 0 for a job that runs once
+	RepeatEvery time.Duration `gorm:"not null;default:0"`
+	LockedAt    *time.Time
+	LastError   string `gorm:"type:text"`
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
+
+// Decode unmarshals the job's payload into v
+func (j *Job) Decode(v interface{}) error {
+	return json.Unmarshal([]byte(j.Payload), v)
+}
+
+// Recurring reports whether the job is queued again after it finishes
+func (j *Job) Recurring() bool {
+	return j.RepeatEvery > 0
+}
+
+// CanRetry reports whether the job can be queued again by hand
+func (j *Job) CanRetry() bool {
+	return j.Status == Dead || (j.Status == Queued && j.Attempts > 0)
+}
+
+/*
+Handler runs a job of one type. Returning an error fails the attempt.
+
+ctx is cancelled when the queue is stopped and its drain deadline passes, so long running
+handlers should check it and return early. A job interrupted this way is retried. It is also
+cancelled if the job's lock could not be kept and another worker has started running it.
+*/
+type Handler func(ctx context.Context, job *Job) error
+
+// Option changes how a job is enqueued
+type Option func(*Job)
+
+// RunAt schedules a job to run no earlier than t
+func RunAt(t time.Time) Option {
+	return func(j *Job) {
+		j.RunAt = t
+	}
+}
+
+// RunIn schedules a job to run after d has passed
+func RunIn(d time.Duration) Option {
+	return func(j *Job) {
+		j.RunAt = time.Now().Add(d)
+	}
+}
+
+// MaxAttempts sets how many times a job is attempted before it is dead
+func MaxAttempts(n int) Option {
+	return func(j *Job) {
+		if n > 0 {
+			j.MaxAttempts = n
+		}
+	}
+}
@@ -0,0 +1,486 @@
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	// JobDeleteDone is a job type for removing old finished jobs with DeleteDone
+	JobDeleteDone = "jobs.delete_done"
+
+	// DefaultMaxAttempts is how many times a job is attempted unless MaxAttempts is given
+	DefaultMaxAttempts = 5
+
+	// pollInterval is how long an idle worker waits before checking for jobs again
+	pollInterval = 2 * time.Second
+	// lockTimeout is how long a running job's lock can go without being refreshed before it is assumed
+	// its worker died and it is run again
+	lockTimeout = 30 * time.Minute
+	// heartbeatInterval is how often the lock of a running job is refreshed, so jobs that take longer
+	// than lockTimeout are not run twice
+	heartbeatInterval = lockTimeout / 6
+	// minBackoff and maxBackoff bound the delay before a failed job is retried
+	minBackoff = 10 * time.Second
+	maxBackoff = time.Hour
+)
+
+/*
+Queue stores jobs in Postgres and runs them on a pool of workers.
+
+Workers claim jobs with SELECT ... FOR UPDATE SKIP LOCKED, so any number of workers, in this
+process or others sharing the database, can take jobs from the same table without running
+a job twice. Handlers must be registered before Start is called, and a worker only claims
+jobs whose type has a handler.
+*/
+type Queue struct {
+	db       *gorm.DB
+	handlers map[string]Handler
+	started  bool
+
+	// wake lets Enqueue start an idle worker without waiting for the poll interval
+	wake     chan struct{}
+	stop     chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+	// ctx is passed to handlers and cancelled if they are still running when Stop gives up waiting
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// NewQueue creates a Queue that stores jobs in db
+func NewQueue(db *gorm.DB) *Queue {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Queue{
+		db:       db,
+		handlers: make(map[string]Handler),
+		wake:     make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+}
+
+// Register sets the handler for jobs of type typ. It must be called before Start.
+func (q *Queue) Register(typ string, h Handler) {
+	if q.started {
+		panic("jobs: Register called after Start")
+	}
+	q.handlers[typ] = h
+}
+
+// Types returns the job types that have handlers
+func (q *Queue) Types() []string {
+	types := make([]string, 0, len(q.handlers))
+	for typ := range q.handlers {
+		types = append(types, typ)
+	}
+	return types
+}
+
+// Enqueue adds a job of type typ with payload, which is marshalled to JSON, to the queue.
+// The job runs as soon as a worker is free unless an Option schedules it for later.
+func (q *Queue) Enqueue(typ string, payload interface{}, opts ...Option) (*Job, error) {
+	job, err := newJob(typ, payload, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := q.db.Create(job).Error; err != nil {
+		return nil, err
+	}
+	q.notify()
+	return job, nil
+}
+
+/*
+Every makes sure a job of type typ runs every interval. The first run is queued straight away
+if there is no recurring job of that type waiting already, and each run queues the next when it
+finishes. Calling Every again with a different interval changes the interval of the waiting job.
+It is safe to call from several processes at once.
+*/
+func (q *Queue) Every(typ string, interval time.Duration, payload interface{}) error {
+	if interval <= 0 {
+		return fmt.Errorf("jobs: interval for %s must be positive", typ)
+	}
+	job, err := newJob(typ, payload, []Option{func(j *Job) { j.RepeatEvery = interval }})
+	if err != nil {
+		return err
+	}
+	tx := q.db.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+	// Serialise callers so two processes starting together do not both queue the job
+	if err := tx.Exec("SELECT pg_advisory_xact_lock(hashtext(?))", "jobs.every:"+typ).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	res := tx.Model(&Job{}).
+		Where("type = ? AND repeat_every > 0 AND status IN (?)", typ, []Status{Queued, Running}).
+		UpdateColumn("repeat_every", interval)
+	if res.Error != nil {
+		tx.Rollback()
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		if err := tx.Create(job).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+	q.notify()
+	return nil
+}
+
+// Start runs workers goroutines that claim and run jobs until Stop is called
+func (q *Queue) Start(workers int) {
+	q.started = true
+	for i := 0; i < workers; i++ {
+		q.wg.Add(1)
+		go q.work()
+	}
+}
+
+/*
+Stop drains the queue. Workers stop claiming new jobs and Stop waits for the jobs already
+running to finish. If ctx is done first, the running jobs' contexts are cancelled and Stop
+waits for their handlers to return before returning ctx's error. Jobs that were interrupted
+are retried the next time the queue is started.
+*/
+func (q *Queue) Stop(ctx context.Context) error {
+	q.stopOnce.Do(func() {
+		close(q.stop)
+	})
+	done := make(chan struct{})
+	go func() {
+		q.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		q.cancel()
+		return nil
+	case <-ctx.Done():
+		q.cancel()
+		<-done
+		return ctx.Err()
+	}
+}
+
+// notify wakes an idle worker, if there is one
+func (q *Queue) notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (q *Queue) work() {
+	defer q.wg.Done()
+	for {
+		select {
+		case <-q.stop:
+			return
+		default:
+		}
+
+		job, err := q.claim()
+		if err != nil {
+			log.Println("jobs: claim failed:", err)
+		}
+		if job == nil {
+			select {
+			case <-q.stop:
+				return
+			case <-q.wake:
+			case <-time.After(pollInterval):
+			}
+			continue
+		}
+		q.run(job)
+	}
+}
+
+// claim marks the next job that is due as running and returns it, or nil if no job is due.
+// Jobs left running by a worker that died are claimed again once lockTimeout has passed.
+func (q *Queue) claim() (*Job, error) {
+	if len(q.handlers) == 0 {
+		return nil, nil
+	}
+	now := time.Now().Truncate(time.Microsecond)
+	var job Job
+	err := q.db.Raw(`
+		UPDATE jobs SET status = ?, attempts = attempts + 1, locked_at = ?, updated_at = ?
+		WHERE id = (
+			SELECT id FROM jobs
+			WHERE type IN (?)
+			AND ((status = ? AND run_at <= ?) OR (status = ? AND locked_at < ?))
+			ORDER BY run_at, id
+			LIMIT 1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING *`,
+		Running, now, now,
+		q.Types(),
+		Queued, now, Running, now.Add(-lockTimeout),
+	).Scan(&job).Error
+	if err == gorm.ErrRecordNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// run calls the job's handler and records the result. The job's lock is refreshed while the handler runs,
+// and the handler's context is cancelled if another worker claims the job anyway.
+func (q *Queue) run(job *Job) {
+	ctx, cancel := context.WithCancel(q.ctx)
+	stop := make(chan struct{})
+	lockedAt := make(chan *time.Time)
+	go func() {
+		lockedAt <- q.heartbeat(job.ID, job.LockedAt, stop, cancel)
+	}()
+	err := q.call(ctx, q.handlers[job.Type], job)
+	close(stop)
+	job.LockedAt = <-lockedAt
+	cancel()
+	if err != nil {
+		log.Printf("jobs: %s job %d failed on attempt %d: %v\n", job.Type, job.ID, job.Attempts, err)
+	}
+	if err := q.finish(job, err); err != nil {
+		log.Printf("jobs: could not save %s job %d: %v\n", job.Type, job.ID, err)
+	}
+}
+
+// call runs h, turning a panic into an error so one bad job cannot stop its worker
+func (q *Queue) call(ctx context.Context, h Handler, job *Job) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v\n%s", r, debug.Stack())
+		}
+	}()
+	return h(ctx, job)
+}
+
+// heartbeat moves the lock of the running job with id forward every heartbeatInterval until stop is closed,
+// and returns the time it was last locked at. If the job is no longer locked at that time because another
+// worker claimed it, lost is called and the heartbeat stops.
+func (q *Queue) heartbeat(id uint, lockedAt *time.Time, stop <-chan struct{}, lost func()) *time.Time {
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return lockedAt
+		case <-ticker.C:
+		}
+		now := time.Now().Truncate(time.Microsecond)
+		res := q.db.Model(&Job{}).
+			Where("id = ? AND status = ? AND locked_at = ?", id, Running, lockedAt).
+			UpdateColumn("locked_at", now)
+		if res.Error != nil {
+			log.Printf("jobs: could not refresh the lock of job %d: %v\n", id, res.Error)
+			continue
+		}
+		if res.RowsAffected == 0 {
+			log.Printf("jobs: job %d was claimed by another worker while it was running\n", id)
+			lost()
+			<-stop
+			return lockedAt
+		}
+		lockedAt = &now
+	}
+}
+
+/*
+finish records the outcome of a job's attempt. A failed job is queued again after a backoff,
+or is dead once it has used all its attempts. A recurring job that is done or dead queues
+its next run. Nothing is saved if the job was claimed again by another worker in the meantime.
+*/
+func (q *Queue) finish(job *Job, runErr error) error {
+	now := time.Now()
+	updates := map[string]interface{}{
+		"locked_at":  nil,
+		"updated_at": now,
+	}
+	switch {
+	case runErr == nil:
+		job.Status = Done
+		updates["last_error"] = ""
+	case job.Attempts < job.MaxAttempts:
+		job.Status = Queued
+		job.RunAt = now.Add(backoff(job.Attempts))
+		updates["run_at"] = job.RunAt
+		updates["last_error"] = runErr.Error()
+	default:
+		job.Status = Dead
+		updates["last_error"] = runErr.Error()
+	}
+	updates["status"] = job.Status
+
+	tx := q.db.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+	res := tx.Model(&Job{}).
+		Where("id = ? AND status = ? AND locked_at = ?", job.ID, Running, job.LockedAt).
+		UpdateColumns(updates)
+	if res.Error != nil {
+		tx.Rollback()
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		tx.Rollback()
+		return nil
+	}
+	if job.Recurring() && job.Status != Queued {
+		// A dead run that was retried by hand may already have queued its next run
+		var waiting int
+		err := tx.Model(&Job{}).
+			Where("type = ? AND repeat_every > 0 AND status IN (?) AND id <> ?", job.Type, []Status{Queued, Running}, job.ID).
+			Count(&waiting).Error
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		if waiting > 0 {
+			return tx.Commit().Error
+		}
+		next := Job{
+			Type:        job.Type,
+			Payload:     job.Payload,
+			Status:      Queued,
+			MaxAttempts: job.MaxAttempts,
+			RunAt:       now.Add(job.RepeatEvery),
+			RepeatEvery: job.RepeatEvery,
+		}
+		if err := tx.Create(&next).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit().Error
+}
+
+// ByID returns the job with id
+func (q *Queue) ByID(id uint) (*Job, error) {
+	var job Job
+	if err := q.db.Where("id = ?", id).First(&job).Error; err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// List returns up to limit jobs with status, or with any status if status is empty, most recently updated first
+func (q *Queue) List(status Status, limit, offset int) ([]Job, error) {
+	var jobs []Job
+	db := q.db.Order("updated_at desc, id desc").Limit(limit).Offset(offset)
+	if status != "" {
+		db = db.Where("status = ?", status)
+	}
+	if err := db.Find(&jobs).Error; err != nil {
+		return nil, err
+	}
+	return jobs, nil
+}
+
+// Counts returns how many jobs have each status
+func (q *Queue) Counts() (map[Status]int, error) {
+	rows, err := q.db.Model(&Job{}).Select("status, count(*)").Group("status").Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	counts := make(map[Status]int, len(Statuses))
+	for rows.Next() {
+		var status Status
+		var n int
+		if err := rows.Scan(&status, &n); err != nil {
+			return nil, err
+		}
+		counts[status] = n
+	}
+	return counts, rows.Err()
+}
+
+// Retry queues a dead job, or a failed job waiting for its next attempt, to run now with a fresh set of attempts
+func (q *Queue) Retry(id uint) error {
+	res := q.db.Model(&Job{}).
+		Where("id = ? AND (status = ? OR (status = ? AND attempts > 0))", id, Dead, Queued).
+		UpdateColumns(map[string]interface{}{
+			"status":     Queued,
+			"attempts":   0,
+			"run_at":     time.Now(),
+			"updated_at": time.Now(),
+		})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	q.notify()
+	return nil
+}
+
+// DeleteDone removes jobs that finished successfully before t and returns how many there were
+func (q *Queue) DeleteDone(before time.Time) (int, error) {
+	res := q.db.Where("status = ? AND updated_at < ?", Done, before).Delete(&Job{})
+	return int(res.RowsAffected), res.Error
+}
+
+// AutoMigrate creates the jobs table
+func (q *Queue) AutoMigrate() error {
+	return q.db.AutoMigrate(&Job{}).Error
+}
+
+// newJob builds a queued job of type typ with payload marshalled to JSON
+func newJob(typ string, payload interface{}, opts []Option) (*Job, error) {
+	if payload == nil {
+		payload = struct{}{}
+	}
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	job := Job{
+		Type:        typ,
+		Payload:     string(b),
+		Status:      Queued,
+		MaxAttempts: DefaultMaxAttempts,
+		RunAt:       time.Now(),
+	}
+	for _, opt := range opts {
+		opt(&job)
+	}
+	return &job, nil
+}
+
+// backoff is the delay before a job is attempted again after its attempts'th attempt failed.
+// It doubles with each attempt, up to maxBackoff, with some jitter so failures do not retry in step.
+func backoff(attempts int) time.Duration {
+	if attempts < 1 {
+		attempts = 1
+	}
+	d := maxBackoff
+	if attempts < 10 {
+		d = minBackoff << uint(attempts-1)
+		if d > maxBackoff {
+			d = maxBackoff
+		}
+	}
+	return d + time.Duration(rand.Int63n(int64(d/5)+1))
+}
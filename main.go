@@ -1,11 +1,18 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/curtisvermeeren/web-development-with-go/controllers"
+	"github.com/curtisvermeeren/web-development-with-go/jobs"
 	"github.com/curtisvermeeren/web-development-with-go/middleware"
 	"github.com/curtisvermeeren/web-development-with-go/models"
 	"github.com/curtisvermeeren/web-development-with-go/rand"
@@ -16,6 +23,9 @@ import (
 func NotFound(w http.ResponseWriter, r *http.Request) {}
 
 func main() {
+	recalculateUsage := flag.Bool("recalculate-usage", false, "rebuild every user's storage usage from their stored files and exit")
+	flag.Parse()
+
 	config := LoadConfig()
 	dbConfig := config.Database
 
@@ -25,7 +35,22 @@ func main() {
 		models.WithLogMode(!config.IsProd()),
 		models.WithUser(config.Pepper, config.HMACKey),
 		models.WithGallery(),
+		models.WithUsage(config.Quota()),
 		models.WithImage(),
+		models.WithImageSigner(config.ImageURLKey, config.ImageURLTTL()),
+		models.WithVariant(config.VariantCacheSize()),
+		models.WithArchive(),
+		models.WithWatermark(),
+		models.WithTrash(config.TrashRetention()),
+		models.WithSearch(),
+		models.WithTag(),
+		models.WithAlbum(),
+		models.WithShareLink(),
+		models.WithComment(),
+		models.WithSelection(),
+		models.WithJobs(),
+		models.WithImport(),
+		models.WithUpload(),
 	)
 	if err != nil {
 		log.Fatal(err)
@@ -38,20 +63,44 @@ func main() {
 	// Create the database schema
 	services.AutoMigrate()
 
+	if *recalculateUsage {
+		n, err := services.Usage.RecalculateAll()
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("Recalculated storage usage for %d users\n", n)
+		return
+	}
+
+	// Run background jobs
+	registerJobs(services)
+	services.Jobs.Start(config.JobWorkers)
+
 	// Create a new router
 	router := mux.NewRouter()
 
 	// Setup Controlelrs
 	staticController := controllers.NewStatic()
 	usersController := controllers.NewUsers(services.User)
-	galleriesController := controllers.NewGalleries(services.Gallery, services.Image, router)
+	galleriesController := controllers.NewGalleries(services.Gallery, services.Image, services.Tag, services.Album, services.Archive, services.ShareLink, services.Import, services.Usage, services.ImageSigner, services.Variant, services.Watermark, services.Comment, services.Selection, router)
+	trashController := controllers.NewTrash(services.Trash, router)
+	searchController := controllers.NewSearch(services.Search)
+	tagsController := controllers.NewTags(services.Gallery, services.Image, services.Tag)
+	uploadsController := controllers.NewUploads(services.Gallery, services.Upload)
+	albumsController := controllers.NewAlbums(services.Album, services.Gallery, services.Image, router)
+	jobsController := controllers.NewJobs(services.Jobs, router)
+	profilesController := controllers.NewProfiles(services.User, services.Gallery, services.Image)
 
 	// Setup middleware
 	userMw := middleware.User{
 		UserService: services.User,
+		Comments:    services.Comment,
 	}
 
 	requireUserMw := middleware.RequireUser{}
+	requireAdminMw := middleware.RequireAdmin{
+		Emails: config.AdminEmails,
+	}
 
 	// Setup CSRF middleware supplied by gorilla/csrf package
 	b, err := rand.Bytes(32)
@@ -66,13 +115,56 @@ func main() {
 	updateGallery := requireUserMw.ApplyFn(galleriesController.Update)
 	deleteGallery := requireUserMw.ApplyFn(galleriesController.Delete)
 	indexGallery := requireUserMw.ApplyFn(galleriesController.Index)
+	similarImages := requireUserMw.ApplyFn(galleriesController.Similar)
 	uploadGallery := requireUserMw.ApplyFn(galleriesController.ImageUpload)
 	deleteImage := requireUserMw.ApplyFn(galleriesController.ImageDelete)
+	updateImage := requireUserMw.ApplyFn(galleriesController.ImageUpdate)
+	coverImage := requireUserMw.ApplyFn(galleriesController.ImageCover)
+	orderImages := requireUserMw.ApplyFn(galleriesController.ImageOrder)
+	bulkImages := requireUserMw.ApplyFn(galleriesController.ImageBulk)
+	createImport := requireUserMw.ApplyFn(galleriesController.ImportCreate)
+	showImport := requireUserMw.ApplyFn(galleriesController.ImportShow)
+	optionsUpload := requireUserMw.ApplyFn(uploadsController.Options)
+	createUpload := requireUserMw.ApplyFn(uploadsController.Create)
+	headUpload := requireUserMw.ApplyFn(uploadsController.Head)
+	patchUpload := requireUserMw.ApplyFn(uploadsController.Patch)
+	deleteUpload := requireUserMw.ApplyFn(uploadsController.Delete)
+	createShare := requireUserMw.ApplyFn(galleriesController.ShareCreate)
+	deleteShare := requireUserMw.ApplyFn(galleriesController.ShareDelete)
+	updateWatermark := requireUserMw.ApplyFn(galleriesController.WatermarkUpdate)
+	deleteWatermark := requireUserMw.ApplyFn(galleriesController.WatermarkDelete)
+	hideComment := requireUserMw.ApplyFn(galleriesController.CommentHide)
+	deleteComment := requireUserMw.ApplyFn(galleriesController.CommentDelete)
+	lockComments := requireUserMw.ApplyFn(galleriesController.CommentLock)
+	indexComments := requireUserMw.ApplyFn(galleriesController.Inbox)
+	updateProofing := requireUserMw.ApplyFn(galleriesController.ProofingUpdate)
+	showProofing := requireUserMw.ApplyFn(galleriesController.ProofingShow)
+	exportProofing := requireUserMw.ApplyFn(galleriesController.ProofingExport)
+	reopenSelection := requireUserMw.ApplyFn(galleriesController.SelectionReopen)
+	indexTrash := requireUserMw.ApplyFn(trashController.Index)
+	restoreTrash := requireUserMw.ApplyFn(trashController.Restore)
+	purgeTrash := requireUserMw.ApplyFn(trashController.Purge)
+	emptyTrash := requireUserMw.ApplyFn(trashController.Empty)
+	indexAlbums := requireUserMw.ApplyFn(albumsController.Index)
+	createAlbum := requireUserMw.ApplyFn(albumsController.Create)
+	editAlbum := requireUserMw.ApplyFn(albumsController.Edit)
+	updateAlbum := requireUserMw.ApplyFn(albumsController.Update)
+	deleteAlbum := requireUserMw.ApplyFn(albumsController.Delete)
+	suggestTags := requireUserMw.ApplyFn(tagsController.Suggest)
 	logoutUser := requireUserMw.ApplyFn(usersController.Logout)
+	editProfile := requireUserMw.ApplyFn(profilesController.Edit)
+	updateProfile := requireUserMw.ApplyFn(profilesController.Update)
+	updateAvatar := requireUserMw.ApplyFn(profilesController.AvatarUpdate)
+	deleteAvatar := requireUserMw.ApplyFn(profilesController.AvatarDelete)
+	indexJobs := requireAdminMw.ApplyFn(jobsController.Index)
+	showJob := requireAdminMw.ApplyFn(jobsController.Show)
+	retryJob := requireAdminMw.ApplyFn(jobsController.Retry)
 
-	// Image routes
-	imageHandler := http.FileServer(http.Dir("./images/"))
-	router.PathPrefix("/images/").Handler(http.StripPrefix("/images/", imageHandler))
+	// Image routes. Anything else under /images/, such as a gallery's directory, is not found.
+	router.HandleFunc("/images/galleries/{id:[0-9]+}/{filename}", galleriesController.ImageShow).Methods("GET", "HEAD")
+	router.PathPrefix("/images/").Handler(http.NotFoundHandler())
+	router.HandleFunc("/img/{id:[0-9]+}/{filename}", galleriesController.VariantShow).Methods("GET", "HEAD")
+	router.HandleFunc("/avatars/{id:[0-9]+}/{filename}", profilesController.Avatar).Methods("GET", "HEAD")
 
 	// Assets
 	assetHandler := http.FileServer(http.Dir("./assets/"))
@@ -91,20 +183,159 @@ func main() {
 	router.Handle("/login", usersController.LoginView).Methods("GET")
 	router.HandleFunc("/login", usersController.Login).Methods("POST")
 	router.HandleFunc("/logout", logoutUser).Methods("POST")
+	// Profile routes
+	router.HandleFunc("/u/{username}", profilesController.Show).Methods("GET")
+	router.HandleFunc("/profile", editProfile).Methods("GET")
+	router.HandleFunc("/profile", updateProfile).Methods("POST")
+	router.HandleFunc("/profile/avatar", updateAvatar).Methods("POST")
+	router.HandleFunc("/profile/avatar/delete", deleteAvatar).Methods("POST")
 	// Gallery routes
 	router.Handle("/galleries/new", galleriesController.New).Methods("GET")
 	router.HandleFunc("/galleries", createGallery).Methods("POST")
-	router.HandleFunc("/galleries/{id:[0-9]+}", galleriesController.Show).Methods("GET").Name(controllers.ShowGallery)
+	router.HandleFunc("/galleries/{publicID:[0-9a-f]{16}}-{slug}", galleriesController.Show).Methods("GET").Name(controllers.ShowGallery)
+	router.HandleFunc("/galleries/{publicID:[0-9a-f]{16}}", galleriesController.Show).Methods("GET")
+	router.HandleFunc("/galleries/{publicID:[0-9a-f]{16}}/images/{filename}", galleriesController.Viewer).Methods("GET").Name(controllers.ShowGalleryImage)
+	// Numeric addresses from before public IDs, registered after them so a public ID made only of digits wins
+	router.HandleFunc("/galleries/{id:[0-9]+}-{slug}", galleriesController.ShowByID).Methods("GET")
+	router.HandleFunc("/galleries/{id:[0-9]+}", galleriesController.ShowByID).Methods("GET")
 	router.HandleFunc("/galleries/{id:[0-9]+}/edit", editGallery).Methods("GET").Name(controllers.EditGallery)
 	router.HandleFunc("/galleries/{id:[0-9]+}/update", updateGallery).Methods("POST")
 	router.HandleFunc("/galleries/{id:[0-9]+}/delete", deleteGallery).Methods("POST")
 	router.Handle("/galleries", indexGallery).Methods("GET").Name(controllers.IndexGalleries)
+	router.HandleFunc("/galleries/similar", similarImages).Methods("GET")
+	router.HandleFunc("/galleries/{publicID:[0-9a-f]{16}}/download", galleriesController.Download).Methods("GET")
+	router.HandleFunc("/galleries/{id:[0-9]+}/imports", createImport).Methods("POST")
+	router.HandleFunc("/galleries/{id:[0-9]+}/imports/{importID:[0-9]+}", showImport).Methods("GET")
+	router.HandleFunc("/galleries/{id:[0-9]+}/uploads", optionsUpload).Methods("OPTIONS")
+	router.HandleFunc("/galleries/{id:[0-9]+}/uploads", createUpload).Methods("POST")
+	router.HandleFunc("/galleries/{id:[0-9]+}/uploads/{uploadID}", headUpload).Methods("HEAD")
+	router.HandleFunc("/galleries/{id:[0-9]+}/uploads/{uploadID}", patchUpload).Methods("PATCH")
+	router.HandleFunc("/galleries/{id:[0-9]+}/uploads/{uploadID}", deleteUpload).Methods("DELETE")
+	router.HandleFunc("/galleries/{id:[0-9]+}/shares", createShare).Methods("POST")
+	router.HandleFunc("/galleries/{id:[0-9]+}/shares/{shareID:[0-9]+}/delete", deleteShare).Methods("POST")
+	router.HandleFunc("/galleries/{id:[0-9]+}/watermark", updateWatermark).Methods("POST")
+	router.HandleFunc("/galleries/{id:[0-9]+}/watermark/delete", deleteWatermark).Methods("POST")
+	router.HandleFunc("/galleries/{publicID:[0-9a-f]{16}}/comments", galleriesController.CommentCreate).Methods("POST")
+	router.HandleFunc("/galleries/{id:[0-9]+}/comments/lock", lockComments).Methods("POST")
+	router.HandleFunc("/galleries/{id:[0-9]+}/comments/{commentID:[0-9]+}/hide", hideComment).Methods("POST")
+	router.HandleFunc("/galleries/{id:[0-9]+}/comments/{commentID:[0-9]+}/delete", deleteComment).Methods("POST")
+	router.HandleFunc("/comments", indexComments).Methods("GET")
+	router.HandleFunc("/galleries/{id:[0-9]+}/proofing", showProofing).Methods("GET")
+	router.HandleFunc("/galleries/{id:[0-9]+}/proofing", updateProofing).Methods("POST")
+	router.HandleFunc("/galleries/{id:[0-9]+}/proofing/export", exportProofing).Methods("GET")
+	router.HandleFunc("/galleries/{publicID:[0-9a-f]{16}}/proofing/favourites", galleriesController.Favourite).Methods("POST")
+	router.HandleFunc("/galleries/{publicID:[0-9a-f]{16}}/proofing/submit", galleriesController.SelectionSubmit).Methods("POST")
+	router.HandleFunc("/galleries/{id:[0-9]+}/proofing/{selectionID:[0-9]+}/reopen", reopenSelection).Methods("POST")
 	router.HandleFunc("/galleries/{id:[0-9]+}/images", uploadGallery).Methods("POST")
+	router.HandleFunc("/galleries/{id:[0-9]+}/images/order", orderImages).Methods("POST")
+	router.HandleFunc("/galleries/{id:[0-9]+}/images/bulk", bulkImages).Methods("POST")
 	router.HandleFunc("/galleries/{id:[0-9]+}/images/{filename}/delete", deleteImage).Methods("POST")
+	router.HandleFunc("/galleries/{id:[0-9]+}/images/{filename}/update", updateImage).Methods("POST")
+	router.HandleFunc("/galleries/{id:[0-9]+}/images/{filename}/cover", coverImage).Methods("POST")
+	// Album routes
+	router.HandleFunc("/albums", indexAlbums).Methods("GET").Name(controllers.IndexAlbums)
+	router.HandleFunc("/albums", createAlbum).Methods("POST")
+	router.HandleFunc("/albums/{id:[0-9]+}", albumsController.Show).Methods("GET").Name(controllers.ShowAlbum)
+	router.HandleFunc("/albums/{id:[0-9]+}/edit", editAlbum).Methods("GET").Name(controllers.EditAlbum)
+	router.HandleFunc("/albums/{id:[0-9]+}/update", updateAlbum).Methods("POST")
+	router.HandleFunc("/albums/{id:[0-9]+}/delete", deleteAlbum).Methods("POST")
+	// Tag routes
+	router.HandleFunc("/galleries/tags", suggestTags).Methods("GET")
+	router.HandleFunc("/tags/{tag}", tagsController.Show).Methods("GET")
+	// Search routes
+	router.HandleFunc("/search", searchController.Results).Methods("GET")
+	// Trash routes
+	router.HandleFunc("/trash", indexTrash).Methods("GET").Name(controllers.IndexTrash)
+	router.HandleFunc("/trash/{id:[0-9]+}/restore", restoreTrash).Methods("POST")
+	router.HandleFunc("/trash/{id:[0-9]+}/purge", purgeTrash).Methods("POST")
+	router.HandleFunc("/trash/empty", emptyTrash).Methods("POST")
+	// Admin routes
+	router.HandleFunc("/admin/jobs", indexJobs).Methods("GET").Name(controllers.IndexJobs)
+	router.HandleFunc("/admin/jobs/{id:[0-9]+}", showJob).Methods("GET")
+	router.HandleFunc("/admin/jobs/{id:[0-9]+}/retry", retryJob).Methods("POST")
 
 	router.NotFoundHandler = staticController.Home
 
-	fmt.Printf("Listening on port :%d\n", config.Port)
-	http.ListenAndServe(fmt.Sprintf(":%d", config.Port), csrfMw(userMw.Apply(router)))
+	server := &http.Server{
+		Addr:    fmt.Sprintf(":%d", config.Port),
+		Handler: csrfMw(userMw.Apply(router)),
+	}
+	go func() {
+		fmt.Printf("Listening on port :%d\n", config.Port)
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
 
+	// On SIGINT or SIGTERM finish the requests and jobs that are running before exiting
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	<-stop
+	log.Println("Shutting down")
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Println("server shutdown:", err)
+	}
+	if err := services.Jobs.Stop(ctx); err != nil {
+		log.Println("jobs: stopped before all jobs finished:", err)
+	}
 }
+
+// shutdownTimeout is how long running requests and jobs are given to finish when the server stops
+const shutdownTimeout = 30 * time.Second
+
+// registerJobs sets the handlers for the background jobs and schedules the recurring ones
+func registerJobs(services *models.Services) {
+	q := services.Jobs
+	q.Register(models.JobRunImport, func(ctx context.Context, job *jobs.Job) error {
+		var payload models.ImportJob
+		if err := job.Decode(&payload); err != nil {
+			return err
+		}
+		return services.Import.Run(ctx, payload.ImportID, job.Attempts >= job.MaxAttempts)
+	})
+	q.Register(models.JobPurgeTrash, func(ctx context.Context, job *jobs.Job) error {
+		n, err := services.Trash.PurgeExpired()
+		if n > 0 {
+			log.Printf("trash: purged %d galleries\n", n)
+		}
+		return err
+	})
+	q.Register(models.JobDeleteExpiredUploads, func(ctx context.Context, job *jobs.Job) error {
+		n, err := services.Upload.DeleteExpired()
+		if n > 0 {
+			log.Printf("uploads: removed %d expired uploads\n", n)
+		}
+		return err
+	})
+	q.Register(models.JobHashImages, func(ctx context.Context, job *jobs.Job) error {
+		n, err := services.Image.HashMissing()
+		if n > 0 {
+			log.Printf("images: hashed %d images\n", n)
+		}
+		return err
+	})
+	q.Register(jobs.JobDeleteDone, func(ctx context.Context, job *jobs.Job) error {
+		_, err := q.DeleteDone(time.Now().Add(-doneJobRetention))
+		return err
+	})
+
+	recurring := []struct {
+		typ      string
+		interval time.Duration
+	}{
+		{models.JobPurgeTrash, time.Hour},
+		{models.JobDeleteExpiredUploads, time.Hour},
+		{models.JobHashImages, 24 * time.Hour},
+		{jobs.JobDeleteDone, 24 * time.Hour},
+	}
+	for _, r := range recurring {
+		if err := q.Every(r.typ, r.interval, nil); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+// doneJobRetention is how long finished jobs are kept so they can be inspected
+const doneJobRetention = 7 * 24 * time.Hour
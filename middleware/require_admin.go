@@ -0,0 +1,35 @@
+package middleware
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/curtisvermeeren/web-development-with-go/context"
+)
+
+// RequireAdmin only lets through users whose email is in Emails. Everyone else gets a 404
+// so the admin pages are not advertised.
+type RequireAdmin struct {
+	Emails []string
+}
+
+func (mw *RequireAdmin) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := context.User(r.Context())
+		if user == nil {
+			http.Redirect(w, r, "/login", http.StatusFound)
+			return
+		}
+		for _, email := range mw.Emails {
+			if strings.EqualFold(email, user.Email) {
+				next(w, r)
+				return
+			}
+		}
+		http.NotFound(w, r)
+	})
+}
+
+func (mw *RequireAdmin) Apply(next http.Handler) http.HandlerFunc {
+	return mw.ApplyFn(next.ServeHTTP)
+}
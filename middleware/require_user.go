@@ -1,6 +1,7 @@
 package middleware
 
 import (
+	"log"
 	"net/http"
 	"strings"
 
@@ -29,13 +30,16 @@ func (mw *RequireUser) Apply(next http.Handler) http.HandlerFunc {
 
 type User struct {
 	models.UserService
+	// Comments counts the comments the user has not seen yet, which are shown in the navbar
+	Comments models.CommentService
 }
 
 func (mw *User) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 
+		// Images are not skipped because who can see them depends on the user
 		path := r.URL.Path
-		if strings.HasPrefix(path, "/assets/") || strings.HasPrefix(path, "/images/") {
+		if strings.HasPrefix(path, "/assets/") {
 			next(w, r)
 			return
 		}
@@ -50,6 +54,12 @@ func (mw *User) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
 			next(w, r)
 			return
 		}
+		// Only pages show the navbar, so images, downloads and JSON requests skip counting comments
+		if mw.Comments != nil && wantsHTML(r) {
+			if user.UnseenComments, err = mw.Comments.UnseenCount(user.ID); err != nil {
+				log.Println(err)
+			}
+		}
 		ctx := r.Context()
 		ctx = context.WithUser(ctx, user)
 		r = r.WithContext(ctx)
@@ -60,3 +70,9 @@ func (mw *User) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
 func (mw *User) Apply(next http.Handler) http.HandlerFunc {
 	return mw.ApplyFn(next.ServeHTTP)
 }
+
+// wantsHTML reports whether the request is a browser asking for a page, which is the only
+// kind of response that includes the navbar
+func wantsHTML(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "text/html")
+}
@@ -0,0 +1,382 @@
+package models
+
+import (
+	"strings"
+
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	// ErrAlbumNotFound is returned when an album does not exist or belongs to another user
+	ErrAlbumNotFound modelError = "models: album not found"
+	// ErrAlbumCycle is returned when an album would be moved inside itself or one of its own albums
+	ErrAlbumCycle modelError = "models: an album cannot be moved inside itself"
+	// ErrAlbumTooDeep is returned when albums would be nested more than maxAlbumDepth levels deep
+	ErrAlbumTooDeep modelError = "models: albums can be nested at most 10 levels deep"
+
+	maxAlbumDepth = 10
+)
+
+/*
+Album groups galleries and other albums into a tree, such as Event -> Day -> Session.
+ParentID is 0 for top level albums.
+
+Visibility is inherited: an album or gallery is private when it, or any album above it, is private.
+The result is stored in EffectiveVisibility on albums and galleries so listings can filter on it directly.
+It is kept up to date by the gorm layers whenever an album or gallery is saved.
+*/
+type Album struct {
+	gorm.Model
+	UserID              uint       `gorm:"not null;index"`
+	ParentID            uint       `gorm:"not null;default:0;index"`
+	Title               string     `gorm:"not null"`
+	Visibility          Visibility `gorm:"not null;default:'public'"`
+	EffectiveVisibility Visibility `gorm:"not null;default:'public'"`
+}
+
+// AlbumNode is an album in a flattened album tree
+type AlbumNode struct {
+	Album
+	Depth int
+}
+
+// AlbumService is used to organise galleries into nested albums
+type AlbumService interface {
+	AlbumDB
+	// Breadcrumbs returns the albums from the top level down to the album with id
+	Breadcrumbs(id uint) ([]Album, error)
+	// Tree returns all of a user's albums in depth first order
+	Tree(userID uint) ([]AlbumNode, error)
+}
+
+// AlbumDB is used to interact with the albums table
+type AlbumDB interface {
+	ByID(id uint) (*Album, error)
+	ByUserID(userID uint) ([]Album, error)
+	ByParentID(userID, parentID uint) ([]Album, error)
+	Create(album *Album) error
+	Update(album *Album) error
+	// Delete removes an album, moving its albums and galleries up to its parent
+	Delete(id uint) error
+}
+
+type albumService struct {
+	AlbumDB
+}
+
+// NewAlbumService creates an AlbumService backed by db
+func NewAlbumService(db *gorm.DB) AlbumService {
+	ag := &albumGorm{db: db}
+	return &albumService{
+		AlbumDB: &albumValidator{
+			AlbumDB: ag,
+		},
+	}
+}
+
+func (as *albumService) Breadcrumbs(id uint) ([]Album, error) {
+	var crumbs []Album
+	for id > 0 && len(crumbs) <= maxAlbumDepth {
+		album, err := as.ByID(id)
+		if err != nil {
+			return nil, err
+		}
+		crumbs = append([]Album{*album}, crumbs...)
+		id = album.ParentID
+	}
+	return crumbs, nil
+}
+
+func (as *albumService) Tree(userID uint) ([]AlbumNode, error) {
+	albums, err := as.ByUserID(userID)
+	if err != nil {
+		return nil, err
+	}
+	children := make(map[uint][]Album)
+	known := make(map[uint]bool, len(albums))
+	for _, a := range albums {
+		known[a.ID] = true
+	}
+	for _, a := range albums {
+		parent := a.ParentID
+		if !known[parent] {
+			parent = 0
+		}
+		children[parent] = append(children[parent], a)
+	}
+
+	var nodes []AlbumNode
+	var walk func(parentID uint, depth int)
+	walk = func(parentID uint, depth int) {
+		for _, a := range children[parentID] {
+			nodes = append(nodes, AlbumNode{Album: a, Depth: depth})
+			walk(a.ID, depth+1)
+		}
+	}
+	walk(0, 0)
+	return nodes, nil
+}
+
+// Indent returns a prefix that shows the node's depth in select menus
+func (n AlbumNode) Indent() string {
+	return strings.Repeat("— ", n.Depth)
+}
+
+// IsPublic reports whether anyone can view the album
+func (a *Album) IsPublic() bool {
+	if a.EffectiveVisibility == "" {
+		return a.Visibility != VisibilityPrivate
+	}
+	return a.EffectiveVisibility != VisibilityPrivate
+}
+
+// VisibleTo reports whether user can view the album. user is nil for visitors who are not logged in.
+func (a *Album) VisibleTo(user *User) bool {
+	if a.IsPublic() {
+		return true
+	}
+	return user != nil && user.ID == a.UserID
+}
+
+// albumGorm represents the database interaction layer for albums
+type albumGorm struct {
+	db *gorm.DB
+}
+
+func (ag *albumGorm) ByID(id uint) (*Album, error) {
+	var album Album
+	if err := first(ag.db.Where("id = ?", id), &album); err != nil {
+		return nil, err
+	}
+	return &album, nil
+}
+
+func (ag *albumGorm) ByUserID(userID uint) ([]Album, error) {
+	var albums []Album
+	if err := ag.db.Where("user_id = ?", userID).Order("title").Find(&albums).Error; err != nil {
+		return nil, err
+	}
+	return albums, nil
+}
+
+func (ag *albumGorm) ByParentID(userID, parentID uint) ([]Album, error) {
+	var albums []Album
+	db := ag.db.Where("user_id = ? AND parent_id = ?", userID, parentID).Order("title")
+	if err := db.Find(&albums).Error; err != nil {
+		return nil, err
+	}
+	return albums, nil
+}
+
+func (ag *albumGorm) Create(album *Album) error {
+	return ag.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(album).Error; err != nil {
+			return err
+		}
+		return syncAlbumVisibility(tx, album)
+	})
+}
+
+func (ag *albumGorm) Update(album *Album) error {
+	return ag.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Save(album).Error; err != nil {
+			return err
+		}
+		return syncAlbumVisibility(tx, album)
+	})
+}
+
+func (ag *albumGorm) Delete(id uint) error {
+	return ag.db.Transaction(func(tx *gorm.DB) error {
+		var album Album
+		if err := first(tx.Where("id = ?", id), &album); err != nil {
+			return err
+		}
+		err := tx.Model(&Album{}).Where("parent_id = ?", id).UpdateColumn("parent_id", album.ParentID).Error
+		if err != nil {
+			return err
+		}
+		err = tx.Unscoped().Model(&Gallery{}).Where("album_id = ?", id).UpdateColumn("album_id", album.ParentID).Error
+		if err != nil {
+			return err
+		}
+		if err := tx.Delete(&album).Error; err != nil {
+			return err
+		}
+		return syncVisibility(tx, album.UserID)
+	})
+}
+
+// syncAlbumVisibility updates the stored visibility of the user's albums and galleries after album was saved
+func syncAlbumVisibility(tx *gorm.DB, album *Album) error {
+	if err := syncVisibility(tx, album.UserID); err != nil {
+		return err
+	}
+	return tx.Model(&Album{}).Where("id = ?", album.ID).Select("effective_visibility").
+		Row().Scan(&album.EffectiveVisibility)
+}
+
+// syncVisibility recomputes the effective visibility of every album and gallery owned by userID.
+// Albums are walked from the top level down so each inherits from an already updated parent.
+func syncVisibility(tx *gorm.DB, userID uint) error {
+	var albums []Album
+	if err := tx.Where("user_id = ?", userID).Find(&albums).Error; err != nil {
+		return err
+	}
+	byID := make(map[uint]*Album, len(albums))
+	for i := range albums {
+		byID[albums[i].ID] = &albums[i]
+	}
+
+	effective := make(map[uint]Visibility, len(albums))
+	var resolve func(a *Album, depth int) Visibility
+	resolve = func(a *Album, depth int) Visibility {
+		if v, ok := effective[a.ID]; ok {
+			return v
+		}
+		v := VisibilityPublic
+		if a.Visibility == VisibilityPrivate {
+			v = VisibilityPrivate
+		} else if parent, ok := byID[a.ParentID]; ok && depth <= maxAlbumDepth {
+			v = resolve(parent, depth+1)
+		}
+		effective[a.ID] = v
+		return v
+	}
+
+	for i := range albums {
+		v := resolve(&albums[i], 0)
+		if albums[i].EffectiveVisibility == v {
+			continue
+		}
+		err := tx.Model(&Album{}).Where("id = ?", albums[i].ID).UpdateColumn("effective_visibility", v).Error
+		if err != nil {
+			return err
+		}
+	}
+	return syncGalleryVisibility(tx, "user_id = ?", userID)
+}
+
+// syncGalleryVisibility recomputes the effective visibility of the galleries matching where
+func syncGalleryVisibility(tx *gorm.DB, where string, args ...interface{}) error {
+	private := string(VisibilityPrivate)
+	sql := `UPDATE galleries SET effective_visibility = CASE
+		WHEN galleries.visibility = '` + private + `' OR EXISTS (
+			SELECT 1 FROM albums WHERE albums.id = galleries.album_id
+			AND albums.deleted_at IS NULL AND albums.effective_visibility = '` + private + `')
+		THEN '` + private + `' ELSE '` + string(VisibilityPublic) + `' END
+		WHERE ` + where
+	return tx.Exec(sql, args...).Error
+}
+
+// albumValidator represents the validation and normalization layer for albums
+type albumValidator struct {
+	AlbumDB
+}
+
+type albumValFn func(*Album) error
+
+func (av *albumValidator) Create(album *Album) error {
+	err := runAlbumValFns(album,
+		av.userIDRequired,
+		av.normalizeTitle,
+		av.titleRequired,
+		av.defaultVisibility,
+		av.visibilityValid,
+		av.parentValid)
+	if err != nil {
+		return err
+	}
+	return av.AlbumDB.Create(album)
+}
+
+func (av *albumValidator) Update(album *Album) error {
+	err := runAlbumValFns(album,
+		av.userIDRequired,
+		av.normalizeTitle,
+		av.titleRequired,
+		av.defaultVisibility,
+		av.visibilityValid,
+		av.parentValid)
+	if err != nil {
+		return err
+	}
+	return av.AlbumDB.Update(album)
+}
+
+func (av *albumValidator) Delete(id uint) error {
+	if id <= 0 {
+		return ErrIDInvalid
+	}
+	return av.AlbumDB.Delete(id)
+}
+
+func runAlbumValFns(album *Album, fns ...albumValFn) error {
+	for _, fn := range fns {
+		if err := fn(album); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (av *albumValidator) userIDRequired(a *Album) error {
+	if a.UserID <= 0 {
+		return ErrUSerIDRequired
+	}
+	return nil
+}
+
+func (av *albumValidator) normalizeTitle(a *Album) error {
+	a.Title = strings.TrimSpace(a.Title)
+	return nil
+}
+
+func (av *albumValidator) titleRequired(a *Album) error {
+	if a.Title == "" {
+		return ErrTitleRequired
+	}
+	return nil
+}
+
+func (av *albumValidator) defaultVisibility(a *Album) error {
+	if a.Visibility == "" {
+		a.Visibility = VisibilityPublic
+	}
+	return nil
+}
+
+func (av *albumValidator) visibilityValid(a *Album) error {
+	switch a.Visibility {
+	case VisibilityPublic, VisibilityPrivate:
+		return nil
+	default:
+		return ErrVisibilityInvalid
+	}
+}
+
+// parentValid walks up from the new parent to the top level. The parent must belong to the same user,
+// the album must not be found among its own ancestors and the tree must not grow deeper than maxAlbumDepth.
+func (av *albumValidator) parentValid(a *Album) error {
+	depth := 1
+	for id := a.ParentID; id > 0; depth++ {
+		if a.ID > 0 && id == a.ID {
+			return ErrAlbumCycle
+		}
+		if depth > maxAlbumDepth {
+			return ErrAlbumTooDeep
+		}
+		parent, err := av.AlbumDB.ByID(id)
+		if err == ErrNotFound {
+			return ErrAlbumNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if parent.UserID != a.UserID {
+			return ErrAlbumNotFound
+		}
+		id = parent.ParentID
+	}
+	return nil
+}
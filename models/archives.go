@@ -0,0 +1,248 @@
+package models
+
+import (
+	"archive/zip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/curtisvermeeren/web-development-with-go/rand"
+)
+
+// manifestName is the name of the file listing the images and their captions inside every archive
+const manifestName = "manifest.json"
+
+/*
+ArchiveService builds ZIP archives of a gallery's original images along with a manifest of their captions.
+
+Archives are streamed as they are written so they are never held in memory. A complete copy of each gallery
+archive is kept on disk so interrupted downloads can be resumed with a Range request. The copy is named by
+the archive's ETag, which changes whenever the gallery or any of its images changes, so a stale archive is
+never served. Archives are byte for byte the same each time they are built from the same images, so a
+download started from a stream can be resumed from the cached copy.
+
+The gallery's Images, with their Tags, must be loaded before calling these methods.
+*/
+type ArchiveService interface {
+	// ETag identifies the current archive of a gallery
+	ETag(gallery *Gallery) (string, error)
+	// Open returns the cached archive with etag, or ErrNotFound if it has not been built
+	Open(galleryID uint, etag string) (*os.File, error)
+	// Build writes the archive to the cache, if it is not there already, and opens it
+	Build(gallery *Gallery, etag string) (*os.File, error)
+	// Stream writes the archive to w, caching it once it is complete
+	Stream(w io.Writer, gallery *Gallery, etag string) error
+	// Write writes an archive of some of a gallery's images to w without caching it
+	Write(w io.Writer, gallery *Gallery, images []Image) error
+	// Delete removes the cached archives of a gallery
+	Delete(galleryID uint) error
+}
+
+// NewArchiveService creates an ArchiveService that caches archives on disk
+func NewArchiveService() ArchiveService {
+	return &archiveService{}
+}
+
+type archiveService struct{}
+
+// Manifest describes the contents of an archive
+type Manifest struct {
+	Gallery     string          `json:"gallery"`
+	Description string          `json:"description,omitempty"`
+	Images      []ManifestImage `json:"images"`
+}
+
+// ManifestImage describes one image in an archive
+type ManifestImage struct {
+	Filename string   `json:"filename"`
+	Caption  string   `json:"caption,omitempty"`
+	AltText  string   `json:"alt_text,omitempty"`
+	Tags     []string `json:"tags,omitempty"`
+}
+
+func (as *archiveService) ETag(gallery *Gallery) (string, error) {
+	h := sha256.New()
+	fmt.Fprintf(h, "%d\n%q\n%q\n%d\n", gallery.ID, gallery.Title, gallery.Description, gallery.UpdatedAt.UnixNano())
+	for _, image := range gallery.Images {
+		info, err := os.Stat(image.RelativePath())
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "%q %d %d %q %q", image.Filename, info.Size(), info.ModTime().UnixNano(), image.Caption, image.AltText)
+		for _, tag := range image.Tags {
+			fmt.Fprintf(h, " %q", tag.Name)
+		}
+		fmt.Fprintln(h)
+	}
+	return hex.EncodeToString(h.Sum(nil)[:16]), nil
+}
+
+func (as *archiveService) Open(galleryID uint, etag string) (*os.File, error) {
+	f, err := os.Open(as.archivePath(galleryID, etag))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	return f, err
+}
+
+func (as *archiveService) Build(gallery *Gallery, etag string) (*os.File, error) {
+	if f, err := as.Open(gallery.ID, etag); err != ErrNotFound {
+		return f, err
+	}
+	if err := as.Stream(io.Discard, gallery, etag); err != nil {
+		return nil, err
+	}
+	return as.Open(gallery.ID, etag)
+}
+
+func (as *archiveService) Stream(w io.Writer, gallery *Gallery, etag string) error {
+	dir := as.archiveDir(gallery.ID)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	token, err := rand.String(12)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.OpenFile(filepath.Join(dir, ".build-"+token), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	// Keep building the cached copy even if the client goes away, so its next attempt can resume from it
+	tee := &teeWriter{cache: tmp, client: w}
+	err = writeArchive(tee, gallery, gallery.Images)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), as.archivePath(gallery.ID, etag)); err != nil {
+		return err
+	}
+	as.removeStale(gallery.ID, etag)
+	return tee.clientErr
+}
+
+func (as *archiveService) Write(w io.Writer, gallery *Gallery, images []Image) error {
+	return writeArchive(w, gallery, images)
+}
+
+func (as *archiveService) Delete(galleryID uint) error {
+	return os.RemoveAll(as.archiveDir(galleryID))
+}
+
+// removeStale removes the cached archives of a gallery other than the one with etag
+func (as *archiveService) removeStale(galleryID uint, etag string) {
+	entries, err := os.ReadDir(as.archiveDir(galleryID))
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if name == etag+".zip" || strings.HasPrefix(name, ".") {
+			continue
+		}
+		if err := os.Remove(filepath.Join(as.archiveDir(galleryID), name)); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+func (as *archiveService) archiveDir(galleryID uint) string {
+	return filepath.Join("archives", "galleries", fmt.Sprintf("%v", galleryID))
+}
+
+func (as *archiveService) archivePath(galleryID uint, etag string) string {
+	return filepath.Join(as.archiveDir(galleryID), etag+".zip")
+}
+
+// teeWriter writes everything to cache, and to client until writing to client fails
+type teeWriter struct {
+	cache     io.Writer
+	client    io.Writer
+	clientErr error
+}
+
+func (t *teeWriter) Write(p []byte) (int, error) {
+	if t.clientErr == nil {
+		_, t.clientErr = t.client.Write(p)
+	}
+	return t.cache.Write(p)
+}
+
+// writeArchive writes a ZIP archive of images and their manifest to w, one file at a time.
+// Images are stored rather than compressed because JPEG and PNG files are already compressed.
+func writeArchive(w io.Writer, gallery *Gallery, images []Image) error {
+	zw := zip.NewWriter(w)
+	manifest := Manifest{
+		Gallery:     gallery.Title,
+		Description: gallery.Description,
+		Images:      make([]ManifestImage, len(images)),
+	}
+	for i, image := range images {
+		if err := addArchiveFile(zw, image.RelativePath(), image.Filename); err != nil {
+			return err
+		}
+		manifest.Images[i] = ManifestImage{
+			Filename: image.Filename,
+			Caption:  image.Caption,
+			AltText:  image.AltText,
+			Tags:     make([]string, len(image.Tags)),
+		}
+		for j, tag := range image.Tags {
+			manifest.Images[i].Tags[j] = tag.Name
+		}
+	}
+
+	header := &zip.FileHeader{
+		Name:     manifestName,
+		Method:   zip.Deflate,
+		Modified: gallery.UpdatedAt.UTC().Truncate(time.Second),
+	}
+	fw, err := zw.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(fw)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(manifest); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// addArchiveFile copies the file at path into zw under name
+func addArchiveFile(zw *zip.Writer, path, name string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	header.Method = zip.Store
+	fw, err := zw.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(fw, f)
+	return err
+}
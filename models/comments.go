@@ -0,0 +1,440 @@
+package models
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	// ErrCommentRequired is returned when a comment has no text
+	ErrCommentRequired modelError = "models: please write a comment"
+	// ErrCommentTooLong is returned when a comment exceeds maxCommentLen
+	ErrCommentTooLong modelError = "models: comments must be at most 2000 characters long"
+	// ErrCommentNameRequired is returned when a guest comments without giving a name
+	ErrCommentNameRequired modelError = "models: please enter your name"
+	// ErrCommentNameTooLong is returned when a guest's name exceeds maxCommentNameLen
+	ErrCommentNameTooLong modelError = "models: names must be at most 50 characters long"
+	// ErrCommentNotFound is returned when a comment being replied to or moderated does not exist
+	ErrCommentNotFound modelError = "models: comment not found"
+	// ErrCommentThrottled is returned when someone leaves more than maxCommentsPerWindow comments within commentWindow
+	ErrCommentThrottled modelError = "models: you are commenting too quickly. Please wait a few minutes and try again"
+
+	maxCommentLen     = 2000
+	maxCommentNameLen = 50
+	// maxCommentDepth is how deeply replies are nested. Replies to the deepest comments join their thread at the same depth.
+	maxCommentDepth = 4
+	// maxCommentsPerWindow comments may be left by one person within commentWindow
+	maxCommentsPerWindow = 5
+	commentWindow        = 10 * time.Minute
+)
+
+/*
+Comment is feedback left on a gallery or one of its images, either by a signed in user or by a guest
+viewing the gallery through a share link. Comments can reply to other comments to form threads.
+
+The gallery's owner is notified of comments they have not seen yet, and can hide or delete comments.
+*/
+type Comment struct {
+	ID        uint `gorm:"primary_key"`
+	GalleryID uint `gorm:"not null;index"`
+	// ImageID is the image the comment is about, or 0 for a comment on the gallery itself
+	ImageID uint `gorm:"not null;default:0;index"`
+	// ParentID is the comment this one replies to, or 0 if it starts a thread
+	ParentID uint `gorm:"not null;default:0"`
+	// OwnerID is the user who owns the gallery and is notified of the comment
+	OwnerID uint `gorm:"not null;index:idx_comments_owner_seen"`
+	// UserID is the user who left the comment, or 0 for a guest
+	UserID uint   `gorm:"not null;default:0"`
+	Name   string `gorm:"not null"`
+	Body   string `gorm:"type:text;not null"`
+	// AuthorKey identifies who left the comment so they can be throttled. See UserAuthorKey and GuestAuthorKey.
+	AuthorKey string `gorm:"not null;index"`
+	// Hidden comments, and the replies to them, are only shown to the gallery's owner
+	Hidden bool `gorm:"not null;default:false"`
+	// Seen is set once the gallery's owner has seen the comment
+	Seen      bool `gorm:"not null;default:false;index:idx_comments_owner_seen"`
+	CreatedAt time.Time
+	// Depth is how deeply the comment is nested in its thread, as set by Thread
+	Depth int `gorm:"-"`
+}
+
+// IsGuest reports whether the comment was left by someone without an account
+func (c *Comment) IsGuest() bool {
+	return c.UserID == 0
+}
+
+// UserAuthorKey identifies a signed in user leaving comments
+func UserAuthorKey(userID uint) string {
+	return fmt.Sprintf("user:%d", userID)
+}
+
+// GuestAuthorKey identifies a guest leaving comments through a share link from address.
+// The address is hashed so it is never stored.
+func GuestAuthorKey(shareLinkID uint, address string) string {
+	sum := sha256.Sum256([]byte(address))
+	return fmt.Sprintf("guest:%d:%s", shareLinkID, hex.EncodeToString(sum[:8]))
+}
+
+// CommentNotice is a comment on one of a user's galleries as listed for them, along with where it was left
+type CommentNotice struct {
+	Comment
+	GalleryTitle    string
+	GallerySlug     string
+	GalleryPublicID string
+	// ImageFilename is the image the comment is about, or empty for a comment on the gallery itself
+	ImageFilename string
+}
+
+// gallery is the gallery the comment was left on, with enough set to build its paths
+func (n CommentNotice) gallery() *Gallery {
+	g := &Gallery{Slug: n.GallerySlug, PublicID: n.GalleryPublicID}
+	g.ID = n.GalleryID
+	return g
+}
+
+// GalleryPath is the path of the page of the gallery the comment was left on
+func (n CommentNotice) GalleryPath() string {
+	return n.gallery().Path()
+}
+
+// ImagePath is the path of the viewer page of the image the comment is about
+func (n CommentNotice) ImagePath() string {
+	return n.gallery().ImagePath(n.ImageFilename)
+}
+
+// Thread orders comments, which must be oldest first, so that every reply follows the comment it replies to,
+// and sets how deeply each is nested. Hidden comments and the replies to them are left out unless includeHidden is set.
+func Thread(comments []Comment, includeHidden bool) []Comment {
+	ids := make(map[uint]bool, len(comments))
+	for _, c := range comments {
+		ids[c.ID] = true
+	}
+	replies := make(map[uint][]Comment)
+	for _, c := range comments {
+		parent := c.ParentID
+		// Replies whose comment is missing start their own thread
+		if !ids[parent] {
+			parent = 0
+		}
+		replies[parent] = append(replies[parent], c)
+	}
+
+	threaded := make([]Comment, 0, len(comments))
+	var walk func(parent uint, depth int)
+	walk = func(parent uint, depth int) {
+		for _, c := range replies[parent] {
+			if c.Hidden && !includeHidden {
+				continue
+			}
+			c.Depth = depth
+			threaded = append(threaded, c)
+			walk(c.ID, depth+1)
+		}
+	}
+	walk(0, 0)
+	return threaded
+}
+
+// CommentService is used to leave, list and moderate comments
+type CommentService interface {
+	CommentDB
+	// Delete removes a comment along with every reply to it
+	Delete(id uint) error
+}
+
+// CommentDB is used to interact with the comments table
+type CommentDB interface {
+	ByID(id uint) (*Comment, error)
+	// ByGalleryID returns the comments on a gallery itself, not its images, oldest first
+	ByGalleryID(galleryID uint) ([]Comment, error)
+	// ByImageID returns the comments on an image, oldest first
+	ByImageID(imageID uint) ([]Comment, error)
+	// ByOwnerID returns the most recent comments on the galleries a user owns
+	ByOwnerID(ownerID uint, limit int) ([]CommentNotice, error)
+	// UnseenCount is how many comments on a user's galleries they have not seen yet
+	UnseenCount(ownerID uint) (int, error)
+	// MarkSeen records that a user has seen the comments on their galleries with ids
+	MarkSeen(ownerID uint, ids []uint) error
+	// CountSince is how many comments the author identified by authorKey has left since t
+	CountSince(authorKey string, t time.Time) (int, error)
+	// Create saves a new comment. Comments left by the gallery's owner are marked as seen.
+	Create(comment *Comment) error
+	SetHidden(id uint, hidden bool) error
+	DeleteIDs(ids []uint) error
+}
+
+// NewCommentService creates a CommentService backed by db
+func NewCommentService(db *gorm.DB) CommentService {
+	return &commentService{
+		CommentDB: &commentValidator{
+			CommentDB: &commentGorm{
+				db: db,
+			},
+		},
+	}
+}
+
+type commentService struct {
+	CommentDB
+}
+
+func (cs *commentService) Delete(id uint) error {
+	comment, err := cs.ByID(id)
+	if err != nil {
+		return err
+	}
+	var thread []Comment
+	if comment.ImageID != 0 {
+		thread, err = cs.ByImageID(comment.ImageID)
+	} else {
+		thread, err = cs.ByGalleryID(comment.GalleryID)
+	}
+	if err != nil {
+		return err
+	}
+
+	ids := []uint{comment.ID}
+	deleted := map[uint]bool{comment.ID: true}
+	// Replies always come after the comment they reply to, so one pass finds them all
+	for _, c := range thread {
+		if deleted[c.ParentID] && !deleted[c.ID] {
+			deleted[c.ID] = true
+			ids = append(ids, c.ID)
+		}
+	}
+	return cs.DeleteIDs(ids)
+}
+
+type commentValidator struct {
+	CommentDB
+}
+
+type commentValFn func(*Comment) error
+
+func (cv *commentValidator) ByID(id uint) (*Comment, error) {
+	if id <= 0 {
+		return nil, ErrCommentNotFound
+	}
+	return cv.CommentDB.ByID(id)
+}
+
+func (cv *commentValidator) Create(comment *Comment) error {
+	err := runCommentValFns(comment,
+		commentGalleryIDRequired,
+		normalizeComment,
+		commentBodyRequired,
+		commentBodyMaxLength,
+		commentNameRequired,
+		commentNameMaxLength,
+		cv.parentValid,
+		cv.notThrottled,
+		seenByOwner)
+	if err != nil {
+		return err
+	}
+	return cv.CommentDB.Create(comment)
+}
+
+func (cv *commentValidator) SetHidden(id uint, hidden bool) error {
+	if id <= 0 {
+		return ErrCommentNotFound
+	}
+	return cv.CommentDB.SetHidden(id, hidden)
+}
+
+func runCommentValFns(comment *Comment, fns ...commentValFn) error {
+	for _, fn := range fns {
+		if err := fn(comment); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func commentGalleryIDRequired(comment *Comment) error {
+	if comment.GalleryID <= 0 || comment.OwnerID <= 0 {
+		return ErrIDInvalid
+	}
+	return nil
+}
+
+func normalizeComment(comment *Comment) error {
+	comment.Name = strings.TrimSpace(comment.Name)
+	comment.Body = strings.TrimSpace(comment.Body)
+	return nil
+}
+
+func commentBodyRequired(comment *Comment) error {
+	if comment.Body == "" {
+		return ErrCommentRequired
+	}
+	return nil
+}
+
+func commentBodyMaxLength(comment *Comment) error {
+	if len([]rune(comment.Body)) > maxCommentLen {
+		return ErrCommentTooLong
+	}
+	return nil
+}
+
+func commentNameRequired(comment *Comment) error {
+	if comment.Name == "" {
+		return ErrCommentNameRequired
+	}
+	return nil
+}
+
+func commentNameMaxLength(comment *Comment) error {
+	if len([]rune(comment.Name)) > maxCommentNameLen {
+		return ErrCommentNameTooLong
+	}
+	return nil
+}
+
+// parentValid checks a reply is to a visible comment on the same gallery or image.
+// Replies nested deeper than maxCommentDepth reply to their parent's parent instead.
+func (cv *commentValidator) parentValid(comment *Comment) error {
+	if comment.ParentID == 0 {
+		return nil
+	}
+	parent, err := cv.CommentDB.ByID(comment.ParentID)
+	if err != nil {
+		return err
+	}
+	if parent.GalleryID != comment.GalleryID || parent.ImageID != comment.ImageID || parent.Hidden {
+		return ErrCommentNotFound
+	}
+
+	// Walk up to the start of the thread to find how deeply the parent is nested
+	ancestors := []uint{parent.ID}
+	for c := parent; c.ParentID != 0 && len(ancestors) < maxCommentDepth; {
+		c, err = cv.CommentDB.ByID(c.ParentID)
+		if err == ErrCommentNotFound {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		ancestors = append(ancestors, c.ID)
+	}
+	if len(ancestors) >= maxCommentDepth {
+		comment.ParentID = ancestors[1]
+	}
+	return nil
+}
+
+func (cv *commentValidator) notThrottled(comment *Comment) error {
+	if comment.AuthorKey == "" {
+		return ErrIDInvalid
+	}
+	n, err := cv.CommentDB.CountSince(comment.AuthorKey, time.Now().Add(-commentWindow))
+	if err != nil {
+		return err
+	}
+	if n >= maxCommentsPerWindow {
+		return ErrCommentThrottled
+	}
+	return nil
+}
+
+// seenByOwner stops the gallery's owner being notified of their own comments
+func seenByOwner(comment *Comment) error {
+	comment.Seen = comment.UserID == comment.OwnerID
+	return nil
+}
+
+// commentGorm represents the database interaction layer for comments
+type commentGorm struct {
+	db *gorm.DB
+}
+
+func (cg *commentGorm) ByID(id uint) (*Comment, error) {
+	var comment Comment
+	err := first(cg.db.Where("id = ?", id), &comment)
+	if err == ErrNotFound {
+		return nil, ErrCommentNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &comment, nil
+}
+
+func (cg *commentGorm) ByGalleryID(galleryID uint) ([]Comment, error) {
+	return cg.find(cg.db.Where("gallery_id = ? AND image_id = 0", galleryID))
+}
+
+func (cg *commentGorm) ByImageID(imageID uint) ([]Comment, error) {
+	return cg.find(cg.db.Where("image_id = ?", imageID))
+}
+
+func (cg *commentGorm) find(db *gorm.DB) ([]Comment, error) {
+	var comments []Comment
+	if err := db.Order("created_at, id").Find(&comments).Error; err != nil {
+		return nil, err
+	}
+	return comments, nil
+}
+
+func (cg *commentGorm) ByOwnerID(ownerID uint, limit int) ([]CommentNotice, error) {
+	var notices []CommentNotice
+	db := cg.db.Table("comments").
+		Select("comments.*, galleries.title AS gallery_title, galleries.slug AS gallery_slug, galleries.public_id AS gallery_public_id, COALESCE(images.filename, '') AS image_filename").
+		Joins("JOIN galleries ON galleries.id = comments.gallery_id").
+		Joins("LEFT JOIN images ON images.id = comments.image_id").
+		Where("comments.owner_id = ? AND galleries.deleted_at IS NULL", ownerID).
+		Order("comments.created_at DESC, comments.id DESC").
+		Limit(limit)
+	if err := db.Scan(&notices).Error; err != nil {
+		return nil, err
+	}
+	return notices, nil
+}
+
+func (cg *commentGorm) UnseenCount(ownerID uint) (int, error) {
+	var n int
+	err := cg.db.Model(&Comment{}).Where("owner_id = ? AND seen = ?", ownerID, false).Count(&n).Error
+	return n, err
+}
+
+func (cg *commentGorm) MarkSeen(ownerID uint, ids []uint) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	db := cg.db.Model(&Comment{}).Where("owner_id = ? AND seen = ? AND id IN (?)", ownerID, false, ids)
+	return db.UpdateColumn("seen", true).Error
+}
+
+func (cg *commentGorm) CountSince(authorKey string, t time.Time) (int, error) {
+	var n int
+	err := cg.db.Model(&Comment{}).Where("author_key = ? AND created_at > ?", authorKey, t).Count(&n).Error
+	return n, err
+}
+
+func (cg *commentGorm) Create(comment *Comment) error {
+	return cg.db.Create(comment).Error
+}
+
+func (cg *commentGorm) SetHidden(id uint, hidden bool) error {
+	db := cg.db.Model(&Comment{}).Where("id = ?", id).UpdateColumn("hidden", hidden)
+	if db.Error != nil {
+		return db.Error
+	}
+	if db.RowsAffected == 0 {
+		return ErrCommentNotFound
+	}
+	return nil
+}
+
+func (cg *commentGorm) DeleteIDs(ids []uint) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	return cg.db.Where("id IN (?)", ids).Delete(&Comment{}).Error
+}
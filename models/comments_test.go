@@ -0,0 +1,14 @@
+package models
+
+import "testing"
+
+func TestCommentNoticePaths(t *testing.T) {
+	n := CommentNotice{GallerySlug: "trip", GalleryPublicID: "0123456789abcdef", ImageFilename: "a b.jpg"}
+	n.GalleryID = 3
+	if got, want := n.GalleryPath(), "/galleries/0123456789abcdef-trip"; got != want {
+		t.Errorf("GalleryPath() = %q, want %q", got, want)
+	}
+	if got, want := n.ImagePath(), "/galleries/0123456789abcdef/images/a%20b.jpg"; got != want {
+		t.Errorf("ImagePath() = %q, want %q", got, want)
+	}
+}
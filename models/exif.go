@@ -0,0 +1,296 @@
+package models
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// exifDateLayout is how EXIF records dates, in the camera's local time without a time zone
+	exifDateLayout = "2006:01:02 15:04:05"
+	// maxEXIFEntries stops a corrupt file from making readEXIF walk an enormous directory
+	maxEXIFEntries = 1000
+)
+
+// EXIF tags that are summarised. Location tags are deliberately never read, so a photo's EXIF summary
+// never reveals where it was taken.
+const (
+	exifTagMake             = 0x010f
+	exifTagModel            = 0x0110
+	exifTagDateTime         = 0x0132
+	exifTagExifIFD          = 0x8769
+	exifTagExposureTime     = 0x829a
+	exifTagFNumber          = 0x829d
+	exifTagISO              = 0x8827
+	exifTagDateTimeOriginal = 0x9003
+	exifTagFocalLength      = 0x920a
+	exifTagLensModel        = 0xa434
+)
+
+// EXIF summarises the camera and settings recorded in a photo
+type EXIF struct {
+	Make  string
+	Model string
+	Lens  string
+	// Taken is when the photo was taken in the camera's local time, or zero if it is not recorded
+	Taken time.Time
+	// ExposureTime is in seconds
+	ExposureTime float64
+	FNumber      float64
+	// FocalLength is in millimetres
+	FocalLength float64
+	ISO         int
+}
+
+// Camera is the make and model of the camera, without the make repeated when the model already includes it
+func (e *EXIF) Camera() string {
+	if e.Make == "" || strings.HasPrefix(strings.ToLower(e.Model), strings.ToLower(e.Make)) {
+		return e.Model
+	}
+	return strings.TrimSpace(e.Make + " " + e.Model)
+}
+
+// Settings are the exposure settings that were recorded, such as "f/2.8", "1/250 s", "35 mm" and "ISO 400"
+func (e *EXIF) Settings() []string {
+	var settings []string
+	if e.FNumber > 0 {
+		settings = append(settings, fmt.Sprintf("f/%g", math.Round(e.FNumber*10)/10))
+	}
+	if e.ExposureTime > 0 {
+		if e.ExposureTime < 1 {
+			settings = append(settings, fmt.Sprintf("1/%d s", int(math.Round(1/e.ExposureTime))))
+		} else {
+			settings = append(settings, fmt.Sprintf("%g s", math.Round(e.ExposureTime*10)/10))
+		}
+	}
+	if e.FocalLength > 0 {
+		settings = append(settings, fmt.Sprintf("%g mm", math.Round(e.FocalLength)))
+	}
+	if e.ISO > 0 {
+		settings = append(settings, fmt.Sprintf("ISO %d", e.ISO))
+	}
+	return settings
+}
+
+// empty reports whether nothing worth showing was recorded
+func (e *EXIF) empty() bool {
+	return e.Camera() == "" && e.Lens == "" && e.Taken.IsZero() && len(e.Settings()) == 0
+}
+
+// EXIF returns a summary of the EXIF metadata in image's file, or nil if it has none.
+// Only JPEG files are read.
+func (is *imageService) EXIF(image *Image) (*EXIF, error) {
+	f, err := os.Open(image.RelativePath())
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return readEXIF(bufio.NewReader(f))
+}
+
+// readEXIF reads the EXIF metadata from the APP1 segment of the JPEG in r.
+// It returns nil without an error when r is not a JPEG or has no usable EXIF metadata.
+func readEXIF(r io.Reader) (*EXIF, error) {
+	var marker [2]byte
+	if _, err := io.ReadFull(r, marker[:]); err != nil || marker != [2]byte{0xff, 0xd8} {
+		return nil, nil
+	}
+	for {
+		if _, err := io.ReadFull(r, marker[:]); err != nil {
+			return nil, nil
+		}
+		if marker[0] != 0xff {
+			return nil, nil
+		}
+		// Markers may be padded with any number of 0xff bytes
+		for marker[1] == 0xff {
+			if _, err := io.ReadFull(r, marker[1:]); err != nil {
+				return nil, nil
+			}
+		}
+		// Metadata always comes before the image data starts
+		if marker[1] == 0xda || marker[1] == 0xd9 {
+			return nil, nil
+		}
+		var length uint16
+		if err := binary.Read(r, binary.BigEndian, &length); err != nil || length < 2 {
+			return nil, nil
+		}
+		if marker[1] != 0xe1 {
+			if _, err := io.CopyN(io.Discard, r, int64(length)-2); err != nil {
+				return nil, nil
+			}
+			continue
+		}
+		segment := make([]byte, length-2)
+		if _, err := io.ReadFull(r, segment); err != nil {
+			return nil, nil
+		}
+		// APP1 is also used for XMP, so keep looking if this is not the EXIF segment
+		if !bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			continue
+		}
+		e := parseTIFF(segment[6:])
+		if e == nil || e.empty() {
+			return nil, nil
+		}
+		return e, nil
+	}
+}
+
+// parseTIFF reads the tags EXIF summarises from the TIFF structure EXIF metadata is stored in,
+// or returns nil if data is not valid TIFF
+func parseTIFF(data []byte) *EXIF {
+	if len(data) < 8 {
+		return nil
+	}
+	var order binary.ByteOrder
+	switch string(data[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return nil
+	}
+	if order.Uint16(data[2:]) != 42 {
+		return nil
+	}
+	t := tiff{data: data, order: order}
+
+	var e EXIF
+	ifd0 := t.ifd(order.Uint32(data[4:]))
+	e.Make = t.ascii(ifd0[exifTagMake])
+	e.Model = t.ascii(ifd0[exifTagModel])
+	taken := t.ascii(ifd0[exifTagDateTime])
+	if offset, ok := t.uint(ifd0[exifTagExifIFD]); ok {
+		exif := t.ifd(uint32(offset))
+		e.Lens = t.ascii(exif[exifTagLensModel])
+		e.ExposureTime = t.rational(exif[exifTagExposureTime])
+		e.FNumber = t.rational(exif[exifTagFNumber])
+		e.FocalLength = t.rational(exif[exifTagFocalLength])
+		if iso, ok := t.uint(exif[exifTagISO]); ok {
+			e.ISO = int(iso)
+		}
+		if original := t.ascii(exif[exifTagDateTimeOriginal]); original != "" {
+			taken = original
+		}
+	}
+	if taken != "" {
+		e.Taken, _ = time.Parse(exifDateLayout, taken)
+	}
+	return &e
+}
+
+// tiff is TIFF data in the byte order it was written in
+type tiff struct {
+	data  []byte
+	order binary.ByteOrder
+}
+
+// tiffEntry is a tag's value in a TIFF directory
+type tiffEntry struct {
+	typ   uint16
+	count uint32
+	// value holds the value itself if it fits in 4 bytes, otherwise its offset
+	value []byte
+}
+
+// tiffTypeSizes are the sizes in bytes of the TIFF value types that are read
+var tiffTypeSizes = map[uint16]uint32{
+	1: 1, // BYTE
+	2: 1, // ASCII
+	3: 2, // SHORT
+	4: 4, // LONG
+	5: 8, // RATIONAL
+}
+
+// ifd returns the entries of the directory at offset keyed by tag. Entries of types that are not read are left out.
+func (t tiff) ifd(offset uint32) map[uint16]tiffEntry {
+	entries := make(map[uint16]tiffEntry)
+	if uint64(offset)+2 > uint64(len(t.data)) {
+		return entries
+	}
+	n := int(t.order.Uint16(t.data[offset:]))
+	if n > maxEXIFEntries {
+		return entries
+	}
+	for i := 0; i < n; i++ {
+		start := int(offset) + 2 + i*12
+		if start+12 > len(t.data) {
+			break
+		}
+		entry := t.data[start : start+12]
+		typ := t.order.Uint16(entry[2:])
+		if _, ok := tiffTypeSizes[typ]; !ok {
+			continue
+		}
+		entries[t.order.Uint16(entry)] = tiffEntry{
+			typ:   typ,
+			count: t.order.Uint32(entry[4:]),
+			value: entry[8:12],
+		}
+	}
+	return entries
+}
+
+// bytes returns the raw value of entry, or nil if it lies outside the data
+func (t tiff) bytes(entry tiffEntry) []byte {
+	size, ok := tiffTypeSizes[entry.typ]
+	if !ok || entry.count == 0 {
+		return nil
+	}
+	n := uint64(size) * uint64(entry.count)
+	if n <= 4 {
+		return entry.value[:n]
+	}
+	offset := uint64(t.order.Uint32(entry.value))
+	if offset+n > uint64(len(t.data)) {
+		return nil
+	}
+	return t.data[offset : offset+n]
+}
+
+// ascii returns entry as a string without its terminating NUL or surrounding space
+func (t tiff) ascii(entry tiffEntry) string {
+	if entry.typ != 2 {
+		return ""
+	}
+	b := t.bytes(entry)
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return strings.TrimSpace(strings.ToValidUTF8(string(b), ""))
+}
+
+// uint returns the first value of a SHORT or LONG entry
+func (t tiff) uint(entry tiffEntry) (uint32, bool) {
+	b := t.bytes(entry)
+	switch {
+	case entry.typ == 3 && len(b) >= 2:
+		return uint32(t.order.Uint16(b)), true
+	case entry.typ == 4 && len(b) >= 4:
+		return t.order.Uint32(b), true
+	}
+	return 0, false
+}
+
+// rational returns the first value of a RATIONAL entry, or 0 if it is missing or invalid
+func (t tiff) rational(entry tiffEntry) float64 {
+	b := t.bytes(entry)
+	if entry.typ != 5 || len(b) < 8 {
+		return 0
+	}
+	num, den := t.order.Uint32(b), t.order.Uint32(b[4:])
+	if den == 0 {
+		return 0
+	}
+	return float64(num) / float64(den)
+}
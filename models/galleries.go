@@ -1,19 +1,86 @@
 package models
 
 import (
+	"strings"
+	"time"
+
 	"github.com/jinzhu/gorm"
 )
 
 const (
-	ErrUSerIDRequired modelError = "models: user ID is required"
-	ErrTitleRequired  modelError = "models: Title is required"
+	ErrUSerIDRequired     modelError = "models: user ID is required"
+	ErrTitleRequired      modelError = "models: Title is required"
+	ErrDescriptionTooLong modelError = "models: description must be at most 10000 characters long"
+	ErrVisibilityInvalid  modelError = "models: visibility must be public or private"
+	// ErrProofingLimitInvalid is returned when a gallery's selection limit is negative
+	ErrProofingLimitInvalid modelError = "models: the number of photos each person can choose cannot be negative"
+
+	maxDescriptionLen = 10000
+)
+
+// Visibility controls who can view a gallery
+type Visibility string
+
+const (
+	// VisibilityPublic galleries can be viewed by anyone
+	VisibilityPublic Visibility = "public"
+	// VisibilityPrivate galleries can only be viewed by their owner
+	VisibilityPrivate Visibility = "private"
 )
 
 type Gallery struct {
 	gorm.Model
-	UserID uint    `gorm:"not_null;index"`
-	Title  string  `gorm:"not_null"`
-	Images []Image `gorm:"-"`
+	UserID      uint       `gorm:"not_null;index"`
+	AlbumID     uint       `gorm:"not null;default:0;index"`
+	Title       string     `gorm:"not_null"`
+	Description string     `gorm:"type:text"`
+	Visibility  Visibility `gorm:"not null;default:'public'"`
+	// Slug is the readable part of the gallery's URL, unique among its owner's galleries
+	Slug string `gorm:"not null;default:''"`
+	// PublicID identifies the gallery in its public URLs, which never use its ID
+	PublicID string `gorm:"not null;default:''"`
+	// EffectiveVisibility is private when the gallery or any album containing it is private
+	EffectiveVisibility Visibility `gorm:"not null;default:'public'"`
+	// CommentsLocked stops new comments being left on the gallery and its images
+	CommentsLocked bool `gorm:"not null;default:false"`
+	// Proofing lets viewers choose their favourite images and submit them as a selection
+	Proofing bool `gorm:"not null;default:false"`
+	// ProofingLimit is how many images each selection can hold, or 0 for no limit
+	ProofingLimit int `gorm:"not null;default:0"`
+	// HiddenFromProfile leaves a public gallery off its owner's public profile
+	HiddenFromProfile bool    `gorm:"not null;default:false"`
+	Images            []Image `gorm:"-"`
+	Tags              []Tag   `gorm:"-"`
+	// Breadcrumbs are the albums containing the gallery, from the top level down
+	Breadcrumbs []Album `gorm:"-"`
+}
+
+// GallerySort is a column galleries can be ordered by
+type GallerySort string
+
+const (
+	SortCreated GallerySort = "created"
+	SortUpdated GallerySort = "updated"
+	SortTitle   GallerySort = "title"
+)
+
+// GalleryQuery holds the options used to find a page of galleries
+type GalleryQuery struct {
+	// UserID restricts the results to galleries owned by the user when set
+	UserID uint
+	// Title restricts the results to galleries whose title contains it, ignoring case
+	Title string
+	// Tag restricts the results to galleries with the tag
+	Tag string
+	// AlbumID restricts the results to galleries directly inside the album
+	AlbumID uint
+	// PublicOnly restricts the results to galleries that are public, including through their albums
+	PublicOnly bool
+	// ProfileOnly restricts the results to galleries shown on their owner's public profile
+	ProfileOnly bool
+	Sort        GallerySort
+	Desc        bool
+	Pagination
 }
 
 type GalleryService interface {
@@ -22,10 +89,23 @@ type GalleryService interface {
 
 type GalleryDB interface {
 	ByID(id uint) (*Gallery, error)
+	ByPublicID(publicID string) (*Gallery, error)
 	ByUserID(userID uint) ([]Gallery, error)
+	Find(query GalleryQuery) ([]Gallery, Page, error)
+	// SetProfileGalleries shows the user's galleries with shownIDs on their public profile and hides the rest
+	SetProfileGalleries(userID uint, shownIDs []uint) error
+	// SlugsWithPrefix is used to find the user's slugs that a new slug made from prefix could clash with
+	SlugsWithPrefix(userID uint, prefix string, exceptID uint) ([]string, error)
 	Create(gallery *Gallery) error
 	Update(gallery *Gallery) error
 	Delete(id uint) error
+
+	// Methods for galleries in the trash
+	DeletedByID(id uint) (*Gallery, error)
+	DeletedByUserID(userID uint) ([]Gallery, error)
+	DeletedBefore(t time.Time) ([]Gallery, error)
+	Restore(id uint) error
+	Purge(id uint) error
 }
 
 type galleryGorm struct {
@@ -33,7 +113,13 @@ type galleryGorm struct {
 }
 
 func (gg *galleryGorm) Create(gallery *Gallery) error {
-	return gg.db.Create(gallery).Error
+	if err := gg.db.Create(gallery).Error; err != nil {
+		return slugTaken(err)
+	}
+	if err := gg.syncVisibility(gallery); err != nil {
+		return err
+	}
+	return indexGallery(gg.db, gallery.ID)
 }
 
 func (gg *galleryGorm) ByID(id uint) (*Gallery, error) {
@@ -47,7 +133,22 @@ func (gg *galleryGorm) ByID(id uint) (*Gallery, error) {
 }
 
 func (gg *galleryGorm) Update(gallery *Gallery) error {
-	return gg.db.Save(gallery).Error
+	if err := gg.db.Save(gallery).Error; err != nil {
+		return slugTaken(err)
+	}
+	if err := gg.syncVisibility(gallery); err != nil {
+		return err
+	}
+	return indexGallery(gg.db, gallery.ID)
+}
+
+// syncVisibility recomputes the gallery's effective visibility from its own and its albums' visibility
+func (gg *galleryGorm) syncVisibility(gallery *Gallery) error {
+	if err := syncGalleryVisibility(gg.db, "id = ?", gallery.ID); err != nil {
+		return err
+	}
+	return gg.db.Unscoped().Model(&Gallery{}).Where("id = ?", gallery.ID).Select("effective_visibility").
+		Row().Scan(&gallery.EffectiveVisibility)
 }
 
 func (gg *galleryGorm) Delete(id uint) error {
@@ -65,12 +166,164 @@ func (gg *galleryGorm) ByUserID(userID uint) ([]Gallery, error) {
 	return galleries, nil
 }
 
+// SetProfileGalleries changes which galleries are on the user's profile without touching when they were last updated
+func (gg *galleryGorm) SetProfileGalleries(userID uint, shownIDs []uint) error {
+	return gg.db.Transaction(func(tx *gorm.DB) error {
+		db := tx.Model(&Gallery{}).Where("user_id = ?", userID)
+		if err := db.UpdateColumn("hidden_from_profile", true).Error; err != nil {
+			return err
+		}
+		if len(shownIDs) == 0 {
+			return nil
+		}
+		return db.Where("id IN (?)", shownIDs).UpdateColumn("hidden_from_profile", false).Error
+	})
+}
+
+// Find returns the page of galleries matching query along with cursors for the neighbouring pages
+func (gg *galleryGorm) Find(query GalleryQuery) ([]Gallery, Page, error) {
+	db := gg.db.Model(&Gallery{})
+	if query.UserID > 0 {
+		db = db.Where("user_id = ?", query.UserID)
+	}
+	if query.Title != "" {
+		db = db.Where("title ILIKE ?", "%"+escapeLike(query.Title)+"%")
+	}
+	if query.Tag != "" {
+		db = db.Where(`id IN (SELECT gallery_tags.gallery_id FROM gallery_tags
+			JOIN tags ON tags.id = gallery_tags.tag_id WHERE tags.name = ?)`, query.Tag)
+	}
+	if query.AlbumID > 0 {
+		db = db.Where("album_id = ?", query.AlbumID)
+	}
+	if query.PublicOnly {
+		db = db.Where("effective_visibility = ?", VisibilityPublic)
+	}
+	if query.ProfileOnly {
+		db = db.Where("hidden_from_profile = ?", false)
+	}
+
+	db, cursor, err := query.Pagination.paginate(db, keyset{
+		Column: query.Sort.column(),
+		Desc:   query.Desc,
+	})
+	if err != nil {
+		return nil, Page{}, err
+	}
+
+	var galleries []Gallery
+	if err := db.Find(&galleries).Error; err != nil {
+		return nil, Page{}, err
+	}
+	page := query.Pagination.pageOf(&galleries, cursor, func(i int) Cursor {
+		return Cursor{
+			Value: query.Sort.value(&galleries[i]),
+			ID:    galleries[i].ID,
+		}
+	})
+	return galleries, page, nil
+}
+
+// column returns the database column for the sort, defaulting to the creation time
+func (s GallerySort) column() string {
+	switch s {
+	case SortUpdated:
+		return "updated_at"
+	case SortTitle:
+		return "title"
+	default:
+		return "created_at"
+	}
+}
+
+// value returns the gallery's value in the sort column as it is stored in a Cursor
+func (s GallerySort) value(g *Gallery) string {
+	switch s {
+	case SortUpdated:
+		return g.UpdatedAt.Format(time.RFC3339Nano)
+	case SortTitle:
+		return g.Title
+	default:
+		return g.CreatedAt.Format(time.RFC3339Nano)
+	}
+}
+
+// escapeLike escapes the wildcard characters of a LIKE pattern so s is matched literally
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
+
+// DeletedByID is used to find a gallery in the trash with matching ID
+// will return ErrNotFound if no deleted gallery is found
+func (gg *galleryGorm) DeletedByID(id uint) (*Gallery, error) {
+	var gallery Gallery
+	db := gg.db.Unscoped().Where("id = ? AND deleted_at IS NOT NULL", id)
+	err := first(db, &gallery)
+	if err != nil {
+		return nil, err
+	}
+	return &gallery, nil
+}
+
+// DeletedByUserID returns the galleries in a user's trash, most recently deleted first
+func (gg *galleryGorm) DeletedByUserID(userID uint) ([]Gallery, error) {
+	var galleries []Gallery
+	db := gg.db.Unscoped().Where("user_id = ? AND deleted_at IS NOT NULL", userID)
+	if err := db.Order("deleted_at desc").Find(&galleries).Error; err != nil {
+		return nil, err
+	}
+	return galleries, nil
+}
+
+// DeletedBefore returns all galleries that were moved to the trash before t
+func (gg *galleryGorm) DeletedBefore(t time.Time) ([]Gallery, error) {
+	var galleries []Gallery
+	db := gg.db.Unscoped().Where("deleted_at IS NOT NULL AND deleted_at < ?", t)
+	if err := db.Find(&galleries).Error; err != nil {
+		return nil, err
+	}
+	return galleries, nil
+}
+
+// Restore takes a gallery out of the trash by clearing its deleted_at column
+func (gg *galleryGorm) Restore(id uint) error {
+	db := gg.db.Unscoped().Model(&Gallery{}).Where("id = ?", id)
+	return db.UpdateColumn("deleted_at", gorm.Expr("NULL")).Error
+}
+
+// Purge permanently removes the gallery row from the database
+func (gg *galleryGorm) Purge(id uint) error {
+	return gg.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("gallery_id = ?", id).Delete(&GalleryTag{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("gallery_id = ?", id).Delete(&ShareLink{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("gallery_id = ?", id).Delete(&Comment{}).Error; err != nil {
+			return err
+		}
+		selections := tx.Model(&Selection{}).Select("id").Where("gallery_id = ?", id).QueryExpr()
+		if err := tx.Where("selection_id IN (?)", selections).Delete(&Favourite{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("gallery_id = ?", id).Delete(&Selection{}).Error; err != nil {
+			return err
+		}
+		gallery := Gallery{Model: gorm.Model{ID: id}}
+		return tx.Unscoped().Delete(&gallery).Error
+	})
+}
+
 func NewGalleryService(db *gorm.DB) GalleryService {
 	return &gallerySerivce{
 		GalleryDB: &galleryValidator{
 			GalleryDB: &galleryGorm{
 				db: db,
 			},
+			albums: &albumGorm{
+				db: db,
+			},
 		},
 	}
 }
@@ -81,6 +334,7 @@ type gallerySerivce struct {
 
 type galleryValidator struct {
 	GalleryDB
+	albums AlbumDB
 }
 
 type galleryValFn func(*Gallery) error
@@ -89,6 +343,14 @@ func (gv *galleryValidator) Create(gallery *Gallery) error {
 	err := runGalleryValFns(gallery,
 		gv.userIDRequired,
 		gv.titleRequired,
+		gv.normalizeDescription,
+		gv.descriptionMaxLength,
+		gv.defaultVisibility,
+		gv.visibilityValid,
+		gv.albumOwned,
+		gv.proofingLimitValid,
+		gv.slugValid,
+		gv.publicIDSet,
 	)
 	if err != nil {
 		return err
@@ -99,13 +361,27 @@ func (gv *galleryValidator) Create(gallery *Gallery) error {
 func (gv *galleryValidator) Update(gallery *Gallery) error {
 	err := runGalleryValFns(gallery,
 		gv.userIDRequired,
-		gv.titleRequired)
+		gv.titleRequired,
+		gv.normalizeDescription,
+		gv.descriptionMaxLength,
+		gv.defaultVisibility,
+		gv.visibilityValid,
+		gv.albumOwned,
+		gv.proofingLimitValid,
+		gv.slugValid)
 	if err != nil {
 		return err
 	}
 	return gv.GalleryDB.Update(gallery)
 }
 
+// Find trims the title filter and normalizes the tag filter before passing the query to the next layer
+func (gv *galleryValidator) Find(query GalleryQuery) ([]Gallery, Page, error) {
+	query.Title = strings.TrimSpace(query.Title)
+	query.Tag = NormalizeTag(query.Tag)
+	return gv.GalleryDB.Find(query)
+}
+
 func runGalleryValFns(gallery *Gallery, fns ...galleryValFn) error {
 	for _, fn := range fns {
 		if err := fn(gallery); err != nil {
@@ -122,6 +398,13 @@ func (gv *galleryValidator) userIDRequired(g *Gallery) error {
 	return nil
 }
 
+func (gv *galleryValidator) proofingLimitValid(g *Gallery) error {
+	if g.ProofingLimit < 0 {
+		return ErrProofingLimitInvalid
+	}
+	return nil
+}
+
 func (gv *galleryValidator) titleRequired(g *Gallery) error {
 	if g.Title == "" {
 		return ErrTitleRequired
@@ -129,6 +412,54 @@ func (gv *galleryValidator) titleRequired(g *Gallery) error {
 	return nil
 }
 
+// normalizeDescription trims surrounding whitespace from the Markdown description
+func (gv *galleryValidator) normalizeDescription(g *Gallery) error {
+	g.Description = strings.TrimSpace(g.Description)
+	return nil
+}
+
+func (gv *galleryValidator) descriptionMaxLength(g *Gallery) error {
+	if len([]rune(g.Description)) > maxDescriptionLen {
+		return ErrDescriptionTooLong
+	}
+	return nil
+}
+
+// defaultVisibility makes galleries public when no visibility was chosen
+func (gv *galleryValidator) defaultVisibility(g *Gallery) error {
+	if g.Visibility == "" {
+		g.Visibility = VisibilityPublic
+	}
+	return nil
+}
+
+func (gv *galleryValidator) visibilityValid(g *Gallery) error {
+	switch g.Visibility {
+	case VisibilityPublic, VisibilityPrivate:
+		return nil
+	default:
+		return ErrVisibilityInvalid
+	}
+}
+
+// albumOwned makes sure a gallery can only be placed in an album owned by the same user
+func (gv *galleryValidator) albumOwned(g *Gallery) error {
+	if g.AlbumID == 0 {
+		return nil
+	}
+	album, err := gv.albums.ByID(g.AlbumID)
+	if err == ErrNotFound {
+		return ErrAlbumNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if album.UserID != g.UserID {
+		return ErrAlbumNotFound
+	}
+	return nil
+}
+
 func (gv *galleryValidator) nonZeroID(g *Gallery) error {
 	if g.ID <= 0 {
 		return ErrIDInvalid
@@ -145,8 +476,76 @@ func (gv *galleryValidator) Delete(id uint) error {
 	return gv.GalleryDB.Delete(gallery.ID)
 }
 
+func (gv *galleryValidator) Restore(id uint) error {
+	var gallery Gallery
+	gallery.ID = id
+	if err := runGalleryValFns(&gallery, gv.nonZeroID); err != nil {
+		return err
+	}
+	return gv.GalleryDB.Restore(gallery.ID)
+}
+
+func (gv *galleryValidator) Purge(id uint) error {
+	var gallery Gallery
+	gallery.ID = id
+	if err := runGalleryValFns(&gallery, gv.nonZeroID); err != nil {
+		return err
+	}
+	return gv.GalleryDB.Purge(gallery.ID)
+}
+
 var _ GalleryDB = &galleryGorm{}
 
+// IsPublic reports whether anyone can view the gallery, taking the visibility of its albums into account
+func (g *Gallery) IsPublic() bool {
+	if g.EffectiveVisibility == "" {
+		return g.Visibility != VisibilityPrivate
+	}
+	return g.EffectiveVisibility != VisibilityPrivate
+}
+
+// VisibleTo reports whether user can view the gallery. user is nil for visitors who are not logged in.
+func (g *Gallery) VisibleTo(user *User) bool {
+	if g.IsPublic() {
+		return true
+	}
+	return user != nil && user.ID == g.UserID
+}
+
+// TagNames returns the gallery's tags as a comma separated list
+func (g *Gallery) TagNames() string {
+	names := make([]string, len(g.Tags))
+	for i, tag := range g.Tags {
+		names[i] = tag.Name
+	}
+	return strings.Join(names, ", ")
+}
+
+// CoverImage returns the image chosen as the gallery's cover, or the first image if none was chosen.
+// Returns nil when the gallery has no images.
+func (g *Gallery) CoverImage() *Image {
+	if len(g.Images) == 0 {
+		return nil
+	}
+	for i := range g.Images {
+		if g.Images[i].Cover {
+			return &g.Images[i]
+		}
+	}
+	return &g.Images[0]
+}
+
+// LastUpdated returns the most recent time the gallery or any of its images changed
+func (g *Gallery) LastUpdated() time.Time {
+	updated := g.UpdatedAt
+	for _, img := range g.Images {
+		if img.UpdatedAt.After(updated) {
+			updated = img.UpdatedAt
+		}
+	}
+	return updated
+}
+
 func (g *Gallery) ImagesSplitN(n int) [][]Image {
 	ret := make([][]Image, n)
 	for i := 0; i < n; i++ {
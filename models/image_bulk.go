@@ -0,0 +1,65 @@
+package models
+
+const (
+	// ErrBulkActionInvalid is returned when a bulk action is not one of the supported actions
+	ErrBulkActionInvalid modelError = "models: please choose an action for the selected images"
+	// ErrDestinationInvalid is returned when images are sent to a gallery that does not exist or belongs to someone else
+	ErrDestinationInvalid modelError = "models: please choose one of your galleries to send the images to"
+)
+
+// ImageResult is the outcome of a bulk action for one image.
+// Err is nil when the action succeeded for the image.
+type ImageResult struct {
+	Filename string
+	Err      error
+}
+
+// ImageResults summarises the outcome of a bulk action
+type ImageResults []ImageResult
+
+// Succeeded counts the images the action succeeded for
+func (r ImageResults) Succeeded() int {
+	n := 0
+	for _, result := range r {
+		if result.Err == nil {
+			n++
+		}
+	}
+	return n
+}
+
+// Failed counts the images the action failed for
+func (r ImageResults) Failed() int {
+	return len(r) - r.Succeeded()
+}
+
+// DeleteMany deletes each image independently, so one image that cannot be deleted does not stop the others
+func (is *imageService) DeleteMany(galleryID uint, filenames []string) ImageResults {
+	results := make(ImageResults, len(filenames))
+	for i, filename := range filenames {
+		results[i].Filename = filename
+		image, err := is.ByFilename(galleryID, filename)
+		if err != nil {
+			results[i].Err = err
+			continue
+		}
+		results[i].Err = is.Delete(image)
+	}
+	return results
+}
+
+// UpdateMany updates each image independently, so one invalid image does not stop the others
+func (is *imageService) UpdateMany(galleryID uint, filenames []string, update func(*Image)) ImageResults {
+	results := make(ImageResults, len(filenames))
+	for i, filename := range filenames {
+		results[i].Filename = filename
+		image, err := is.ByFilename(galleryID, filename)
+		if err != nil {
+			results[i].Err = err
+			continue
+		}
+		update(image)
+		results[i].Err = is.Update(image)
+	}
+	return results
+}
@@ -0,0 +1,340 @@
+package models
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"image"
+	_ "image/jpeg" // register the decoders used for perceptual hashes
+	_ "image/png"
+	"io"
+	"log"
+	"math/bits"
+	"os"
+	"sort"
+	"strconv"
+)
+
+const (
+	// DefaultSimilarDistance is how many bits two perceptual hashes may differ by for the images to count as similar
+	DefaultSimilarDistance = 10
+	// MaxSimilarDistance is the largest distance that can be searched for, beyond which most photos look alike
+	MaxSimilarDistance = 20
+
+	// maxHashPixels stops perceptual hashes being computed for images too large to decode comfortably
+	maxHashPixels = 40000000
+	// hashBatchSize is how many images HashMissing loads at a time
+	hashBatchSize = 100
+)
+
+// SimilarGroup is a set of a user's images that look alike
+type SimilarGroup struct {
+	Images []Image
+}
+
+// FindDuplicate returns the image in the gallery with galleryID whose content is the same as r,
+// or nil if there is none. r is rewound afterwards so it can still be saved.
+func (is *imageService) FindDuplicate(galleryID uint, r io.ReadSeeker) (*Image, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return nil, err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	image, err := is.ImageDB.BySHA256(galleryID, hex.EncodeToString(h.Sum(nil)))
+	if err == ErrNotFound {
+		return nil, nil
+	}
+	return image, err
+}
+
+// Similar groups a user's images whose perceptual hashes differ by at most maxDistance bits.
+// Images are grouped transitively, so A and C are in the same group when both look like B.
+// Groups with only one image are left out.
+func (is *imageService) Similar(userID uint, maxDistance int) ([]SimilarGroup, error) {
+	if maxDistance < 0 || maxDistance > MaxSimilarDistance {
+		maxDistance = DefaultSimilarDistance
+	}
+	images, err := is.ImageDB.HashedByUserID(userID)
+	if err != nil {
+		return nil, err
+	}
+	return groupSimilar(images, maxDistance), nil
+}
+
+// groupSimilar groups images whose perceptual hashes differ by at most maxDistance bits, largest groups first.
+// Each image is only compared with the hashes a BK-tree finds near it, rather than with every other image.
+func groupSimilar(images []Image, maxDistance int) []SimilarGroup {
+	parent := make([]int, len(images))
+	for i := range parent {
+		parent[i] = i
+	}
+	var root func(int) int
+	root = func(i int) int {
+		for parent[i] != i {
+			parent[i] = parent[parent[i]]
+			i = parent[i]
+		}
+		return i
+	}
+	union := func(i, j int) {
+		parent[root(i)] = root(j)
+	}
+
+	// Images with the same hash are joined straight away, so the tree only holds each hash once
+	first := make(map[uint64]int, len(images))
+	var tree bkTree
+	for i, image := range images {
+		hash, _ := strconv.ParseUint(image.PerceptualHash, 16, 64)
+		if j, ok := first[hash]; ok {
+			union(i, j)
+			continue
+		}
+		tree.within(hash, maxDistance, func(j int) {
+			union(i, j)
+		})
+		tree.add(hash, i)
+		first[hash] = i
+	}
+
+	byRoot := make(map[int][]Image)
+	var order []int
+	for i, image := range images {
+		r := root(i)
+		if _, ok := byRoot[r]; !ok {
+			order = append(order, r)
+		}
+		byRoot[r] = append(byRoot[r], image)
+	}
+	var groups []SimilarGroup
+	for _, r := range order {
+		if len(byRoot[r]) > 1 {
+			groups = append(groups, SimilarGroup{Images: byRoot[r]})
+		}
+	}
+	sort.SliceStable(groups, func(i, j int) bool {
+		return len(groups[i].Images) > len(groups[j].Images)
+	})
+	return groups
+}
+
+// bkTree indexes perceptual hashes by their Hamming distance from one another.
+// Every child of a node is at a different distance from it, so by the triangle inequality a search
+// only has to visit the children whose distance is within maxDistance of the hash's own distance to the node.
+type bkTree struct {
+	root *bkNode
+}
+
+type bkNode struct {
+	hash uint64
+	// index is the position of the hash's image in the slice being grouped
+	index    int
+	children map[int]*bkNode
+}
+
+// add puts hash, found at index, in the tree. The hash must not already be in it.
+func (t *bkTree) add(hash uint64, index int) {
+	node := &bkNode{hash: hash, index: index}
+	if t.root == nil {
+		t.root = node
+		return
+	}
+	n := t.root
+	for {
+		d := bits.OnesCount64(n.hash ^ hash)
+		child, ok := n.children[d]
+		if !ok {
+			if n.children == nil {
+				n.children = make(map[int]*bkNode)
+			}
+			n.children[d] = node
+			return
+		}
+		n = child
+	}
+}
+
+// within calls fn with the index of every hash in the tree that differs from hash by at most maxDistance bits
+func (t *bkTree) within(hash uint64, maxDistance int, fn func(index int)) {
+	if t.root == nil {
+		return
+	}
+	stack := []*bkNode{t.root}
+	for len(stack) > 0 {
+		n := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		d := bits.OnesCount64(n.hash ^ hash)
+		if d <= maxDistance {
+			fn(n.index)
+		}
+		for cd, child := range n.children {
+			if cd >= d-maxDistance && cd <= d+maxDistance {
+				stack = append(stack, child)
+			}
+		}
+	}
+}
+
+// HashMissing computes the hashes and placeholders of images stored before they were recorded and returns how many it hashed
+func (is *imageService) HashMissing() (int, error) {
+	n := 0
+	var afterID uint
+	for {
+		images, err := is.ImageDB.Unhashed(afterID, hashBatchSize)
+		if err != nil {
+			return n, err
+		}
+		if len(images) == 0 {
+			return n, nil
+		}
+		for i := range images {
+			image := &images[i]
+			afterID = image.ID
+			err := hashImageFile(image)
+			if os.IsNotExist(err) {
+				continue
+			}
+			if err != nil {
+				log.Printf("images: could not hash %s: %v\n", image.RelativePath(), err)
+				continue
+			}
+			if err := is.ImageDB.SetHashes(image); err != nil {
+				return n, err
+			}
+			n++
+		}
+	}
+}
+
+// hashImageFile sets the hex encoded SHA-256 of image's file along with everything describeImage works out from it
+func hashImageFile(image *Image) error {
+	sum, err := hashFile(image.RelativePath())
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(image.RelativePath())
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	image.SHA256 = sum
+	describeImage(f, image)
+	return nil
+}
+
+// describeImage decodes the image in r and sets img's size, perceptual hash, BlurHash and dominant colour.
+// Those that cannot be worked out, because r is not an image or is too large to decode, are left empty.
+func describeImage(r io.ReadSeeker, img *Image) {
+	config, _, err := image.DecodeConfig(r)
+	if err != nil {
+		return
+	}
+	img.Width, img.Height = config.Width, config.Height
+	if config.Width*config.Height > maxHashPixels {
+		return
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return
+	}
+	decoded, _, err := image.Decode(r)
+	if err != nil {
+		return
+	}
+	img.PerceptualHash = perceptualHash(decoded)
+	setPlaceholders(img, decoded)
+}
+
+// perceptualHash returns a difference hash (dHash) of img as 16 hex digits.
+// The image is shrunk to 9x8 greyscale cells and each bit records whether a cell is brighter than the one to its right,
+// so the hash survives resizing, recompression and small colour changes.
+func perceptualHash(img image.Image) string {
+	const w, h = 9, 8
+	var cells [h][w]float64
+	b := img.Bounds()
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			cells[y][x] = cellBrightness(img, image.Rect(
+				b.Min.X+x*b.Dx()/w, b.Min.Y+y*b.Dy()/h,
+				b.Min.X+(x+1)*b.Dx()/w, b.Min.Y+(y+1)*b.Dy()/h,
+			))
+		}
+	}
+	var hash uint64
+	for y := 0; y < h; y++ {
+		for x := 0; x < w-1; x++ {
+			hash <<= 1
+			if cells[y][x] > cells[y][x+1] {
+				hash |= 1
+			}
+		}
+	}
+	return fmt.Sprintf("%016x", hash)
+}
+
+// cellBrightness averages the brightness of up to 16x16 evenly spaced pixels in rect
+func cellBrightness(img image.Image, rect image.Rectangle) float64 {
+	const samples = 16
+	stepX, stepY := rect.Dx()/samples, rect.Dy()/samples
+	if stepX < 1 {
+		stepX = 1
+	}
+	if stepY < 1 {
+		stepY = 1
+	}
+	var total float64
+	var count int
+	for y := rect.Min.Y; y < rect.Max.Y; y += stepY {
+		for x := rect.Min.X; x < rect.Max.X; x += stepX {
+			r, g, b, _ := img.At(x, y).RGBA()
+			total += 0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)
+			count++
+		}
+	}
+	if count == 0 {
+		return 0
+	}
+	return total / float64(count)
+}
+
+func (ig *imageGorm) BySHA256(galleryID uint, sum string) (*Image, error) {
+	var image Image
+	if err := first(ig.db.Where("gallery_id = ? AND sha256 = ?", galleryID, sum), &image); err != nil {
+		return nil, err
+	}
+	return &image, nil
+}
+
+func (ig *imageGorm) HashedByUserID(userID uint) ([]Image, error) {
+	var images []Image
+	db := ig.db.Select("images.*").
+		Joins("JOIN galleries ON galleries.id = images.gallery_id").
+		Where("galleries.user_id = ? AND galleries.deleted_at IS NULL", userID).
+		Where("images.perceptual_hash <> ''").
+		Order("images.gallery_id, images.position, images.id")
+	if err := db.Find(&images).Error; err != nil {
+		return nil, err
+	}
+	return images, nil
+}
+
+func (ig *imageGorm) Unhashed(afterID uint, limit int) ([]Image, error) {
+	var images []Image
+	// Images hashed before sizes and placeholders were recorded have a perceptual hash but no width
+	db := ig.db.Where("(sha256 = '' OR (width = 0 AND perceptual_hash <> '')) AND id > ?", afterID).Order("id").Limit(limit)
+	if err := db.Find(&images).Error; err != nil {
+		return nil, err
+	}
+	return images, nil
+}
+
+func (ig *imageGorm) SetHashes(image *Image) error {
+	return ig.db.Model(&Image{ID: image.ID}).UpdateColumns(map[string]interface{}{
+		"sha256":          image.SHA256,
+		"perceptual_hash": image.PerceptualHash,
+		"width":           image.Width,
+		"height":          image.Height,
+		"blur_hash":       image.BlurHash,
+		"dominant_color":  image.DominantColor,
+	}).Error
+}
@@ -0,0 +1,131 @@
+package models
+
+import (
+	"math/bits"
+	"math/rand"
+	"sort"
+	"strconv"
+	"testing"
+)
+
+func TestGroupSimilar(t *testing.T) {
+	hashes := []uint64{
+		0x0,
+		0x0,                // the same as the first
+		0x7,                // 3 bits from the first
+		0x3f,               // 3 bits from the one before, 6 from the first
+		0xffff000000000000, // far from everything
+		0xffff00000000000f, // 4 bits from the one before
+		0x00ff00ff00ff00ff, // on its own
+	}
+	tests := []struct {
+		maxDistance int
+		want        [][]int
+	}{
+		{0, [][]int{{0, 1}}},
+		{3, [][]int{{0, 1, 2, 3}}},
+		{4, [][]int{{0, 1, 2, 3}, {4, 5}}},
+	}
+	for _, tt := range tests {
+		got := groupIndexes(groupSimilar(imagesWithHashes(hashes), tt.maxDistance))
+		if !equalGroups(got, tt.want) {
+			t.Errorf("groupSimilar(%d) = %v, want %v", tt.maxDistance, got, tt.want)
+		}
+	}
+}
+
+func TestGroupSimilarMatchesEveryPair(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	// Clusters of hashes a few bits apart, so there are groups to find at every distance
+	var hashes []uint64
+	for c := 0; c < 40; c++ {
+		centre := r.Uint64()
+		for i := r.Intn(8); i >= 0; i-- {
+			h := centre
+			for b := r.Intn(12); b > 0; b-- {
+				h ^= 1 << uint(r.Intn(64))
+			}
+			hashes = append(hashes, h)
+		}
+	}
+	images := imagesWithHashes(hashes)
+	for _, d := range []int{0, 3, DefaultSimilarDistance, MaxSimilarDistance} {
+		got := groupIndexes(groupSimilar(images, d))
+		want := pairwiseGroups(hashes, d)
+		if !equalGroups(got, want) {
+			t.Errorf("distance %d: groupSimilar = %v, want %v", d, got, want)
+		}
+	}
+}
+
+func imagesWithHashes(hashes []uint64) []Image {
+	images := make([]Image, len(hashes))
+	for i, h := range hashes {
+		images[i].ID = uint(i)
+		images[i].PerceptualHash = strconv.FormatUint(h, 16)
+	}
+	return images
+}
+
+// groupIndexes returns the IDs of the images in each group, sorted so groups can be compared
+func groupIndexes(groups []SimilarGroup) [][]int {
+	out := make([][]int, len(groups))
+	for i, g := range groups {
+		for _, image := range g.Images {
+			out[i] = append(out[i], int(image.ID))
+		}
+		sort.Ints(out[i])
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i][0] < out[j][0] })
+	return out
+}
+
+// pairwiseGroups groups hashes by comparing every pair, as Similar used to
+func pairwiseGroups(hashes []uint64, maxDistance int) [][]int {
+	group := make([]int, len(hashes))
+	for i := range group {
+		group[i] = i
+	}
+	for i := range hashes {
+		for j := i + 1; j < len(hashes); j++ {
+			if bits.OnesCount64(hashes[i]^hashes[j]) > maxDistance || group[i] == group[j] {
+				continue
+			}
+			from, to := group[j], group[i]
+			for k := range group {
+				if group[k] == from {
+					group[k] = to
+				}
+			}
+		}
+	}
+	byGroup := make(map[int][]int)
+	for i, g := range group {
+		byGroup[g] = append(byGroup[g], i)
+	}
+	var out [][]int
+	for _, members := range byGroup {
+		if len(members) > 1 {
+			out = append(out, members)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i][0] < out[j][0] })
+	return out
+}
+
+func equalGroups(a, b [][]int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if len(a[i]) != len(b[i]) {
+			return false
+		}
+		for j := range a[i] {
+			if a[i][j] != b[i][j] {
+				return false
+			}
+		}
+	}
+	return true
+}
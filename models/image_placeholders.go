@@ -0,0 +1,184 @@
+package models
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"strings"
+
+	xdraw "golang.org/x/image/draw"
+)
+
+const (
+	// placeholderSampleSize is the largest width or height images are shrunk to before their placeholders are worked out
+	placeholderSampleSize = 32
+	// blurHashComponents is how many cosine components a BlurHash has along an image's longer side
+	blurHashComponents = 4
+	// colorBits is how many bits of each channel are kept when counting which colour is most common
+	colorBits = 3
+)
+
+// base83 is the alphabet BlurHash strings are written in
+const base83 = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+// setPlaceholders works out what is shown in place of img while it loads, its BlurHash and dominant colour,
+// and stores them on image
+func setPlaceholders(image *Image, img image.Image) {
+	sample := placeholderSample(img)
+	image.BlurHash = blurHash(sample)
+	image.DominantColor = dominantColor(sample)
+}
+
+// placeholderSample shrinks img to at most placeholderSampleSize pixels on its longer side, which is all the
+// detail a placeholder needs
+func placeholderSample(img image.Image) *image.RGBA {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w > h && w > placeholderSampleSize {
+		w, h = placeholderSampleSize, int(math.Max(1, math.Round(float64(h)*placeholderSampleSize/float64(w))))
+	} else if h > placeholderSampleSize {
+		w, h = int(math.Max(1, math.Round(float64(w)*placeholderSampleSize/float64(h)))), placeholderSampleSize
+	}
+	sample := image.NewRGBA(image.Rect(0, 0, w, h))
+	xdraw.ApproxBiLinear.Scale(sample, sample.Bounds(), img, b, xdraw.Src, nil)
+	return sample
+}
+
+/*
+blurHash encodes img as a BlurHash (https://blurha.sh), a short string describing a blurred version of an
+image that browsers can draw while the image itself loads.
+
+The image is described by the average colour plus a few cosine components, blurHashComponents along its
+longer side and one fewer along its shorter side. Colours are worked out in linear light and each component
+is written in base 83.
+*/
+func blurHash(img *image.RGBA) string {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w == 0 || h == 0 {
+		return ""
+	}
+	cx, cy := blurHashComponents, blurHashComponents-1
+	if h > w {
+		cx, cy = cy, cx
+	}
+
+	factors := make([][3]float64, 0, cx*cy)
+	for j := 0; j < cy; j++ {
+		for i := 0; i < cx; i++ {
+			var f [3]float64
+			for y := 0; y < h; y++ {
+				for x := 0; x < w; x++ {
+					basis := math.Cos(math.Pi*float64(i*x)/float64(w)) * math.Cos(math.Pi*float64(j*y)/float64(h))
+					p := img.RGBAAt(b.Min.X+x, b.Min.Y+y)
+					f[0] += basis * srgbToLinear(p.R)
+					f[1] += basis * srgbToLinear(p.G)
+					f[2] += basis * srgbToLinear(p.B)
+				}
+			}
+			normalisation := 2.0
+			if i == 0 && j == 0 {
+				normalisation = 1
+			}
+			scale := normalisation / float64(w*h)
+			factors = append(factors, [3]float64{f[0] * scale, f[1] * scale, f[2] * scale})
+		}
+	}
+
+	var hash strings.Builder
+	writeBase83(&hash, (cx-1)+(cy-1)*9, 1)
+
+	dc, ac := factors[0], factors[1:]
+	maxValue := 1.0
+	if len(ac) > 0 {
+		actualMax := 0.0
+		for _, f := range ac {
+			actualMax = math.Max(actualMax, math.Max(math.Abs(f[0]), math.Max(math.Abs(f[1]), math.Abs(f[2]))))
+		}
+		quantisedMax := int(math.Max(0, math.Min(82, math.Floor(actualMax*166-0.5))))
+		maxValue = float64(quantisedMax+1) / 166
+		writeBase83(&hash, quantisedMax, 1)
+	} else {
+		writeBase83(&hash, 0, 1)
+	}
+
+	writeBase83(&hash, linearToSRGB(dc[0])<<16+linearToSRGB(dc[1])<<8+linearToSRGB(dc[2]), 4)
+	for _, f := range ac {
+		quant := func(v float64) int {
+			return int(math.Max(0, math.Min(18, math.Floor(signPow(v/maxValue, 0.5)*9+9.5))))
+		}
+		writeBase83(&hash, quant(f[0])*19*19+quant(f[1])*19+quant(f[2]), 2)
+	}
+	return hash.String()
+}
+
+// writeBase83 writes value to sb as length base 83 digits
+func writeBase83(sb *strings.Builder, value, length int) {
+	for i := 1; i <= length; i++ {
+		digit := (value / int(math.Pow(83, float64(length-i)))) % 83
+		sb.WriteByte(base83[digit])
+	}
+}
+
+// srgbToLinear converts an sRGB channel value to linear light from 0 to 1
+func srgbToLinear(c uint8) float64 {
+	v := float64(c) / 255
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+// linearToSRGB converts a linear light value to an sRGB channel value from 0 to 255
+func linearToSRGB(v float64) int {
+	v = math.Max(0, math.Min(1, v))
+	if v <= 0.0031308 {
+		return int(v*12.92*255 + 0.5)
+	}
+	return int((1.055*math.Pow(v, 1/2.4)-0.055)*255 + 0.5)
+}
+
+// signPow raises the magnitude of v to exp, keeping its sign
+func signPow(v, exp float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(v), exp), v)
+}
+
+// dominantColor returns the most common colour in img as a CSS hex colour, such as "#3a5f8c".
+// Similar colours are counted together and the result is their average. Mostly transparent pixels are ignored.
+func dominantColor(img *image.RGBA) string {
+	type bucket struct {
+		count   int
+		r, g, b int
+	}
+	buckets := make(map[int]*bucket)
+	var best *bucket
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			p := img.RGBAAt(x, y)
+			if p.A < 0x80 {
+				continue
+			}
+			// Undo the premultiplied alpha of partly transparent pixels
+			r, g, bl := int(p.R)*0xff/int(p.A), int(p.G)*0xff/int(p.A), int(p.B)*0xff/int(p.A)
+			const shift = 8 - colorBits
+			key := r>>shift<<(2*colorBits) | g>>shift<<colorBits | bl>>shift
+			bk := buckets[key]
+			if bk == nil {
+				bk = &bucket{}
+				buckets[key] = bk
+			}
+			bk.count++
+			bk.r += r
+			bk.g += g
+			bk.b += bl
+			if best == nil || bk.count > best.count {
+				best = bk
+			}
+		}
+	}
+	if best == nil {
+		return ""
+	}
+	return fmt.Sprintf("#%02x%02x%02x", best.r/best.count, best.g/best.count, best.b/best.count)
+}
@@ -0,0 +1,97 @@
+package models
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/curtisvermeeren/web-development-with-go/hash"
+)
+
+const (
+	// ErrSignatureInvalid is returned when a signed image URL has been tampered with or was signed with another key
+	ErrSignatureInvalid modelError = "models: image link is invalid"
+	// ErrSignatureExpired is returned when a signed image URL is used after it expires
+	ErrSignatureExpired modelError = "models: image link has expired"
+)
+
+/*
+ImageSigner signs image URLs so they can be loaded without a session until they expire, such as from a CDN
+or by someone viewing a private gallery through a share link.
+
+A signature is an HMAC of the URL's path, the Variant it asks for, if any, and its expiry time. Expiry times
+are rounded up so a page loaded several times in a row gets the same URLs, which lets browsers and CDNs cache them.
+*/
+type ImageSigner struct {
+	hmac hash.HMAC
+	ttl  time.Duration
+}
+
+// NewImageSigner creates an ImageSigner that signs URLs with key. Signed URLs last for at least ttl.
+func NewImageSigner(key string, ttl time.Duration) *ImageSigner {
+	return &ImageSigner{
+		hmac: hash.NewHMAC(key),
+		ttl:  ttl,
+	}
+}
+
+// Expiry returns when a URL signed now would expire: ttl from now rounded up to a multiple of half of ttl
+func (s *ImageSigner) Expiry(now time.Time) time.Time {
+	window := s.ttl / 2
+	if window <= 0 {
+		window = time.Second
+	}
+	return now.Add(s.ttl).Truncate(window).Add(window)
+}
+
+// Sign returns the signature of a URL with path and variant that expires at expires
+func (s *ImageSigner) Sign(path, variant string, expires time.Time) string {
+	return s.hmac.Hash(signingInput(path, variant, expires.Unix()))
+}
+
+// Verify checks the signature of a URL with path and variant, using its expires and sig query parameters, at now.
+// It returns ErrSignatureInvalid if the signature does not match and ErrSignatureExpired if it has expired.
+func (s *ImageSigner) Verify(path, variant string, query url.Values, now time.Time) error {
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil {
+		return ErrSignatureInvalid
+	}
+	if !s.hmac.Equal(signingInput(path, variant, expires), query.Get("sig")) {
+		return ErrSignatureInvalid
+	}
+	if now.Unix() > expires {
+		return ErrSignatureExpired
+	}
+	return nil
+}
+
+// SignedPath is the image's Path with a signature that lets anyone load the image until the signature expires
+func (i *Image) SignedPath(s *ImageSigner) string {
+	return s.signURL(i.Path(), "")
+}
+
+// SignedVariantPath is the image's VariantPath with a signature that lets anyone load the variant until the
+// signature expires. Variants that are not presets can only be loaded with a signature.
+func (i *Image) SignedVariantPath(s *ImageSigner, v Variant) string {
+	return s.signURL(i.VariantPath(v), v.String())
+}
+
+// signURL adds the expires and sig query parameters for variant to rawURL
+func (s *ImageSigner) signURL(rawURL, variant string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	expires := s.Expiry(time.Now())
+	q := u.Query()
+	q.Set("expires", strconv.FormatInt(expires.Unix(), 10))
+	q.Set("sig", s.Sign(u.Path, variant, expires))
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// signingInput is the text that is signed for a URL
+func signingInput(path, variant string, expires int64) string {
+	return fmt.Sprintf("%s\n%s\n%d", path, variant, expires)
+}
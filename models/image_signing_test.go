@@ -0,0 +1,83 @@
+package models
+
+import (
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestImageSignerVerify(t *testing.T) {
+	s := NewImageSigner("a key that is long enough to sign with", time.Hour)
+	now := time.Unix(1700000000, 0)
+	expires := s.Expiry(now)
+	signed := func(path, variant string, expires time.Time) url.Values {
+		return url.Values{
+			"expires": {strconv.FormatInt(expires.Unix(), 10)},
+			"sig":     {s.Sign(path, variant, expires)},
+		}
+	}
+	later := expires.Add(time.Hour)
+
+	tests := []struct {
+		name    string
+		path    string
+		variant string
+		query   url.Values
+		now     time.Time
+		want    error
+	}{
+		{"valid", "/images/galleries/1/a.jpg", "", signed("/images/galleries/1/a.jpg", "", expires), now, nil},
+		{"valid variant", "/img/1/a.jpg", "w=800", signed("/img/1/a.jpg", "w=800", expires), now, nil},
+		{"at expiry", "/images/galleries/1/a.jpg", "", signed("/images/galleries/1/a.jpg", "", expires), expires, nil},
+		{"expired", "/images/galleries/1/a.jpg", "", signed("/images/galleries/1/a.jpg", "", expires), expires.Add(time.Second), ErrSignatureExpired},
+		{"other path", "/images/galleries/2/a.jpg", "", signed("/images/galleries/1/a.jpg", "", expires), now, ErrSignatureInvalid},
+		{"other variant", "/img/1/a.jpg", "w=4000", signed("/img/1/a.jpg", "w=800", expires), now, ErrSignatureInvalid},
+		{"extended expiry", "/images/galleries/1/a.jpg", "", url.Values{
+			"expires": {strconv.FormatInt(later.Unix(), 10)},
+			"sig":     {s.Sign("/images/galleries/1/a.jpg", "", expires)},
+		}, now, ErrSignatureInvalid},
+		{"other key", "/images/galleries/1/a.jpg", "", url.Values{
+			"expires": {strconv.FormatInt(expires.Unix(), 10)},
+			"sig":     {NewImageSigner("another key that is long enough too", time.Hour).Sign("/images/galleries/1/a.jpg", "", expires)},
+		}, now, ErrSignatureInvalid},
+		{"no expiry", "/images/galleries/1/a.jpg", "", url.Values{"sig": {s.Sign("/images/galleries/1/a.jpg", "", expires)}}, now, ErrSignatureInvalid},
+		{"no signature", "/images/galleries/1/a.jpg", "", url.Values{"expires": {strconv.FormatInt(expires.Unix(), 10)}}, now, ErrSignatureInvalid},
+	}
+	for _, tt := range tests {
+		if got := s.Verify(tt.path, tt.variant, tt.query, tt.now); got != tt.want {
+			t.Errorf("%s: Verify = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestImageSignerExpiry(t *testing.T) {
+	s := NewImageSigner("key", time.Hour)
+	now := time.Unix(1700000000, 0)
+	expires := s.Expiry(now)
+	if expires.Before(now.Add(time.Hour)) || expires.After(now.Add(90*time.Minute)) {
+		t.Errorf("Expiry(%v) = %v, want between one hour and an hour and a half later", now, expires)
+	}
+	// Pages loaded a moment apart get the same URLs so they can be cached
+	if got := s.Expiry(now.Add(time.Minute)); !got.Equal(expires) {
+		t.Errorf("Expiry a minute later = %v, want %v", got, expires)
+	}
+	if got := s.Expiry(expires.Add(-time.Hour - time.Second)); !got.Equal(expires) {
+		t.Errorf("Expiry just before the window ends = %v, want %v", got, expires)
+	}
+}
+
+func TestSignedPathVerifies(t *testing.T) {
+	s := NewImageSigner("a key that is long enough to sign with", time.Hour)
+	image := Image{GalleryID: 1, Filename: "a b.jpg"}
+	u, err := url.Parse(image.SignedPath(s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Verify(u.Path, "", u.Query(), time.Now()); err != nil {
+		t.Errorf("Verify(%s) = %v, want nil", u, err)
+	}
+	if err := s.Verify(u.Path, "", u.Query(), time.Now().Add(2*time.Hour)); err != ErrSignatureExpired {
+		t.Errorf("Verify(%s) two hours later = %v, want %v", u, err, ErrSignatureExpired)
+	}
+}
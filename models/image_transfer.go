@@ -0,0 +1,312 @@
+package models
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/curtisvermeeren/web-development-with-go/rand"
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	// ErrNoImagesSelected is returned when a bulk action is requested without selecting any images
+	ErrNoImagesSelected modelError = "models: no images were selected"
+	// ErrSameGallery is returned when images are moved or copied into the gallery they are already in
+	ErrSameGallery modelError = "models: images are already in that gallery"
+)
+
+// stagedImage is an image file that has been written to its destination gallery but not yet recorded there
+type stagedImage struct {
+	source Image
+	dest   Image
+	path   string
+}
+
+// Move moves the images with filenames from the gallery srcID to the gallery dstID and returns them as they are now.
+// Images keep their captions and alt text and are added to the end of the destination. Filenames that are already
+// taken in the destination are given a numbered suffix.
+//
+// The move happens in stages so a failure part way never loses or half-moves an image: the files are first copied
+// into the destination, then the image records are updated in a single transaction, and only then are the original
+// files removed. If copying or the transaction fails, every copied file is removed and the source is left untouched.
+func (is *imageService) Move(srcID uint, filenames []string, dstID uint) ([]Image, error) {
+	return is.transfer(srcID, filenames, dstID, true)
+}
+
+// Copy copies the images with filenames from the gallery srcID to the gallery dstID.
+// It is all or nothing in the same way as Move, and leaves the source gallery unchanged.
+func (is *imageService) Copy(srcID uint, filenames []string, dstID uint) ([]Image, error) {
+	return is.transfer(srcID, filenames, dstID, false)
+}
+
+func (is *imageService) transfer(srcID uint, filenames []string, dstID uint, move bool) ([]Image, error) {
+	if len(filenames) == 0 {
+		return nil, ErrNoImagesSelected
+	}
+	if srcID == dstID {
+		return nil, ErrSameGallery
+	}
+
+	sources, err := is.selected(srcID, filenames)
+	if err != nil {
+		return nil, err
+	}
+	existing, err := is.ByGalleryID(dstID)
+	if err != nil {
+		return nil, err
+	}
+	dstPath, err := is.makeImagePath(dstID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Copies, and moves to another user's gallery, count towards the destination owner's quota
+	srcOwner, err := is.ImageDB.OwnerID(srcID)
+	if err != nil {
+		return nil, err
+	}
+	dstOwner, err := is.ImageDB.OwnerID(dstID)
+	if err != nil {
+		return nil, err
+	}
+	var bytes int64
+	for _, src := range sources {
+		info, err := os.Stat(src.RelativePath())
+		if err != nil {
+			return nil, err
+		}
+		bytes += info.Size()
+	}
+	counted := !move || srcOwner != dstOwner
+	if counted {
+		if err := is.usage.Reserve(dstOwner, bytes, len(sources)); err != nil {
+			return nil, err
+		}
+	}
+
+	taken := make(map[string]bool, len(existing)+len(sources))
+	for _, img := range existing {
+		taken[img.Filename] = true
+	}
+	position := nextPosition(existing)
+
+	// Stage 1: write every file under a hidden temporary name, which ByGalleryID ignores
+	staged := make([]stagedImage, 0, len(sources))
+	cleanup := func() {
+		for _, s := range staged {
+			os.Remove(s.path)
+		}
+		if counted {
+			is.usage.Release(dstOwner, bytes, len(sources))
+		}
+	}
+	for _, src := range sources {
+		dest := src
+		dest.GalleryID = dstID
+		dest.Filename = uniqueFilename(taken, src.Filename)
+		dest.Position = position
+		dest.Cover = false
+		taken[dest.Filename] = true
+		position++
+
+		tmp, err := stageFile(src.RelativePath(), dstPath)
+		if err != nil {
+			cleanup()
+			return nil, err
+		}
+		staged = append(staged, stagedImage{source: src, dest: dest, path: tmp})
+	}
+
+	// Stage 2: give the files their real names. Renames within a directory are atomic.
+	for i, s := range staged {
+		final := filepath.Join(dstPath, s.dest.Filename)
+		if err := os.Rename(s.path, final); err != nil {
+			cleanup()
+			return nil, err
+		}
+		staged[i].path = final
+	}
+
+	// Stage 3: record the images in the destination in one transaction
+	dests := make([]Image, len(staged))
+	for i, s := range staged {
+		dests[i] = s.dest
+	}
+	if move {
+		err = is.ImageDB.MoveAll(dests)
+	} else {
+		for i := range dests {
+			dests[i].ID = 0
+		}
+		err = is.ImageDB.CopyAll(sources, dests)
+	}
+	if err != nil {
+		cleanup()
+		return nil, err
+	}
+
+	// Stage 4: the destination is complete, so the originals of moved images can go.
+	// A failure here only leaves a stray file behind, which is logged rather than undoing the move.
+	if move {
+		for _, s := range staged {
+			if err := os.Remove(s.source.RelativePath()); err != nil && !os.IsNotExist(err) {
+				log.Println("images: could not remove moved image:", err)
+			}
+		}
+		if counted {
+			if err := is.usage.Release(srcOwner, bytes, len(sources)); err != nil {
+				log.Println("images: could not update usage:", err)
+			}
+		}
+	}
+	return dests, nil
+}
+
+// selected returns the images of a gallery with the given filenames, in gallery order
+func (is *imageService) selected(galleryID uint, filenames []string) ([]Image, error) {
+	images, err := is.ByGalleryID(galleryID)
+	if err != nil {
+		return nil, err
+	}
+	want := make(map[string]bool, len(filenames))
+	for _, filename := range filenames {
+		want[filename] = true
+	}
+	var ret []Image
+	for _, img := range images {
+		if want[img.Filename] {
+			ret = append(ret, img)
+			delete(want, img.Filename)
+		}
+	}
+	if len(want) > 0 {
+		return nil, ErrNotFound
+	}
+	return ret, nil
+}
+
+// stageFile copies the file at src into dir under a hidden temporary name and returns its path
+func stageFile(src, dir string) (string, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+
+	token, err := rand.String(12)
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, ".transfer-"+token)
+	out, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(path)
+		return "", err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(path)
+		return "", err
+	}
+	return path, nil
+}
+
+// uniqueFilename returns filename, or filename with a numbered suffix such as "photo-2.jpg" if it is taken
+func uniqueFilename(taken map[string]bool, filename string) string {
+	if !taken[filename] {
+		return filename
+	}
+	ext := filepath.Ext(filename)
+	base := strings.TrimSuffix(filename, ext)
+	for n := 2; ; n++ {
+		candidate := fmt.Sprintf("%s-%d%s", base, n, ext)
+		if !taken[candidate] {
+			return candidate
+		}
+	}
+}
+
+// CopyAll adds copies, the records of new images copied from sources, in a single transaction.
+// Each copy is given the tags of the source at the same index.
+func (ig *imageGorm) CopyAll(sources, copies []Image) error {
+	return ig.db.Transaction(func(tx *gorm.DB) error {
+		for i := range copies {
+			if err := tx.Create(&copies[i]).Error; err != nil {
+				return err
+			}
+			err := tx.Exec(`INSERT INTO image_tags (image_id, tag_id) SELECT ?, tag_id FROM image_tags WHERE image_id = ?`,
+				copies[i].ID, sources[i].ID).Error
+			if err != nil {
+				return err
+			}
+			if err := indexImage(tx, copies[i].ID); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// MoveAll saves the new gallery, filename, position and cover flag of several images, and moves their comments
+// with them, in a single transaction. Images are taken out of selections made from the galleries they leave.
+func (ig *imageGorm) MoveAll(images []Image) error {
+	return ig.db.Transaction(func(tx *gorm.DB) error {
+		for _, img := range images {
+			db := tx.Model(&Image{}).Where("id = ?", img.ID)
+			err := db.Updates(map[string]interface{}{
+				"gallery_id": img.GalleryID,
+				"filename":   img.Filename,
+				"position":   img.Position,
+				"cover":      img.Cover,
+			}).Error
+			if err != nil {
+				return err
+			}
+			// Comments on the image follow it, and notify the owner of the gallery it moved to
+			err = tx.Model(&Comment{}).Where("image_id = ?", img.ID).Updates(map[string]interface{}{
+				"gallery_id": img.GalleryID,
+				"owner_id":   gorm.Expr("(SELECT user_id FROM galleries WHERE id = ?)", img.GalleryID),
+			}).Error
+			if err != nil {
+				return err
+			}
+			selections := tx.Model(&Selection{}).Select("id").Where("gallery_id = ?", img.GalleryID).QueryExpr()
+			err = tx.Where("image_id = ? AND selection_id NOT IN (?)", img.ID, selections).Delete(&Favourite{}).Error
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (iv *imageValidator) CopyAll(sources, copies []Image) error {
+	for i := range copies {
+		err := runImageValFns(&copies[i],
+			galleryIDRequired,
+			filenameSafe,
+			normalizeImageText,
+			captionMaxLength,
+			altTextMaxLength)
+		if err != nil {
+			return err
+		}
+	}
+	return iv.ImageDB.CopyAll(sources, copies)
+}
+
+func (iv *imageValidator) MoveAll(images []Image) error {
+	for i := range images {
+		if err := runImageValFns(&images[i], galleryIDRequired, filenameSafe); err != nil {
+			return err
+		}
+	}
+	return iv.ImageDB.MoveAll(images)
+}
@@ -0,0 +1,278 @@
+package models
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"math"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+
+	xdraw "golang.org/x/image/draw"
+)
+
+const (
+	// ErrVariantInvalid is returned when the size, fit or format asked for an image is not allowed
+	ErrVariantInvalid modelError = "models: image size or format is invalid"
+	// ErrFormatUnsupported is returned when an image is asked for in a format this server cannot write
+	ErrFormatUnsupported modelError = "models: image format is not supported"
+
+	// maxVariantSize is the largest width or height an image can be resized to
+	maxVariantSize = 4096
+	// maxVariantPixels stops variants being made of images too large to decode comfortably
+	maxVariantPixels = 40000000
+	// jpegQuality is the quality JPEG variants are written with
+	jpegQuality = 85
+)
+
+// Fit is how an image is resized to a width and height with a different aspect ratio
+type Fit string
+
+const (
+	// FitContain shrinks the image to fit inside the width and height, keeping all of it
+	FitContain Fit = "contain"
+	// FitCover shrinks the image to fill the width and height and crops whatever is left over from its centre
+	FitCover Fit = "cover"
+)
+
+// Image formats a variant can be written in
+const (
+	FormatJPEG = "jpeg"
+	FormatPNG  = "png"
+	FormatWebP = "webp"
+)
+
+/*
+Variant is a resized or converted version of an image, made when it is first asked for.
+
+Images are never enlarged. A Width or Height of 0 leaves that side to follow the aspect ratio, and an empty
+Format keeps the original image's format. Variants can be one of the VariantPresets, which anyone who can
+view an image may ask for, or any other size, which needs a signed URL so the server cannot be made to
+resize images to every size there is.
+*/
+type Variant struct {
+	// Preset is the name of the preset the variant is, if any
+	Preset string
+	Width  int
+	Height int
+	Fit    Fit
+	Format string
+}
+
+// VariantPresets are the variants anyone who can view an image may ask for without a signed URL
+var VariantPresets = map[string]Variant{
+	"thumb":  {Preset: "thumb", Width: 480, Fit: FitContain},
+	"square": {Preset: "square", Width: 400, Height: 400, Fit: FitCover},
+	"medium": {Preset: "medium", Width: 1200, Height: 1200, Fit: FitContain},
+	"large":  {Preset: "large", Width: 2048, Height: 2048, Fit: FitContain},
+}
+
+/*
+ParseVariant reads a variant from the query parameters of an image URL. A preset is asked for by name with
+preset, and any other variant with w and h for its size, fit for how it fits that size and fmt for its format.
+It returns ErrVariantInvalid if the parameters do not describe a variant that can be made.
+*/
+func ParseVariant(query url.Values) (Variant, error) {
+	if name := query.Get("preset"); name != "" {
+		v, ok := VariantPresets[name]
+		if !ok || query.Get("w") != "" || query.Get("h") != "" || query.Get("fit") != "" || query.Get("fmt") != "" {
+			return Variant{}, ErrVariantInvalid
+		}
+		return v, nil
+	}
+
+	var v Variant
+	var err error
+	if v.Width, err = variantSize(query.Get("w")); err != nil {
+		return Variant{}, err
+	}
+	if v.Height, err = variantSize(query.Get("h")); err != nil {
+		return Variant{}, err
+	}
+	if v.Width == 0 && v.Height == 0 {
+		return Variant{}, ErrVariantInvalid
+	}
+	switch fit := Fit(query.Get("fit")); fit {
+	case "", FitContain:
+		v.Fit = FitContain
+	case FitCover:
+		v.Fit = FitCover
+	default:
+		return Variant{}, ErrVariantInvalid
+	}
+	switch format := strings.ToLower(query.Get("fmt")); format {
+	case "":
+	case "jpg", FormatJPEG:
+		v.Format = FormatJPEG
+	case FormatPNG:
+		v.Format = FormatPNG
+	case FormatWebP:
+		if !webpSupported {
+			return Variant{}, ErrFormatUnsupported
+		}
+		v.Format = FormatWebP
+	default:
+		return Variant{}, ErrVariantInvalid
+	}
+	return v, nil
+}
+
+// variantSize parses a width or height, which may be left out
+func variantSize(s string) (int, error) {
+	if s == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 || n > maxVariantSize {
+		return 0, ErrVariantInvalid
+	}
+	return n, nil
+}
+
+// Query returns the query parameters that ask for the variant
+func (v Variant) Query() url.Values {
+	if v.Preset != "" {
+		return url.Values{"preset": {v.Preset}}
+	}
+	q := url.Values{}
+	if v.Width > 0 {
+		q.Set("w", strconv.Itoa(v.Width))
+	}
+	if v.Height > 0 {
+		q.Set("h", strconv.Itoa(v.Height))
+	}
+	if v.Fit != "" && v.Fit != FitContain {
+		q.Set("fit", string(v.Fit))
+	}
+	if v.Format != "" {
+		q.Set("fmt", v.Format)
+	}
+	return q
+}
+
+// String is the variant's query parameters in a fixed order, which is what signatures for the variant cover
+func (v Variant) String() string {
+	return v.Query().Encode()
+}
+
+// VariantPath is the URL the variant of the image is served from. Like Path, it includes the image's Version
+// once the image has been hashed.
+func (i *Image) VariantPath(v Variant) string {
+	q := v.Query()
+	if version := i.Version(); version != "" {
+		q.Set("v", version)
+	}
+	temp := url.URL{
+		Path:     fmt.Sprintf("/img/%d/%s", i.GalleryID, i.Filename),
+		RawQuery: q.Encode(),
+	}
+	return temp.String()
+}
+
+// ThumbPath is the URL of the image's thumbnail preset
+func (i *Image) ThumbPath() string {
+	return i.VariantPath(VariantPresets["thumb"])
+}
+
+// format is the format the variant of the image with filename is written in
+func (v Variant) format(filename string) string {
+	if v.Format != "" {
+		return v.Format
+	}
+	if ext := strings.ToLower(path.Ext(filename)); ext == ".png" {
+		return FormatPNG
+	}
+	return FormatJPEG
+}
+
+// formatExt is the file extension of an image format
+func formatExt(format string) string {
+	switch format {
+	case FormatPNG:
+		return ".png"
+	case FormatWebP:
+		return ".webp"
+	}
+	return ".jpg"
+}
+
+// decodeVariantSource reads the image a variant is made from, refusing images with too many pixels
+func decodeVariantSource(r io.ReadSeeker) (image.Image, error) {
+	config, _, err := image.DecodeConfig(r)
+	if err != nil {
+		return nil, err
+	}
+	if config.Width*config.Height > maxVariantPixels {
+		return nil, fmt.Errorf("models: image is too large to resize: %dx%d", config.Width, config.Height)
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	img, _, err := image.Decode(r)
+	return img, err
+}
+
+// transform resizes src to v. Images written as JPEG are drawn over white, since JPEG has no transparency.
+func (v Variant) transform(src image.Image, format string) *image.RGBA {
+	b := src.Bounds()
+	crop, width, height := v.layout(b.Dx(), b.Dy())
+	crop = crop.Add(b.Min)
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	op := xdraw.Src
+	if format == FormatJPEG {
+		draw.Draw(dst, dst.Bounds(), image.White, image.Point{}, draw.Src)
+		op = xdraw.Over
+	}
+	xdraw.CatmullRom.Scale(dst, dst.Bounds(), src, crop, op, nil)
+	return dst
+}
+
+// layout works out which part of an image of srcW by srcH pixels the variant shows and the size it is drawn at
+func (v Variant) layout(srcW, srcH int) (image.Rectangle, int, int) {
+	crop := image.Rect(0, 0, srcW, srcH)
+	sw, sh := float64(srcW), float64(srcH)
+	w, h := float64(v.Width), float64(v.Height)
+
+	var scale float64
+	switch {
+	case w == 0:
+		scale = h / sh
+	case h == 0:
+		scale = w / sw
+	case v.Fit == FitCover:
+		// Crop the centre of the image to the variant's aspect ratio, then scale that to fill it
+		if sw/sh > w/h {
+			cw := int(math.Round(sh * w / h))
+			crop = image.Rect((srcW-cw)/2, 0, (srcW-cw)/2+cw, srcH)
+		} else {
+			ch := int(math.Round(sw * h / w))
+			crop = image.Rect(0, (srcH-ch)/2, srcW, (srcH-ch)/2+ch)
+		}
+		scale = w / float64(crop.Dx())
+	default:
+		scale = math.Min(w/sw, h/sh)
+	}
+	if scale > 1 {
+		scale = 1
+	}
+	width := int(math.Max(1, math.Round(float64(crop.Dx())*scale)))
+	height := int(math.Max(1, math.Round(float64(crop.Dy())*scale)))
+	return crop, width, height
+}
+
+// encodeVariant writes img to w in format
+func encodeVariant(w io.Writer, img image.Image, format string) error {
+	switch format {
+	case FormatPNG:
+		return png.Encode(w, img)
+	case FormatWebP:
+		return encodeWebP(w, img)
+	}
+	return jpeg.Encode(w, img, &jpeg.Options{Quality: jpegQuality})
+}
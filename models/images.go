@@ -1,73 +1,403 @@
 package models
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"net/url"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/curtisvermeeren/web-development-with-go/rand"
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	// ErrFilenameInvalid is returned when an image filename is empty or contains a path
+	ErrFilenameInvalid modelError = "models: image filename is invalid"
+	// ErrCaptionTooLong is returned when an image caption exceeds maxCaptionLen
+	ErrCaptionTooLong modelError = "models: caption must be at most 1000 characters long"
+	// ErrAltTextTooLong is returned when an image's alt text exceeds maxAltTextLen
+	ErrAltTextTooLong modelError = "models: alt text must be at most 250 characters long"
+
+	maxCaptionLen = 1000
+	maxAltTextLen = 250
+	// imageVersionLen is how many hex digits of an image's SHA-256 hash are used as its version
+	imageVersionLen = 16
 )
 
+// Image is a file stored in a gallery's image directory along with the metadata saved for it in the database
+type Image struct {
+	ID        uint   `gorm:"primary_key"`
+	GalleryID uint   `gorm:"not null;unique_index:idx_images_gallery_filename"`
+	Filename  string `gorm:"not null;unique_index:idx_images_gallery_filename"`
+	Position  int    `gorm:"not null;default:0"`
+	Cover     bool   `gorm:"not null;default:false"`
+	Caption   string `gorm:"type:text"`
+	AltText   string
+	// SHA256 is the hex encoded SHA-256 hash of the file, used to find exact duplicates
+	SHA256 string `gorm:"column:sha256;not null;default:'';index"`
+	// PerceptualHash is a hex encoded hash of what the image looks like, used to find similar photos.
+	// It is empty if the image could not be decoded.
+	PerceptualHash string `gorm:"not null;default:''"`
+	// Width and Height are the image's size in pixels, or 0 if it could not be decoded
+	Width  int `gorm:"not null;default:0"`
+	Height int `gorm:"not null;default:0"`
+	// BlurHash describes a blurred version of the image that is drawn in its place while it loads
+	BlurHash string `gorm:"not null;default:''"`
+	// DominantColor is the image's most common colour as a CSS hex colour, shown before its BlurHash is drawn
+	DominantColor string `gorm:"not null;default:''"`
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+	Tags          []Tag `gorm:"-"`
+}
+
+// ImageService is used to store image files for a gallery and manage their captions, alt text and ordering
 type ImageService interface {
 	Create(galleryID uint, r io.Reader, filename string) error
 	ByGalleryID(galleryID uint) ([]Image, error)
+	// ByGalleryIDs returns the images of several galleries, keyed by gallery ID, for listing them
+	ByGalleryIDs(galleryIDs []uint) (map[uint][]Image, error)
+	ByFilename(galleryID uint, filename string) (*Image, error)
+	Update(image *Image) error
+	Reorder(galleryID uint, filenames []string) error
+	SetCover(galleryID uint, filename string) error
+	Move(srcID uint, filenames []string, dstID uint) ([]Image, error)
+	Copy(srcID uint, filenames []string, dstID uint) ([]Image, error)
+	// FindDuplicate returns the image in a gallery with the same content as r, or nil if there is none
+	FindDuplicate(galleryID uint, r io.ReadSeeker) (*Image, error)
+	// Similar groups a user's images that look alike
+	Similar(userID uint, maxDistance int) ([]SimilarGroup, error)
+	// HashMissing computes the hashes of images stored before hashes were recorded
+	HashMissing() (int, error)
+	// EXIF returns a summary of the camera settings recorded in an image, or nil if there are none
+	EXIF(image *Image) (*EXIF, error)
+	// DeleteMany deletes the images of a gallery with filenames, reporting the outcome for each one
+	DeleteMany(galleryID uint, filenames []string) ImageResults
+	// UpdateMany applies update to each of the images of a gallery with filenames and saves them,
+	// reporting the outcome for each one
+	UpdateMany(galleryID uint, filenames []string, update func(*Image)) ImageResults
 	Delete(i *Image) error
+	DeleteAll(galleryID uint) error
 }
 
-type imageService struct{}
+// ImageDB is used to interact with the images table
+type ImageDB interface {
+	ByGalleryID(galleryID uint) ([]Image, error)
+	ByGalleryIDs(galleryIDs []uint) ([]Image, error)
+	ByFilename(galleryID uint, filename string) (*Image, error)
+	Create(image *Image) error
+	Update(image *Image) error
+	Delete(id uint) error
+	DeleteByGalleryID(galleryID uint) error
+	SetPositions(galleryID uint, ids []uint) error
+	SetCover(galleryID, id uint) error
+	CopyAll(sources, copies []Image) error
+	MoveAll(images []Image) error
+	BySHA256(galleryID uint, sum string) (*Image, error)
+	// HashedByUserID returns the images in a user's galleries that have a perceptual hash
+	HashedByUserID(userID uint) ([]Image, error)
+	// Unhashed returns up to limit images with IDs after afterID whose hashes or placeholders have not been computed
+	Unhashed(afterID uint, limit int) ([]Image, error)
+	// SetHashes saves the hashes, size and placeholders of an image
+	SetHashes(image *Image) error
+	// OwnerID returns the ID of the user who owns a gallery, even if it is in the trash
+	OwnerID(galleryID uint) (uint, error)
+}
+
+type imageService struct {
+	ImageDB
+	usage UsageService
+	// placeMu is held while an uploaded file is moved into place, so the size of any file it replaces
+	// cannot change between being measured and being replaced
+	placeMu sync.Mutex
+}
 
-func NewImageService() ImageService {
-	return &imageService{}
+// NewImageService creates an ImageService storing files on disk and image records in db.
+// Stored files are counted towards their owner's usage.
+func NewImageService(db *gorm.DB, usage UsageService) ImageService {
+	return &imageService{
+		ImageDB: &imageValidator{
+			ImageDB: &imageGorm{
+				db: db,
+			},
+		},
+		usage: usage,
+	}
 }
 
+// Create writes the image file to the gallery's directory and adds it to the end of the gallery.
+// Uploading a file with the same name as an existing image replaces the file but keeps its metadata.
+// The file is counted towards the gallery owner's usage, and ErrStorageQuota or ErrImageQuota is returned
+// without storing it if it does not fit in their quota.
 func (is *imageService) Create(galleryID uint, r io.Reader, filename string) error {
+	image := Image{
+		GalleryID: galleryID,
+		Filename:  filename,
+	}
+	if err := runImageValFns(&image, filenameSafe); err != nil {
+		return err
+	}
+	ownerID, err := is.ImageDB.OwnerID(galleryID)
+	if err != nil {
+		return err
+	}
+
 	path, err := is.makeImagePath(galleryID)
 	if err != nil {
 		return err
 	}
 
-	destination, err := os.Create(filepath.Join(path, filename))
+	// Write to a hidden temporary file first so an upload over quota never replaces an existing image
+	token, err := rand.String(12)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.OpenFile(filepath.Join(path, ".upload-"+token), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, h), r)
 	if err != nil {
 		return err
 	}
-	defer destination.Close()
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	image.SHA256 = hex.EncodeToString(h.Sum(nil))
+	describeImage(tmp, &image)
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := is.place(ownerID, tmp.Name(), image.RelativePath(), size); err != nil {
+		return err
+	}
 
-	_, err = io.Copy(destination, r)
+	existing, err := is.ImageDB.ByFilename(galleryID, image.Filename)
+	if err == nil {
+		image.ID = existing.ID
+		return is.ImageDB.SetHashes(&image)
+	}
+	if err != ErrNotFound {
+		return err
+	}
+	images, err := is.ImageDB.ByGalleryID(galleryID)
 	if err != nil {
 		return err
 	}
+	image.Position = nextPosition(images)
+	return is.ImageDB.Create(&image)
+}
 
+// place moves the file at tmp, which is size bytes long, to path and counts it towards the owner's usage.
+// Replacing a file only counts the difference in size. Uploads to the same path at the same time
+// are placed one after the other so each is counted against the file it really replaces.
+func (is *imageService) place(ownerID uint, tmp, path string, size int64) error {
+	is.placeMu.Lock()
+	defer is.placeMu.Unlock()
+	addedBytes, addedImages := size, 1
+	if info, err := os.Stat(path); err == nil {
+		addedBytes -= info.Size()
+		addedImages = 0
+	}
+	if err := is.usage.Reserve(ownerID, addedBytes, addedImages); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		is.usage.Release(ownerID, addedBytes, addedImages)
+		return err
+	}
 	return nil
 }
 
+// ByGalleryID returns the images of a gallery in display order.
+// Files on disk that have no record yet, such as those uploaded before images were stored in the database, are added to the end.
+// Records whose file no longer exists are left out.
 func (is *imageService) ByGalleryID(galleryID uint) ([]Image, error) {
-	path := is.imagePath(galleryID)
-	strings, err := filepath.Glob(filepath.Join(path, "*"))
+	files, err := is.filenames(galleryID)
+	if err != nil {
+		return nil, err
+	}
+	records, err := is.ImageDB.ByGalleryID(galleryID)
 	if err != nil {
 		return nil, err
 	}
 
-	ret := make([]Image, len(strings))
-	for i, imgStr := range strings {
-		ret[i] = Image{
-			Filename:  filepath.Base(imgStr),
+	onDisk := make(map[string]bool, len(files))
+	for _, filename := range files {
+		onDisk[filename] = true
+	}
+
+	ret := make([]Image, 0, len(files))
+	known := make(map[string]bool, len(records))
+	for _, img := range records {
+		known[img.Filename] = true
+		if onDisk[img.Filename] {
+			ret = append(ret, img)
+		}
+	}
+
+	position := nextPosition(records)
+	for _, filename := range files {
+		if known[filename] {
+			continue
+		}
+		img := Image{
 			GalleryID: galleryID,
+			Filename:  filename,
+			Position:  position,
+		}
+		if err := is.ImageDB.Create(&img); err != nil {
+			return nil, err
 		}
+		ret = append(ret, img)
+		position++
 	}
 
 	return ret, nil
 }
 
+// ByGalleryIDs returns the images of several galleries in display order with one query.
+// Unlike ByGalleryID it only reads the database, so it is cheap enough for pages listing many galleries.
+func (is *imageService) ByGalleryIDs(galleryIDs []uint) (map[uint][]Image, error) {
+	ret := make(map[uint][]Image, len(galleryIDs))
+	if len(galleryIDs) == 0 {
+		return ret, nil
+	}
+	images, err := is.ImageDB.ByGalleryIDs(galleryIDs)
+	if err != nil {
+		return nil, err
+	}
+	for _, img := range images {
+		ret[img.GalleryID] = append(ret[img.GalleryID], img)
+	}
+	return ret, nil
+}
+
+// Reorder sets the position of each image in the gallery to the order of filenames.
+// Images that are not listed keep their relative order after the listed ones.
+func (is *imageService) Reorder(galleryID uint, filenames []string) error {
+	images, err := is.ByGalleryID(galleryID)
+	if err != nil {
+		return err
+	}
+	order := make(map[string]int, len(filenames))
+	for i, filename := range filenames {
+		if _, ok := order[filename]; !ok {
+			order[filename] = i
+		}
+	}
+	sort.SliceStable(images, func(i, j int) bool {
+		oi, iok := order[images[i].Filename]
+		oj, jok := order[images[j].Filename]
+		switch {
+		case iok && jok:
+			return oi < oj
+		default:
+			return iok && !jok
+		}
+	})
+
+	ids := make([]uint, len(images))
+	for i, img := range images {
+		ids[i] = img.ID
+	}
+	return is.ImageDB.SetPositions(galleryID, ids)
+}
+
+// SetCover marks the image with filename as the gallery's cover image
+func (is *imageService) SetCover(galleryID uint, filename string) error {
+	image, err := is.ImageDB.ByFilename(galleryID, filename)
+	if err != nil {
+		return err
+	}
+	return is.ImageDB.SetCover(galleryID, image.ID)
+}
+
+// Delete removes the image file and its record
 func (is *imageService) Delete(i *Image) error {
-	return os.Remove(i.RelativePath())
+	if err := runImageValFns(i, filenameSafe); err != nil {
+		return err
+	}
+	ownerID, err := is.ImageDB.OwnerID(i.GalleryID)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(i.RelativePath())
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(i.RelativePath()); err != nil {
+		return err
+	}
+	if err := is.usage.Release(ownerID, info.Size(), 1); err != nil {
+		return err
+	}
+	image, err := is.ImageDB.ByFilename(i.GalleryID, i.Filename)
+	if err == ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return is.ImageDB.Delete(image.ID)
+}
+
+// DeleteAll removes every image stored for a gallery along with its directory
+func (is *imageService) DeleteAll(galleryID uint) error {
+	ownerID, err := is.ImageDB.OwnerID(galleryID)
+	if err != nil {
+		return err
+	}
+	bytes, images, err := galleryDiskUsage(galleryID)
+	if err != nil {
+		return err
+	}
+	if err := os.RemoveAll(is.imagePath(galleryID)); err != nil {
+		return err
+	}
+	if err := is.usage.Release(ownerID, bytes, images); err != nil {
+		return err
+	}
+	return is.ImageDB.DeleteByGalleryID(galleryID)
+}
+
+// filenames lists the image files in a gallery's directory in name order.
+// Hidden files, which are used while images are being transferred, and directories are skipped.
+func (is *imageService) filenames(galleryID uint) ([]string, error) {
+	entries, err := os.ReadDir(is.imagePath(galleryID))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		names = append(names, entry.Name())
+	}
+	return names, nil
 }
 
 func (is *imageService) imagePath(galleryID uint) string {
-	return filepath.Join("images", "galleries", fmt.Sprintf("%v", galleryID))
+	return galleryImagePath(galleryID)
 }
 
 func (is *imageService) makeImagePath(galleryID uint) (string, error) {
-	galleryPath := filepath.Join("images", "galleries", fmt.Sprintf("%v", galleryID))
+	galleryPath := galleryImagePath(galleryID)
 	err := os.MkdirAll(galleryPath, 0755)
 	if err != nil {
 		return "", err
@@ -75,19 +405,249 @@ func (is *imageService) makeImagePath(galleryID uint) (string, error) {
 	return galleryPath, nil
 }
 
-type Image struct {
-	GalleryID uint
-	Filename  string
+// galleryImagePath is the directory a gallery's image files are stored in
+func galleryImagePath(galleryID uint) string {
+	return filepath.Join("images", "galleries", fmt.Sprintf("%v", galleryID))
+}
+
+// nextPosition returns the position after the last of images
+func nextPosition(images []Image) int {
+	position := 0
+	for _, img := range images {
+		if img.Position >= position {
+			position = img.Position + 1
+		}
+	}
+	return position
+}
+
+// imageGorm represents the database interaction layer for images
+type imageGorm struct {
+	db *gorm.DB
+}
+
+func (ig *imageGorm) ByGalleryID(galleryID uint) ([]Image, error) {
+	var images []Image
+	db := ig.db.Where("gallery_id = ?", galleryID).Order("position, id")
+	if err := db.Find(&images).Error; err != nil {
+		return nil, err
+	}
+	return images, nil
+}
+
+func (ig *imageGorm) ByGalleryIDs(galleryIDs []uint) ([]Image, error) {
+	var images []Image
+	db := ig.db.Where("gallery_id IN (?)", galleryIDs).Order("gallery_id, position, id")
+	if err := db.Find(&images).Error; err != nil {
+		return nil, err
+	}
+	return images, nil
+}
+
+func (ig *imageGorm) ByFilename(galleryID uint, filename string) (*Image, error) {
+	var image Image
+	db := ig.db.Where("gallery_id = ? AND filename = ?", galleryID, filename)
+	if err := first(db, &image); err != nil {
+		return nil, err
+	}
+	return &image, nil
+}
+
+func (ig *imageGorm) OwnerID(galleryID uint) (uint, error) {
+	var gallery Gallery
+	if err := first(ig.db.Unscoped().Select("user_id").Where("id = ?", galleryID), &gallery); err != nil {
+		return 0, err
+	}
+	return gallery.UserID, nil
+}
+
+func (ig *imageGorm) Create(image *Image) error {
+	if err := ig.db.Create(image).Error; err != nil {
+		return err
+	}
+	return indexImage(ig.db, image.ID)
+}
+
+func (ig *imageGorm) Update(image *Image) error {
+	if err := ig.db.Save(image).Error; err != nil {
+		return err
+	}
+	return indexImage(ig.db, image.ID)
 }
 
+func (ig *imageGorm) Delete(id uint) error {
+	return ig.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("image_id = ?", id).Delete(&ImageTag{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("image_id = ?", id).Delete(&Comment{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("image_id = ?", id).Delete(&Favourite{}).Error; err != nil {
+			return err
+		}
+		image := Image{ID: id}
+		return tx.Delete(&image).Error
+	})
+}
+
+func (ig *imageGorm) DeleteByGalleryID(galleryID uint) error {
+	return ig.db.Transaction(func(tx *gorm.DB) error {
+		ids := tx.Model(&Image{}).Select("id").Where("gallery_id = ?", galleryID).QueryExpr()
+		if err := tx.Where("image_id IN (?)", ids).Delete(&ImageTag{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("image_id IN (?)", ids).Delete(&Comment{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("image_id IN (?)", ids).Delete(&Favourite{}).Error; err != nil {
+			return err
+		}
+		return tx.Where("gallery_id = ?", galleryID).Delete(&Image{}).Error
+	})
+}
+
+// SetPositions numbers the images with ids from zero in the order given, in a single transaction
+func (ig *imageGorm) SetPositions(galleryID uint, ids []uint) error {
+	return ig.db.Transaction(func(tx *gorm.DB) error {
+		for position, id := range ids {
+			db := tx.Model(&Image{}).Where("id = ? AND gallery_id = ?", id, galleryID)
+			if err := db.UpdateColumn("position", position).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// SetCover clears the cover flag on every image in the gallery and sets it on the image with id
+func (ig *imageGorm) SetCover(galleryID, id uint) error {
+	return ig.db.Transaction(func(tx *gorm.DB) error {
+		db := tx.Model(&Image{}).Where("gallery_id = ?", galleryID)
+		if err := db.UpdateColumn("cover", false).Error; err != nil {
+			return err
+		}
+		db = tx.Model(&Image{}).Where("id = ? AND gallery_id = ?", id, galleryID)
+		return db.UpdateColumn("cover", true).Error
+	})
+}
+
+// imageValidator represents the validation and normalization layer for images
+type imageValidator struct {
+	ImageDB
+}
+
+type imageValFn func(*Image) error
+
+func (iv *imageValidator) Create(image *Image) error {
+	err := runImageValFns(image,
+		galleryIDRequired,
+		filenameSafe,
+		normalizeImageText,
+		captionMaxLength,
+		altTextMaxLength)
+	if err != nil {
+		return err
+	}
+	return iv.ImageDB.Create(image)
+}
+
+func (iv *imageValidator) Update(image *Image) error {
+	err := runImageValFns(image,
+		galleryIDRequired,
+		filenameSafe,
+		normalizeImageText,
+		captionMaxLength,
+		altTextMaxLength)
+	if err != nil {
+		return err
+	}
+	return iv.ImageDB.Update(image)
+}
+
+func (iv *imageValidator) Delete(id uint) error {
+	if id <= 0 {
+		return ErrIDInvalid
+	}
+	return iv.ImageDB.Delete(id)
+}
+
+func runImageValFns(image *Image, fns ...imageValFn) error {
+	for _, fn := range fns {
+		if err := fn(image); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func galleryIDRequired(i *Image) error {
+	if i.GalleryID <= 0 {
+		return ErrIDInvalid
+	}
+	return nil
+}
+
+// filenameSafe makes sure a filename cannot escape the gallery's directory.
+// Names starting with a dot are reserved for files that are still being written.
+func filenameSafe(i *Image) error {
+	if i.Filename == "" || i.Filename != filepath.Base(i.Filename) ||
+		strings.HasPrefix(i.Filename, ".") || strings.ContainsAny(i.Filename, `/\`) {
+		return ErrFilenameInvalid
+	}
+	return nil
+}
+
+// normalizeImageText trims whitespace around the caption and alt text
+func normalizeImageText(i *Image) error {
+	i.Caption = strings.TrimSpace(i.Caption)
+	i.AltText = strings.TrimSpace(i.AltText)
+	return nil
+}
+
+func captionMaxLength(i *Image) error {
+	if len([]rune(i.Caption)) > maxCaptionLen {
+		return ErrCaptionTooLong
+	}
+	return nil
+}
+
+func altTextMaxLength(i *Image) error {
+	if len([]rune(i.AltText)) > maxAltTextLen {
+		return ErrAltTextTooLong
+	}
+	return nil
+}
+
+// Path is the URL the image is served from. Once the image has been hashed the URL includes its Version,
+// so the URL changes whenever the file does and browsers can cache each URL forever.
 func (i *Image) Path() string {
 	temp := url.URL{
 		Path: "/" + i.RelativePath(),
 	}
+	if v := i.Version(); v != "" {
+		temp.RawQuery = url.Values{"v": {v}}.Encode()
+	}
 	return temp.String()
 }
 
+// Version identifies the content of the image file, or is empty if the image has not been hashed
+func (i *Image) Version() string {
+	if len(i.SHA256) < imageVersionLen {
+		return ""
+	}
+	return i.SHA256[:imageVersionLen]
+}
+
 func (i *Image) RelativePath() string {
 	galleryID := fmt.Sprintf("%v", i.GalleryID)
 	return filepath.ToSlash(filepath.Join("images", "galleries", galleryID, i.Filename))
 }
+
+// Alt returns the image's alt text, falling back to its caption
+func (i *Image) Alt() string {
+	if i.AltText != "" {
+		return i.AltText
+	}
+	return i.Caption
+}
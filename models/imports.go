@@ -0,0 +1,415 @@
+package models
+
+import (
+	"archive/zip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/curtisvermeeren/web-development-with-go/jobs"
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	// ErrImportNotZip is returned when an uploaded import is not a ZIP archive
+	ErrImportNotZip modelError = "models: imports must be ZIP archives"
+	// ErrImportTooLarge is returned when an import has more than maxImportEntries files
+	ErrImportTooLarge modelError = "models: imports can contain at most 5000 files"
+
+	maxImportEntries   = 5000
+	maxImportEntrySize = 50 << 20 // 50 megabytes
+	maxImportNotes     = 200
+	// importAttempts is how many times an import is tried before it fails, such as when the database is unavailable
+	importAttempts = 3
+)
+
+// ImportStatus is the progress of an import
+type ImportStatus string
+
+const (
+	ImportPending ImportStatus = "pending"
+	ImportRunning ImportStatus = "running"
+	ImportDone    ImportStatus = "done"
+	ImportFailed  ImportStatus = "failed"
+)
+
+/*
+Import unpacks a ZIP archive of images into a gallery in the background, as a JobRunImport job.
+
+Every entry is checked before it is imported. Entries with unsafe paths, files that are not JPEG or PNG images,
+files that are too large, images that are already in the gallery and images that do not fit in the user's quota
+are skipped, and the reason is recorded in Notes. Images keep their name without any folders, with a numbered
+suffix if the name is taken.
+*/
+type Import struct {
+	ID        uint         `gorm:"primary_key"`
+	GalleryID uint         `gorm:"not null;index"`
+	UserID    uint         `gorm:"not null"`
+	Status    ImportStatus `gorm:"not null;default:'pending'"`
+	Total     int          `gorm:"not null;default:0"`
+	Processed int          `gorm:"not null;default:0"`
+	Imported  int          `gorm:"not null;default:0"`
+	Skipped   int          `gorm:"not null;default:0"`
+	// Notes lists the skipped entries and why, one per line
+	Notes     string `gorm:"type:text"`
+	Error     string
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// Finished reports whether the import has stopped, successfully or not
+func (i *Import) Finished() bool {
+	return i.Status == ImportDone || i.Status == ImportFailed
+}
+
+// Percent is how much of the import has been processed, from 0 to 100
+func (i *Import) Percent() int {
+	if i.Total == 0 {
+		if i.Finished() {
+			return 100
+		}
+		return 0
+	}
+	return i.Processed * 100 / i.Total
+}
+
+// NoteLines returns the notes about skipped entries
+func (i *Import) NoteLines() []string {
+	if i.Notes == "" {
+		return nil
+	}
+	return strings.Split(i.Notes, "\n")
+}
+
+// ImportService is used to import ZIP archives of images into galleries
+type ImportService interface {
+	// Create saves the archive in r and queues a job to import it into the gallery with galleryID
+	Create(galleryID, userID uint, r io.Reader) (*Import, error)
+	ByID(id uint) (*Import, error)
+	// ByGalleryID returns the most recent imports into a gallery, newest first
+	ByGalleryID(galleryID uint, limit int) ([]Import, error)
+	// Run imports the archive of the import with id. It does nothing if the import has finished.
+	// If it fails the import is left pending to be run again, unless lastAttempt is true when it is marked failed.
+	// An import interrupted by ctx is always left to be run again.
+	Run(ctx context.Context, id uint, lastAttempt bool) error
+}
+
+// NewImportService creates an ImportService that adds images to galleries with is and runs imports on queue
+func NewImportService(db *gorm.DB, is ImageService, queue *jobs.Queue) ImportService {
+	return &importService{
+		db:    db,
+		is:    is,
+		queue: queue,
+	}
+}
+
+type importService struct {
+	db    *gorm.DB
+	is    ImageService
+	queue *jobs.Queue
+}
+
+func (ims *importService) Create(galleryID, userID uint, r io.Reader) (*Import, error) {
+	if galleryID <= 0 || userID <= 0 {
+		return nil, ErrIDInvalid
+	}
+	imp := Import{
+		GalleryID: galleryID,
+		UserID:    userID,
+		Status:    ImportPending,
+	}
+	if err := ims.db.Create(&imp).Error; err != nil {
+		return nil, err
+	}
+	if err := ims.save(&imp, r); err != nil {
+		ims.db.Delete(&imp)
+		return nil, err
+	}
+	_, err := ims.queue.Enqueue(JobRunImport, ImportJob{ImportID: imp.ID}, jobs.MaxAttempts(importAttempts))
+	if err != nil {
+		os.Remove(ims.archivePath(imp.ID))
+		ims.db.Delete(&imp)
+		return nil, err
+	}
+	return &imp, nil
+}
+
+func (ims *importService) ByID(id uint) (*Import, error) {
+	var imp Import
+	if err := first(ims.db.Where("id = ?", id), &imp); err != nil {
+		return nil, err
+	}
+	return &imp, nil
+}
+
+func (ims *importService) ByGalleryID(galleryID uint, limit int) ([]Import, error) {
+	var imps []Import
+	db := ims.db.Where("gallery_id = ?", galleryID).Order("id desc").Limit(limit)
+	if err := db.Find(&imps).Error; err != nil {
+		return nil, err
+	}
+	return imps, nil
+}
+
+// save writes the uploaded archive to disk and checks that it is a ZIP archive small enough to import
+func (ims *importService) save(imp *Import, r io.Reader) error {
+	if err := os.MkdirAll("imports", 0755); err != nil {
+		return err
+	}
+	f, err := os.Create(ims.archivePath(imp.ID))
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	zr, err := zip.OpenReader(f.Name())
+	if err != nil {
+		os.Remove(f.Name())
+		return ErrImportNotZip
+	}
+	defer zr.Close()
+	if len(zr.File) > maxImportEntries {
+		os.Remove(f.Name())
+		return ErrImportTooLarge
+	}
+	return nil
+}
+
+func (ims *importService) Run(ctx context.Context, id uint, lastAttempt bool) error {
+	imp, err := ims.ByID(id)
+	if err != nil {
+		return err
+	}
+	if imp.Finished() {
+		return nil
+	}
+	err = ims.run(ctx, imp)
+	switch {
+	case err == nil:
+		os.Remove(ims.archivePath(imp.ID))
+	case ctx.Err() != nil || !lastAttempt:
+		// Carry on next time from the entry after the last one processed
+		imp.Status = ImportPending
+		if err := ims.update(imp); err != nil {
+			log.Println(err)
+		}
+	default:
+		imp.Status = ImportFailed
+		imp.Error = "The import could not be completed. Please try again."
+		if err := ims.update(imp); err != nil {
+			log.Println(err)
+		}
+		os.Remove(ims.archivePath(imp.ID))
+	}
+	return err
+}
+
+// run imports every entry of the archive, checking ctx between entries.
+// Progress is saved after each entry so the edit page can show it.
+func (ims *importService) run(ctx context.Context, imp *Import) error {
+	zr, err := zip.OpenReader(ims.archivePath(imp.ID))
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	existing, err := ims.is.ByGalleryID(imp.GalleryID)
+	if err != nil {
+		return err
+	}
+	taken := make(map[string]bool, len(existing))
+	seen := make(map[string]bool, len(existing))
+	for _, image := range existing {
+		taken[image.Filename] = true
+		if image.SHA256 != "" {
+			seen[image.SHA256] = true
+		} else if sum, err := hashFile(image.RelativePath()); err == nil {
+			seen[sum] = true
+		}
+	}
+
+	var files []*zip.File
+	for _, f := range zr.File {
+		if !f.FileInfo().IsDir() {
+			files = append(files, f)
+		}
+	}
+	// A retried import keeps the progress and counts of the attempts before it
+	if imp.Processed > len(files) {
+		imp.Processed = len(files)
+	}
+	imp.Status = ImportRunning
+	imp.Total = len(files)
+	imp.Error = ""
+	if err := ims.update(imp); err != nil {
+		return err
+	}
+
+	notes := imp.NoteLines()
+	for _, f := range files[imp.Processed:] {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		filename, err := ims.importEntry(imp.GalleryID, f, taken, seen)
+		if err == nil {
+			imp.Imported++
+			taken[filename] = true
+		} else if reason, ok := err.(importSkip); ok {
+			imp.Skipped++
+			if len(notes) < maxImportNotes {
+				notes = append(notes, fmt.Sprintf("%s: %s", strings.ReplaceAll(f.Name, "\n", " "), reason))
+			}
+		} else {
+			return err
+		}
+		imp.Processed++
+		imp.Notes = strings.Join(notes, "\n")
+		if err := ims.update(imp); err != nil {
+			return err
+		}
+	}
+
+	imp.Status = ImportDone
+	return ims.update(imp)
+}
+
+// importSkip is returned by importEntry when an entry is skipped rather than imported
+type importSkip string
+
+func (s importSkip) Error() string {
+	return string(s)
+}
+
+// importEntry checks the archive entry f and adds it to the gallery with galleryID, returning the filename used.
+// taken holds the filenames already in the gallery and seen the SHA-256 hashes of its images.
+func (ims *importService) importEntry(galleryID uint, f *zip.File, taken, seen map[string]bool) (string, error) {
+	if !safeArchivePath(f.Name) {
+		return "", importSkip("unsafe path")
+	}
+	name := path.Base(f.Name)
+	if strings.HasPrefix(f.Name, "__MACOSX/") || !IsImageFilename(name) {
+		return "", importSkip("not a JPEG or PNG image")
+	}
+	if f.UncompressedSize64 > maxImportEntrySize {
+		return "", importSkip("larger than 50 MB")
+	}
+
+	// Read the entry once to check what it contains and whether it is a duplicate before writing it
+	rc, err := f.Open()
+	if err != nil {
+		return "", importSkip("could not be read")
+	}
+	h := sha256.New()
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(rc, head)
+	h.Write(head[:n])
+	// The size in the entry's header may be wrong, so the entry is measured as it is read
+	rest, err := io.Copy(h, io.LimitReader(rc, maxImportEntrySize+1-int64(n)))
+	rc.Close()
+	if err != nil {
+		return "", importSkip("could not be read")
+	}
+	size := int64(n) + rest
+	if size > maxImportEntrySize {
+		return "", importSkip("larger than 50 MB")
+	}
+	if !isImageContent(head[:n]) {
+		return "", importSkip("not a JPEG or PNG image")
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+	if seen[sum] {
+		return "", importSkip("duplicate of an image already in the gallery")
+	}
+
+	filename := uniqueFilename(taken, name)
+	if err := runImageValFns(&Image{GalleryID: galleryID, Filename: filename}, filenameSafe); err != nil {
+		return "", importSkip("invalid filename")
+	}
+	rc, err = f.Open()
+	if err != nil {
+		return "", importSkip("could not be read")
+	}
+	defer rc.Close()
+	err = ims.is.Create(galleryID, io.LimitReader(rc, size), filename)
+	switch err {
+	case nil:
+	case ErrStorageQuota, ErrImageQuota:
+		return "", importSkip("does not fit in your storage quota")
+	default:
+		return "", err
+	}
+	seen[sum] = true
+	return filename, nil
+}
+
+func (ims *importService) update(imp *Import) error {
+	return ims.db.Save(imp).Error
+}
+
+func (ims *importService) archivePath(id uint) string {
+	return filepath.Join("imports", fmt.Sprintf("%v.zip", id))
+}
+
+// IsImageFilename reports whether filename looks like a JPEG or PNG image rather than a hidden or other file
+func IsImageFilename(filename string) bool {
+	if strings.HasPrefix(filename, ".") {
+		return false
+	}
+	switch strings.ToLower(path.Ext(filename)) {
+	case ".jpg", ".jpeg", ".png":
+		return true
+	}
+	return false
+}
+
+// isImageContent reports whether head, the first 512 bytes of a file or all of it if shorter, is a JPEG or PNG image
+func isImageContent(head []byte) bool {
+	switch http.DetectContentType(head) {
+	case "image/jpeg", "image/png":
+		return true
+	}
+	return false
+}
+
+// safeArchivePath reports whether name, the path of a ZIP entry, stays inside the folder it is unpacked into
+func safeArchivePath(name string) bool {
+	if name == "" || strings.ContainsAny(name, "\\\x00") || strings.HasPrefix(name, "/") || strings.Contains(name, ":") {
+		return false
+	}
+	for _, part := range strings.Split(name, "/") {
+		if part == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+// hashFile returns the hex encoded SHA-256 hash of the file at path
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
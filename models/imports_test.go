@@ -0,0 +1,23 @@
+package models
+
+import "testing"
+
+func TestIsImageContent(t *testing.T) {
+	tests := []struct {
+		name string
+		head []byte
+		want bool
+	}{
+		{"jpeg", []byte{0xFF, 0xD8, 0xFF, 0xE0, 0x00, 0x10, 'J', 'F', 'I', 'F'}, true},
+		{"png", []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR"), true},
+		{"gif", []byte("GIF89a"), false},
+		{"html named .jpg", []byte("<html><script>alert(1)</script>"), false},
+		{"text", []byte("hello"), false},
+		{"empty", nil, false},
+	}
+	for _, tt := range tests {
+		if got := isImageContent(tt.head); got != tt.want {
+			t.Errorf("%s: isImageContent = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
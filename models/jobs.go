@@ -0,0 +1,18 @@
+package models
+
+// Types of the background jobs queued by the services. Their handlers are registered in main.
+const (
+	// JobPurgeTrash permanently deletes galleries that have been in the trash past the retention period
+	JobPurgeTrash = "trash.purge"
+	// JobDeleteExpiredUploads removes uploads that were abandoned part way
+	JobDeleteExpiredUploads = "uploads.delete_expired"
+	// JobHashImages hashes images stored before duplicate detection was added
+	JobHashImages = "images.hash_missing"
+	// JobRunImport imports an uploaded archive into a gallery. Its payload is an ImportJob.
+	JobRunImport = "imports.run"
+)
+
+// ImportJob is the payload of a JobRunImport job
+type ImportJob struct {
+	ImportID uint `json:"import_id"`
+}
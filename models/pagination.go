@@ -0,0 +1,162 @@
+package models
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"reflect"
+
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	// ErrCursorInvalid is returned when a pagination cursor cannot be decoded
+	ErrCursorInvalid modelError = "models: page cursor is invalid"
+
+	// DefaultPageLimit is the number of results per page when no limit is requested
+	DefaultPageLimit = 24
+	// MaxPageLimit is the largest page that can be requested
+	MaxPageLimit = 100
+)
+
+/*
+Pagination holds the options used to request one page of a listing.
+
+Listings are paginated with keyset (cursor) pagination: a Cursor records the sort value and ID of the row at the edge
+of a page, and the next query continues from there. This stays fast for deep pages and is stable when rows are added.
+Offset can be used instead of Cursor to jump straight to a position in the listing.
+
+A listing uses Pagination by calling paginate on its query, running the query into a slice, then calling pageOf on the results.
+*/
+type Pagination struct {
+	Limit  int
+	Cursor string
+	Offset int
+}
+
+// Page describes the neighbours of a page of results.
+// Next and Prev are encoded cursors and are empty when there is no page in that direction.
+type Page struct {
+	Next string
+	Prev string
+}
+
+// Cursor marks the row at the edge of a page.
+// Before is set when the cursor is used to fetch the page preceding the row rather than the page following it.
+type Cursor struct {
+	Value  string `json:"v"`
+	ID     uint   `json:"id"`
+	Before bool   `json:"b,omitempty"`
+}
+
+// keyset describes the column a listing is ordered by. Rows with equal values are ordered by ID.
+type keyset struct {
+	Column string
+	Desc   bool
+}
+
+// Encode returns the cursor as an opaque URL safe string
+func (c Cursor) Encode() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// DecodeCursor parses a cursor created by Cursor.Encode.
+// Returns nil without an error when s is empty.
+func DecodeCursor(s string) (*Cursor, error) {
+	if s == "" {
+		return nil, nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, ErrCursorInvalid
+	}
+	var c Cursor
+	if err := json.Unmarshal(b, &c); err != nil || c.ID == 0 {
+		return nil, ErrCursorInvalid
+	}
+	return &c, nil
+}
+
+// HasNext reports whether there is a page after this one
+func (p Page) HasNext() bool {
+	return p.Next != ""
+}
+
+// HasPrev reports whether there is a page before this one
+func (p Page) HasPrev() bool {
+	return p.Prev != ""
+}
+
+// limit returns the requested limit bounded to a sensible range
+func (p Pagination) limit() int {
+	switch {
+	case p.Limit <= 0:
+		return DefaultPageLimit
+	case p.Limit > MaxPageLimit:
+		return MaxPageLimit
+	default:
+		return p.Limit
+	}
+}
+
+// paginate orders db by ks and restricts it to the requested page.
+// One row more than the limit is selected so pageOf can tell whether another page exists.
+func (p Pagination) paginate(db *gorm.DB, ks keyset) (*gorm.DB, *Cursor, error) {
+	cursor, err := DecodeCursor(p.Cursor)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Walking backwards from a cursor reverses the order; pageOf puts the rows back afterwards
+	desc := ks.Desc
+	if cursor != nil && cursor.Before {
+		desc = !desc
+	}
+	dir, cmp := "ASC", ">"
+	if desc {
+		dir, cmp = "DESC", "<"
+	}
+
+	if cursor != nil {
+		db = db.Where("("+ks.Column+", id) "+cmp+" (?, ?)", cursor.Value, cursor.ID)
+	} else if p.Offset > 0 {
+		db = db.Offset(p.Offset)
+	}
+	db = db.Order(ks.Column + " " + dir).Order("id " + dir).Limit(p.limit() + 1)
+	return db, cursor, nil
+}
+
+// pageOf trims the extra row selected by paginate from results, which must be a pointer to a slice,
+// restores the listing order and returns the surrounding Page.
+// cursorOf must return the cursor for the element at index i of the trimmed results.
+func (p Pagination) pageOf(results interface{}, cursor *Cursor, cursorOf func(i int) Cursor) Page {
+	v := reflect.ValueOf(results).Elem()
+	limit := p.limit()
+	more := v.Len() > limit
+	if more {
+		v.Set(v.Slice(0, limit))
+	}
+
+	backwards := cursor != nil && cursor.Before
+	if backwards {
+		swap := reflect.Swapper(v.Interface())
+		for i, j := 0, v.Len()-1; i < j; i, j = i+1, j-1 {
+			swap(i, j)
+		}
+	}
+
+	var page Page
+	n := v.Len()
+	if n == 0 {
+		return page
+	}
+	if more || backwards {
+		page.Next = cursorOf(n - 1).Encode()
+	}
+	if (backwards && more) || (!backwards && (cursor != nil || p.Offset > 0)) {
+		prev := cursorOf(0)
+		prev.Before = true
+		page.Prev = prev.Encode()
+	}
+	return page
+}
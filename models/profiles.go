@@ -0,0 +1,253 @@
+package models
+
+import (
+	"bytes"
+	"fmt"
+	"image/jpeg"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	// ErrUsernameInvalid is returned when a username is not 3 to 30 lowercase letters, digits, hyphens or underscores
+	ErrUsernameInvalid modelError = "models: usernames must be 3 to 30 letters, numbers, hyphens or underscores, starting with a letter or number"
+	// ErrUsernameTaken is returned when another user already has the username
+	ErrUsernameTaken modelError = "models: that username is already taken"
+	// ErrUsernameRequired is returned when a profile is made public without a username to find it by
+	ErrUsernameRequired modelError = "models: please choose a username for your public profile"
+	// ErrBioTooLong is returned when a bio exceeds maxBioLen
+	ErrBioTooLong modelError = "models: your bio must be at most 2000 characters long"
+	// ErrWebsiteInvalid is returned when a website is not an http or https URL
+	ErrWebsiteInvalid modelError = "models: website must be a link starting with http:// or https://"
+	// ErrProfileSortInvalid is returned when a profile's galleries are ordered by something other than a GallerySort
+	ErrProfileSortInvalid modelError = "models: galleries can be ordered by newest, recently updated or title"
+	// ErrAvatarInvalid is returned when an uploaded avatar is not an image or is too large
+	ErrAvatarInvalid modelError = "models: avatars must be JPEG or PNG images of at most 5 MB"
+
+	maxBioLen         = 2000
+	maxWebsiteLen     = 200
+	maxAvatarBytes    = 5 << 20
+	avatarSize        = 256
+	avatarDir         = "avatars"
+	avatarJPEGQuality = 85
+)
+
+var usernameRegex = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{2,29}$`)
+
+// ProfileSorts are the orders a user's public profile can list their galleries in
+var ProfileSorts = []GallerySort{SortCreated, SortUpdated, SortTitle}
+
+// Label is how the sort is described on the profile settings page
+func (s GallerySort) Label() string {
+	switch s {
+	case SortUpdated:
+		return "Recently updated"
+	case SortTitle:
+		return "Title"
+	}
+	return "Newest"
+}
+
+// ProfileURL is the path of the user's public profile, or empty if they have not chosen a username
+func (u *User) ProfileURL() string {
+	if u.Username == "" {
+		return ""
+	}
+	return "/u/" + url.PathEscape(u.Username)
+}
+
+// AvatarURL is the path of the user's avatar, or empty if they have not uploaded one
+func (u *User) AvatarURL() string {
+	if u.Avatar == "" {
+		return ""
+	}
+	return fmt.Sprintf("/avatars/%v/%s", u.ID, url.PathEscape(u.Avatar))
+}
+
+// AvatarPath is where the user's avatar is stored, relative to the working directory
+func (u *User) AvatarPath() string {
+	return filepath.Join(avatarDir, filepath.Base(u.Avatar))
+}
+
+// Initial is the first letter of the user's name, shown in place of an avatar
+func (u *User) Initial() string {
+	for _, r := range strings.TrimSpace(u.Name) {
+		return strings.ToUpper(string(r))
+	}
+	return "?"
+}
+
+// SetAvatar crops the image in r to a square, stores it as the user's avatar and replaces any previous avatar
+func (us *userService) SetAvatar(user *User, r io.Reader) error {
+	data, err := io.ReadAll(io.LimitReader(r, maxAvatarBytes+1))
+	if err != nil {
+		return err
+	}
+	if len(data) > maxAvatarBytes {
+		return ErrAvatarInvalid
+	}
+	src, err := decodeVariantSource(bytes.NewReader(data))
+	if err != nil {
+		return ErrAvatarInvalid
+	}
+	square := Variant{Width: avatarSize, Height: avatarSize, Fit: FitCover}
+	avatar := square.transform(src, FormatJPEG)
+
+	if err := os.MkdirAll(avatarDir, 0755); err != nil {
+		return err
+	}
+	// The filename changes with every upload so browsers never show an old avatar from their cache
+	name := fmt.Sprintf("%d-%d.jpg", user.ID, time.Now().UnixNano())
+	tmp := filepath.Join(avatarDir, "."+name)
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if err := jpeg.Encode(f, avatar, &jpeg.Options{Quality: avatarJPEGQuality}); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(avatarDir, name)); err != nil {
+		return err
+	}
+
+	old := user.Avatar
+	user.Avatar = name
+	if err := us.Update(user); err != nil {
+		user.Avatar = old
+		os.Remove(filepath.Join(avatarDir, name))
+		return err
+	}
+	removeAvatar(old)
+	return nil
+}
+
+// RemoveAvatar deletes the user's avatar
+func (us *userService) RemoveAvatar(user *User) error {
+	old := user.Avatar
+	user.Avatar = ""
+	if err := us.Update(user); err != nil {
+		user.Avatar = old
+		return err
+	}
+	removeAvatar(old)
+	return nil
+}
+
+// removeAvatar deletes the avatar file with name, if there is one
+func removeAvatar(name string) {
+	if name == "" {
+		return
+	}
+	if err := os.Remove(filepath.Join(avatarDir, filepath.Base(name))); err != nil && !os.IsNotExist(err) {
+		log.Println(err)
+	}
+}
+
+// migrateUsers adds the index that keeps usernames unique, which gorm cannot create because
+// users without a username all share the empty one
+func migrateUsers(db *gorm.DB) error {
+	return db.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS idx_users_username ON users (username) WHERE username <> ''`).Error
+}
+
+// normalizeProfile trims the profile fields and lowercases the username
+func (uv *userValidator) normalizeProfile(user *User) error {
+	user.Username = strings.ToLower(strings.TrimSpace(user.Username))
+	user.Bio = strings.TrimSpace(user.Bio)
+	user.Website = strings.TrimSpace(user.Website)
+	return nil
+}
+
+func (uv *userValidator) usernameFormat(user *User) error {
+	if user.Username == "" {
+		if user.ProfilePublic {
+			return ErrUsernameRequired
+		}
+		return nil
+	}
+	if !usernameRegex.MatchString(user.Username) {
+		return ErrUsernameInvalid
+	}
+	return nil
+}
+
+// usernameIsAvail is used to validate that no other user has the username
+func (uv *userValidator) usernameIsAvail(user *User) error {
+	if user.Username == "" {
+		return nil
+	}
+	existing, err := uv.UserDB.ByUsername(user.Username)
+	if err == ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if user.ID != existing.ID {
+		return ErrUsernameTaken
+	}
+	return nil
+}
+
+func (uv *userValidator) bioMaxLength(user *User) error {
+	if len([]rune(user.Bio)) > maxBioLen {
+		return ErrBioTooLong
+	}
+	return nil
+}
+
+func (uv *userValidator) websiteValid(user *User) error {
+	if user.Website == "" {
+		return nil
+	}
+	u, err := url.Parse(user.Website)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || len(user.Website) > maxWebsiteLen {
+		return ErrWebsiteInvalid
+	}
+	return nil
+}
+
+func (uv *userValidator) profileSortValid(user *User) error {
+	if user.ProfileSort == "" {
+		user.ProfileSort = SortCreated
+	}
+	for _, s := range ProfileSorts {
+		if user.ProfileSort == s {
+			return nil
+		}
+	}
+	return ErrProfileSortInvalid
+}
+
+// ByUsername will normalize a username before passing it to the next layer for querying
+func (uv *userValidator) ByUsername(username string) (*User, error) {
+	username = strings.ToLower(strings.TrimSpace(username))
+	if username == "" {
+		return nil, ErrNotFound
+	}
+	return uv.UserDB.ByUsername(username)
+}
+
+// ByUsername is used to find a user with a matching username
+// will return ErrNotFound if no matching user is found
+func (ug *userGorm) ByUsername(username string) (*User, error) {
+	var user User
+	err := first(ug.db.Where("username = ?", username), &user)
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
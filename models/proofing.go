@@ -0,0 +1,413 @@
+package models
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	// ErrProofingClosed is returned when favourites are chosen on a gallery that is not open for proofing
+	ErrProofingClosed modelError = "models: this gallery is not open for proofing"
+	// ErrSelectionNotFound is returned when a selection does not exist
+	ErrSelectionNotFound modelError = "models: selection not found"
+	// ErrSelectionSubmitted is returned when a selection is changed after it was submitted
+	ErrSelectionSubmitted modelError = "models: your selection has already been submitted"
+	// ErrSelectionLimit is returned when a selection would hold more images than the gallery allows
+	ErrSelectionLimit modelError = "models: you have already chosen as many photos as this gallery allows. Remove one to choose another"
+	// ErrSelectionEmpty is returned when a selection without any images is submitted
+	ErrSelectionEmpty modelError = "models: please choose at least one photo before submitting your selection"
+	// ErrSelectionNameRequired is returned when a selection is submitted without a name
+	ErrSelectionNameRequired modelError = "models: please enter your name"
+	// ErrSelectionNameTooLong is returned when a selection's name exceeds maxSelectionNameLen
+	ErrSelectionNameTooLong modelError = "models: names must be at most 50 characters long"
+	// ErrSelectionNoteTooLong is returned when a selection's note exceeds maxSelectionNoteLen
+	ErrSelectionNoteTooLong modelError = "models: notes must be at most 2000 characters long"
+	// ErrSelectionThrottled is returned when more than maxSelectionsPerWindow guest selections are started
+	// from one address within selectionWindow
+	ErrSelectionThrottled modelError = "models: too many selections have been started from your network. Please wait a while and try again"
+
+	maxSelectionNameLen = 50
+	maxSelectionNoteLen = 2000
+	// maxSelectionsPerWindow guest selections may be started from one address within selectionWindow
+	maxSelectionsPerWindow = 10
+	selectionWindow        = time.Hour
+)
+
+/*
+Selection is the list of favourite images one person chooses from a gallery that is open for proofing,
+such as a client picking which photos of a shoot to have retouched. Selections are made by signed in users
+and by guests, who are told apart by AuthorKey.
+
+Once submitted with a name and an optional note a selection can no longer be changed, unless the gallery's
+owner reopens it.
+*/
+type Selection struct {
+	ID        uint `gorm:"primary_key"`
+	GalleryID uint `gorm:"not null;unique_index:idx_selections_gallery_author"`
+	// AuthorKey identifies who is making the selection. See UserAuthorKey and GuestSelectionKey.
+	AuthorKey string `gorm:"not null;unique_index:idx_selections_gallery_author"`
+	// ThrottleKey identifies the address a guest's selection was started from, so guests cannot start
+	// selections without limit by clearing their cookie. See GuestAddressKey.
+	ThrottleKey string `gorm:"not null;default:'';index"`
+	// UserID is the user making the selection, or 0 for a guest
+	UserID uint   `gorm:"not null;default:0"`
+	Name   string `gorm:"not null;default:''"`
+	Note   string `gorm:"type:text;not null;default:''"`
+	// SubmittedAt is when the selection was sent to the gallery's owner, or nil while it is being made
+	SubmittedAt *time.Time
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+	// ImageIDs are the images chosen, in the order they were chosen
+	ImageIDs []uint `gorm:"-"`
+}
+
+// Favourite is an image chosen as part of a selection
+type Favourite struct {
+	SelectionID uint `gorm:"primary_key;auto_increment:false"`
+	ImageID     uint `gorm:"primary_key;auto_increment:false;index"`
+	CreatedAt   time.Time
+}
+
+// Submitted reports whether the selection has been sent to the gallery's owner
+func (s *Selection) Submitted() bool {
+	return s.SubmittedAt != nil
+}
+
+// Has reports whether the image with imageID has been chosen
+func (s *Selection) Has(imageID uint) bool {
+	for _, id := range s.ImageIDs {
+		if id == imageID {
+			return true
+		}
+	}
+	return false
+}
+
+// Count is how many images have been chosen
+func (s *Selection) Count() int {
+	return len(s.ImageIDs)
+}
+
+// GuestSelectionKey identifies a guest making a selection from the random token stored in their browser.
+// The token is hashed so it is never stored.
+func GuestSelectionKey(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return "guest:" + hex.EncodeToString(sum[:16])
+}
+
+// GuestAddressKey identifies the address a guest starts selections from.
+// The address is hashed so it is never stored.
+func GuestAddressKey(address string) string {
+	sum := sha256.Sum256([]byte(address))
+	return "address:" + hex.EncodeToString(sum[:8])
+}
+
+// SelectionService is used to make, submit and review selections
+type SelectionService interface {
+	SelectionDB
+	// Favourite adds the image with imageID to selection, or removes it when favourite is false.
+	// The selection may hold at most limit images, or any number if limit is 0.
+	Favourite(selection *Selection, imageID uint, favourite bool, limit int) error
+	// Submit sends selection to the gallery's owner. It must hold at most limit images, or any number if limit is 0.
+	Submit(selection *Selection, limit int) error
+	// Reopen lets a submitted selection be changed and submitted again
+	Reopen(selection *Selection) error
+}
+
+// SelectionDB is used to interact with the selections and favourites tables
+type SelectionDB interface {
+	ByID(id uint) (*Selection, error)
+	// ByAuthor returns the selection someone is making from a gallery, or ErrSelectionNotFound if they have not started one
+	ByAuthor(galleryID uint, authorKey string) (*Selection, error)
+	// ByGalleryID returns every selection made from a gallery, most recently submitted first and unsubmitted ones last
+	ByGalleryID(galleryID uint) ([]Selection, error)
+	Create(selection *Selection) error
+	Update(selection *Selection) error
+	// AddImage adds the image with imageID to the selection unless it already holds limit images,
+	// in which case ErrSelectionLimit is returned. A limit of 0 means there is no limit.
+	AddImage(selectionID, imageID uint, limit int) error
+	RemoveImage(selectionID, imageID uint) error
+	// CountSince is how many selections with throttleKey have been started since t
+	CountSince(throttleKey string, t time.Time) (int, error)
+}
+
+// NewSelectionService creates a SelectionService backed by db
+func NewSelectionService(db *gorm.DB) SelectionService {
+	return &selectionService{
+		SelectionDB: &selectionValidator{
+			SelectionDB: &selectionGorm{
+				db: db,
+			},
+		},
+	}
+}
+
+type selectionService struct {
+	SelectionDB
+}
+
+func (ss *selectionService) Favourite(selection *Selection, imageID uint, favourite bool, limit int) error {
+	if selection.Submitted() {
+		return ErrSelectionSubmitted
+	}
+	if favourite == selection.Has(imageID) {
+		return nil
+	}
+	if !favourite {
+		if err := ss.RemoveImage(selection.ID, imageID); err != nil {
+			return err
+		}
+		ids := selection.ImageIDs[:0]
+		for _, id := range selection.ImageIDs {
+			if id != imageID {
+				ids = append(ids, id)
+			}
+		}
+		selection.ImageIDs = ids
+		return nil
+	}
+	if err := ss.AddImage(selection.ID, imageID, limit); err != nil {
+		return err
+	}
+	selection.ImageIDs = append(selection.ImageIDs, imageID)
+	return nil
+}
+
+func (ss *selectionService) Submit(selection *Selection, limit int) error {
+	if selection.Submitted() {
+		return ErrSelectionSubmitted
+	}
+	if selection.Count() == 0 {
+		return ErrSelectionEmpty
+	}
+	// The owner may have lowered the limit since the images were chosen
+	if limit > 0 && selection.Count() > limit {
+		return ErrSelectionLimit
+	}
+	now := time.Now()
+	selection.SubmittedAt = &now
+	if err := ss.Update(selection); err != nil {
+		selection.SubmittedAt = nil
+		return err
+	}
+	return nil
+}
+
+func (ss *selectionService) Reopen(selection *Selection) error {
+	selection.SubmittedAt = nil
+	return ss.Update(selection)
+}
+
+type selectionValidator struct {
+	SelectionDB
+}
+
+type selectionValFn func(*Selection) error
+
+func (sv *selectionValidator) ByID(id uint) (*Selection, error) {
+	if id <= 0 {
+		return nil, ErrSelectionNotFound
+	}
+	return sv.SelectionDB.ByID(id)
+}
+
+func (sv *selectionValidator) ByAuthor(galleryID uint, authorKey string) (*Selection, error) {
+	if authorKey == "" {
+		return nil, ErrSelectionNotFound
+	}
+	return sv.SelectionDB.ByAuthor(galleryID, authorKey)
+}
+
+func (sv *selectionValidator) Create(selection *Selection) error {
+	err := runSelectionValFns(selection,
+		selectionIDsRequired,
+		sv.notThrottled,
+		normalizeSelection,
+		selectionNameMaxLength,
+		selectionNoteMaxLength)
+	if err != nil {
+		return err
+	}
+	return sv.SelectionDB.Create(selection)
+}
+
+func (sv *selectionValidator) Update(selection *Selection) error {
+	err := runSelectionValFns(selection,
+		selectionIDsRequired,
+		normalizeSelection,
+		selectionNameRequired,
+		selectionNameMaxLength,
+		selectionNoteMaxLength)
+	if err != nil {
+		return err
+	}
+	return sv.SelectionDB.Update(selection)
+}
+
+func runSelectionValFns(selection *Selection, fns ...selectionValFn) error {
+	for _, fn := range fns {
+		if err := fn(selection); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// notThrottled limits how many selections guests can start from one address
+func (sv *selectionValidator) notThrottled(selection *Selection) error {
+	if selection.ThrottleKey == "" {
+		return nil
+	}
+	n, err := sv.SelectionDB.CountSince(selection.ThrottleKey, time.Now().Add(-selectionWindow))
+	if err != nil {
+		return err
+	}
+	if n >= maxSelectionsPerWindow {
+		return ErrSelectionThrottled
+	}
+	return nil
+}
+
+func selectionIDsRequired(selection *Selection) error {
+	if selection.GalleryID <= 0 || selection.AuthorKey == "" {
+		return ErrIDInvalid
+	}
+	return nil
+}
+
+func normalizeSelection(selection *Selection) error {
+	selection.Name = strings.TrimSpace(selection.Name)
+	selection.Note = strings.TrimSpace(selection.Note)
+	return nil
+}
+
+// selectionNameRequired makes sure the owner knows who sent a submitted selection
+func selectionNameRequired(selection *Selection) error {
+	if selection.Submitted() && selection.Name == "" {
+		return ErrSelectionNameRequired
+	}
+	return nil
+}
+
+func selectionNameMaxLength(selection *Selection) error {
+	if len([]rune(selection.Name)) > maxSelectionNameLen {
+		return ErrSelectionNameTooLong
+	}
+	return nil
+}
+
+func selectionNoteMaxLength(selection *Selection) error {
+	if len([]rune(selection.Note)) > maxSelectionNoteLen {
+		return ErrSelectionNoteTooLong
+	}
+	return nil
+}
+
+// selectionGorm represents the database interaction layer for selections
+type selectionGorm struct {
+	db *gorm.DB
+}
+
+func (sg *selectionGorm) ByID(id uint) (*Selection, error) {
+	return sg.first(sg.db.Where("id = ?", id))
+}
+
+func (sg *selectionGorm) ByAuthor(galleryID uint, authorKey string) (*Selection, error) {
+	return sg.first(sg.db.Where("gallery_id = ? AND author_key = ?", galleryID, authorKey))
+}
+
+func (sg *selectionGorm) first(db *gorm.DB) (*Selection, error) {
+	var selection Selection
+	err := first(db, &selection)
+	if err == ErrNotFound {
+		return nil, ErrSelectionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	selections := []Selection{selection}
+	if err := sg.loadImages(selections); err != nil {
+		return nil, err
+	}
+	return &selections[0], nil
+}
+
+func (sg *selectionGorm) ByGalleryID(galleryID uint) ([]Selection, error) {
+	var selections []Selection
+	err := sg.db.Where("gallery_id = ?", galleryID).
+		Order("submitted_at IS NULL, submitted_at DESC, updated_at DESC").
+		Find(&selections).Error
+	if err != nil {
+		return nil, err
+	}
+	if err := sg.loadImages(selections); err != nil {
+		return nil, err
+	}
+	return selections, nil
+}
+
+// loadImages sets the ImageIDs of each of selections
+func (sg *selectionGorm) loadImages(selections []Selection) error {
+	if len(selections) == 0 {
+		return nil
+	}
+	index := make(map[uint]int, len(selections))
+	ids := make([]uint, len(selections))
+	for i, s := range selections {
+		index[s.ID] = i
+		ids[i] = s.ID
+	}
+	var favourites []Favourite
+	err := sg.db.Where("selection_id IN (?)", ids).Order("created_at, image_id").Find(&favourites).Error
+	if err != nil {
+		return err
+	}
+	for _, f := range favourites {
+		s := &selections[index[f.SelectionID]]
+		s.ImageIDs = append(s.ImageIDs, f.ImageID)
+	}
+	return nil
+}
+
+func (sg *selectionGorm) Create(selection *Selection) error {
+	return sg.db.Create(selection).Error
+}
+
+func (sg *selectionGorm) Update(selection *Selection) error {
+	return sg.db.Save(selection).Error
+}
+
+// AddImage locks the selection while it counts its images, so concurrent requests cannot
+// both add an image when only one more is allowed
+func (sg *selectionGorm) AddImage(selectionID, imageID uint, limit int) error {
+	return sg.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Exec(`SELECT id FROM selections WHERE id = ? FOR UPDATE`, selectionID).Error
+		if err != nil {
+			return err
+		}
+		res := tx.Exec(`INSERT INTO favourites (selection_id, image_id, created_at)
+			SELECT ?, ?, ? WHERE ? = 0 OR (SELECT count(*) FROM favourites WHERE selection_id = ?) < ?`,
+			selectionID, imageID, time.Now(), limit, selectionID, limit)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return ErrSelectionLimit
+		}
+		return nil
+	})
+}
+
+func (sg *selectionGorm) RemoveImage(selectionID, imageID uint) error {
+	return sg.db.Where("selection_id = ? AND image_id = ?", selectionID, imageID).Delete(&Favourite{}).Error
+}
+
+func (sg *selectionGorm) CountSince(throttleKey string, t time.Time) (int, error) {
+	var n int
+	err := sg.db.Model(&Selection{}).Where("throttle_key = ? AND created_at > ?", throttleKey, t).Count(&n).Error
+	return n, err
+}
@@ -0,0 +1,208 @@
+package models
+
+import (
+	"strings"
+
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	// ErrSearchTooLong is returned when a search query exceeds maxSearchLen
+	ErrSearchTooLong modelError = "models: search must be at most 200 characters long"
+
+	maxSearchLen = 200
+
+	// searchConfig is the PostgreSQL text search configuration used for indexing and querying
+	searchConfig = "english"
+
+	// Markers placed around matches by ts_headline. They are split out by parseHighlight so
+	// the matched text can be escaped and rendered by the templates like any other text.
+	highlightStart = "[[[hl]]]"
+	highlightStop  = "[[[/hl]]]"
+)
+
+// gallerySearchVector is the SQL expression that builds a gallery's search_vector.
+// Titles rank above tags and descriptions. Image captions are indexed separately on the images table.
+const gallerySearchVector = `setweight(to_tsvector('` + searchConfig + `', coalesce(title, '')), 'A') || ` +
+	`setweight(to_tsvector('` + searchConfig + `', coalesce((SELECT string_agg(tags.name, ' ') FROM gallery_tags ` +
+	`JOIN tags ON tags.id = gallery_tags.tag_id WHERE gallery_tags.gallery_id = galleries.id), '')), 'B') || ` +
+	`setweight(to_tsvector('` + searchConfig + `', coalesce(description, '')), 'B')`
+
+// imageSearchVector is the SQL expression that builds an image's search_vector
+const imageSearchVector = `setweight(to_tsvector('` + searchConfig + `', coalesce(caption, '')), 'C') || ` +
+	`setweight(to_tsvector('` + searchConfig + `', coalesce((SELECT string_agg(tags.name, ' ') FROM image_tags ` +
+	`JOIN tags ON tags.id = image_tags.tag_id WHERE image_tags.image_id = images.id), '')), 'C') || ` +
+	`setweight(to_tsvector('` + searchConfig + `', coalesce(alt_text, '')), 'D')`
+
+// SearchQuery holds the options for a search
+type SearchQuery struct {
+	Text string
+	// ViewerID is the ID of the user searching, or 0 for visitors. Private galleries are only returned to their owner.
+	ViewerID uint
+	Limit    int
+	Offset   int
+}
+
+// SearchResult is a gallery matching a search along with the highlighted parts that matched
+type SearchResult struct {
+	Gallery Gallery
+	Rank    float64
+	Title   Highlight
+	Snippet Highlight
+}
+
+// Highlight is text split into the parts that matched a search and the parts that did not
+type Highlight []HighlightPart
+
+// HighlightPart is a run of text within a Highlight
+type HighlightPart struct {
+	Text  string
+	Match bool
+}
+
+// SearchService is used to find galleries by their title, tags, description and image captions
+type SearchService interface {
+	// Search returns results ordered by rank, and whether more results follow them
+	Search(query SearchQuery) ([]SearchResult, bool, error)
+}
+
+// NewSearchService creates a SearchService backed by PostgreSQL full-text search
+func NewSearchService(db *gorm.DB) SearchService {
+	return &searchValidator{
+		SearchService: &searchGorm{
+			db: db,
+		},
+	}
+}
+
+// searchValidator normalizes queries before they are run
+type searchValidator struct {
+	SearchService
+}
+
+func (sv *searchValidator) Search(query SearchQuery) ([]SearchResult, bool, error) {
+	query.Text = strings.Join(strings.Fields(query.Text), " ")
+	if query.Text == "" {
+		return nil, false, nil
+	}
+	if len([]rune(query.Text)) > maxSearchLen {
+		return nil, false, ErrSearchTooLong
+	}
+	if query.Offset < 0 {
+		query.Offset = 0
+	}
+	query.Limit = Pagination{Limit: query.Limit}.limit()
+	return sv.SearchService.Search(query)
+}
+
+// searchGorm runs searches against the tsvector columns of galleries and images
+type searchGorm struct {
+	db *gorm.DB
+}
+
+// searchRow is a row returned by the search query
+type searchRow struct {
+	Gallery
+	Rank          float64
+	TitleHeadline string
+	Snippet       string
+}
+
+// searchSQL ranks galleries by their own vector, adding half the rank of their best matching image caption.
+// The snippet highlights matches in the description and in the captions of matching images.
+const searchSQL = `
+SELECT g.*, r.rank,
+	ts_headline('` + searchConfig + `', g.title, q, 'HighlightAll=true, StartSel="` + highlightStart + `", StopSel="` + highlightStop + `"') AS title_headline,
+	ts_headline('` + searchConfig + `', concat_ws(' … ', nullif(g.description, ''), c.captions), q,
+		'MaxFragments=2, MaxWords=30, MinWords=10, StartSel="` + highlightStart + `", StopSel="` + highlightStop + `"') AS snippet
+FROM galleries g
+CROSS JOIN websearch_to_tsquery('` + searchConfig + `', ?) q
+LEFT JOIN LATERAL (
+	SELECT max(ts_rank(i.search_vector, q)) AS rank, string_agg(i.caption, ' … ' ORDER BY i.position) AS captions
+	FROM images i
+	WHERE i.gallery_id = g.id AND i.search_vector @@ q
+) c ON true
+CROSS JOIN LATERAL (
+	SELECT ts_rank(g.search_vector, q) + coalesce(c.rank, 0) * 0.5 AS rank
+) r
+WHERE g.deleted_at IS NULL
+	AND (g.effective_visibility = ? OR g.user_id = ?)
+	AND (g.search_vector @@ q OR c.rank IS NOT NULL)
+ORDER BY r.rank DESC, g.id DESC
+LIMIT ? OFFSET ?`
+
+func (sg *searchGorm) Search(query SearchQuery) ([]SearchResult, bool, error) {
+	var rows []searchRow
+	db := sg.db.Raw(searchSQL, query.Text, VisibilityPublic, query.ViewerID, query.Limit+1, query.Offset)
+	if err := db.Scan(&rows).Error; err != nil {
+		return nil, false, err
+	}
+
+	more := len(rows) > query.Limit
+	if more {
+		rows = rows[:query.Limit]
+	}
+	results := make([]SearchResult, len(rows))
+	for i, row := range rows {
+		results[i] = SearchResult{
+			Gallery: row.Gallery,
+			Rank:    row.Rank,
+			Title:   parseHighlight(row.TitleHeadline),
+			Snippet: parseHighlight(row.Snippet),
+		}
+	}
+	return results, more, nil
+}
+
+// parseHighlight splits text marked up by ts_headline into matching and non-matching parts
+func parseHighlight(s string) Highlight {
+	var h Highlight
+	for s != "" {
+		start := strings.Index(s, highlightStart)
+		if start < 0 {
+			h = append(h, HighlightPart{Text: s})
+			break
+		}
+		if start > 0 {
+			h = append(h, HighlightPart{Text: s[:start]})
+		}
+		s = s[start+len(highlightStart):]
+		stop := strings.Index(s, highlightStop)
+		if stop < 0 {
+			h = append(h, HighlightPart{Text: s, Match: true})
+			break
+		}
+		h = append(h, HighlightPart{Text: s[:stop], Match: true})
+		s = s[stop+len(highlightStop):]
+	}
+	return h
+}
+
+// migrateSearch adds the tsvector columns and GIN indexes used by search, which gorm cannot create,
+// and fills in vectors for rows that were created before search existed
+func migrateSearch(db *gorm.DB) error {
+	statements := []string{
+		`ALTER TABLE galleries ADD COLUMN IF NOT EXISTS search_vector tsvector`,
+		`CREATE INDEX IF NOT EXISTS idx_galleries_search_vector ON galleries USING GIN (search_vector)`,
+		`UPDATE galleries SET search_vector = ` + gallerySearchVector + ` WHERE search_vector IS NULL`,
+		`ALTER TABLE images ADD COLUMN IF NOT EXISTS search_vector tsvector`,
+		`CREATE INDEX IF NOT EXISTS idx_images_search_vector ON images USING GIN (search_vector)`,
+		`UPDATE images SET search_vector = ` + imageSearchVector + ` WHERE search_vector IS NULL`,
+	}
+	for _, stmt := range statements {
+		if err := db.Exec(stmt).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// indexGallery rebuilds the search_vector of the gallery with id
+func indexGallery(db *gorm.DB, id uint) error {
+	return db.Exec(`UPDATE galleries SET search_vector = `+gallerySearchVector+` WHERE id = ?`, id).Error
+}
+
+// indexImage rebuilds the search_vector of the image with id
+func indexImage(db *gorm.DB, id uint) error {
+	return db.Exec(`UPDATE images SET search_vector = `+imageSearchVector+` WHERE id = ?`, id).Error
+}
@@ -1,12 +1,32 @@
 package models
 
-import "github.com/jinzhu/gorm"
+import (
+	"time"
+
+	"github.com/curtisvermeeren/web-development-with-go/jobs"
+	"github.com/jinzhu/gorm"
+)
 
 type Services struct {
-	Gallery GalleryService
-	User    UserService
-	Image   ImageService
-	db      *gorm.DB
+	Gallery     GalleryService
+	User        UserService
+	Image       ImageService
+	ImageSigner *ImageSigner
+	Variant     VariantService
+	Watermark   WatermarkService
+	Trash       TrashService
+	Search      SearchService
+	Tag         TagService
+	Album       AlbumService
+	Archive     ArchiveService
+	ShareLink   ShareLinkService
+	Comment     CommentService
+	Selection   SelectionService
+	Import      ImportService
+	Upload      UploadService
+	Usage       UsageService
+	Jobs        *jobs.Queue
+	db          *gorm.DB
 }
 
 func NewServices(cfgs ...ServicesConfig) (*Services, error) {
@@ -52,9 +72,122 @@ func WithGallery() ServicesConfig {
 	}
 }
 
+// WithImageSigner signs image URLs with key so they last for at least ttl
+func WithImageSigner(key string, ttl time.Duration) ServicesConfig {
+	return func(s *Services) error {
+		s.ImageSigner = NewImageSigner(key, ttl)
+		return nil
+	}
+}
+
+// WithUsage limits every user to quota. It must be applied before WithImage.
+func WithUsage(quota Quota) ServicesConfig {
+	return func(s *Services) error {
+		s.Usage = NewUsageService(s.db, quota)
+		return nil
+	}
+}
+
+// WithImage must be applied after WithUsage
 func WithImage() ServicesConfig {
 	return func(s *Services) error {
-		s.Image = NewImageService()
+		s.Image = NewImageService(s.db, s.Usage)
+		return nil
+	}
+}
+
+// WithVariant caches up to maxBytes of resized and converted images
+func WithVariant(maxBytes int64) ServicesConfig {
+	return func(s *Services) error {
+		s.Variant = NewVariantService(maxBytes)
+		return nil
+	}
+}
+
+func WithWatermark() ServicesConfig {
+	return func(s *Services) error {
+		s.Watermark = NewWatermarkService(s.db)
+		return nil
+	}
+}
+
+func WithArchive() ServicesConfig {
+	return func(s *Services) error {
+		s.Archive = NewArchiveService()
+		return nil
+	}
+}
+
+// WithTrash must be applied after WithGallery, WithImage, WithArchive and WithWatermark
+func WithTrash(retention time.Duration) ServicesConfig {
+	return func(s *Services) error {
+		s.Trash = NewTrashService(s.Gallery, s.Image, s.Archive, s.Watermark, retention)
+		return nil
+	}
+}
+
+func WithSearch() ServicesConfig {
+	return func(s *Services) error {
+		s.Search = NewSearchService(s.db)
+		return nil
+	}
+}
+
+func WithTag() ServicesConfig {
+	return func(s *Services) error {
+		s.Tag = NewTagService(s.db)
+		return nil
+	}
+}
+
+func WithAlbum() ServicesConfig {
+	return func(s *Services) error {
+		s.Album = NewAlbumService(s.db)
+		return nil
+	}
+}
+
+// WithJobs must be applied before any services that queue jobs
+func WithJobs() ServicesConfig {
+	return func(s *Services) error {
+		s.Jobs = jobs.NewQueue(s.db)
+		return nil
+	}
+}
+
+// WithImport must be applied after WithImage and WithJobs
+func WithImport() ServicesConfig {
+	return func(s *Services) error {
+		s.Import = NewImportService(s.db, s.Image, s.Jobs)
+		return nil
+	}
+}
+
+// WithUpload must be applied after WithUsage and WithImage
+func WithUpload() ServicesConfig {
+	return func(s *Services) error {
+		s.Upload = NewUploadService(s.db, s.Image, s.Usage)
+		return nil
+	}
+}
+
+func WithShareLink() ServicesConfig {
+	return func(s *Services) error {
+		s.ShareLink = NewShareLinkService(s.db)
+		return nil
+	}
+}
+
+func WithSelection() ServicesConfig {
+	return func(s *Services) error {
+		s.Selection = NewSelectionService(s.db)
+		return nil
+	}
+}
+
+func WithComment() ServicesConfig {
+	return func(s *Services) error {
+		s.Comment = NewCommentService(s.db)
 		return nil
 	}
 }
@@ -66,12 +199,25 @@ func (s *Services) Close() error {
 
 // AutoMigrate all tables
 func (s *Services) AutoMigrate() error {
-	return s.db.AutoMigrate(&User{}, &Gallery{}).Error
+	if err := s.db.AutoMigrate(&User{}, &Gallery{}, &Image{}, &Tag{}, &GalleryTag{}, &ImageTag{}, &Album{}, &ShareLink{}, &Import{}, &Upload{}, &Usage{}, &Watermark{}, &Comment{}, &Selection{}, &Favourite{}, &jobs.Job{}).Error; err != nil {
+		return err
+	}
+	if err := migrateSearch(s.db); err != nil {
+		return err
+	}
+	if err := migrateUsers(s.db); err != nil {
+		return err
+	}
+	if err := migrateGallerySlugs(s.db); err != nil {
+		return err
+	}
+	// Fill in effective visibility for galleries created before albums existed
+	return syncGalleryVisibility(s.db, "effective_visibility <> visibility AND album_id = 0")
 }
 
 // Drop all tables and rebuild them
 func (s *Services) DestructiveReset() error {
-	err := s.db.DropTableIfExists(&User{}, &Gallery{}).Error
+	err := s.db.DropTableIfExists(&User{}, &Gallery{}, &Image{}, &Tag{}, &GalleryTag{}, &ImageTag{}, &Album{}, &ShareLink{}, &Import{}, &Upload{}, &Usage{}, &Watermark{}, &Comment{}, &Selection{}, &Favourite{}, &jobs.Job{}).Error
 	if err != nil {
 		return err
 	}
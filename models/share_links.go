@@ -0,0 +1,123 @@
+package models
+
+import (
+	"time"
+
+	"github.com/curtisvermeeren/web-development-with-go/rand"
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	// ErrShareLinkNotFound is returned when a share link does not exist or is for another gallery
+	ErrShareLinkNotFound modelError = "models: share link not found"
+
+	shareTokenBytes = 24
+)
+
+/*
+ShareLink gives anyone with its token access to a gallery, even a private one.
+The token is sent as the share query parameter, for example /galleries/PUBLICID-SLUG?share=TOKEN.
+Downloading the gallery's images is only allowed when AllowDownload is set.
+*/
+type ShareLink struct {
+	ID            uint   `gorm:"primary_key"`
+	GalleryID     uint   `gorm:"not null;index"`
+	Token         string `gorm:"not null;unique_index"`
+	AllowDownload bool   `gorm:"not null;default:false"`
+	CreatedAt     time.Time
+}
+
+// ShareLinkService is used to create and look up share links for galleries
+type ShareLinkService interface {
+	ShareLinkDB
+}
+
+// ShareLinkDB is used to interact with the share_links table
+type ShareLinkDB interface {
+	// ByToken returns the share link with token for the gallery with galleryID
+	ByToken(galleryID uint, token string) (*ShareLink, error)
+	ByGalleryID(galleryID uint) ([]ShareLink, error)
+	// Create generates a new token for link and saves it
+	Create(link *ShareLink) error
+	// Delete revokes the share link with id from the gallery with galleryID
+	Delete(galleryID, id uint) error
+}
+
+// NewShareLinkService creates a ShareLinkService backed by db
+func NewShareLinkService(db *gorm.DB) ShareLinkService {
+	return &shareLinkValidator{
+		ShareLinkDB: &shareLinkGorm{
+			db: db,
+		},
+	}
+}
+
+type shareLinkValidator struct {
+	ShareLinkDB
+}
+
+func (sv *shareLinkValidator) ByToken(galleryID uint, token string) (*ShareLink, error) {
+	if galleryID <= 0 || token == "" {
+		return nil, ErrShareLinkNotFound
+	}
+	return sv.ShareLinkDB.ByToken(galleryID, token)
+}
+
+func (sv *shareLinkValidator) Create(link *ShareLink) error {
+	if link.GalleryID <= 0 {
+		return ErrIDInvalid
+	}
+	token, err := rand.String(shareTokenBytes)
+	if err != nil {
+		return err
+	}
+	link.Token = token
+	return sv.ShareLinkDB.Create(link)
+}
+
+func (sv *shareLinkValidator) Delete(galleryID, id uint) error {
+	if galleryID <= 0 || id <= 0 {
+		return ErrIDInvalid
+	}
+	return sv.ShareLinkDB.Delete(galleryID, id)
+}
+
+// shareLinkGorm represents the database interaction layer for share links
+type shareLinkGorm struct {
+	db *gorm.DB
+}
+
+func (sg *shareLinkGorm) ByToken(galleryID uint, token string) (*ShareLink, error) {
+	var link ShareLink
+	err := first(sg.db.Where("gallery_id = ? AND token = ?", galleryID, token), &link)
+	if err == ErrNotFound {
+		return nil, ErrShareLinkNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &link, nil
+}
+
+func (sg *shareLinkGorm) ByGalleryID(galleryID uint) ([]ShareLink, error) {
+	var links []ShareLink
+	if err := sg.db.Where("gallery_id = ?", galleryID).Order("id").Find(&links).Error; err != nil {
+		return nil, err
+	}
+	return links, nil
+}
+
+func (sg *shareLinkGorm) Create(link *ShareLink) error {
+	return sg.db.Create(link).Error
+}
+
+func (sg *shareLinkGorm) Delete(galleryID, id uint) error {
+	db := sg.db.Where("gallery_id = ? AND id = ?", galleryID, id).Delete(&ShareLink{})
+	if db.Error != nil {
+		return db.Error
+	}
+	if db.RowsAffected == 0 {
+		return ErrShareLinkNotFound
+	}
+	return nil
+}
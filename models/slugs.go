@@ -0,0 +1,227 @@
+package models
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/curtisvermeeren/web-development-with-go/rand"
+	"github.com/jinzhu/gorm"
+	"github.com/lib/pq"
+)
+
+const (
+	// ErrSlugInvalid is returned when a chosen slug has no letters or numbers to make a URL from
+	ErrSlugInvalid modelError = "models: the web address must contain letters or numbers"
+	// ErrSlugTaken is returned when another of the user's galleries already has the slug
+	ErrSlugTaken modelError = "models: another of your galleries already uses that web address"
+
+	maxSlugLen = 60
+	// defaultSlug is used when a title has no letters or numbers to make a slug from
+	defaultSlug = "gallery"
+	// slugIndex is the index that keeps each user's slugs unique
+	slugIndex = "idx_galleries_user_slug"
+	// publicIDBytes is how many random bytes make up a gallery's public ID, which is written as hex
+	publicIDBytes = 8
+)
+
+// Slugify turns s into lowercase ASCII letters and numbers separated by single hyphens,
+// at most maxSlugLen long. Anything else is treated as a separator.
+func Slugify(s string) string {
+	var b strings.Builder
+	hyphen := false
+	for _, r := range strings.ToLower(s) {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+			if hyphen && b.Len() > 0 {
+				b.WriteByte('-')
+			}
+			hyphen = false
+			b.WriteRune(r)
+		case r == '\'' || r == '’':
+			// Apostrophes are dropped rather than splitting words, so "Ann's" becomes "anns"
+		default:
+			hyphen = true
+		}
+	}
+	return truncateSlug(b.String(), maxSlugLen)
+}
+
+// truncateSlug shortens slug to at most n bytes without leaving a trailing hyphen
+func truncateSlug(slug string, n int) string {
+	if len(slug) > n {
+		slug = slug[:n]
+	}
+	return strings.TrimRight(slug, "-")
+}
+
+// Path is the path of the gallery's page, with its slug when it has one
+func (g *Gallery) Path() string {
+	if g.Slug == "" {
+		return fmt.Sprintf("/galleries/%s", g.PublicID)
+	}
+	return fmt.Sprintf("/galleries/%s-%s", g.PublicID, g.Slug)
+}
+
+// ImagePath is the path of the viewer page for the gallery's image with filename
+func (g *Gallery) ImagePath(filename string) string {
+	return fmt.Sprintf("/galleries/%s/images/%s", g.PublicID, url.PathEscape(filename))
+}
+
+// newPublicID returns a random ID for a gallery's public URLs, so they cannot be guessed from its ID
+func newPublicID() (string, error) {
+	b, err := rand.Bytes(publicIDBytes)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// publicIDSet gives a new gallery its public ID
+func (gv *galleryValidator) publicIDSet(g *Gallery) error {
+	if g.PublicID != "" {
+		return nil
+	}
+	id, err := newPublicID()
+	if err != nil {
+		return err
+	}
+	g.PublicID = id
+	return nil
+}
+
+// slugValid normalizes a slug the user chose and makes sure none of their other galleries has it.
+// Galleries without a slug are given one made from their title, numbered when the user already has it.
+func (gv *galleryValidator) slugValid(g *Gallery) error {
+	if strings.TrimSpace(g.Slug) != "" {
+		g.Slug = Slugify(g.Slug)
+		if g.Slug == "" {
+			return ErrSlugInvalid
+		}
+		taken, err := gv.GalleryDB.SlugsWithPrefix(g.UserID, g.Slug, g.ID)
+		if err != nil {
+			return err
+		}
+		for _, slug := range taken {
+			if slug == g.Slug {
+				return ErrSlugTaken
+			}
+		}
+		return nil
+	}
+
+	base := Slugify(g.Title)
+	if base == "" {
+		base = defaultSlug
+	}
+	taken, err := gv.GalleryDB.SlugsWithPrefix(g.UserID, base, g.ID)
+	if err != nil {
+		return err
+	}
+	g.Slug = uniqueSlug(base, taken)
+	return nil
+}
+
+// slugTaken returns ErrSlugTaken when err is Postgres refusing a slug that another of the user's galleries
+// took after slugValid checked it, and err otherwise
+func slugTaken(err error) error {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code.Name() == "unique_violation" && pqErr.Constraint == slugIndex {
+		return ErrSlugTaken
+	}
+	return err
+}
+
+// uniqueSlug returns base, or base followed by the lowest number that makes it different from every slug in taken
+func uniqueSlug(base string, taken []string) string {
+	used := make(map[string]bool, len(taken))
+	for _, slug := range taken {
+		used[slug] = true
+	}
+	if !used[base] {
+		return base
+	}
+	for i := 2; ; i++ {
+		suffix := fmt.Sprintf("-%d", i)
+		slug := truncateSlug(base, maxSlugLen-len(suffix)) + suffix
+		if !used[slug] {
+			return slug
+		}
+	}
+}
+
+// SlugsWithPrefix returns the slugs of the user's galleries, including those in the trash, that are prefix
+// or start with prefix followed by a hyphen. The gallery with exceptID is left out.
+func (gg *galleryGorm) SlugsWithPrefix(userID uint, prefix string, exceptID uint) ([]string, error) {
+	var slugs []string
+	db := gg.db.Unscoped().Model(&Gallery{}).
+		Where("user_id = ? AND id <> ?", userID, exceptID).
+		Where("slug = ? OR slug LIKE ?", prefix, escapeLike(prefix)+"-%")
+	if err := db.Pluck("slug", &slugs).Error; err != nil {
+		return nil, err
+	}
+	return slugs, nil
+}
+
+// ByPublicID is used to find the gallery with the public ID from its URL
+func (gg *galleryGorm) ByPublicID(publicID string) (*Gallery, error) {
+	var gallery Gallery
+	db := gg.db.Where("public_id = ?", publicID)
+	err := first(db, &gallery)
+	if err != nil {
+		return nil, err
+	}
+	return &gallery, nil
+}
+
+// migrateGallerySlugs gives galleries created before slugs and public IDs existed a slug made from their title
+// and a public ID, then adds the indexes that keep each user's slugs and every public ID unique
+func migrateGallerySlugs(db *gorm.DB) error {
+	var missing []Gallery
+	err := db.Unscoped().Select("id").Where("public_id = ''").Order("id").Find(&missing).Error
+	if err != nil {
+		return err
+	}
+	for _, g := range missing {
+		id, err := newPublicID()
+		if err != nil {
+			return err
+		}
+		err = db.Unscoped().Model(&Gallery{}).Where("id = ?", g.ID).UpdateColumn("public_id", id).Error
+		if err != nil {
+			return err
+		}
+	}
+	err = db.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS idx_galleries_public_id ON galleries (public_id)`).Error
+	if err != nil {
+		return err
+	}
+
+	var galleries []Gallery
+	err = db.Unscoped().Select("id, user_id, title").Where("slug = ''").Order("id").Find(&galleries).Error
+	if err != nil {
+		return err
+	}
+	for _, g := range galleries {
+		base := Slugify(g.Title)
+		if base == "" {
+			base = defaultSlug
+		}
+		var taken []string
+		err := db.Unscoped().Model(&Gallery{}).
+			Where("user_id = ? AND slug <> ''", g.UserID).
+			Where("slug = ? OR slug LIKE ?", base, escapeLike(base)+"-%").
+			Pluck("slug", &taken).Error
+		if err != nil {
+			return err
+		}
+		// Each slug is saved before the next gallery's is chosen, so the query above sees it
+		err = db.Unscoped().Model(&Gallery{}).Where("id = ?", g.ID).UpdateColumn("slug", uniqueSlug(base, taken)).Error
+		if err != nil {
+			return err
+		}
+	}
+	return db.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS ` + slugIndex + ` ON galleries (user_id, slug) WHERE slug <> ''`).Error
+}
@@ -0,0 +1,77 @@
+package models
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/lib/pq"
+)
+
+func TestSlugify(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"", ""},
+		{"Wedding", "wedding"},
+		{"Ann's  Wedding!!", "anns-wedding"},
+		{"Ann’s party", "anns-party"},
+		{"--Café 2024--", "caf-2024"},
+		{"A_b", "a-b"},
+		{"日本", ""},
+		{"!!!", ""},
+		{strings.Repeat("a", 70), strings.Repeat("a", 60)},
+		{strings.Repeat("a", 59) + " b", strings.Repeat("a", 59)},
+	}
+	for _, tt := range tests {
+		if got := Slugify(tt.in); got != tt.want {
+			t.Errorf("Slugify(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestUniqueSlug(t *testing.T) {
+	long := strings.Repeat("a", 60)
+	tests := []struct {
+		base  string
+		taken []string
+		want  string
+	}{
+		{"a", nil, "a"},
+		{"a", []string{"a-2"}, "a"},
+		{"a", []string{"a"}, "a-2"},
+		{"a", []string{"a", "a-2", "a-b"}, "a-3"},
+		{"a", []string{"a", "a-3"}, "a-2"},
+		{long, []string{long}, strings.Repeat("a", 58) + "-2"},
+		{strings.Repeat("a", 57) + "-b", []string{strings.Repeat("a", 57) + "-b"}, strings.Repeat("a", 57) + "-2"},
+	}
+	for _, tt := range tests {
+		if got := uniqueSlug(tt.base, tt.taken); got != tt.want {
+			t.Errorf("uniqueSlug(%q, %q) = %q, want %q", tt.base, tt.taken, got, tt.want)
+		}
+	}
+}
+
+func TestSlugTaken(t *testing.T) {
+	other := errors.New("connection refused")
+	tests := []struct {
+		name string
+		err  error
+		want error
+	}{
+		{"slug index", &pq.Error{Code: "23505", Constraint: slugIndex}, ErrSlugTaken},
+		{"other index", &pq.Error{Code: "23505", Constraint: "idx_galleries_public_id"}, nil},
+		{"other error", other, other},
+	}
+	for _, tt := range tests {
+		got := slugTaken(tt.err)
+		want := tt.want
+		if want == nil {
+			want = tt.err
+		}
+		if got != want {
+			t.Errorf("%s: slugTaken(%v) = %v, want %v", tt.name, tt.err, got, want)
+		}
+	}
+}
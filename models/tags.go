@@ -0,0 +1,285 @@
+package models
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	// ErrTagInvalid is returned when a tag is too long or contains a comma or slash
+	ErrTagInvalid modelError = "models: tags must be at most 50 characters and cannot contain commas or slashes"
+	// ErrTooManyTags is returned when a gallery or image is given more than maxTagsPerGallery tags
+	ErrTooManyTags modelError = "models: a gallery or image can have at most 20 tags"
+
+	maxTagLen         = 50
+	maxTagsPerGallery = 20
+	tagCloudSizes     = 5
+)
+
+// Tag is a user defined label that can be attached to many galleries.
+// Names are stored normalized so "Beach", " beach " and "BEACH" are the same tag.
+type Tag struct {
+	ID   uint   `gorm:"primary_key"`
+	Name string `gorm:"not null;unique_index"`
+}
+
+// GalleryTag joins galleries to their tags
+type GalleryTag struct {
+	GalleryID uint `gorm:"primary_key;auto_increment:false"`
+	TagID     uint `gorm:"primary_key;auto_increment:false;index"`
+}
+
+// ImageTag joins images to their tags
+type ImageTag struct {
+	ImageID uint `gorm:"primary_key;auto_increment:false"`
+	TagID   uint `gorm:"primary_key;auto_increment:false;index"`
+}
+
+// TagCount is a tag in a tag cloud. Size ranges from 1 for the least used tags to 5 for the most used.
+type TagCount struct {
+	Name  string
+	Count int
+	Size  int
+}
+
+// TagService is used to tag galleries and to browse galleries by tag
+type TagService interface {
+	ByGalleryID(galleryID uint) ([]Tag, error)
+	// SetGalleryTags replaces the tags of a gallery with names, creating tags that do not exist yet
+	SetGalleryTags(galleryID uint, names []string) error
+	// ByImageIDs returns the tags of each of the images with imageIDs, keyed by image ID
+	ByImageIDs(imageIDs []uint) (map[uint][]Tag, error)
+	// AddImageTags adds names to the tags of an image, keeping the tags it already has
+	AddImageTags(imageID uint, names []string) error
+	// Suggest returns up to limit tags starting with prefix, the user's own tags first
+	Suggest(userID uint, prefix string, limit int) ([]Tag, error)
+	// CloudByUserID counts the tags on a user's galleries, only counting public galleries when publicOnly is set
+	CloudByUserID(userID uint, publicOnly bool) ([]TagCount, error)
+}
+
+// NewTagService creates a TagService backed by db
+func NewTagService(db *gorm.DB) TagService {
+	return &tagValidator{
+		TagService: &tagGorm{
+			db: db,
+		},
+	}
+}
+
+// tagValidator normalizes tag names before they reach the database
+type tagValidator struct {
+	TagService
+}
+
+func (tv *tagValidator) SetGalleryTags(galleryID uint, names []string) error {
+	if galleryID <= 0 {
+		return ErrIDInvalid
+	}
+	normalized, err := normalizeTags(names)
+	if err != nil {
+		return err
+	}
+	return tv.TagService.SetGalleryTags(galleryID, normalized)
+}
+
+func (tv *tagValidator) AddImageTags(imageID uint, names []string) error {
+	if imageID <= 0 {
+		return ErrIDInvalid
+	}
+	normalized, err := normalizeTags(names)
+	if err != nil {
+		return err
+	}
+	if len(normalized) == 0 {
+		return nil
+	}
+	return tv.TagService.AddImageTags(imageID, normalized)
+}
+
+// normalizeTags normalizes names and removes blanks and duplicates
+func normalizeTags(names []string) ([]string, error) {
+	seen := make(map[string]bool, len(names))
+	normalized := make([]string, 0, len(names))
+	for _, name := range names {
+		name = NormalizeTag(name)
+		if name == "" || seen[name] {
+			continue
+		}
+		if len([]rune(name)) > maxTagLen || strings.ContainsAny(name, ",/") {
+			return nil, ErrTagInvalid
+		}
+		seen[name] = true
+		normalized = append(normalized, name)
+	}
+	if len(normalized) > maxTagsPerGallery {
+		return nil, ErrTooManyTags
+	}
+	return normalized, nil
+}
+
+func (tv *tagValidator) Suggest(userID uint, prefix string, limit int) ([]Tag, error) {
+	prefix = NormalizeTag(prefix)
+	if prefix == "" {
+		return nil, nil
+	}
+	if limit <= 0 || limit > maxTagsPerGallery {
+		limit = 10
+	}
+	return tv.TagService.Suggest(userID, prefix, limit)
+}
+
+// NormalizeTag converts a tag name to lowercase, trims it and collapses runs of whitespace to single spaces
+func NormalizeTag(name string) string {
+	return strings.Join(strings.Fields(strings.ToLower(name)), " ")
+}
+
+// ParseTags splits a comma separated list of tag names
+func ParseTags(s string) []string {
+	return strings.Split(s, ",")
+}
+
+// tagGorm represents the database interaction layer for tags
+type tagGorm struct {
+	db *gorm.DB
+}
+
+func (tg *tagGorm) ByGalleryID(galleryID uint) ([]Tag, error) {
+	var tags []Tag
+	db := tg.db.Joins("JOIN gallery_tags ON gallery_tags.tag_id = tags.id").
+		Where("gallery_tags.gallery_id = ?", galleryID).
+		Order("tags.name")
+	if err := db.Find(&tags).Error; err != nil {
+		return nil, err
+	}
+	return tags, nil
+}
+
+func (tg *tagGorm) SetGalleryTags(galleryID uint, names []string) error {
+	return tg.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("gallery_id = ?", galleryID).Delete(&GalleryTag{}).Error; err != nil {
+			return err
+		}
+		for _, name := range names {
+			var tag Tag
+			if err := tx.Where(Tag{Name: name}).FirstOrCreate(&tag).Error; err != nil {
+				return err
+			}
+			join := GalleryTag{GalleryID: galleryID, TagID: tag.ID}
+			if err := tx.Create(&join).Error; err != nil {
+				return err
+			}
+		}
+		return indexGallery(tx, galleryID)
+	})
+}
+
+func (tg *tagGorm) ByImageIDs(imageIDs []uint) (map[uint][]Tag, error) {
+	ret := make(map[uint][]Tag)
+	if len(imageIDs) == 0 {
+		return ret, nil
+	}
+	var rows []struct {
+		ImageID uint
+		ID      uint
+		Name    string
+	}
+	db := tg.db.Table("tags").
+		Select("image_tags.image_id, tags.id, tags.name").
+		Joins("JOIN image_tags ON image_tags.tag_id = tags.id").
+		Where("image_tags.image_id IN (?)", imageIDs).
+		Order("tags.name")
+	if err := db.Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		ret[row.ImageID] = append(ret[row.ImageID], Tag{ID: row.ID, Name: row.Name})
+	}
+	return ret, nil
+}
+
+func (tg *tagGorm) AddImageTags(imageID uint, names []string) error {
+	return tg.db.Transaction(func(tx *gorm.DB) error {
+		for _, name := range names {
+			var tag Tag
+			if err := tx.Where(Tag{Name: name}).FirstOrCreate(&tag).Error; err != nil {
+				return err
+			}
+			err := tx.Exec(`INSERT INTO image_tags (image_id, tag_id) VALUES (?, ?) ON CONFLICT DO NOTHING`,
+				imageID, tag.ID).Error
+			if err != nil {
+				return err
+			}
+		}
+		var count int
+		if err := tx.Model(&ImageTag{}).Where("image_id = ?", imageID).Count(&count).Error; err != nil {
+			return err
+		}
+		if count > maxTagsPerGallery {
+			return ErrTooManyTags
+		}
+		return indexImage(tx, imageID)
+	})
+}
+
+func (tg *tagGorm) Suggest(userID uint, prefix string, limit int) ([]Tag, error) {
+	var tags []Tag
+	own := `EXISTS (SELECT 1 FROM gallery_tags gt JOIN galleries g ON g.id = gt.gallery_id
+		WHERE gt.tag_id = tags.id AND g.user_id = ? AND g.deleted_at IS NULL)`
+	// Only tags the user could already see are suggested: those on their own galleries and images,
+	// and those on galleries and images anyone can view
+	visible := `(EXISTS (SELECT 1 FROM gallery_tags gt JOIN galleries g ON g.id = gt.gallery_id
+		WHERE gt.tag_id = tags.id AND g.deleted_at IS NULL AND (g.user_id = ? OR g.effective_visibility = ?))
+		OR EXISTS (SELECT 1 FROM image_tags it JOIN images i ON i.id = it.image_id JOIN galleries g ON g.id = i.gallery_id
+		WHERE it.tag_id = tags.id AND g.deleted_at IS NULL AND (g.user_id = ? OR g.effective_visibility = ?)))`
+	db := tg.db.Where("name LIKE ?", escapeLike(prefix)+"%").
+		Where(visible, userID, VisibilityPublic, userID, VisibilityPublic).
+		Order(gorm.Expr("CASE WHEN "+own+" THEN 0 ELSE 1 END", userID)).
+		Order("name").
+		Limit(limit)
+	if err := db.Find(&tags).Error; err != nil {
+		return nil, err
+	}
+	return tags, nil
+}
+
+func (tg *tagGorm) CloudByUserID(userID uint, publicOnly bool) ([]TagCount, error) {
+	var counts []TagCount
+	db := tg.db.Table("tags").
+		Select("tags.name, count(*) AS count").
+		Joins("JOIN gallery_tags ON gallery_tags.tag_id = tags.id").
+		Joins("JOIN galleries ON galleries.id = gallery_tags.gallery_id").
+		Where("galleries.user_id = ? AND galleries.deleted_at IS NULL", userID)
+	if publicOnly {
+		db = db.Where("galleries.effective_visibility = ?", VisibilityPublic)
+	}
+	db = db.Group("tags.name")
+	if err := db.Scan(&counts).Error; err != nil {
+		return nil, err
+	}
+	sizeTagCloud(counts)
+	return counts, nil
+}
+
+// sizeTagCloud sorts counts by name and spreads their sizes between 1 and tagCloudSizes by usage
+func sizeTagCloud(counts []TagCount) {
+	sort.Slice(counts, func(i, j int) bool {
+		return counts[i].Name < counts[j].Name
+	})
+	min, max := 0, 0
+	for i, c := range counts {
+		if i == 0 || c.Count < min {
+			min = c.Count
+		}
+		if c.Count > max {
+			max = c.Count
+		}
+	}
+	for i := range counts {
+		counts[i].Size = 1
+		if max > min {
+			counts[i].Size = 1 + (counts[i].Count-min)*(tagCloudSizes-1)/(max-min)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package models
+
+import (
+	"time"
+)
+
+const (
+	// ErrNotInTrash is returned when a gallery to restore or purge is not in the user's trash
+	ErrNotInTrash modelError = "models: gallery is not in the trash"
+)
+
+// TrashService is used to list, restore and permanently remove soft-deleted galleries.
+// Purging a gallery removes its database row, its image files and everything else stored for it.
+type TrashService interface {
+	ByUserID(userID uint) ([]Gallery, error)
+	Restore(userID, galleryID uint) error
+	Purge(userID, galleryID uint) error
+	Empty(userID uint) error
+	PurgeExpired() (int, error)
+	Retention() time.Duration
+}
+
+type trashService struct {
+	gs         GalleryService
+	is         ImageService
+	archives   ArchiveService
+	watermarks WatermarkService
+	retention  time.Duration
+}
+
+// NewTrashService creates a TrashService that purges galleries after they have been in the trash for retention
+func NewTrashService(gs GalleryService, is ImageService, archives ArchiveService, watermarks WatermarkService,
+	retention time.Duration) TrashService {
+	return &trashService{
+		gs:         gs,
+		is:         is,
+		archives:   archives,
+		watermarks: watermarks,
+		retention:  retention,
+	}
+}
+
+// ByUserID returns the galleries in the user's trash
+func (ts *trashService) ByUserID(userID uint) ([]Gallery, error) {
+	return ts.gs.DeletedByUserID(userID)
+}
+
+// Restore moves a gallery owned by userID out of the trash
+func (ts *trashService) Restore(userID, galleryID uint) error {
+	gallery, err := ts.owned(userID, galleryID)
+	if err != nil {
+		return err
+	}
+	return ts.gs.Restore(gallery.ID)
+}
+
+// Purge permanently deletes a gallery owned by userID that is in the trash
+func (ts *trashService) Purge(userID, galleryID uint) error {
+	gallery, err := ts.owned(userID, galleryID)
+	if err != nil {
+		return err
+	}
+	return ts.purge(gallery)
+}
+
+// Empty permanently deletes every gallery in the user's trash
+func (ts *trashService) Empty(userID uint) error {
+	galleries, err := ts.gs.DeletedByUserID(userID)
+	if err != nil {
+		return err
+	}
+	for i := range galleries {
+		if err := ts.purge(&galleries[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PurgeExpired permanently deletes all galleries that have been in the trash longer than the retention period.
+// It returns the number of galleries that were purged.
+func (ts *trashService) PurgeExpired() (int, error) {
+	galleries, err := ts.gs.DeletedBefore(time.Now().Add(-ts.retention))
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for i := range galleries {
+		if err := ts.purge(&galleries[i]); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// Retention returns how long galleries stay in the trash before being purged
+func (ts *trashService) Retention() time.Duration {
+	return ts.retention
+}
+
+// owned returns the deleted gallery with galleryID if it belongs to userID
+func (ts *trashService) owned(userID, galleryID uint) (*Gallery, error) {
+	gallery, err := ts.gs.DeletedByID(galleryID)
+	if err == ErrNotFound {
+		return nil, ErrNotInTrash
+	}
+	if err != nil {
+		return nil, err
+	}
+	if gallery.UserID != userID {
+		return nil, ErrNotInTrash
+	}
+	return gallery, nil
+}
+
+// purge removes the gallery's images before the gallery itself so a failure never leaves orphaned files
+func (ts *trashService) purge(gallery *Gallery) error {
+	if err := ts.is.DeleteAll(gallery.ID); err != nil {
+		return err
+	}
+	if err := ts.archives.Delete(gallery.ID); err != nil {
+		return err
+	}
+	if err := ts.watermarks.Delete(gallery.ID); err != nil {
+		return err
+	}
+	return ts.gs.Purge(gallery.ID)
+}
@@ -0,0 +1,244 @@
+package models
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/curtisvermeeren/web-development-with-go/rand"
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	// ErrUploadOffset is returned when a chunk does not start where the upload left off
+	ErrUploadOffset modelError = "models: upload offset does not match"
+	// ErrUploadTooLarge is returned when an upload is larger than MaxUploadSize or a chunk goes past its length
+	ErrUploadTooLarge modelError = "models: uploads can be at most 200 MB"
+	// ErrUploadEmpty is returned when an upload has no bytes
+	ErrUploadEmpty modelError = "models: uploads cannot be empty"
+	// ErrUploadNotImage is returned when a finished upload is not a JPEG or PNG image, whatever its filename says
+	ErrUploadNotImage modelError = "models: only JPEG and PNG images can be uploaded"
+
+	// MaxUploadSize is the largest file that can be uploaded in chunks
+	MaxUploadSize = 200 << 20 // 200 megabytes
+	// UploadExpiry is how long an unfinished upload is kept after its last chunk
+	UploadExpiry = 24 * time.Hour
+
+	uploadIDBytes = 24
+)
+
+/*
+Upload is a file being uploaded to a gallery in chunks, so an interrupted upload can carry on from
+Offset rather than starting again. Chunks are appended to a file under uploads/ and the finished file
+is added to the gallery with ImageService.Create.
+*/
+type Upload struct {
+	ID        string `gorm:"primary_key"`
+	GalleryID uint   `gorm:"not null;index"`
+	UserID    uint   `gorm:"not null"`
+	Filename  string `gorm:"not null"`
+	Length    int64  `gorm:"not null"`
+	Offset    int64  `gorm:"not null;default:0"`
+	ExpiresAt time.Time
+	CreatedAt time.Time
+}
+
+// Complete reports whether every byte of the upload has been received
+func (u *Upload) Complete() bool {
+	return u.Offset == u.Length
+}
+
+// UploadService is used to upload files to galleries in chunks
+type UploadService interface {
+	// Create starts an upload of upload.Length bytes, or returns ErrStorageQuota or ErrImageQuota if it would not fit
+	Create(upload *Upload) error
+	// ByID returns the unfinished upload with id, or ErrNotFound if it does not exist or has expired
+	ByID(id string) (*Upload, error)
+	// Append adds the chunk in r, which must start at offset, to the upload.
+	// The upload is added to its gallery once it is complete.
+	Append(upload *Upload, offset int64, r io.Reader) error
+	// Delete cancels an upload
+	Delete(upload *Upload) error
+	// DeleteExpired removes uploads that have not received a chunk for UploadExpiry and returns how many there were
+	DeleteExpired() (int, error)
+}
+
+// NewUploadService creates an UploadService that adds finished uploads to galleries with is.
+// Uploads that would not fit in their user's quota are refused before any of the file is sent.
+func NewUploadService(db *gorm.DB, is ImageService, usage UsageService) UploadService {
+	return &uploadService{
+		db:    db,
+		is:    is,
+		usage: usage,
+	}
+}
+
+type uploadService struct {
+	db    *gorm.DB
+	is    ImageService
+	usage UsageService
+	// locks holds a *sync.Mutex per upload ID so chunks for the same upload are written one at a time
+	locks sync.Map
+}
+
+func (us *uploadService) Create(upload *Upload) error {
+	if upload.GalleryID <= 0 || upload.UserID <= 0 {
+		return ErrIDInvalid
+	}
+	if upload.Length == 0 {
+		return ErrUploadEmpty
+	}
+	if upload.Length < 0 || upload.Length > MaxUploadSize {
+		return ErrUploadTooLarge
+	}
+	if err := runImageValFns(&Image{GalleryID: upload.GalleryID, Filename: upload.Filename}, filenameSafe); err != nil {
+		return err
+	}
+	if !IsImageFilename(upload.Filename) {
+		return ErrFilenameInvalid
+	}
+	if err := us.usage.Check(upload.UserID, upload.Length, 1); err != nil {
+		return err
+	}
+
+	id, err := rand.String(uploadIDBytes)
+	if err != nil {
+		return err
+	}
+	upload.ID = id
+	upload.Offset = 0
+	upload.ExpiresAt = time.Now().Add(UploadExpiry)
+
+	if err := os.MkdirAll("uploads", 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(us.partPath(upload.ID), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := us.db.Create(upload).Error; err != nil {
+		os.Remove(us.partPath(upload.ID))
+		return err
+	}
+	return nil
+}
+
+func (us *uploadService) ByID(id string) (*Upload, error) {
+	var upload Upload
+	if err := first(us.db.Where("id = ? AND expires_at > ?", id, time.Now()), &upload); err != nil {
+		return nil, err
+	}
+	return &upload, nil
+}
+
+func (us *uploadService) Append(upload *Upload, offset int64, r io.Reader) error {
+	lock, _ := us.locks.LoadOrStore(upload.ID, &sync.Mutex{})
+	lock.(*sync.Mutex).Lock()
+	defer lock.(*sync.Mutex).Unlock()
+
+	// Another chunk may have been written while this one waited for the lock
+	current, err := us.ByID(upload.ID)
+	if err != nil {
+		return err
+	}
+	*upload = *current
+	if offset != upload.Offset {
+		return ErrUploadOffset
+	}
+
+	f, err := os.OpenFile(us.partPath(upload.ID), os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	// Start from the recorded offset so bytes left over from a failed chunk are overwritten
+	if _, err := f.Seek(upload.Offset, io.SeekStart); err != nil {
+		f.Close()
+		return err
+	}
+	remaining := upload.Length - upload.Offset
+	n, copyErr := io.Copy(f, io.LimitReader(r, remaining))
+	if err := f.Close(); copyErr == nil {
+		copyErr = err
+	}
+
+	// Save whatever arrived, even if the connection dropped part way, so the client can resume from there
+	upload.Offset += n
+	upload.ExpiresAt = time.Now().Add(UploadExpiry)
+	err = us.db.Model(upload).Updates(map[string]interface{}{
+		"offset":     upload.Offset,
+		"expires_at": upload.ExpiresAt,
+	}).Error
+	if err != nil {
+		return err
+	}
+	if copyErr != nil {
+		return copyErr
+	}
+	if upload.Complete() {
+		return us.finish(upload)
+	}
+	return nil
+}
+
+func (us *uploadService) Delete(upload *Upload) error {
+	defer us.locks.Delete(upload.ID)
+	if err := os.Remove(us.partPath(upload.ID)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return us.db.Where("id = ?", upload.ID).Delete(&Upload{}).Error
+}
+
+func (us *uploadService) DeleteExpired() (int, error) {
+	var uploads []Upload
+	if err := us.db.Where("expires_at <= ?", time.Now()).Find(&uploads).Error; err != nil {
+		return 0, err
+	}
+	for i := range uploads {
+		if err := us.Delete(&uploads[i]); err != nil {
+			return i, err
+		}
+	}
+	return len(uploads), nil
+}
+
+// finish adds a complete upload to its gallery and removes the upload.
+// Uploads that are not images are removed without being added.
+func (us *uploadService) finish(upload *Upload) error {
+	f, err := os.Open(us.partPath(upload.ID))
+	if err != nil {
+		return err
+	}
+	head := make([]byte, 512)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		f.Close()
+		return err
+	}
+	if !isImageContent(head[:n]) {
+		f.Close()
+		if err := us.Delete(upload); err != nil {
+			return err
+		}
+		return ErrUploadNotImage
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		f.Close()
+		return err
+	}
+	err = us.is.Create(upload.GalleryID, f, upload.Filename)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	return us.Delete(upload)
+}
+
+func (us *uploadService) partPath(id string) string {
+	return filepath.Join("uploads", fmt.Sprintf("%s.part", id))
+}
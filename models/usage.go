@@ -0,0 +1,278 @@
+package models
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	// ErrStorageQuota is returned when storing an image would take a user over their storage quota
+	ErrStorageQuota modelError = "models: you have run out of storage space. Delete some images or galleries to make room"
+	// ErrImageQuota is returned when storing an image would take a user over the number of images they can store
+	ErrImageQuota modelError = "models: you have reached the number of images you can store. Delete some images or galleries to make room"
+)
+
+// Quota limits how much a user can store. A limit of 0 means there is no limit.
+type Quota struct {
+	MaxBytes  int64
+	MaxImages int
+}
+
+/*
+Usage is how many bytes of image files and how many images a user has stored, including in galleries in the trash.
+
+It is kept up to date as images are added and removed rather than being worked out from the files each time.
+A user's usage is calculated from their stored files the first time it is needed, and can be rebuilt at any time
+with Recalculate, such as after files were changed by hand.
+*/
+type Usage struct {
+	UserID    uint  `gorm:"primary_key;auto_increment:false"`
+	Bytes     int64 `gorm:"not null;default:0"`
+	Images    int   `gorm:"not null;default:0"`
+	UpdatedAt time.Time
+	// Quota is the limit the usage counts towards. It is not stored.
+	Quota Quota `gorm:"-"`
+}
+
+// BytesPercent is how much of the storage quota is used, from 0 to 100, or 0 if storage is unlimited
+func (u *Usage) BytesPercent() int {
+	return percent(u.Bytes, u.Quota.MaxBytes)
+}
+
+// ImagesPercent is how much of the image quota is used, from 0 to 100, or 0 if images are unlimited
+func (u *Usage) ImagesPercent() int {
+	return percent(int64(u.Images), int64(u.Quota.MaxImages))
+}
+
+// Percent is how much of whichever quota is closest to being reached is used, from 0 to 100
+func (u *Usage) Percent() int {
+	if images := u.ImagesPercent(); images > u.BytesPercent() {
+		return images
+	}
+	return u.BytesPercent()
+}
+
+// Level is the Bootstrap context of a usage meter, which turns to a warning and then danger as the quota fills up
+func (u *Usage) Level() string {
+	switch p := u.Percent(); {
+	case p >= 95:
+		return "danger"
+	case p >= 80:
+		return "warning"
+	}
+	return "success"
+}
+
+// BytesText is the storage used in a human readable form, such as "12.5 MB"
+func (u *Usage) BytesText() string {
+	return FormatBytes(u.Bytes)
+}
+
+// MaxBytesText is the storage quota in a human readable form
+func (u *Usage) MaxBytesText() string {
+	return FormatBytes(u.Quota.MaxBytes)
+}
+
+// UsageService keeps track of how much each user has stored and enforces their quota
+type UsageService interface {
+	// ByUserID returns a user's usage along with their quota
+	ByUserID(userID uint) (*Usage, error)
+	// Check returns ErrStorageQuota or ErrImageQuota if adding bytes and images would take a user over their quota
+	Check(userID uint, bytes int64, images int) error
+	// Reserve adds bytes and images to a user's usage, or returns ErrStorageQuota or ErrImageQuota without changing it
+	// if that would take them over their quota. Reductions are always allowed.
+	Reserve(userID uint, bytes int64, images int) error
+	// Release removes bytes and images from a user's usage
+	Release(userID uint, bytes int64, images int) error
+	// Recalculate rebuilds a user's usage from their stored files
+	Recalculate(userID uint) (*Usage, error)
+	// RecalculateAll rebuilds the usage of every user and returns how many users there are
+	RecalculateAll() (int, error)
+}
+
+// NewUsageService creates a UsageService that limits every user to quota
+func NewUsageService(db *gorm.DB, quota Quota) UsageService {
+	return &usageService{
+		db:    db,
+		quota: quota,
+	}
+}
+
+type usageService struct {
+	db    *gorm.DB
+	quota Quota
+}
+
+func (us *usageService) ByUserID(userID uint) (*Usage, error) {
+	var usage Usage
+	err := first(us.db.Where("user_id = ?", userID), &usage)
+	if err == ErrNotFound {
+		return us.Recalculate(userID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	usage.Quota = us.quota
+	return &usage, nil
+}
+
+func (us *usageService) Check(userID uint, bytes int64, images int) error {
+	usage, err := us.ByUserID(userID)
+	if err != nil {
+		return err
+	}
+	return us.exceeded(usage, bytes, images)
+}
+
+func (us *usageService) Reserve(userID uint, bytes int64, images int) error {
+	// Make sure the user has a usage row to update
+	usage, err := us.ByUserID(userID)
+	if err != nil {
+		return err
+	}
+
+	// Check and add in one statement so concurrent uploads cannot both squeeze under the quota
+	db := us.db.Model(&Usage{}).Where("user_id = ?", userID)
+	if us.quota.MaxBytes > 0 && bytes > 0 {
+		db = db.Where("bytes + ? <= ?", bytes, us.quota.MaxBytes)
+	}
+	if us.quota.MaxImages > 0 && images > 0 {
+		db = db.Where("images + ? <= ?", images, us.quota.MaxImages)
+	}
+	res := db.UpdateColumns(map[string]interface{}{
+		"bytes":      gorm.Expr("GREATEST(bytes + ?, 0)", bytes),
+		"images":     gorm.Expr("GREATEST(images + ?, 0)", images),
+		"updated_at": time.Now(),
+	})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		if err := us.exceeded(usage, bytes, images); err != nil {
+			return err
+		}
+		// The usage changed since it was read, so report whichever limit is closer
+		if us.quota.MaxBytes > 0 && bytes > 0 {
+			return ErrStorageQuota
+		}
+		return ErrImageQuota
+	}
+	return nil
+}
+
+func (us *usageService) Release(userID uint, bytes int64, images int) error {
+	return us.db.Model(&Usage{}).Where("user_id = ?", userID).UpdateColumns(map[string]interface{}{
+		"bytes":      gorm.Expr("GREATEST(bytes - ?, 0)", bytes),
+		"images":     gorm.Expr("GREATEST(images - ?, 0)", images),
+		"updated_at": time.Now(),
+	}).Error
+}
+
+func (us *usageService) Recalculate(userID uint) (*Usage, error) {
+	var galleries []Gallery
+	// Galleries in the trash still have their files, so they count too
+	if err := us.db.Unscoped().Select("id").Where("user_id = ?", userID).Find(&galleries).Error; err != nil {
+		return nil, err
+	}
+	usage := Usage{
+		UserID:    userID,
+		UpdatedAt: time.Now(),
+		Quota:     us.quota,
+	}
+	for _, gallery := range galleries {
+		bytes, images, err := galleryDiskUsage(gallery.ID)
+		if err != nil {
+			return nil, err
+		}
+		usage.Bytes += bytes
+		usage.Images += images
+	}
+	err := us.db.Exec(`INSERT INTO usages (user_id, bytes, images, updated_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT (user_id) DO UPDATE SET bytes = EXCLUDED.bytes, images = EXCLUDED.images, updated_at = EXCLUDED.updated_at`,
+		usage.UserID, usage.Bytes, usage.Images, usage.UpdatedAt).Error
+	if err != nil {
+		return nil, err
+	}
+	return &usage, nil
+}
+
+func (us *usageService) RecalculateAll() (int, error) {
+	var ids []uint
+	if err := us.db.Model(&User{}).Pluck("id", &ids).Error; err != nil {
+		return 0, err
+	}
+	for _, id := range ids {
+		if _, err := us.Recalculate(id); err != nil {
+			return 0, err
+		}
+	}
+	return len(ids), nil
+}
+
+// exceeded returns the quota error for adding bytes and images to usage, or nil if they fit
+func (us *usageService) exceeded(usage *Usage, bytes int64, images int) error {
+	if us.quota.MaxBytes > 0 && bytes > 0 && usage.Bytes+bytes > us.quota.MaxBytes {
+		return ErrStorageQuota
+	}
+	if us.quota.MaxImages > 0 && images > 0 && usage.Images+images > us.quota.MaxImages {
+		return ErrImageQuota
+	}
+	return nil
+}
+
+// galleryDiskUsage adds up the size and number of the image files in a gallery's directory
+func galleryDiskUsage(galleryID uint) (int64, int, error) {
+	entries, err := os.ReadDir(galleryImagePath(galleryID))
+	if os.IsNotExist(err) {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	var bytes int64
+	var images int
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		info, err := entry.Info()
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+		bytes += info.Size()
+		images++
+	}
+	return bytes, images, nil
+}
+
+// FormatBytes formats n bytes in the largest unit that keeps the number at least 1, such as "1.5 GB"
+func FormatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// percent returns n as a percentage of max, capped at 100, or 0 if max is 0
+func percent(n, max int64) int {
+	if max <= 0 {
+		return 0
+	}
+	if n >= max {
+		return 100
+	}
+	return int(n * 100 / max)
+}
@@ -0,0 +1,196 @@
+package models
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestUsageExceeded(t *testing.T) {
+	us := &usageService{quota: Quota{MaxBytes: 100, MaxImages: 2}}
+	tests := []struct {
+		name   string
+		usage  Usage
+		bytes  int64
+		images int
+		want   error
+	}{
+		{"empty", Usage{}, 10, 1, nil},
+		{"up to the byte limit", Usage{Bytes: 90, Images: 1}, 10, 1, nil},
+		{"one byte over", Usage{Bytes: 90, Images: 1}, 11, 1, ErrStorageQuota},
+		{"up to the image limit", Usage{Bytes: 0, Images: 1}, 1, 1, nil},
+		{"one image over", Usage{Bytes: 0, Images: 2}, 1, 1, ErrImageQuota},
+		{"both over", Usage{Bytes: 100, Images: 2}, 1, 1, ErrStorageQuota},
+		{"replacing at the limit", Usage{Bytes: 100, Images: 2}, 0, 0, nil},
+		{"shrinking over the limit", Usage{Bytes: 150, Images: 3}, -10, 0, nil},
+	}
+	for _, tt := range tests {
+		if got := us.exceeded(&tt.usage, tt.bytes, tt.images); got != tt.want {
+			t.Errorf("%s: exceeded(%d, %d) = %v, want %v", tt.name, tt.bytes, tt.images, got, tt.want)
+		}
+	}
+
+	unlimited := &usageService{}
+	if err := unlimited.exceeded(&Usage{Bytes: 1 << 40, Images: 1 << 20}, 1<<30, 1); err != nil {
+		t.Errorf("exceeded with no quota = %v, want nil", err)
+	}
+}
+
+func TestPlaceReservesAtTheQuotaLimit(t *testing.T) {
+	dir := t.TempDir()
+	usage := &memoryUsage{quota: Quota{MaxBytes: 100, MaxImages: 2}, usage: Usage{Bytes: 80, Images: 1}}
+	is := &imageService{usage: usage}
+
+	first := filepath.Join(dir, "a.jpg")
+	steps := []struct {
+		name       string
+		path       string
+		size       int
+		want       error
+		wantBytes  int64
+		wantImages int
+	}{
+		{"new file up to the limit", first, 20, nil, 100, 2},
+		{"new file over the byte limit", filepath.Join(dir, "b.jpg"), 1, ErrStorageQuota, 100, 2},
+		{"smaller replacement", first, 5, nil, 85, 2},
+		{"replacement back up to the limit", first, 20, nil, 100, 2},
+		{"replacement over the limit", first, 21, ErrStorageQuota, 100, 2},
+	}
+	for i, step := range steps {
+		tmp := tempFile(t, dir, i, step.size)
+		err := is.place(1, tmp, step.path, int64(step.size))
+		if err != step.want {
+			t.Errorf("%s: place = %v, want %v", step.name, err, step.want)
+		}
+		if usage.usage.Bytes != step.wantBytes || usage.usage.Images != step.wantImages {
+			t.Errorf("%s: usage = %d bytes, %d images, want %d bytes, %d images",
+				step.name, usage.usage.Bytes, usage.usage.Images, step.wantBytes, step.wantImages)
+		}
+		if err != nil {
+			if _, statErr := os.Stat(tmp); statErr != nil {
+				t.Errorf("%s: the refused file was moved: %v", step.name, statErr)
+			}
+		}
+	}
+	info, err := os.Stat(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != 20 {
+		t.Errorf("%s is %d bytes, want 20", first, info.Size())
+	}
+}
+
+func TestPlaceReleasesWhenTheMoveFails(t *testing.T) {
+	dir := t.TempDir()
+	usage := &memoryUsage{quota: Quota{MaxBytes: 100}, usage: Usage{Bytes: 50, Images: 1}}
+	is := &imageService{usage: usage}
+
+	err := is.place(1, filepath.Join(dir, "missing"), filepath.Join(dir, "a.jpg"), 50)
+	if err == nil {
+		t.Fatal("place of a missing file succeeded")
+	}
+	if usage.usage.Bytes != 50 || usage.usage.Images != 1 {
+		t.Errorf("usage = %d bytes, %d images, want it released back to 50 bytes, 1 image", usage.usage.Bytes, usage.usage.Images)
+	}
+}
+
+func TestPlaceCountsConcurrentReplacements(t *testing.T) {
+	dir := t.TempDir()
+	usage := &memoryUsage{}
+	is := &imageService{usage: usage}
+	path := filepath.Join(dir, "a.jpg")
+
+	var wg sync.WaitGroup
+	for i := 1; i <= 20; i++ {
+		tmp := tempFile(t, dir, i, i*10)
+		wg.Add(1)
+		go func(tmp string, size int64) {
+			defer wg.Done()
+			if err := is.place(1, tmp, path, size); err != nil {
+				t.Error(err)
+			}
+		}(tmp, int64(i*10))
+	}
+	wg.Wait()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage.usage.Bytes != info.Size() || usage.usage.Images != 1 {
+		t.Errorf("usage = %d bytes, %d images, want %d bytes, 1 image for the file left in place",
+			usage.usage.Bytes, usage.usage.Images, info.Size())
+	}
+}
+
+// tempFile writes an upload of size bytes to dir, as place expects to find it
+func tempFile(t *testing.T, dir string, i, size int) string {
+	t.Helper()
+	tmp := filepath.Join(dir, "upload-"+strconv.Itoa(i))
+	if err := os.WriteFile(tmp, make([]byte, size), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return tmp
+}
+
+// memoryUsage is a UsageService for one user that keeps their usage in memory.
+// Reserve and Release follow the same rules as the statements usageService runs.
+type memoryUsage struct {
+	mu    sync.Mutex
+	quota Quota
+	usage Usage
+}
+
+func (m *memoryUsage) ByUserID(userID uint) (*Usage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	usage := m.usage
+	usage.Quota = m.quota
+	return &usage, nil
+}
+
+func (m *memoryUsage) Check(userID uint, bytes int64, images int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return (&usageService{quota: m.quota}).exceeded(&m.usage, bytes, images)
+}
+
+func (m *memoryUsage) Reserve(userID uint, bytes int64, images int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := (&usageService{quota: m.quota}).exceeded(&m.usage, bytes, images); err != nil {
+		return err
+	}
+	m.add(bytes, images)
+	return nil
+}
+
+func (m *memoryUsage) Release(userID uint, bytes int64, images int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.add(-bytes, -images)
+	return nil
+}
+
+// add changes the usage without letting it go below zero, like GREATEST(..., 0)
+func (m *memoryUsage) add(bytes int64, images int) {
+	m.usage.Bytes += bytes
+	if m.usage.Bytes < 0 {
+		m.usage.Bytes = 0
+	}
+	m.usage.Images += images
+	if m.usage.Images < 0 {
+		m.usage.Images = 0
+	}
+}
+
+func (m *memoryUsage) Recalculate(userID uint) (*Usage, error) {
+	return m.ByUserID(userID)
+}
+
+func (m *memoryUsage) RecalculateAll() (int, error) {
+	return 1, nil
+}
@@ -13,6 +13,7 @@ userGorm is a struct that is used for interacting directly with the database.
 */
 
 import (
+	"io"
 	"regexp"
 	"strings"
 
@@ -65,6 +66,9 @@ func (e modelError) Public() string {
 // UserService is a set of methods used to manipulate and work with the user model
 type UserService interface {
 	Authenticate(email, password string) (*User, error)
+	// SetAvatar crops the uploaded image in r to a square and makes it the user's avatar
+	SetAvatar(user *User, r io.Reader) error
+	RemoveAvatar(user *User) error
 	UserDB
 }
 
@@ -93,6 +97,18 @@ type User struct {
 	PasswordHash string `gorm:"not null"`
 	Remember     string `gorm:"-"`
 	RememberHash string `gorm:"not null;unique_index"`
+	// Username is the optional name the user's public profile is found by at /u/{username}
+	Username string `gorm:"not null;default:''"`
+	Bio      string `gorm:"type:text;not null;default:''"`
+	Website  string `gorm:"not null;default:''"`
+	// Avatar is the filename of the user's avatar in the avatars directory, or empty if they have none
+	Avatar string `gorm:"not null;default:''"`
+	// ProfilePublic shows the user's profile to everyone. Otherwise only the user can see it.
+	ProfilePublic bool `gorm:"not null;default:false"`
+	// ProfileSort is the order the user's galleries are listed in on their profile
+	ProfileSort GallerySort `gorm:"not null;default:'created'"`
+	// UnseenComments is how many comments on the user's galleries they have not seen yet
+	UnseenComments int `gorm:"-"`
 }
 
 // UserDB defines methods used to interact with the users database
@@ -101,6 +117,7 @@ type UserDB interface {
 	ByID(id uint) (*User, error)
 	ByEmail(email string) (*User, error)
 	ByRemember(token string) (*User, error)
+	ByUsername(username string) (*User, error)
 
 	// Methods for altering users
 	Create(user *User) error
@@ -244,7 +261,13 @@ func (uv *userValidator) Update(user *User) error {
 		uv.normalizeEmail,
 		uv.requireEmail,
 		uv.emailFormat,
-		uv.emailIsAvail)
+		uv.emailIsAvail,
+		uv.normalizeProfile,
+		uv.usernameFormat,
+		uv.usernameIsAvail,
+		uv.bioMaxLength,
+		uv.websiteValid,
+		uv.profileSortValid)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,246 @@
+package models
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// variantDir is where variants are cached
+const (
+	variantDir = "variants"
+	// maxVariantAttempts is how many times a variant is made for one request when the cache keeps evicting it
+	maxVariantAttempts = 3
+)
+
+/*
+VariantService makes resized and converted variants of images and caches them on disk.
+
+Variants can have a gallery's Watermark drawn on them. Cached variants are named by a hash of the image's
+path, its content, the variant and the watermark, so a variant is never served after any of them change.
+The cache is kept under a size limit by removing the variants that were used least recently, and concurrent
+requests for a variant that is not cached yet wait for it to be made once rather than each making it.
+*/
+type VariantService interface {
+	// Open returns the cached file of a variant of image with wm drawn on it, making it first if it is not cached.
+	// wm may be nil for a variant without a watermark.
+	Open(image *Image, v Variant, wm *Watermark) (*os.File, error)
+	// ContentType is the MIME type of a variant of image
+	ContentType(image *Image, v Variant) string
+}
+
+// NewVariantService creates a VariantService whose cache holds up to maxBytes of variants.
+// A limit of 0 means there is no limit.
+func NewVariantService(maxBytes int64) VariantService {
+	return &variantService{
+		maxBytes: maxBytes,
+		// Resizing is CPU bound, so making more variants at once than there are CPUs only slows each one down
+		workers: make(chan struct{}, runtime.NumCPU()),
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+type variantService struct {
+	maxBytes int64
+	workers  chan struct{}
+	group    singleflight.Group
+
+	loadOnce sync.Once
+	loadErr  error
+
+	mu sync.Mutex
+	// lru holds the cached variants with the most recently used at the front
+	lru     *list.List
+	entries map[string]*list.Element
+	size    int64
+}
+
+// variantEntry is a cached variant file
+type variantEntry struct {
+	name string
+	size int64
+}
+
+func (vs *variantService) Open(image *Image, v Variant, wm *Watermark) (*os.File, error) {
+	if err := vs.load(); err != nil {
+		return nil, err
+	}
+	name, err := vs.name(image, v, wm)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(filepath.Join(variantDir, name))
+	if err == nil {
+		vs.touch(name)
+		return f, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	// The cache may evict the variant between it being made and opened, so it is made again when that happens
+	for attempt := 0; ; attempt++ {
+		_, err, _ = vs.group.Do(name, func() (interface{}, error) {
+			return nil, vs.make(image, v, wm, name)
+		})
+		if err != nil {
+			return nil, err
+		}
+		f, err = os.Open(filepath.Join(variantDir, name))
+		if err == nil || !os.IsNotExist(err) || attempt == maxVariantAttempts-1 {
+			return f, err
+		}
+	}
+}
+
+func (vs *variantService) ContentType(image *Image, v Variant) string {
+	return "image/" + v.format(image.Filename)
+}
+
+// name is the file a variant of image with wm drawn on it is cached in
+func (vs *variantService) name(image *Image, v Variant, wm *Watermark) (string, error) {
+	// Images that have not been hashed yet are told apart by their size and modification time instead
+	version := image.SHA256
+	if version == "" {
+		info, err := os.Stat(image.RelativePath())
+		if err != nil {
+			return "", err
+		}
+		version = fmt.Sprintf("%d-%d", info.Size(), info.ModTime().UnixNano())
+	}
+	format := v.format(image.Filename)
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%s\n%s\n%s", image.RelativePath(), version, v.String(), format)
+	if wm != nil {
+		fmt.Fprintf(h, "\n%s", wm.Version())
+	}
+	return hex.EncodeToString(h.Sum(nil))[:32] + formatExt(format), nil
+}
+
+// make writes a variant of image with wm drawn on it to the cache as name
+func (vs *variantService) make(image *Image, v Variant, wm *Watermark, name string) error {
+	vs.workers <- struct{}{}
+	defer func() { <-vs.workers }()
+
+	src, err := os.Open(image.RelativePath())
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	img, err := decodeVariantSource(src)
+	if err != nil {
+		return err
+	}
+	format := v.format(image.Filename)
+	dst := v.transform(img, format)
+	if wm != nil {
+		if err := wm.draw(dst); err != nil {
+			return err
+		}
+	}
+
+	// Write to a hidden file first so a variant is never read half written
+	tmp, err := os.CreateTemp(variantDir, ".variant-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := encodeVariant(tmp, dst, format); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	info, err := os.Stat(tmp.Name())
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(variantDir, name)); err != nil {
+		return err
+	}
+	vs.add(name, info.Size())
+	return nil
+}
+
+// load reads which variants are cached the first time the cache is used, oldest first, and removes any
+// files left half written when the server stopped
+func (vs *variantService) load() error {
+	vs.loadOnce.Do(func() {
+		if vs.loadErr = os.MkdirAll(variantDir, 0755); vs.loadErr != nil {
+			return
+		}
+		dirEntries, err := os.ReadDir(variantDir)
+		if err != nil {
+			vs.loadErr = err
+			return
+		}
+		var infos []os.FileInfo
+		for _, entry := range dirEntries {
+			info, err := entry.Info()
+			if err != nil || !info.Mode().IsRegular() {
+				continue
+			}
+			if strings.HasPrefix(entry.Name(), ".") {
+				os.Remove(filepath.Join(variantDir, entry.Name()))
+				continue
+			}
+			infos = append(infos, info)
+		}
+		sort.Slice(infos, func(i, j int) bool {
+			return infos[i].ModTime().Before(infos[j].ModTime())
+		})
+		for _, info := range infos {
+			vs.add(info.Name(), info.Size())
+		}
+	})
+	return vs.loadErr
+}
+
+// touch marks a cached variant as just used. Its modification time is updated too so the order in which
+// variants were used survives a restart.
+func (vs *variantService) touch(name string) {
+	vs.mu.Lock()
+	if el, ok := vs.entries[name]; ok {
+		vs.lru.MoveToFront(el)
+	}
+	vs.mu.Unlock()
+	now := time.Now()
+	os.Chtimes(filepath.Join(variantDir, name), now, now)
+}
+
+// add records a newly cached variant and removes the least recently used variants until the cache fits
+// within its size limit. The variant just added is never removed, even if it is larger than the limit.
+func (vs *variantService) add(name string, size int64) {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+	if el, ok := vs.entries[name]; ok {
+		vs.size -= el.Value.(*variantEntry).size
+		vs.lru.Remove(el)
+	}
+	vs.entries[name] = vs.lru.PushFront(&variantEntry{name: name, size: size})
+	vs.size += size
+
+	for vs.maxBytes > 0 && vs.size > vs.maxBytes && vs.lru.Len() > 1 {
+		el := vs.lru.Back()
+		entry := el.Value.(*variantEntry)
+		if err := os.Remove(filepath.Join(variantDir, entry.name)); err != nil && !os.IsNotExist(err) {
+			log.Println(err)
+		}
+		vs.lru.Remove(el)
+		delete(vs.entries, entry.name)
+		vs.size -= entry.size
+	}
+}
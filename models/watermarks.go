@@ -0,0 +1,447 @@
+package models
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	xdraw "golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+)
+
+const (
+	// ErrWatermarkTextRequired is returned when a text watermark has no text
+	ErrWatermarkTextRequired modelError = "models: please enter the text of the watermark"
+	// ErrWatermarkTextTooLong is returned when a watermark's text exceeds maxWatermarkTextLen
+	ErrWatermarkTextTooLong modelError = "models: watermark text must be at most 100 characters long"
+	// ErrWatermarkImageRequired is returned when an image watermark is saved before an image has been uploaded for it
+	ErrWatermarkImageRequired modelError = "models: please choose a PNG image for the watermark"
+	// ErrWatermarkImageInvalid is returned when a watermark image is not a PNG or is too large
+	ErrWatermarkImageInvalid modelError = "models: watermark image must be a PNG no larger than 2000x2000 pixels"
+	// ErrWatermarkInvalid is returned when a watermark's kind or position is not one of the allowed values
+	ErrWatermarkInvalid modelError = "models: watermark settings are invalid"
+
+	maxWatermarkTextLen = 100
+	// maxWatermarkImageSize is the largest width or height of a watermark image
+	maxWatermarkImageSize = 2000
+	// maxWatermarkImageBytes is the largest watermark image file that can be uploaded
+	maxWatermarkImageBytes = 5 << 20
+
+	defaultWatermarkOpacity = 50
+	defaultWatermarkScale   = 25
+	minWatermarkPercent     = 5
+)
+
+// WatermarkKind is whether a watermark is text or an image
+type WatermarkKind string
+
+const (
+	WatermarkText  WatermarkKind = "text"
+	WatermarkImage WatermarkKind = "image"
+)
+
+// WatermarkPosition is where a watermark is drawn on an image
+type WatermarkPosition string
+
+const (
+	WatermarkTopLeft     WatermarkPosition = "top-left"
+	WatermarkTopRight    WatermarkPosition = "top-right"
+	WatermarkCenter      WatermarkPosition = "center"
+	WatermarkBottomLeft  WatermarkPosition = "bottom-left"
+	WatermarkBottomRight WatermarkPosition = "bottom-right"
+)
+
+// WatermarkPositions lists the positions a watermark can be drawn at, in the order they are offered
+var WatermarkPositions = []WatermarkPosition{
+	WatermarkTopLeft,
+	WatermarkTopRight,
+	WatermarkCenter,
+	WatermarkBottomLeft,
+	WatermarkBottomRight,
+}
+
+// Label is the position as shown in forms, such as "Bottom right"
+func (p WatermarkPosition) Label() string {
+	label := strings.ReplaceAll(string(p), "-", " ")
+	if label == "" {
+		return label
+	}
+	return strings.ToUpper(label[:1]) + label[1:]
+}
+
+/*
+Watermark is drawn on the resized images of a gallery shown to anyone other than its owner.
+The original image files are never changed.
+
+A watermark is either Text or a PNG image uploaded for the gallery. Opacity is how opaque it is and Scale
+is how wide it is, both as a percentage: Scale 25 makes the watermark a quarter of the width of the image.
+*/
+type Watermark struct {
+	GalleryID uint              `gorm:"primary_key;auto_increment:false"`
+	Kind      WatermarkKind     `gorm:"not null"`
+	Text      string            `gorm:"not null;default:''"`
+	Position  WatermarkPosition `gorm:"not null"`
+	Opacity   int               `gorm:"not null"`
+	Scale     int               `gorm:"not null"`
+	UpdatedAt time.Time
+	// NewImage is an uploaded PNG that replaces the watermark's image once the watermark is saved
+	NewImage []byte `gorm:"-"`
+}
+
+// Version identifies the watermark's settings and image, so images drawn with it can be cached
+func (wm *Watermark) Version() string {
+	return fmt.Sprintf("%s %q %s %d %d %d", wm.Kind, wm.Text, wm.Position, wm.Opacity, wm.Scale, wm.UpdatedAt.UnixNano())
+}
+
+// IsImage reports whether the watermark is an uploaded image rather than text
+func (wm *Watermark) IsImage() bool {
+	return wm.Kind == WatermarkImage
+}
+
+// WatermarkService is used to set up the watermarks of galleries
+type WatermarkService interface {
+	// ByGalleryID returns a gallery's watermark, or ErrNotFound if it does not have one
+	ByGalleryID(galleryID uint) (*Watermark, error)
+	// Save creates or updates a gallery's watermark. If image is not nil it is stored as the
+	// watermark's image, replacing any image uploaded before.
+	Save(wm *Watermark, image io.Reader) error
+	// Delete removes a gallery's watermark along with its image
+	Delete(galleryID uint) error
+}
+
+// WatermarkDB is used to interact with the watermarks table
+type WatermarkDB interface {
+	ByGalleryID(galleryID uint) (*Watermark, error)
+	Save(wm *Watermark) error
+	Delete(galleryID uint) error
+}
+
+// NewWatermarkService creates a WatermarkService storing watermarks in db and their images on disk
+func NewWatermarkService(db *gorm.DB) WatermarkService {
+	return &watermarkService{
+		WatermarkDB: &watermarkValidator{
+			WatermarkDB: &watermarkGorm{
+				db: db,
+			},
+		},
+	}
+}
+
+type watermarkService struct {
+	WatermarkDB
+}
+
+func (ws *watermarkService) Save(wm *Watermark, image io.Reader) error {
+	if image != nil {
+		data, err := io.ReadAll(io.LimitReader(image, maxWatermarkImageBytes+1))
+		if err != nil {
+			return err
+		}
+		wm.NewImage = data
+	}
+	return ws.WatermarkDB.Save(wm)
+}
+
+func (ws *watermarkService) Delete(galleryID uint) error {
+	if err := ws.WatermarkDB.Delete(galleryID); err != nil {
+		return err
+	}
+	if err := os.Remove(watermarkImagePath(galleryID)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// saveWatermarkImage stores data as the image of a gallery's watermark
+func saveWatermarkImage(galleryID uint, data []byte) error {
+	if err := os.MkdirAll("watermarks", 0755); err != nil {
+		return err
+	}
+	// Write to a hidden file first so a half written image is never drawn
+	path := watermarkImagePath(galleryID)
+	tmp := filepath.Join("watermarks", "."+filepath.Base(path))
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// watermarkImagePath is where the image of a gallery's image watermark is stored
+func watermarkImagePath(galleryID uint) string {
+	return filepath.Join("watermarks", fmt.Sprintf("%v.png", galleryID))
+}
+
+type watermarkValidator struct {
+	WatermarkDB
+}
+
+type watermarkValFn func(*Watermark) error
+
+func (wv *watermarkValidator) Save(wm *Watermark) error {
+	err := runWatermarkValFns(wm,
+		watermarkGalleryIDRequired,
+		watermarkKindValid,
+		normalizeWatermarkText,
+		watermarkTextRequired,
+		watermarkTextMaxLength,
+		watermarkNewImageValid,
+		watermarkImageRequired,
+		watermarkPositionValid,
+		watermarkPercentsInRange)
+	if err != nil {
+		return err
+	}
+	// The uploaded image is only stored once the rest of the watermark is known to be valid
+	if wm.NewImage != nil {
+		if err := saveWatermarkImage(wm.GalleryID, wm.NewImage); err != nil {
+			return err
+		}
+		wm.NewImage = nil
+	}
+	return wv.WatermarkDB.Save(wm)
+}
+
+func (wv *watermarkValidator) Delete(galleryID uint) error {
+	if galleryID <= 0 {
+		return ErrIDInvalid
+	}
+	return wv.WatermarkDB.Delete(galleryID)
+}
+
+func runWatermarkValFns(wm *Watermark, fns ...watermarkValFn) error {
+	for _, fn := range fns {
+		if err := fn(wm); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func watermarkGalleryIDRequired(wm *Watermark) error {
+	if wm.GalleryID <= 0 {
+		return ErrIDInvalid
+	}
+	return nil
+}
+
+func watermarkKindValid(wm *Watermark) error {
+	switch wm.Kind {
+	case WatermarkText, WatermarkImage:
+		return nil
+	}
+	return ErrWatermarkInvalid
+}
+
+func normalizeWatermarkText(wm *Watermark) error {
+	wm.Text = strings.TrimSpace(wm.Text)
+	return nil
+}
+
+func watermarkTextRequired(wm *Watermark) error {
+	if wm.Kind == WatermarkText && wm.Text == "" {
+		return ErrWatermarkTextRequired
+	}
+	return nil
+}
+
+func watermarkTextMaxLength(wm *Watermark) error {
+	if len([]rune(wm.Text)) > maxWatermarkTextLen {
+		return ErrWatermarkTextTooLong
+	}
+	return nil
+}
+
+// watermarkNewImageValid checks an uploaded image is a PNG small enough to be a watermark
+func watermarkNewImageValid(wm *Watermark) error {
+	if wm.NewImage == nil {
+		return nil
+	}
+	if len(wm.NewImage) > maxWatermarkImageBytes {
+		return ErrWatermarkImageInvalid
+	}
+	config, err := png.DecodeConfig(bytes.NewReader(wm.NewImage))
+	if err != nil || config.Width > maxWatermarkImageSize || config.Height > maxWatermarkImageSize {
+		return ErrWatermarkImageInvalid
+	}
+	return nil
+}
+
+func watermarkImageRequired(wm *Watermark) error {
+	if wm.Kind != WatermarkImage || wm.NewImage != nil {
+		return nil
+	}
+	if _, err := os.Stat(watermarkImagePath(wm.GalleryID)); err != nil {
+		return ErrWatermarkImageRequired
+	}
+	return nil
+}
+
+func watermarkPositionValid(wm *Watermark) error {
+	if wm.Position == "" {
+		wm.Position = WatermarkBottomRight
+	}
+	for _, position := range WatermarkPositions {
+		if wm.Position == position {
+			return nil
+		}
+	}
+	return ErrWatermarkInvalid
+}
+
+// watermarkPercentsInRange fills in the default opacity and scale and keeps both between 5 and 100 percent
+func watermarkPercentsInRange(wm *Watermark) error {
+	if wm.Opacity == 0 {
+		wm.Opacity = defaultWatermarkOpacity
+	}
+	if wm.Scale == 0 {
+		wm.Scale = defaultWatermarkScale
+	}
+	wm.Opacity = clampPercent(wm.Opacity)
+	wm.Scale = clampPercent(wm.Scale)
+	return nil
+}
+
+func clampPercent(n int) int {
+	if n < minWatermarkPercent {
+		return minWatermarkPercent
+	}
+	if n > 100 {
+		return 100
+	}
+	return n
+}
+
+// watermarkGorm represents the database interaction layer for watermarks
+type watermarkGorm struct {
+	db *gorm.DB
+}
+
+func (wg *watermarkGorm) ByGalleryID(galleryID uint) (*Watermark, error) {
+	var wm Watermark
+	if err := first(wg.db.Where("gallery_id = ?", galleryID), &wm); err != nil {
+		return nil, err
+	}
+	return &wm, nil
+}
+
+func (wg *watermarkGorm) Save(wm *Watermark) error {
+	return wg.db.Save(wm).Error
+}
+
+func (wg *watermarkGorm) Delete(galleryID uint) error {
+	return wg.db.Where("gallery_id = ?", galleryID).Delete(&Watermark{}).Error
+}
+
+// watermarkFont is the typeface text watermarks are drawn in
+var watermarkFont, watermarkFontErr = opentype.Parse(gobold.TTF)
+
+// draw draws the watermark on dst
+func (wm *Watermark) draw(dst *image.RGBA) error {
+	var mark *image.RGBA
+	var err error
+	width := dst.Bounds().Dx() * wm.Scale / 100
+	if wm.IsImage() {
+		mark, err = wm.imageMark(width)
+	} else {
+		mark, err = wm.textMark(width)
+	}
+	if err != nil {
+		return err
+	}
+
+	b := dst.Bounds()
+	mb := mark.Bounds()
+	margin := int(math.Min(float64(b.Dx()), float64(b.Dy())) * 0.03)
+	var at image.Point
+	switch wm.Position {
+	case WatermarkTopLeft:
+		at = image.Pt(b.Min.X+margin, b.Min.Y+margin)
+	case WatermarkTopRight:
+		at = image.Pt(b.Max.X-margin-mb.Dx(), b.Min.Y+margin)
+	case WatermarkCenter:
+		at = image.Pt(b.Min.X+(b.Dx()-mb.Dx())/2, b.Min.Y+(b.Dy()-mb.Dy())/2)
+	case WatermarkBottomLeft:
+		at = image.Pt(b.Min.X+margin, b.Max.Y-margin-mb.Dy())
+	default:
+		at = image.Pt(b.Max.X-margin-mb.Dx(), b.Max.Y-margin-mb.Dy())
+	}
+	opacity := image.NewUniform(color.Alpha16{A: uint16(0xffff * wm.Opacity / 100)})
+	draw.DrawMask(dst, mb.Add(at), mark, mb.Min, opacity, image.Point{}, draw.Over)
+	return nil
+}
+
+// imageMark is the watermark's image scaled to width
+func (wm *Watermark) imageMark(width int) (*image.RGBA, error) {
+	f, err := os.Open(watermarkImagePath(wm.GalleryID))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	src, err := png.Decode(f)
+	if err != nil {
+		return nil, err
+	}
+	sb := src.Bounds()
+	if width < 1 {
+		width = 1
+	}
+	height := int(math.Max(1, math.Round(float64(sb.Dy())*float64(width)/float64(sb.Dx()))))
+	mark := image.NewRGBA(image.Rect(0, 0, width, height))
+	xdraw.CatmullRom.Scale(mark, mark.Bounds(), src, sb, xdraw.Src, nil)
+	return mark, nil
+}
+
+// textMark is the watermark's text in white with a dark shadow, sized so it is width pixels wide
+func (wm *Watermark) textMark(width int) (*image.RGBA, error) {
+	if watermarkFontErr != nil {
+		return nil, watermarkFontErr
+	}
+	// Measure the text at a known size to work out the size that makes it the right width
+	const measureSize = 100
+	face, err := opentype.NewFace(watermarkFont, &opentype.FaceOptions{Size: measureSize, DPI: 72})
+	if err != nil {
+		return nil, err
+	}
+	advance := font.MeasureString(face, wm.Text).Ceil()
+	face.Close()
+	if advance <= 0 {
+		advance = 1
+	}
+	size := math.Max(8, measureSize*float64(width)/float64(advance))
+
+	face, err = opentype.NewFace(watermarkFont, &opentype.FaceOptions{Size: size, DPI: 72, Hinting: font.HintingFull})
+	if err != nil {
+		return nil, err
+	}
+	defer face.Close()
+	metrics := face.Metrics()
+	shadow := int(math.Max(1, size/20))
+	mark := image.NewRGBA(image.Rect(0, 0,
+		font.MeasureString(face, wm.Text).Ceil()+shadow,
+		(metrics.Ascent+metrics.Descent).Ceil()+shadow))
+
+	d := font.Drawer{
+		Dst:  mark,
+		Src:  image.NewUniform(color.Gray{Y: 0x20}),
+		Face: face,
+		Dot:  fixed.P(shadow, metrics.Ascent.Ceil()+shadow),
+	}
+	d.DrawString(wm.Text)
+	d.Src = image.White
+	d.Dot = fixed.P(0, metrics.Ascent.Ceil())
+	d.DrawString(wm.Text)
+	return mark, nil
+}
@@ -0,0 +1,22 @@
+//go:build cgo
+// +build cgo
+
+package models
+
+import (
+	"image"
+	"io"
+
+	"github.com/chai2010/webp"
+)
+
+// webpSupported reports whether variants can be written as WebP, which needs cgo
+const webpSupported = true
+
+// webpQuality is the quality lossy WebP variants are written with
+const webpQuality = 80
+
+// encodeWebP writes img to w as a lossy WebP image
+func encodeWebP(w io.Writer, img image.Image) error {
+	return webp.Encode(w, img, &webp.Options{Quality: webpQuality})
+}
@@ -0,0 +1,17 @@
+//go:build !cgo
+// +build !cgo
+
+package models
+
+import (
+	"image"
+	"io"
+)
+
+// webpSupported reports whether variants can be written as WebP, which needs cgo
+const webpSupported = false
+
+// encodeWebP returns ErrFormatUnsupported, since the WebP encoder needs cgo
+func encodeWebP(w io.Writer, img image.Image) error {
+	return ErrFormatUnsupported
+}
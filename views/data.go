@@ -39,6 +39,12 @@ type PublicError interface {
 
 // SetAlert adds an alert to a Data object
 func (d *Data) SetAlert(err error) {
+	alert := ErrorAlert(err)
+	d.Alert = &alert
+}
+
+// ErrorAlert creates an error alert for err, using a generic message unless err is a PublicError
+func ErrorAlert(err error) Alert {
 	var msg string
 
 	// Check if the error is for Public or if it should be generic
@@ -48,7 +54,7 @@ func (d *Data) SetAlert(err error) {
 		log.Println(err)
 		msg = AlertMsgGeneric
 	}
-	d.Alert = &Alert{
+	return Alert{
 		Level:   AlertLvlError,
 		Message: msg,
 	}
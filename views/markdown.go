@@ -0,0 +1,29 @@
+package views
+
+import (
+	"bytes"
+	"html/template"
+	"log"
+
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/extension"
+	"github.com/yuin/goldmark/renderer/html"
+)
+
+// md converts user supplied Markdown to HTML.
+// goldmark omits raw HTML and drops links with dangerous schemes such as javascript: unless html.WithUnsafe is set,
+// which keeps the output safe to render as template.HTML.
+var md = goldmark.New(
+	goldmark.WithExtensions(extension.Linkify, extension.Strikethrough),
+	goldmark.WithRendererOptions(html.WithHardWraps()),
+)
+
+// Markdown renders the Markdown source as sanitized HTML
+func Markdown(source string) template.HTML {
+	var buf bytes.Buffer
+	if err := md.Convert([]byte(source), &buf); err != nil {
+		log.Println(err)
+		return template.HTML(template.HTMLEscapeString(source))
+	}
+	return template.HTML(buf.String())
+}
@@ -112,6 +112,7 @@ func NewView(layout string, files ...string) *View {
 		"pathEscape": func(s string) string {
 			return url.PathEscape(s)
 		},
+		"markdown": Markdown,
 	}).ParseFiles(files...)
 	if err != nil {
 		panic(err)